@@ -0,0 +1,202 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// IPListACL allows or denies destination addresses based on a list of CIDR
+// ranges. The most specific matching range wins.
+type IPListACL struct {
+	// DefaultAllow is used for addresses not matching any range
+	DefaultAllow bool
+	trie         CIDRTrie
+	// tenants holds the rules of tenants with their own rule set
+	tenants map[string]*IPListACL
+}
+
+// SetTenantACL sets the rules for clients of tenant. The rules of the tenant
+// replace the rules of this acl for its clients
+func (a *IPListACL) SetTenantACL(tenant string, acl *IPListACL) {
+	if a.tenants == nil {
+		a.tenants = make(map[string]*IPListACL)
+	}
+	a.tenants[tenant] = acl
+}
+
+// ForTenant returns the rules of tenant. Tenants without their own rule set
+// use this acl
+func (a *IPListACL) ForTenant(tenant string) *IPListACL {
+	if acl, ok := a.tenants[tenant]; ok {
+		return acl
+	}
+	return a
+}
+
+// Allow adds a range that is allowed
+func (a *IPListACL) Allow(cidr string) error {
+	return a.add(cidr, true)
+}
+
+// Deny adds a range that is denied
+func (a *IPListACL) Deny(cidr string) error {
+	return a.add(cidr, false)
+}
+
+func (a *IPListACL) add(cidr string, allow bool) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid cidr %s: %w", cidr, err)
+	}
+	a.trie.Insert(network, allow)
+	return nil
+}
+
+// Allowed checks if the ip is allowed by the acl
+func (a *IPListACL) Allowed(ip net.IP) bool {
+	allow, matched := a.trie.Lookup(ip)
+	if !matched {
+		return a.DefaultAllow
+	}
+	return allow
+}
+
+// LoadACLFile reads an access list from a file. Every line contains either
+// "allow <cidr>", "deny <cidr>" or "default allow|deny". Empty lines and lines
+// starting with # are ignored
+func LoadACLFile(path string) (*IPListACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &IPListACL{}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid acl rule in %s line %d", path, lineNumber)
+		}
+		switch fields[0] {
+		case "allow":
+			err = acl.Allow(fields[1])
+		case "deny":
+			err = acl.Deny(fields[1])
+		case "default":
+			switch fields[1] {
+			case "allow":
+				acl.DefaultAllow = true
+			case "deny":
+				acl.DefaultAllow = false
+			default:
+				err = fmt.Errorf("invalid default %q", fields[1])
+			}
+		default:
+			err = fmt.Errorf("invalid action %q", fields[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl rule in %s line %d: %w", path, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// checkDestination checks the request against the configured access lists.
+// Domain names are resolved once and every address is checked. The vetted
+// addresses are stored in the request so the handler can dial them without
+// resolving the name again.
+func (p *Proxy) checkDestination(ctx context.Context, request *Request, clientIP net.IP) *Error {
+	if request.AddressType == RequestAddressTypeUnixPath {
+		// enabled explicitly with AllowUnixTargets, there is no address or
+		// port to check
+		return nil
+	}
+	if !p.portAllowed(request.DestinationPort) {
+		setDenyReason(ctx, "port not allowed")
+		return &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("destination %s denied: port %d is not allowed", request.getDestinationString(), request.DestinationPort)}
+	}
+
+	if err := p.checkEgressFamily(request); err != nil {
+		return err
+	}
+
+	// the name is also resolved if the egress family is restricted or a
+	// custom resolver is set so the handler only dials the addresses returned
+	// by it
+	acl := p.getACL()
+	if tenant, ok := TenantFromContext(ctx); ok && acl != nil {
+		acl = acl.ForTenant(tenant)
+	}
+	if acl == nil && !p.BlockPrivateDestinations && p.GeoIPFilter == nil && p.EgressFamily == FamilyAny && p.Resolver == nil {
+		return nil
+	}
+
+	ips, err := p.resolveDestination(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if acl != nil && !acl.Allowed(ip) {
+			return &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("destination %s denied by acl: address %s", request.getDestinationString(), ip)}
+		}
+		if p.BlockPrivateDestinations && isPrivateIP(ip) {
+			setDenyReason(ctx, "private address")
+			return &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("destination %s denied: private address %s", request.getDestinationString(), ip)}
+		}
+	}
+
+	// the geoip filter needs both addresses so it is skipped for transports
+	// without a client address. The handler may dial any of the addresses so
+	// all are checked
+	if p.GeoIPFilter != nil && clientIP != nil {
+		for _, ip := range ips {
+			if allow, reason := p.GeoIPFilter(clientIP, ip); !allow {
+				setDenyReason(ctx, reason)
+				return &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("destination %s denied by geoip filter for client %s: address %s: %s", request.getDestinationString(), clientIP, ip, reason)}
+			}
+		}
+	}
+	return nil
+}
+
+// setDenyReason records why the request was denied in the stats of the
+// session
+func setDenyReason(ctx context.Context, reason string) {
+	if stats, ok := StatsFromContext(ctx); ok {
+		stats.DenyReason = reason
+	}
+}
+
+// portAllowed checks the port against AllowedPorts and AllowedPortRanges. All
+// ports are allowed if both are empty
+func (p *Proxy) portAllowed(port uint16) bool {
+	if len(p.AllowedPorts) == 0 && len(p.AllowedPortRanges) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedPorts {
+		if int(port) == allowed {
+			return true
+		}
+	}
+	for _, r := range p.AllowedPortRanges {
+		if int(port) >= r[0] && int(port) <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestIPListACL(t *testing.T) {
+	acl := &IPListACL{DefaultAllow: true}
+	if err := acl.Deny("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Allow("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Allow("not a cidr"); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+
+	tenant := &IPListACL{}
+	if err := tenant.Allow("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	acl.SetTenantACL("acme", tenant)
+
+	tests := []struct {
+		tenant string
+		ip     string
+		want   bool
+	}{
+		{"", "10.0.0.1", false},
+		{"", "10.1.0.1", true},
+		{"", "192.0.2.1", true},
+		{"acme", "10.0.0.1", true},
+		{"acme", "192.0.2.1", false},
+		{"other", "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := acl.ForTenant(tt.tenant).Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("tenant %q ip %s: got %v, want %v", tt.tenant, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestLoadACLFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		allowed []string
+		denied  []string
+		wantErr bool
+	}{
+		{
+			name:    "rules",
+			content: "# private ranges\ndefault allow\n\ndeny 10.0.0.0/8\nallow 10.1.0.0/16\ndeny fd00::/8\n",
+			allowed: []string{"10.1.2.3", "192.0.2.1", "2001:db8::1"},
+			denied:  []string{"10.2.3.4", "fd00::1"},
+		},
+		{
+			name:    "default deny",
+			content: "allow 192.0.2.0/24\n",
+			allowed: []string{"192.0.2.1"},
+			denied:  []string{"198.51.100.1"},
+		},
+		{name: "invalid action", content: "permit 10.0.0.0/8\n", wantErr: true},
+		{name: "invalid cidr", content: "deny 10.0.0.0/33\n", wantErr: true},
+		{name: "invalid default", content: "default maybe\n", wantErr: true},
+		{name: "missing field", content: "deny\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "acl")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			acl, err := LoadACLFile(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range tt.allowed {
+				if !acl.Allowed(net.ParseIP(ip)) {
+					t.Errorf("%s denied", ip)
+				}
+			}
+			for _, ip := range tt.denied {
+				if acl.Allowed(net.ParseIP(ip)) {
+					t.Errorf("%s allowed", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowedPorts(t *testing.T) {
+	p := &Proxy{
+		AllowedPorts:      []int{443},
+		AllowedPortRanges: [][2]int{{8000, 8080}},
+	}
+	tests := []struct {
+		port   uint16
+		denied bool
+	}{
+		{443, false},
+		{8000, false},
+		{8080, false},
+		{80, true},
+		{7999, true},
+		{8081, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(int(tt.port)), func(t *testing.T) {
+			request := ipRequest("93.184.216.34")
+			request.DestinationPort = tt.port
+			stats := &SessionStats{}
+			err := p.checkDestination(WithStats(context.Background(), stats), &request, nil)
+			if !tt.denied {
+				if err != nil {
+					t.Fatalf("unexpected denial: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("port was not denied")
+			}
+			if err.Reason != RequestReplyConnectionNotAllowed {
+				t.Fatalf("got reason %s, want %s", err.Reason, RequestReplyConnectionNotAllowed)
+			}
+			if stats.DenyReason != "port not allowed" {
+				t.Fatalf("got deny reason %q, want %q", stats.DenyReason, "port not allowed")
+			}
+		})
+	}
+}
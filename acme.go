@@ -0,0 +1,65 @@
+package socks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEManager obtains and renews certificates from Let's Encrypt. Certificates
+// are requested on the first TLS handshake and renewed before they expire
+// without restarting the proxy
+type ACMEManager struct {
+	manager *autocert.Manager
+}
+
+// NewACMEManager creates a manager for the domain. Certificates and the
+// account key are stored in cacheDir so they survive restarts
+func NewACMEManager(domain, cacheDir string) *ACMEManager {
+	return &ACMEManager{
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domain),
+			Cache:      autocert.DirCache(cacheDir),
+		},
+	}
+}
+
+// SetDirectoryURL sets the ACME directory. Defaults to Let's Encrypt
+// production, use this for the staging environment or a local ACME server
+func (m *ACMEManager) SetDirectoryURL(url string) {
+	if m.manager.Client == nil {
+		m.manager.Client = &acme.Client{}
+	}
+	m.manager.Client.DirectoryURL = url
+}
+
+// TLSConfig returns a config serving the managed certificates. It answers
+// TLS-ALPN-01 challenges on the same listener so port 80 is not needed
+func (m *ACMEManager) TLSConfig() *tls.Config {
+	config := m.manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	return config
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes all other requests to
+// fallback. It must be served on port 80 if TLS-ALPN-01 can not be used
+func (m *ACMEManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.manager.HTTPHandler(fallback)
+}
+
+// ListenTLSAutoTLS starts the proxy on a TLS listener with certificates for
+// domain from Let's Encrypt. The certificates are cached in cacheDir
+func (p *Proxy) ListenTLSAutoTLS(addr, domain, cacheDir string) error {
+	m := NewACMEManager(domain, cacheDir)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", addr, err)
+	}
+	go p.Serve(tls.NewListener(listener, m.TLSConfig()))
+	return nil
+}
@@ -0,0 +1,132 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// CredentialStore validates usernames and passwords for the username/password
+// authentication method (rfc1929)
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+// StaticCredentials is a CredentialStore backed by a map of usernames to
+// passwords
+type StaticCredentials map[string]string
+
+// Valid checks if the password matches the stored password of the user
+func (s StaticCredentials) Valid(username, password string) bool {
+	stored, ok := s[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// LoadCredentialsFile reads a file containing one username:password pair per
+// line. Empty lines and lines starting with # are ignored
+func LoadCredentialsFile(path string) (StaticCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := make(StaticCredentials)
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid credentials in %s line %d", path, lineNumber)
+		}
+		creds[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+/*
+	+----+------+----------+------+----------+
+	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	+----+------+----------+------+----------+
+	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	+----+------+----------+------+----------+
+
+	The VER field contains the current version of the subnegotiation,
+	which is X'01'.
+
+	+----+--------+
+	|VER | STATUS |
+	+----+--------+
+	| 1  |   1    |
+	+----+--------+
+
+	A STATUS field of X'00' indicates success. If the server returns a
+	`failure' (STATUS value other than X'00') status, it MUST close the
+	connection.
+*/
+func parseUsernamePassword(buf []byte) (string, string, error) {
+	if len(buf) < 2 {
+		return "", "", fmt.Errorf("invalid authentication request length (%d)", len(buf))
+	}
+	if buf[0] != usernamePasswordVersion {
+		return "", "", fmt.Errorf("invalid authentication version %#x", buf[0])
+	}
+	userLen := int(buf[1])
+	if len(buf) < 2+userLen+1 {
+		return "", "", fmt.Errorf("invalid authentication request length (%d)", len(buf))
+	}
+	username := string(buf[2 : 2+userLen])
+	passLen := int(buf[2+userLen])
+	if len(buf) < 3+userLen+passLen {
+		return "", "", fmt.Errorf("invalid authentication request length (%d)", len(buf))
+	}
+	password := string(buf[3+userLen : 3+userLen+passLen])
+	return username, password, nil
+}
+
+const (
+	usernamePasswordVersion = 0x01
+	usernamePasswordSuccess = 0x00
+	usernamePasswordFailure = 0x01
+)
+
+// handleUsernamePasswordAuth runs the username/password subnegotiation and
+// returns the authenticated user
+func (p *Proxy) handleUsernamePasswordAuth(ctx context.Context, conn io.ReadWriteCloser, creds CredentialStore) (string, *Error) {
+	buf, err := connectionRead(ctx, conn, p.Timeout, p.clock())
+	if err != nil {
+		return "", &Error{Reason: RequestReplyConnectionRefused, Err: err}
+	}
+	username, password, err := parseUsernamePassword(buf)
+	if err != nil {
+		return "", &Error{Reason: RequestReplyConnectionRefused, Err: err}
+	}
+
+	status := byte(usernamePasswordSuccess)
+	valid := creds.Valid(username, password)
+	if !valid {
+		status = usernamePasswordFailure
+	}
+	if err := connectionWrite(ctx, conn, []byte{usernamePasswordVersion, status}, p.Timeout, p.clock()); err != nil {
+		return "", &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send authentication reply: %w", err)}
+	}
+	if !valid {
+		return "", &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("invalid credentials for user %q", username)}
+	}
+	return username, nil
+}
@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUsernamePasswordAuth(t *testing.T) {
+	target := lineServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  StaticCredentials{"alice": "secret"},
+	}
+	addr := serveProxy(t, p)
+
+	conn := dialProxy(t, addr, "alice", "secret")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+}
+
+func TestUsernamePasswordAuthFailureClosesConnection(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  StaticCredentials{"alice": "secret"},
+	}
+	conn, err := net.Dial("tcp", serveProxy(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, MethodUsernamePassword}); err != nil {
+		t.Fatal(err)
+	}
+	selection := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selection); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x05, 'w', 'r', 'o', 'n', 'g'}); err != nil {
+		t.Fatal(err)
+	}
+	// only the failure status, no socks reply
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{usernamePasswordVersion, usernamePasswordFailure}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// bannerVersion is the version of the banner subnegotiation
+const bannerVersion = 0x01
+
+// maxBannerLength is the longest banner that can be sent
+const maxBannerLength = 255
+
+// bannerEnabled checks if the banner is sent to clients offering MethodBanner
+func (p *Proxy) bannerEnabled() bool {
+	return p.Debug && p.Banner != ""
+}
+
+// withBanner selects MethodBanner instead of no authentication if the banner
+// is enabled and the client offers it. The banner never replaces an
+// authentication method
+func (p *Proxy) withBanner(method Methods, offered []Methods) Methods {
+	if method != MethodNoAuthRequired || !p.bannerEnabled() || !containsMethod(offered, MethodBanner) {
+		return method
+	}
+	return MethodBanner
+}
+
+/*
+	+----+-----+----------+
+	|VER | LEN |  BANNER  |
+	+----+-----+----------+
+	| 1  |  1  | 0 to 255 |
+	+----+-----+----------+
+
+	The VER field contains the version of the subnegotiation, which is
+	X'01'. The request follows without authentication.
+*/
+func (p *Proxy) sendBanner(ctx context.Context, conn io.ReadWriteCloser) *Error {
+	banner := p.Banner
+	if len(banner) > maxBannerLength {
+		banner = banner[:maxBannerLength]
+	}
+	buf := make([]byte, 0, 2+len(banner))
+	buf = append(buf, bannerVersion, byte(len(banner)))
+	buf = append(buf, banner...)
+	if err := connectionWrite(ctx, conn, buf, p.Timeout, p.clock()); err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send banner: %w", err)}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name    string
+		debug   bool
+		banner  string
+		offered []byte
+		want    []byte
+	}{
+		{"offered", true, "gosocks", []byte{MethodNoAuthRequired, MethodBanner}, append([]byte{0x05, MethodBanner, 0x01, 7}, "gosocks"...)},
+		{"cut", true, long, []byte{MethodBanner, MethodNoAuthRequired}, append([]byte{0x05, MethodBanner, 0x01, 255}, long[:255]...)},
+		{"not offered", true, "gosocks", []byte{MethodNoAuthRequired}, []byte{0x05, MethodNoAuthRequired}},
+		{"debug disabled", false, "gosocks", []byte{MethodNoAuthRequired, MethodBanner}, []byte{0x05, MethodNoAuthRequired}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{
+				Proxyhandler: &DefaultHandler{Timeout: time.Second},
+				Timeout:      time.Second,
+				Debug:        tt.debug,
+				Banner:       tt.banner,
+			}
+			conn, err := net.Dial("tcp", serveProxy(t, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			greeting := append([]byte{0x05, byte(len(tt.offered))}, tt.offered...)
+			if _, err := conn.Write(greeting); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("got % x, want % x", got, tt.want)
+			}
+			// nothing else is sent before the request
+			if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("got %d more bytes and error %v", n, err)
+			}
+			if err := conn.SetReadDeadline(time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			if reply := sendRequest(t, conn, lineServer(t)); reply != RequestReplySucceeded {
+				t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+			}
+			roundTrip(t, conn)
+		})
+	}
+}
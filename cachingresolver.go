@@ -0,0 +1,83 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// CachingResolver caches the results of another Resolver. Nothing is cached
+// unless a TTL is set
+type CachingResolver struct {
+	// Resolver does the actual lookups. Uses net.DefaultResolver if nil
+	Resolver Resolver
+	// TTLSeconds is the time successful lookups are cached. 0 disables it
+	TTLSeconds int
+	// NXDOMAINTTLSeconds is the time lookups of non-existent domains are
+	// cached. The cached error is returned without asking the resolver
+	// again. 0 disables it
+	NXDOMAINTTLSeconds int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// LookupIPAddr returns the cached result for host or asks the underlying
+// resolver
+func (c *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok && now.After(entry.expires) {
+		delete(c.entries, host)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		addrs := make([]net.IPAddr, len(entry.addrs))
+		copy(addrs, entry.addrs)
+		return addrs, nil
+	}
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	switch {
+	case err == nil && c.TTLSeconds > 0:
+		cached := make([]net.IPAddr, len(addrs))
+		copy(cached, addrs)
+		c.store(host, cacheEntry{addrs: cached, expires: now.Add(time.Duration(c.TTLSeconds) * time.Second)})
+	case isNXDOMAIN(err) && c.NXDOMAINTTLSeconds > 0:
+		c.store(host, cacheEntry{err: err, expires: now.Add(time.Duration(c.NXDOMAINTTLSeconds) * time.Second)})
+	}
+	return addrs, err
+}
+
+func (c *CachingResolver) store(host string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[host] = entry
+}
+
+// isNXDOMAIN reports whether err means the domain does not exist. Temporary
+// failures and timeouts are not cached
+func isNXDOMAIN(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errorResolver fails every lookup with err and counts the lookups
+type errorResolver struct {
+	calls int64
+	err   error
+}
+
+func (r *errorResolver) LookupIPAddr(_ context.Context, _ string) ([]net.IPAddr, error) {
+	atomic.AddInt64(&r.calls, 1)
+	return nil, r.err
+}
+
+func TestCachingResolverNXDOMAIN(t *testing.T) {
+	nxdomain := &net.DNSError{Err: "no such host", Name: "missing.example", IsNotFound: true}
+	tests := []struct {
+		name  string
+		err   error
+		ttl   int
+		calls int64
+	}{
+		{"cached", nxdomain, 60, 1},
+		{"disabled", nxdomain, 0, 10},
+		{"temporary failure", &net.DNSError{Err: "server misbehaving", Name: "missing.example", IsTemporary: true}, 60, 10},
+		{"timeout", &net.DNSError{Err: "i/o timeout", Name: "missing.example", IsTimeout: true}, 60, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &errorResolver{err: tt.err}
+			c := &CachingResolver{Resolver: upstream, NXDOMAINTTLSeconds: tt.ttl}
+			for i := 0; i < 10; i++ {
+				if _, err := c.LookupIPAddr(context.Background(), "missing.example"); !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+			}
+			if calls := atomic.LoadInt64(&upstream.calls); calls != tt.calls {
+				t.Fatalf("upstream got %d lookups, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestCachingResolverNXDOMAINExpiry(t *testing.T) {
+	upstream := &errorResolver{err: &net.DNSError{Err: "no such host", Name: "missing.example", IsNotFound: true}}
+	c := &CachingResolver{Resolver: upstream, NXDOMAINTTLSeconds: 60}
+	if _, err := c.LookupIPAddr(context.Background(), "missing.example"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := c.LookupIPAddr(context.Background(), "other.example"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls := atomic.LoadInt64(&upstream.calls); calls != 2 {
+		t.Fatalf("upstream got %d lookups, want one per name", calls)
+	}
+
+	// let the entry expire
+	c.mu.Lock()
+	entry := c.entries["missing.example"]
+	entry.expires = time.Now().Add(-time.Second)
+	c.entries["missing.example"] = entry
+	c.mu.Unlock()
+	if _, err := c.LookupIPAddr(context.Background(), "missing.example"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls := atomic.LoadInt64(&upstream.calls); calls != 3 {
+		t.Fatalf("upstream got %d lookups, want 3 after the entry expired", calls)
+	}
+}
@@ -0,0 +1,144 @@
+package socks
+
+import (
+	"net"
+)
+
+// CIDRTrie is a path compressed binary trie (patricia trie) holding CIDR
+// ranges for IPv4 and IPv6. Lookups take at most 32 (IPv4) or 128 (IPv6)
+// steps regardless of the number of inserted ranges and always return the
+// longest matching prefix.
+// The zero value is an empty trie ready to use.
+type CIDRTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	// ip is the network address masked to bits
+	ip       net.IP
+	bits     int
+	set      bool
+	allow    bool
+	children [2]*trieNode
+}
+
+// Insert adds the range to the trie. Inserting the same range twice
+// overwrites the previous value
+func (t *CIDRTrie) Insert(cidr *net.IPNet, allow bool) {
+	if cidr == nil {
+		return
+	}
+	ones, _ := cidr.Mask.Size()
+	ip := cidr.IP.Mask(cidr.Mask)
+	if ip == nil {
+		return
+	}
+	root := &t.v6
+	if len(cidr.Mask) == net.IPv4len {
+		ip = ip.To4()
+		root = &t.v4
+	} else {
+		ip = ip.To16()
+	}
+	trieInsert(root, ip, ones, allow)
+}
+
+// Lookup returns the value of the longest range containing ip. matched is
+// false if no range contains the ip
+func (t *CIDRTrie) Lookup(ip net.IP) (allow bool, matched bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return trieLookup(t.v4, ip4)
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return trieLookup(t.v6, ip16)
+	}
+	return false, false
+}
+
+func trieInsert(n **trieNode, ip net.IP, bits int, allow bool) {
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &trieNode{ip: ip, bits: bits, set: true, allow: allow}
+			return
+		}
+
+		common := commonPrefixLen(cur.ip, ip, minInt(cur.bits, bits))
+		if common == cur.bits {
+			if bits == cur.bits {
+				cur.set = true
+				cur.allow = allow
+				return
+			}
+			// the new range is inside the current one
+			n = &cur.children[bitAt(ip, cur.bits)]
+			continue
+		}
+
+		leaf := &trieNode{ip: ip, bits: bits, set: true, allow: allow}
+		if common == bits {
+			// the new range contains the current node
+			leaf.children[bitAt(cur.ip, bits)] = cur
+			*n = leaf
+			return
+		}
+
+		// both ranges differ after common bits so we need a branch node
+		branch := &trieNode{ip: ip.Mask(net.CIDRMask(common, len(ip)*8)), bits: common}
+		branch.children[bitAt(cur.ip, common)] = cur
+		branch.children[bitAt(ip, common)] = leaf
+		*n = branch
+		return
+	}
+}
+
+func trieLookup(n *trieNode, ip net.IP) (allow bool, matched bool) {
+	for n != nil {
+		if commonPrefixLen(n.ip, ip, n.bits) < n.bits {
+			break
+		}
+		if n.set {
+			allow, matched = n.allow, true
+		}
+		if n.bits >= len(ip)*8 {
+			break
+		}
+		n = n.children[bitAt(ip, n.bits)]
+	}
+	return allow, matched
+}
+
+// bitAt returns the bit at position i (0 is the most significant bit)
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonPrefixLen returns the number of equal leading bits in a and b
+// limited to max
+func commonPrefixLen(a, b net.IP, max int) int {
+	n := 0
+	for i := 0; i < len(a) && i < len(b) && n < max; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,150 @@
+package socks
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func mustCIDR(tb testing.TB, s string) *net.IPNet {
+	tb.Helper()
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return network
+}
+
+func TestCIDRTrieLookup(t *testing.T) {
+	var trie CIDRTrie
+	rules := []struct {
+		cidr  string
+		allow bool
+	}{
+		{"10.0.0.0/8", true},
+		{"10.1.0.0/16", false},
+		{"10.1.2.0/24", true},
+		{"192.168.1.0/24", false},
+		{"192.168.0.0/16", true},
+		{"2001:db8::/32", true},
+		{"2001:db8:1::/48", false},
+		{"fd00::/8", false},
+	}
+	for _, r := range rules {
+		trie.Insert(mustCIDR(t, r.cidr), r.allow)
+	}
+
+	tests := []struct {
+		ip      string
+		allow   bool
+		matched bool
+	}{
+		{"10.0.0.1", true, true},
+		{"10.1.0.1", false, true},
+		{"10.1.2.3", true, true},
+		{"10.1.3.3", false, true},
+		{"192.168.1.1", false, true},
+		{"192.168.2.1", true, true},
+		{"172.16.0.1", false, false},
+		{"::ffff:10.1.2.3", true, true},
+		{"2001:db8::1", true, true},
+		{"2001:db8:1::1", false, true},
+		{"fd12::1", false, true},
+		{"2001:db9::1", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			allow, matched := trie.Lookup(net.ParseIP(tt.ip))
+			if allow != tt.allow || matched != tt.matched {
+				t.Fatalf("got (%v, %v), want (%v, %v)", allow, matched, tt.allow, tt.matched)
+			}
+		})
+	}
+}
+
+func TestCIDRTrieOverwrite(t *testing.T) {
+	var trie CIDRTrie
+	trie.Insert(mustCIDR(t, "10.0.0.0/8"), true)
+	trie.Insert(mustCIDR(t, "10.0.0.0/8"), false)
+	if allow, matched := trie.Lookup(net.ParseIP("10.2.3.4")); allow || !matched {
+		t.Fatalf("got (%v, %v), want the second value", allow, matched)
+	}
+}
+
+// linearACL is the reference the trie is compared against
+type linearACL []struct {
+	network *net.IPNet
+	allow   bool
+}
+
+func (l linearACL) lookup(ip net.IP) (allow bool, matched bool) {
+	best := -1
+	for _, r := range l {
+		if !r.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := r.network.Mask.Size(); ones >= best {
+			best = ones
+			allow, matched = r.allow, true
+		}
+	}
+	return allow, matched
+}
+
+// randomRanges returns n random IPv4 ranges between /8 and /32
+func randomRanges(rnd *rand.Rand, n int) linearACL {
+	ranges := make(linearACL, n)
+	for i := range ranges {
+		ip := net.IPv4(byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))).To4()
+		mask := net.CIDRMask(8+rnd.Intn(25), 32)
+		ranges[i].network = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		ranges[i].allow = rnd.Intn(2) == 0
+	}
+	return ranges
+}
+
+func TestCIDRTrieMatchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ranges := randomRanges(rnd, 2000)
+	// a range inserted twice keeps the last value, like the linear scan
+	var trie CIDRTrie
+	for _, r := range ranges {
+		trie.Insert(r.network, r.allow)
+	}
+	for i := 0; i < 2000; i++ {
+		ip := net.IPv4(byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)))
+		if i%2 == 0 {
+			// make sure a good part of the addresses is inside a range
+			ip = ranges[rnd.Intn(len(ranges))].network.IP
+		}
+		wantAllow, wantMatched := ranges.lookup(ip)
+		allow, matched := trie.Lookup(ip)
+		if allow != wantAllow || matched != wantMatched {
+			t.Fatalf("%s: got (%v, %v), want (%v, %v)", ip, allow, matched, wantAllow, wantMatched)
+		}
+	}
+}
+
+func BenchmarkCIDRTrieLookup(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	ranges := randomRanges(rnd, 10000)
+	var trie CIDRTrie
+	for _, r := range ranges {
+		trie.Insert(r.network, r.allow)
+	}
+	ip := net.ParseIP("203.0.113.7")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Lookup(ip)
+	}
+}
+
+func BenchmarkLinearScanLookup(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	ranges := randomRanges(rnd, 10000)
+	ip := net.ParseIP("203.0.113.7")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ranges.lookup(ip)
+	}
+}
@@ -0,0 +1,288 @@
+package socks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ContextDialer dials connections. net.Dialer implements this interface
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Client connects to destinations through a socks5 proxy
+type Client struct {
+	// ProxyAddr is the address of the socks5 proxy
+	ProxyAddr string
+	// Username and Password are used for username/password authentication if
+	// Username is set
+	Username string
+	Password string
+	// Timeout is used for connecting to the proxy and the handshake
+	Timeout time.Duration
+	// Dialer is used to connect to the proxy. A net.Dialer is used if nil,
+	// in js/wasm builds a WebSocketDialer
+	Dialer ContextDialer
+	// TLSConfig enables tls for the connection to the proxy. ServerName
+	// defaults to the host of ProxyAddr
+	TLSConfig *tls.Config
+	// ServerFingerprint is the hex encoded SHA-256 of the DER encoded
+	// certificate of the proxy. If set, tls is used and the certificate is
+	// only checked against the fingerprint instead of the certificate
+	// chain, for proxies with self-signed certificates
+	ServerFingerprint string
+}
+
+// Dial connects to address through the proxy. Only tcp networks are
+// supported
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy. Only tcp networks are
+// supported
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s not supported", network)
+	}
+
+	conn, bound, err := c.open(ctx, RequestCmdConnect, address)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientConn{Conn: conn, boundAddr: bound}, nil
+}
+
+// open connects to the proxy and sends the request. It returns the
+// connection and the bound address of the first reply
+func (c *Client) open(ctx context.Context, cmd RequestCmd, address string) (net.Conn, net.Addr, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	d := c.Dialer
+	if d == nil {
+		d = defaultDialer()
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.ProxyAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to proxy %s: %w", c.ProxyAddr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	tlsConn, err := c.startTLS(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn = tlsConn
+
+	bound, err := c.handshake(conn, cmd, address)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// clear the handshake deadline
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, bound, nil
+}
+
+// ClientConn is a connection through the proxy returned by Client.Dial
+type ClientConn struct {
+	net.Conn
+	boundAddr net.Addr
+}
+
+// BoundAddr returns the address the proxy used to connect to the
+// destination as sent in its reply. For BIND it is the address of the peer
+// that connected to the proxy. It is a *net.TCPAddr or a *DomainAddr if the
+// proxy replied with a domain name
+func (c *ClientConn) BoundAddr() net.Addr {
+	return c.boundAddr
+}
+
+// CloseWrite half-closes the connection to the proxy if supported
+func (c *ClientConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("connection of type %T does not support CloseWrite", c.Conn)
+}
+
+// DomainAddr is an address with a domain name as sent by proxies replying
+// with the domain name address type
+type DomainAddr struct {
+	Host string
+	Port int
+}
+
+// Network returns the network of the address
+func (a *DomainAddr) Network() string { return "tcp" }
+
+func (a *DomainAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+func (c *Client) handshake(conn net.Conn, cmd RequestCmd, address string) (net.Addr, error) {
+	if err := c.negotiateMethod(conn); err != nil {
+		return nil, err
+	}
+
+	request, err := buildRequest(cmd, address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("could not send request: %w", err)
+	}
+
+	return readReply(conn)
+}
+
+func (c *Client) negotiateMethod(conn net.Conn) error {
+	methods := []byte{MethodNoAuthRequired}
+	if c.Username != "" {
+		methods = append(methods, MethodUsernamePassword)
+	}
+	hello := append([]byte{Version5.Value(), byte(len(methods))}, methods...)
+	if _, err := conn.Write(hello); err != nil {
+		return fmt.Errorf("could not send hello: %w", err)
+	}
+
+	selection := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selection); err != nil {
+		return fmt.Errorf("could not read method selection: %w", err)
+	}
+	if selection[0] != Version5.Value() {
+		return fmt.Errorf("invalid socks version %s in method selection", Version(selection[0]))
+	}
+
+	switch selection[1] {
+	case MethodNoAuthRequired:
+		return nil
+	case MethodUsernamePassword:
+		if c.Username == "" {
+			return fmt.Errorf("proxy requires username/password authentication")
+		}
+		return c.authenticate(conn)
+	case MethodNoAcceptableMethods:
+		return fmt.Errorf("proxy accepted none of the offered methods")
+	default:
+		return fmt.Errorf("proxy selected unsupported method %s", Methods(selection[1]))
+	}
+}
+
+func (c *Client) authenticate(conn net.Conn) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return fmt.Errorf("username and password must not be longer than 255 bytes")
+	}
+	buf := []byte{usernamePasswordVersion, byte(len(c.Username))}
+	buf = append(buf, c.Username...)
+	buf = append(buf, byte(len(c.Password)))
+	buf = append(buf, c.Password...)
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("could not send credentials: %w", err)
+	}
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("could not read authentication status: %w", err)
+	}
+	if status[1] != usernamePasswordSuccess {
+		return fmt.Errorf("authentication failed")
+	}
+	return nil
+}
+
+// buildRequest creates a socks5 request for the address in host:port format
+func buildRequest(cmd RequestCmd, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s: %w", portString, err)
+	}
+
+	buf := []byte{Version5.Value(), byte(cmd), 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, RequestAddressTypeIPv4.Value())
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, RequestAddressTypeIPv6.Value())
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname %s is too long", host)
+		}
+		buf = append(buf, RequestAddressTypeDomainname.Value(), byte(len(host)))
+		buf = append(buf, host...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	return append(buf, portBytes...), nil
+}
+
+// readReply reads exactly one reply from the connection so no tunneled data
+// is consumed and returns the bound address of the reply
+func readReply(conn io.Reader) (net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("could not read reply: %w", err)
+	}
+	if header[0] != Version5.Value() {
+		return nil, fmt.Errorf("invalid socks version %s in reply", Version(header[0]))
+	}
+
+	addrType := RequestAddressType(header[3])
+	var addrLen int
+	switch addrType {
+	case RequestAddressTypeIPv4:
+		addrLen = net.IPv4len
+	case RequestAddressTypeIPv6:
+		addrLen = net.IPv6len
+	case RequestAddressTypeDomainname:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, fmt.Errorf("could not read reply: %w", err)
+		}
+		addrLen = int(length[0])
+	default:
+		return nil, fmt.Errorf("address type %s in reply not supported", addrType)
+	}
+	// address and port
+	rest := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return nil, fmt.Errorf("could not read reply: %w", err)
+	}
+
+	if reason := RequestReplyReason(header[1]); reason != RequestReplySucceeded {
+		return nil, fmt.Errorf("proxy returned error reply %s", reason)
+	}
+	port := int(binary.BigEndian.Uint16(rest[addrLen:]))
+	if addrType == RequestAddressTypeDomainname {
+		return &DomainAddr{Host: string(rest[:addrLen]), Port: port}, nil
+	}
+	return &net.TCPAddr{IP: net.IP(rest[:addrLen]), Port: port}, nil
+}
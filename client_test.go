@@ -0,0 +1,166 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	payload := []byte("HTTP/1.1 200 OK\r\n")
+	tests := []struct {
+		name    string
+		reply   []byte
+		want    string
+		network string
+		wantErr bool
+	}{
+		{
+			name:    "ipv4",
+			reply:   []byte{0x05, 0x00, 0x00, 0x01, 192, 0, 2, 1, 0x1f, 0x90},
+			want:    "192.0.2.1:8080",
+			network: "tcp",
+		},
+		{
+			name:    "ipv6",
+			reply:   append(append([]byte{0x05, 0x00, 0x00, 0x04}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb),
+			want:    "[2001:db8::1]:443",
+			network: "tcp",
+		},
+		{
+			name:    "domain",
+			reply:   append(append([]byte{0x05, 0x00, 0x00, 0x03, 17}, "proxy.example.com"...), 0x04, 0x38),
+			want:    "proxy.example.com:1080",
+			network: "tcp",
+		},
+		{
+			name:    "empty domain",
+			reply:   []byte{0x05, 0x00, 0x00, 0x03, 0, 0x00, 0x50},
+			want:    ":80",
+			network: "tcp",
+		},
+		{
+			name:    "error reply",
+			reply:   []byte{0x05, byte(RequestReplyHostUnreachable), 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "invalid version",
+			reply:   []byte{0x04, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "invalid address type",
+			reply:   []byte{0x05, 0x00, 0x00, 0x05, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+	}
+	// the connection ends in the middle of the domain
+	if _, err := readReply(bytes.NewReader([]byte{0x05, 0x00, 0x00, 0x03, 10, 'a', 'b'})); err == nil {
+		t.Error("truncated reply accepted")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(append(append([]byte{}, tt.reply...), payload...))
+			addr, err := readReply(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got address %s", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tt.want || addr.Network() != tt.network {
+				t.Fatalf("got %s/%s, want %s/%s", addr.Network(), addr, tt.network, tt.want)
+			}
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, payload) {
+				t.Fatalf("got %q after the reply, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+// TestDialDomainBoundAddress uses a server that sends a domain bound address
+// and the first tunnel data in the same write
+func TestDialDomainBoundAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	payload := []byte("SSH-2.0-OpenSSH_9.6\r\n")
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// greeting and request
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+			return
+		}
+		if _, err := readRequestBytes(conn); err != nil {
+			return
+		}
+		reply := append([]byte{0x05, 0x00, 0x00, 0x03, 13}, "relay.example"...)
+		reply = append(reply, 0x04, 0x38)
+		_, _ = conn.Write(append(reply, payload...))
+	}()
+
+	client := &Client{ProxyAddr: l.Addr().String(), Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", "192.0.2.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bound, ok := conn.(*ClientConn).BoundAddr().(*DomainAddr)
+	if !ok || bound.Host != "relay.example" || bound.Port != 1080 {
+		t.Fatalf("got bound address %v", conn.(*ClientConn).BoundAddr())
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
+
+// readRequestBytes reads a socks5 request with an ipv4, ipv6 or domain
+// address
+func readRequestBytes(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var n int
+	switch RequestAddressType(header[3]) {
+	case RequestAddressTypeIPv4:
+		n = net.IPv4len
+	case RequestAddressTypeIPv6:
+		n = net.IPv6len
+	default:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, err
+		}
+		n = int(length[0])
+	}
+	rest := make([]byte, n+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return append(header, rest...), nil
+}
@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bind sends a BIND request to the proxy. expectedPeer is the address of the
+// host that will connect, an empty string lets any host connect. The
+// returned listener holds the address the proxy listens on, pass it to the
+// peer out of band like with the FTP PORT command. Accept then waits for the
+// peer to connect
+func (c *Client) Bind(ctx context.Context, expectedPeer string) (*BindListener, error) {
+	if expectedPeer == "" {
+		expectedPeer = "0.0.0.0:0"
+	}
+	conn, addr, err := c.open(ctx, RequestCmdBind, expectedPeer)
+	if err != nil {
+		return nil, err
+	}
+	return &BindListener{conn: conn, addr: addr}, nil
+}
+
+// BindListener accepts the single inbound connection of a BIND request
+type BindListener struct {
+	conn net.Conn
+	addr net.Addr
+
+	mu sync.Mutex
+	// used is set once Accept was called
+	used bool
+	// accepted is set if the connection was handed to the caller
+	accepted bool
+}
+
+// Addr returns the address the proxy listens on for the peer as sent in the
+// first reply. It is a *net.TCPAddr or a *DomainAddr
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Accept waits for the peer to connect to the proxy
+func (l *BindListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for the second reply of the proxy announcing the
+// inbound connection. The returned connection is a *ClientConn, its
+// BoundAddr is the address of the peer. Only one connection can be accepted,
+// the connection to the proxy is closed if waiting fails
+func (l *BindListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	l.mu.Lock()
+	if l.used {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("bind listener already used")
+	}
+	l.used = true
+	l.mu.Unlock()
+
+	// interrupt the read if the context ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	peer, err := readReply(l.conn)
+	if err == nil {
+		err = l.conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		l.conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accepted = true
+	return &ClientConn{Conn: l.conn, boundAddr: peer}, nil
+}
+
+// Close closes the connection to the proxy and interrupts a waiting Accept.
+// After a connection was accepted it is owned by the caller and not closed
+func (l *BindListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accepted {
+		return nil
+	}
+	return l.conn.Close()
+}
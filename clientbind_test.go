@@ -0,0 +1,152 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// bindServer is a fake proxy supporting only BIND. It accepts one
+// connection and sends the first reply after the request. Closing peer
+// simulates the inbound connection, the second reply is sent together with
+// the first data of the peer. The request is sent on requests
+func bindServer(t *testing.T, first, second []byte) (addr string, peer chan<- struct{}, requests <-chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	connected := make(chan struct{})
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, 3)); err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+			return
+		}
+		request, err := readRequestBytes(conn)
+		if err != nil {
+			return
+		}
+		received <- request
+		if _, err := conn.Write(first); err != nil {
+			return
+		}
+		<-connected
+		if _, err := conn.Write(append(append([]byte{}, second...), "hello"...)); err != nil {
+			return
+		}
+		// keep the connection open until the client closes it
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	return l.Addr().String(), connected, received
+}
+
+func TestClientBind(t *testing.T) {
+	ipv4 := []byte{0x05, 0x00, 0x00, 0x01, 192, 0, 2, 10, 0x9c, 0x40}
+	ipv6 := append(append([]byte{0x05, 0x00, 0x00, 0x04}, net.ParseIP("2001:db8::7")...), 0xc3, 0x50)
+	domain := append(append([]byte{0x05, 0x00, 0x00, 0x03, 13}, "relay.example"...), 0x04, 0x38)
+	tests := []struct {
+		name          string
+		expectedPeer  string
+		first, second []byte
+		listen, peer  string
+	}{
+		{"ipv4 then ipv6", "198.51.100.1:0", ipv4, ipv6, "192.0.2.10:40000", "[2001:db8::7]:50000"},
+		{"domain then ipv4", "", domain, ipv4, "relay.example:1080", "192.0.2.10:40000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, peer, requests := bindServer(t, tt.first, tt.second)
+			client := &Client{ProxyAddr: addr, Timeout: 5 * time.Second}
+			l, err := client.Bind(context.Background(), tt.expectedPeer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			wantPeer := tt.expectedPeer
+			if wantPeer == "" {
+				wantPeer = "0.0.0.0:0"
+			}
+			want, err := buildRequest(RequestCmdBind, wantPeer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-requests; !bytes.Equal(got, want) {
+				t.Fatalf("proxy got request %x, want %x", got, want)
+			}
+			if got := l.Addr().String(); got != tt.listen {
+				t.Fatalf("got listen address %s, want %s", got, tt.listen)
+			}
+
+			close(peer)
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.(*ClientConn).BoundAddr().String(); got != tt.peer {
+				t.Fatalf("got peer address %s, want %s", got, tt.peer)
+			}
+			// data sent with the second reply is not lost
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "hello" {
+				t.Fatalf("got %q, want hello", buf)
+			}
+			if _, err := l.Accept(); err == nil {
+				t.Fatal("second Accept succeeded")
+			}
+		})
+	}
+}
+
+func TestClientBindAcceptContext(t *testing.T) {
+	addr, _, _ := bindServer(t, []byte{0x05, 0x00, 0x00, 0x01, 192, 0, 2, 10, 0x9c, 0x40}, nil)
+	client := &Client{ProxyAddr: addr, Timeout: 5 * time.Second}
+	l, err := client.Bind(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the peer never connects
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClientBindErrorReply(t *testing.T) {
+	refused := []byte{0x05, byte(RequestReplyConnectionRefused), 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	addr, peer, _ := bindServer(t, []byte{0x05, 0x00, 0x00, 0x01, 192, 0, 2, 10, 0x9c, 0x40}, refused)
+	client := &Client{ProxyAddr: addr, Timeout: 5 * time.Second}
+	l, err := client.Bind(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	close(peer)
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("error in the second reply was accepted")
+	}
+}
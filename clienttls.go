@@ -0,0 +1,79 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// tlsConfig returns the tls configuration for the connection to the proxy or
+// nil if tls is not used
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	if c.TLSConfig == nil && c.ServerFingerprint == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.ProxyAddr); err == nil {
+			config.ServerName = host
+		}
+	}
+	if c.ServerFingerprint == "" {
+		return config, nil
+	}
+
+	want, err := parseFingerprint(c.ServerFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	verify := config.VerifyConnection
+	// the fingerprint replaces the chain validation so self-signed
+	// certificates can be used
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("proxy did not send a certificate")
+		}
+		got := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if !bytes.Equal(got[:], want) {
+			return fmt.Errorf("certificate fingerprint %x of the proxy does not match", got)
+		}
+		if verify != nil {
+			return verify(state)
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// parseFingerprint decodes a hex encoded SHA-256 fingerprint. Colons like in
+// the output of openssl x509 -fingerprint are ignored
+func parseFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid server fingerprint %q, expected the hex encoded SHA-256 of the certificate", s)
+	}
+	return b, nil
+}
+
+// startTLS runs the tls handshake on the connection to the proxy if tls is
+// configured
+func (c *Client) startTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	config, err := c.tlsConfig()
+	if err != nil || config == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("tls handshake with proxy %s failed: %w", c.ProxyAddr, err)
+	}
+	return tlsConn, nil
+}
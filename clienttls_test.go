@@ -0,0 +1,110 @@
+package socks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate and its SHA-256 fingerprint
+func selfSigned(t *testing.T, name string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:])
+}
+
+func TestClientServerFingerprint(t *testing.T) {
+	cert, fingerprint := selfSigned(t, "proxy")
+	_, otherFingerprint := selfSigned(t, "other")
+	p := &Proxy{Proxyhandler: &DefaultHandler{Timeout: time.Second}, Timeout: time.Second}
+	addr := serveTLSProxy(t, p, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	target := lineServer(t)
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantErr     bool
+	}{
+		{"matching", fingerprint, false},
+		{"openssl format", strings.ToUpper(colonSeparated(fingerprint)), false},
+		{"other certificate", otherFingerprint, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{ProxyAddr: addr, Timeout: 5 * time.Second, ServerFingerprint: tt.fingerprint}
+			conn, err := client.Dial("tcp", target)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("connected to a proxy with another certificate")
+				}
+				if !strings.Contains(err.Error(), "fingerprint") {
+					t.Fatalf("got error %v, want a fingerprint mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			roundTrip(t, conn)
+		})
+	}
+}
+
+// TestClientServerFingerprintWithoutPin checks that the self-signed
+// certificate is rejected by the chain validation without a fingerprint
+func TestClientServerFingerprintWithoutPin(t *testing.T) {
+	cert, _ := selfSigned(t, "proxy")
+	p := &Proxy{Proxyhandler: &DefaultHandler{Timeout: time.Second}, Timeout: time.Second}
+	addr := serveTLSProxy(t, p, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	client := &Client{ProxyAddr: addr, Timeout: 5 * time.Second, TLSConfig: &tls.Config{}}
+	conn, err := client.Dial("tcp", lineServer(t))
+	if err == nil {
+		conn.Close()
+		t.Fatal("accepted a self-signed certificate without a fingerprint")
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	_, fingerprint := selfSigned(t, "proxy")
+	for _, s := range []string{"", "abc", fingerprint[:62], fingerprint + "00", "zz" + fingerprint[2:]} {
+		if _, err := parseFingerprint(s); err == nil {
+			t.Fatalf("parsed invalid fingerprint %q", s)
+		}
+	}
+}
+
+// colonSeparated formats a hex fingerprint like openssl x509 -fingerprint
+func colonSeparated(s string) string {
+	var parts []string
+	for i := 0; i < len(s); i += 2 {
+		parts = append(parts, s[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,175 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListenPacket sends an UDP ASSOCIATE request and returns a connection that
+// relays datagrams through the proxy. WriteTo and ReadFrom use the real
+// addresses of the peers, the socks udp header is added and removed
+// internally. The returned connection is a *ClientPacketConn. It is closed
+// when the proxy closes the control connection
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	control, bound, err := c.open(ctx, RequestCmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	relay, err := relayAddr(control, bound)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("could not bind udp socket: %w", err)
+	}
+
+	pc := &ClientPacketConn{conn: conn, control: control, relay: relay}
+	go pc.watchControl()
+	return pc, nil
+}
+
+// relayAddr returns the address to send datagrams to from the bound address
+// of the reply. The proxy address is used if the proxy replied with the
+// unspecified address
+func relayAddr(control net.Conn, bound net.Addr) (*net.UDPAddr, error) {
+	var relay *net.UDPAddr
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		relay = &net.UDPAddr{IP: a.IP, Port: a.Port}
+	case *DomainAddr:
+		resolved, err := net.ResolveUDPAddr("udp", net.JoinHostPort(a.Host, strconv.Itoa(a.Port)))
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve udp relay %s: %w", a, err)
+		}
+		relay = resolved
+	default:
+		return nil, fmt.Errorf("unsupported udp relay address %v", bound)
+	}
+	if relay.IP.IsUnspecified() {
+		relay.IP = addrIP(control.RemoteAddr())
+	}
+	if relay.IP == nil || relay.Port == 0 {
+		return nil, fmt.Errorf("invalid udp relay address %s", relay)
+	}
+	return relay, nil
+}
+
+// ClientPacketConn is an UDP association through the proxy returned by
+// Client.ListenPacket
+type ClientPacketConn struct {
+	conn    *net.UDPConn
+	control net.Conn
+	relay   *net.UDPAddr
+
+	closeOnce sync.Once
+}
+
+// watchControl closes the association when the control connection drops
+func (c *ClientPacketConn) watchControl() {
+	_, _ = io.Copy(io.Discard, c.control)
+	log.Debugf("udp association control connection to %s closed", c.control.RemoteAddr())
+	c.Close()
+}
+
+// ReadFrom reads the next datagram relayed by the proxy and returns the
+// address of the peer that sent it. Datagrams not sent by the relay,
+// fragmented datagrams and datagrams with a domain name source are dropped.
+// If b is too small the truncated payload is returned with
+// io.ErrShortBuffer
+func (c *ClientPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			log.Debugf("dropping datagram from %s: not sent by the relay", from)
+			continue
+		}
+		header, data, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			log.Debugf("dropping datagram from the relay: %v", err)
+			continue
+		}
+		if header.AddressType == RequestAddressTypeDomainname {
+			log.Debugf("dropping datagram from domain name source %s", header.getDestinationString())
+			continue
+		}
+		src := &net.UDPAddr{IP: net.IP(header.DestinationAddress), Port: int(header.DestinationPort)}
+		n = copy(b, data)
+		if n < len(data) {
+			return n, src, io.ErrShortBuffer
+		}
+		return n, src, nil
+	}
+}
+
+// WriteTo sends b to addr through the proxy. addr can be an *net.UDPAddr or
+// any address in host:port format, domain names are resolved by the proxy
+func (c *ClientPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	request, err := buildRequest(RequestCmdAssociate, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	// the udp header has the address in the same format as the request
+	// after the first three bytes
+	datagram := make([]byte, 0, len(request)+len(b))
+	datagram = append(datagram, 0, 0, 0)
+	datagram = append(datagram, request[3:]...)
+	datagram = append(datagram, b...)
+	if len(datagram) > maxUDPPayload {
+		return 0, fmt.Errorf("datagram of %d bytes with header exceeds the maximum size of %d bytes", len(datagram), maxUDPPayload)
+	}
+	if _, err := c.conn.WriteToUDP(datagram, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the association by closing the control connection
+func (c *ClientPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		if cerr := c.control.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// LocalAddr returns the local address of the udp socket
+func (c *ClientPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RelayAddr returns the address of the udp relay of the proxy
+func (c *ClientPacketConn) RelayAddr() net.Addr {
+	return c.relay
+}
+
+// SetDeadline sets the read and write deadlines of the udp socket
+func (c *ClientPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the udp socket
+func (c *ClientPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the udp socket
+func (c *ClientPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,102 @@
+package socks
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the time source of the handshake, session, UDP idle and resume
+// timeouts and of the HandshakeDeadline. Tests can replace it with a fake
+// clock like sockstest.FakeClock to trigger the timeouts without waiting.
+// Other deadlines of network connections, like the IdleTimeout, are handled
+// by the operating system and always use the real time
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f once d elapsed. C of the returned timer is nil
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock, see time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock uses the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// clock returns the configured clock or the real clock
+func (p *Proxy) clock() Clock {
+	if p.Clock == nil {
+		return realClock{}
+	}
+	return p.Clock
+}
+
+// withTimeout works like context.WithTimeout with the time of clock
+func withTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	c := &timeoutCtx{Context: cancelCtx, deadline: clock.Now().Add(d)}
+	timer := clock.AfterFunc(d, func() {
+		atomic.StoreInt32(&c.expired, 1)
+		cancel()
+	})
+	return c, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// timeoutCtx is canceled by the timer of a Clock and reports
+// context.DeadlineExceeded like a context with a real deadline
+type timeoutCtx struct {
+	context.Context
+	deadline time.Time
+	expired  int32
+}
+
+func (c *timeoutCtx) Deadline() (time.Time, bool) {
+	if parent, ok := c.Context.Deadline(); ok && parent.Before(c.deadline) {
+		return parent, true
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutCtx) Err() error {
+	err := c.Context.Err()
+	if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package socks_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+// TestTimeoutUsesClock checks that the read timeout of the handshake fires
+// when the injected clock advances, not after the real time elapsed
+func TestTimeoutUsesClock(t *testing.T) {
+	clock := sockstest.NewFakeClock(time.Now())
+	p := &socks.Proxy{
+		Proxyhandler: sockstest.NewMockHandler(),
+		Timeout:      time.Hour,
+		Clock:        clock,
+	}
+	conn, err := net.Dial("tcp", serve(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client sends nothing, the proxy waits for the greeting
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour - time.Second)
+	stillOpen(t, conn)
+
+	clock.Advance(time.Second)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("the timeout did not fire when the clock advanced")
+	}
+	if pending := clock.Pending(); pending != 0 {
+		t.Fatalf("got %d pending timers after the connection was closed", pending)
+	}
+}
@@ -0,0 +1,74 @@
+package socks
+
+// CloseReason describes why a session ended
+type CloseReason int32
+
+const (
+	// CloseReasonNone means the session is still open
+	CloseReasonNone CloseReason = iota
+	// CloseReasonClientEOF means the client closed the connection
+	CloseReasonClientEOF
+	// CloseReasonRemoteEOF means the remote closed the connection
+	CloseReasonRemoteEOF
+	// CloseReasonIdleTimeout means no data was transferred for too long
+	CloseReasonIdleTimeout
+	// CloseReasonMaxLifetime means the session exceeded MaxSessionDuration
+	CloseReasonMaxLifetime
+	// CloseReasonKilledByAdmin means the session was closed with CloseSession
+	CloseReasonKilledByAdmin
+	// CloseReasonShutdown means the proxy was stopped
+	CloseReasonShutdown
+	// CloseReasonCopyErrorClientToRemote means copying from the client to
+	// the remote failed
+	CloseReasonCopyErrorClientToRemote
+	// CloseReasonCopyErrorRemoteToClient means copying from the remote to
+	// the client failed
+	CloseReasonCopyErrorRemoteToClient
+	// CloseReasonHandshakeFailure means the socks handshake failed before
+	// the session was established. SessionStats.HandshakeReply holds the
+	// reply sent to the client
+	CloseReasonHandshakeFailure
+	// CloseReasonStalledPeer means a write to the client or the remote did
+	// not finish within WriteStallTimeout
+	CloseReasonStalledPeer
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonClientEOF:
+		return "client eof"
+	case CloseReasonRemoteEOF:
+		return "remote eof"
+	case CloseReasonIdleTimeout:
+		return "idle timeout"
+	case CloseReasonMaxLifetime:
+		return "max lifetime exceeded"
+	case CloseReasonKilledByAdmin:
+		return "killed by admin"
+	case CloseReasonShutdown:
+		return "shutdown"
+	case CloseReasonCopyErrorClientToRemote:
+		return "copy error client to remote"
+	case CloseReasonCopyErrorRemoteToClient:
+		return "copy error remote to client"
+	case CloseReasonHandshakeFailure:
+		return "handshake failure"
+	case CloseReasonStalledPeer:
+		return "stalled peer"
+	default:
+		return "unknown"
+	}
+}
+
+// byProxy checks if the proxy closed the session on purpose. No error reply
+// is sent in this case
+func (r CloseReason) byProxy() bool {
+	switch r {
+	case CloseReasonIdleTimeout, CloseReasonMaxLifetime, CloseReasonKilledByAdmin, CloseReasonShutdown, CloseReasonStalledPeer:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,186 @@
+// gosocks-bench measures the performance of a socks5 proxy. The target should
+// be an echo server, every connection sends the payload and reads it back.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+)
+
+type result struct {
+	Connections       int     `json:"connections"`
+	Errors            int     `json:"errors"`
+	Duration          string  `json:"duration"`
+	ConnectionsPerSec float64 `json:"connections_per_sec"`
+	BytesPerSec       float64 `json:"bytes_per_sec"`
+	LatencyP50        string  `json:"latency_p50"`
+	LatencyP95        string  `json:"latency_p95"`
+	LatencyP99        string  `json:"latency_p99"`
+}
+
+type sample struct {
+	latency time.Duration
+	bytes   int64
+	err     error
+}
+
+func main() {
+	proxyAddr := flag.String("proxy-addr", "127.0.0.1:1080", "address of the socks5 proxy")
+	targetAddr := flag.String("target-addr", "", "address of an echo server to connect to through the proxy")
+	connections := flag.Int("connections", 1000, "total number of connections, 0 means unlimited until duration is reached")
+	duration := flag.Duration("duration", 0, "maximum duration of the benchmark, 0 means no limit")
+	concurrency := flag.Int("concurrency", 10, "number of concurrent connections")
+	payloadSize := flag.Int("payload-size", 1024, "bytes sent and read back on every connection")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout per connection")
+	username := flag.String("username", "", "username for the proxy")
+	password := flag.String("password", "", "password for the proxy")
+	jsonOutput := flag.Bool("json", false, "print results as json")
+	flag.Parse()
+
+	if *targetAddr == "" {
+		fmt.Fprintln(os.Stderr, "--target-addr is required")
+		os.Exit(1)
+	}
+	if *connections <= 0 && *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "one of --connections or --duration must be set")
+		os.Exit(1)
+	}
+	if *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "--concurrency must be greater than 0")
+		os.Exit(1)
+	}
+
+	client := &socks.Client{
+		ProxyAddr: *proxyAddr,
+		Username:  *username,
+		Password:  *password,
+		Timeout:   *timeout,
+	}
+	payload := bytes.Repeat([]byte("A"), *payloadSize)
+
+	ctx := context.Background()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	jobs := make(chan struct{})
+	samples := make(chan sample)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				samples <- run(client, *targetAddr, payload, *timeout)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := 0; *connections <= 0 || i < *connections; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- struct{}{}:
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(samples)
+	}()
+
+	start := time.Now()
+	var latencies []time.Duration
+	var totalBytes int64
+	errors := 0
+	for s := range samples {
+		if s.err != nil {
+			errors++
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		totalBytes += s.bytes
+	}
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r := result{
+		Connections:       len(latencies),
+		Errors:            errors,
+		Duration:          elapsed.String(),
+		ConnectionsPerSec: float64(len(latencies)) / elapsed.Seconds(),
+		BytesPerSec:       float64(totalBytes) / elapsed.Seconds(),
+		LatencyP50:        percentile(latencies, 50).String(),
+		LatencyP95:        percentile(latencies, 95).String(),
+		LatencyP99:        percentile(latencies, 99).String(),
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "connections\t%d\n", r.Connections)
+	fmt.Fprintf(w, "errors\t%d\n", r.Errors)
+	fmt.Fprintf(w, "duration\t%s\n", r.Duration)
+	fmt.Fprintf(w, "connections/sec\t%.2f\n", r.ConnectionsPerSec)
+	fmt.Fprintf(w, "bytes/sec\t%.2f\n", r.BytesPerSec)
+	fmt.Fprintf(w, "latency p50\t%s\n", r.LatencyP50)
+	fmt.Fprintf(w, "latency p95\t%s\n", r.LatencyP95)
+	fmt.Fprintf(w, "latency p99\t%s\n", r.LatencyP99)
+	w.Flush()
+}
+
+// run connects through the proxy, sends the payload and reads it back. The
+// latency includes the proxy handshake and the round trip
+func run(client *socks.Client, target string, payload []byte, timeout time.Duration) sample {
+	start := time.Now()
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		return sample{err: err}
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return sample{err: err}
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return sample{err: err}
+	}
+	read, err := io.CopyN(io.Discard, conn, int64(len(payload)))
+	if err != nil {
+		return sample{err: err}
+	}
+	return sample{latency: time.Since(start), bytes: int64(len(payload)) + read}
+}
+
+// percentile returns the p-th percentile of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const daemonEnv = "GOSOCKS_DAEMON"
+
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// daemonize starts the current binary again in a new session and returns the
+// pid of the new process. Go can not fork so the process is re-executed
+func daemonize() (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	return cmd.Process.Pid, nil
+}
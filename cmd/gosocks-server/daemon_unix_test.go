@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+)
+
+func TestDaemonize(t *testing.T) {
+	target := echoServer(t)
+	addr := freeAddr(t)
+	pidFile := filepath.Join(t.TempDir(), "gosocks.pid")
+	if out, err := exec.Command(binary, "-listen", addr, "-daemonize", "-pidfile", pidFile).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = syscall.Kill(pid, syscall.SIGKILL) })
+
+	waitListening(t, addr)
+	checkEcho(t, &socks.Client{ProxyAddr: addr, Timeout: 5 * time.Second}, target)
+}
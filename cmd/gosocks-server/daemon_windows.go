@@ -0,0 +1,13 @@
+package main
+
+import (
+	"fmt"
+)
+
+func isDaemon() bool {
+	return false
+}
+
+func daemonize() (int, error) {
+	return 0, fmt.Errorf("daemonize is not supported on windows")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	socks "github.com/firefart/gosocks"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHandler(c config) (socks.ProxyHandler, error) {
+	switch c.upstream {
+	case "direct":
+		return socks.DefaultHandler{Timeout: c.timeout}, nil
+	case "socks5":
+		if c.upstreamAddr == "" {
+			return nil, fmt.Errorf("upstream-addr is required for socks5 upstreams")
+		}
+		return &chainHandler{
+			client: &socks.Client{
+				ProxyAddr: c.upstreamAddr,
+				Username:  c.upstreamUser,
+				Password:  c.upstreamPass,
+				Timeout:   c.timeout,
+			},
+		}, nil
+	case "ssh":
+		return newSSHHandler(c)
+	default:
+		return nil, fmt.Errorf("invalid upstream mode %q", c.upstream)
+	}
+}
+
+// chainHandler connects to destinations through another socks5 proxy
+type chainHandler struct {
+	socks.DefaultHandler
+	client *socks.Client
+}
+
+func (h *chainHandler) PreHandler(ctx context.Context, request socks.Request) (io.ReadWriteCloser, *socks.Error) {
+	conn, err := dialFirst(ctx, destinations(request), h.client.DialContext)
+	if err != nil {
+		return nil, &socks.Error{Reason: socks.RequestReplyHostUnreachable, Err: err}
+	}
+	return conn, nil
+}
+
+// sshHandler connects to destinations through an ssh server like ssh -D
+type sshHandler struct {
+	socks.DefaultHandler
+	client *ssh.Client
+}
+
+func newSSHHandler(c config) (*sshHandler, error) {
+	if c.upstreamAddr == "" {
+		return nil, fmt.Errorf("upstream-addr is required for ssh upstreams")
+	}
+	if c.sshKnownHosts == "" {
+		return nil, fmt.Errorf("ssh-known-hosts is required for ssh upstreams")
+	}
+	hostKeyCallback, err := knownhosts.New(c.sshKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if c.sshKeyFile != "" {
+		key, err := os.ReadFile(c.sshKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse ssh key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.upstreamPass != "" {
+		auth = append(auth, ssh.Password(c.upstreamPass))
+	}
+
+	client, err := ssh.Dial("tcp", c.upstreamAddr, &ssh.ClientConfig{
+		User:            c.upstreamUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         c.timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to ssh server: %w", err)
+	}
+	return &sshHandler{client: client}, nil
+}
+
+func (h *sshHandler) PreHandler(ctx context.Context, request socks.Request) (io.ReadWriteCloser, *socks.Error) {
+	conn, err := dialFirst(ctx, destinations(request), h.client.DialContext)
+	if err != nil {
+		return nil, &socks.Error{Reason: socks.RequestReplyHostUnreachable, Err: err}
+	}
+	return conn, nil
+}
+
+// destination returns the destination of the request in host:port format
+func destination(request socks.Request) string {
+	var host string
+	switch request.AddressType {
+	case socks.RequestAddressTypeIPv4, socks.RequestAddressTypeIPv6:
+		host = net.IP(request.DestinationAddress).String()
+	default:
+		host = string(request.DestinationAddress)
+	}
+	return net.JoinHostPort(host, fmt.Sprint(request.DestinationPort))
+}
+
+// destinations returns the addresses to connect to. If the proxy already
+// resolved and vetted the name the addresses are used so the upstream does
+// not resolve it again
+func destinations(request socks.Request) []string {
+	if len(request.ResolvedAddresses) == 0 {
+		return []string{destination(request)}
+	}
+	port := fmt.Sprint(request.DestinationPort)
+	addrs := make([]string, 0, len(request.ResolvedAddresses))
+	for _, ip := range request.ResolvedAddresses {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs
+}
+
+// dialFirst returns the first connection to one of the addresses
+func dialFirst(ctx context.Context, addrs []string, dial func(ctx context.Context, network, address string) (net.Conn, error)) (net.Conn, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
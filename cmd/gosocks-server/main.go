@@ -0,0 +1,160 @@
+// gosocks-server is a standalone socks5 proxy server
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime/debug"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	log "github.com/sirupsen/logrus"
+)
+
+type config struct {
+	listenAddr     string
+	upstream       string
+	upstreamAddr   string
+	upstreamUser   string
+	upstreamPass   string
+	sshKeyFile     string
+	sshKnownHosts  string
+	authFile       string
+	aclFile        string
+	tlsCert        string
+	tlsKey         string
+	timeout        time.Duration
+	maxConnections int
+	daemonize      bool
+	pidFile        string
+	debug          bool
+}
+
+func main() {
+	c := config{}
+	flag.StringVar(&c.listenAddr, "listen", "127.0.0.1:1080", "address to listen on")
+	flag.StringVar(&c.upstream, "upstream", "direct", "upstream dial mode: direct, socks5 or ssh")
+	flag.StringVar(&c.upstreamAddr, "upstream-addr", "", "address of the upstream socks5 proxy or ssh server")
+	flag.StringVar(&c.upstreamUser, "upstream-user", "", "username for the upstream socks5 proxy or ssh server")
+	flag.StringVar(&c.upstreamPass, "upstream-password", "", "password for the upstream socks5 proxy or ssh server")
+	flag.StringVar(&c.sshKeyFile, "ssh-key", "", "private key file for the ssh upstream")
+	flag.StringVar(&c.sshKnownHosts, "ssh-known-hosts", "", "known_hosts file to verify the ssh upstream")
+	flag.StringVar(&c.authFile, "auth-file", "", "file with username:password lines, enables authentication")
+	flag.StringVar(&c.aclFile, "acl-file", "", "file with destination acl rules")
+	flag.StringVar(&c.tlsCert, "tls-cert", "", "tls certificate, enables tls on the listener")
+	flag.StringVar(&c.tlsKey, "tls-key", "", "tls private key")
+	flag.DurationVar(&c.timeout, "timeout", 10*time.Second, "timeout for the handshake and connecting to destinations")
+	flag.IntVar(&c.maxConnections, "max-connections", 0, "maximum number of concurrent connections, 0 means no limit")
+	flag.BoolVar(&c.daemonize, "daemonize", false, "run in the background")
+	flag.StringVar(&c.pidFile, "pidfile", "", "write the pid of the daemon to this file")
+	flag.BoolVar(&c.debug, "debug", false, "enable debug logging")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(buildVersion())
+		return
+	}
+
+	if c.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if c.daemonize && !isDaemon() {
+		pid, err := daemonize()
+		if err != nil {
+			log.Fatalf("could not daemonize: %v", err)
+		}
+		if c.pidFile != "" {
+			if err := os.WriteFile(c.pidFile, []byte(fmt.Sprintf("%d\n", pid)), 0o644); err != nil {
+				log.Fatalf("could not write pidfile: %v", err)
+			}
+		}
+		fmt.Printf("started daemon with pid %d\n", pid)
+		return
+	}
+
+	if err := run(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(c config) error {
+	handler, err := newHandler(c)
+	if err != nil {
+		return err
+	}
+
+	p := &socks.Proxy{
+		ServerAddr:     c.listenAddr,
+		Proxyhandler:   handler,
+		Timeout:        c.timeout,
+		MaxConnections: c.maxConnections,
+		Done:           make(chan struct{}),
+	}
+
+	if c.authFile != "" {
+		creds, err := socks.LoadCredentialsFile(c.authFile)
+		if err != nil {
+			return fmt.Errorf("could not load auth file: %w", err)
+		}
+		p.Credentials = creds
+	}
+
+	if c.aclFile != "" {
+		acl, err := socks.LoadACLFile(c.aclFile)
+		if err != nil {
+			return fmt.Errorf("could not load acl file: %w", err)
+		}
+		p.ACL = acl
+	}
+
+	var listener net.Listener
+	if c.tlsCert != "" || c.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return fmt.Errorf("could not load tls certificate: %w", err)
+		}
+		listener, err = tls.Listen("tcp", c.listenAddr, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		listener, err = net.Listen("tcp", c.listenAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	printConfig(c)
+	go p.Serve(listener)
+	return p.HandleSignals(30 * time.Second)
+}
+
+func printConfig(c config) {
+	log.Infof("gosocks-server %s", buildVersion())
+	log.Infof("listen address: %s (tls: %t)", c.listenAddr, c.tlsCert != "")
+	if c.upstream == "direct" {
+		log.Infof("upstream: direct")
+	} else {
+		log.Infof("upstream: %s %s", c.upstream, c.upstreamAddr)
+	}
+	log.Infof("authentication: %t", c.authFile != "")
+	log.Infof("acl file: %s", c.aclFile)
+	log.Infof("timeout: %s", c.timeout)
+	log.Infof("max connections: %d", c.maxConnections)
+}
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return info.Main.Version
+}
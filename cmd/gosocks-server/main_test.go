@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+)
+
+// binary is the gosocks-server built for the integration tests
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gosocks-server")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "gosocks-server")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not build gosocks-server: %v\n%s", err, out)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startServer runs the binary with the flags and waits until it accepts
+// connections. It returns the listen address
+func startServer(t *testing.T, args ...string) string {
+	t.Helper()
+	addr := freeAddr(t)
+	cmd := exec.Command(binary, append([]string{"-listen", addr}, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	waitListening(t, addr)
+	return addr
+}
+
+// waitListening waits until the server accepts connections on addr
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gosocks-server did not start listening on %s: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// echoServer answers every line with the same line
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte(line)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// checkEcho connects to target through the proxy and sends a line
+func checkEcho(t *testing.T, client *socks.Client, target string) {
+	t.Helper()
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("got %q, want %q", line, "hello\n")
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVersion(t *testing.T) {
+	out, err := exec.Command(binary, "-version").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		t.Fatal("no version printed")
+	}
+}
+
+func TestDirect(t *testing.T) {
+	target := echoServer(t)
+	addr := startServer(t)
+	checkEcho(t, &socks.Client{ProxyAddr: addr, Timeout: 5 * time.Second}, target)
+}
+
+func TestAuthentication(t *testing.T) {
+	target := echoServer(t)
+	addr := startServer(t, "-auth-file", writeFile(t, "users", "alice:secret\n"))
+	checkEcho(t, &socks.Client{ProxyAddr: addr, Username: "alice", Password: "secret", Timeout: 5 * time.Second}, target)
+
+	client := &socks.Client{ProxyAddr: addr, Username: "alice", Password: "wrong", Timeout: 5 * time.Second}
+	if conn, err := client.Dial("tcp", target); err == nil {
+		conn.Close()
+		t.Fatal("connected with a wrong password")
+	}
+}
+
+func TestACL(t *testing.T) {
+	target := echoServer(t)
+	addr := startServer(t, "-acl-file", writeFile(t, "acl", "default allow\ndeny 127.0.0.0/8\n"))
+	client := &socks.Client{ProxyAddr: addr, Timeout: 5 * time.Second}
+	if conn, err := client.Dial("tcp", target); err == nil {
+		conn.Close()
+		t.Fatal("connected to a denied destination")
+	}
+}
+
+func TestSocks5Upstream(t *testing.T) {
+	target := echoServer(t)
+	upstream := startServer(t, "-auth-file", writeFile(t, "users", "bob:hunter2\n"))
+	addr := startServer(t, "-upstream", "socks5", "-upstream-addr", upstream, "-upstream-user", "bob", "-upstream-password", "hunter2")
+	checkEcho(t, &socks.Client{ProxyAddr: addr, Timeout: 5 * time.Second}, target)
+}
@@ -0,0 +1,82 @@
+package socks_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+// recordingDialer wraps the connections to the proxy in a RecordingConn
+type recordingDialer struct {
+	mu    sync.Mutex
+	conns []*sockstest.RecordingConn
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	rc := sockstest.NewRecordingConn(conn)
+	d.mu.Lock()
+	d.conns = append(d.conns, rc)
+	d.mu.Unlock()
+	return rc, nil
+}
+
+// TestCompliantV5Handshake checks the handshakes of a live proxy with
+// AssertCompliantV5Handshake. The error reply case is the regression test
+// for the BND.PORT of error replies
+func TestCompliantV5Handshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  *sockstest.MockHandler
+		creds    socks.CredentialStore
+		username string
+		wantErr  bool
+	}{
+		{"no authentication", sockstest.NewMockHandler(), nil, "", false},
+		{"username/password", sockstest.NewMockHandler(), socks.StaticCredentials{"user": "pass"}, "user", false},
+		{"error reply", sockstest.NewMockHandler(sockstest.WithPreHandlerError(&socks.Error{Reason: socks.RequestReplyHostUnreachable, Err: errors.New("unreachable")})), nil, "", true},
+		{"no acceptable method", sockstest.NewMockHandler(), socks.StaticCredentials{"user": "pass"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &socks.Proxy{
+				Proxyhandler: tt.handler,
+				Timeout:      time.Second,
+				Credentials:  tt.creds,
+			}
+			dialer := &recordingDialer{}
+			client := &socks.Client{
+				ProxyAddr: serve(t, p),
+				Username:  tt.username,
+				Password:  "pass",
+				Timeout:   5 * time.Second,
+				Dialer:    dialer,
+			}
+			conn, err := client.Dial("tcp", "192.0.2.1:80")
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			}
+			if len(dialer.conns) != 1 {
+				t.Fatalf("got %d connections, want 1", len(dialer.conns))
+			}
+			sockstest.AssertCompliantV5Handshake(t, dialer.conns[0].Transcript())
+		})
+	}
+}
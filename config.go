@@ -0,0 +1,359 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration that can be read from strings like "10s" in
+// config files
+type Duration time.Duration
+
+// UnmarshalText parses the duration
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalText formats the duration
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// ACLConfig holds the access list configuration
+type ACLConfig struct {
+	// DefaultAllow is used for destinations not matching any range
+	DefaultAllow bool `yaml:"default_allow" toml:"default_allow"`
+	// Allow holds the allowed CIDR ranges
+	Allow []string `yaml:"allow" toml:"allow"`
+	// Deny holds the denied CIDR ranges
+	Deny []string `yaml:"deny" toml:"deny"`
+}
+
+// Config holds the proxy configuration that can be read from a file
+type Config struct {
+	// ListenAddr is the address the proxy listens on
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// Timeout is used for reads and writes during the socks handshake
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+	// DialTimeout is the connect timeout to the destination
+	DialTimeout Duration `yaml:"dial_timeout" toml:"dial_timeout"`
+	// MaxConnections limits the number of concurrent client connections
+	MaxConnections int `yaml:"max_connections" toml:"max_connections"`
+	// AuthFile points to a file with username:password lines. Enables
+	// username/password authentication if set
+	AuthFile string `yaml:"auth_file" toml:"auth_file"`
+	// ACL holds the destination access list. No access list is used if
+	// nil
+	ACL *ACLConfig `yaml:"acl" toml:"acl"`
+	// BlockPrivateDestinations denies requests to private addresses
+	BlockPrivateDestinations bool `yaml:"block_private_destinations" toml:"block_private_destinations"`
+	// AllowedPorts restricts the destination ports
+	AllowedPorts []int `yaml:"allowed_ports" toml:"allowed_ports"`
+	// AllowedPortRanges restricts the destination ports to the inclusive ranges
+	AllowedPortRanges [][2]int `yaml:"allowed_port_ranges" toml:"allowed_port_ranges"`
+	// Rewrites holds the destination rewrite rules
+	Rewrites map[string]string `yaml:"rewrites" toml:"rewrites"`
+	// EnableSessionResume enables the experimental session resume extension
+	EnableSessionResume bool `yaml:"enable_session_resume" toml:"enable_session_resume"`
+	// SessionResumeTimeout is the time a broken session waits to be resumed
+	SessionResumeTimeout Duration `yaml:"session_resume_timeout" toml:"session_resume_timeout"`
+	// EgressFamily restricts destinations to "ipv4" or "ipv6". Defaults to
+	// "any"
+	EgressFamily EgressFamily `yaml:"egress_family" toml:"egress_family"`
+	// MaxSessionDuration closes sessions open longer than the duration
+	MaxSessionDuration Duration `yaml:"max_session_duration" toml:"max_session_duration"`
+	// HandshakeDeadline limits the time for the whole handshake
+	HandshakeDeadline Duration `yaml:"handshake_deadline" toml:"handshake_deadline"`
+	// LogSampleLimit is the number of identical failure messages logged per
+	// minute. 0 logs every message
+	LogSampleLimit int `yaml:"log_sample_limit" toml:"log_sample_limit"`
+	// MaxConcurrentHandshakes limits the number of connections in the
+	// handshake
+	MaxConcurrentHandshakes int `yaml:"max_concurrent_handshakes" toml:"max_concurrent_handshakes"`
+	// WriteStallTimeout closes sessions with a write blocked for longer
+	WriteStallTimeout Duration `yaml:"write_stall_timeout" toml:"write_stall_timeout"`
+	// ReusePort is the number of listeners opened with SO_REUSEPORT
+	ReusePort int `yaml:"reuse_port" toml:"reuse_port"`
+
+	path   string
+	useEnv bool
+	proxy  *Proxy
+}
+
+// LoadConfig reads the config file. The format is determined by the file
+// extension (.yaml, .yml or .toml)
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(content, c); err != nil {
+			return nil, fmt.Errorf("could not parse config %s: %w", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(content, c); err != nil {
+			return nil, fmt.Errorf("could not parse config %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", filepath.Ext(path))
+	}
+	c.path = path
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the config for errors
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen_addr is required")
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen_addr %q: %w", c.ListenAddr, err)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial_timeout must not be negative")
+	}
+	if c.SessionResumeTimeout < 0 {
+		return fmt.Errorf("session_resume_timeout must not be negative")
+	}
+	if c.MaxSessionDuration < 0 {
+		return fmt.Errorf("max_session_duration must not be negative")
+	}
+	if c.HandshakeDeadline < 0 {
+		return fmt.Errorf("handshake_deadline must not be negative")
+	}
+	if c.LogSampleLimit < 0 {
+		return fmt.Errorf("log_sample_limit must not be negative")
+	}
+	if c.MaxConcurrentHandshakes < 0 {
+		return fmt.Errorf("max_concurrent_handshakes must not be negative")
+	}
+	if c.WriteStallTimeout < 0 {
+		return fmt.Errorf("write_stall_timeout must not be negative")
+	}
+	if c.ReusePort < 0 {
+		return fmt.Errorf("reuse_port must not be negative")
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative")
+	}
+	for _, port := range c.AllowedPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d in allowed_ports", port)
+		}
+	}
+	for _, r := range c.AllowedPortRanges {
+		if r[0] < 1 || r[1] > 65535 || r[0] > r[1] {
+			return fmt.Errorf("invalid port range %d-%d in allowed_port_ranges", r[0], r[1])
+		}
+	}
+	if c.ACL != nil {
+		if _, err := c.ACL.build(); err != nil {
+			return err
+		}
+	}
+	if err := (&Proxy{}).SetRewriteRules(c.Rewrites); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *ACLConfig) build() (*IPListACL, error) {
+	acl := &IPListACL{DefaultAllow: a.DefaultAllow}
+	for _, cidr := range a.Allow {
+		if err := acl.Allow(cidr); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range a.Deny {
+		if err := acl.Deny(cidr); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+// Build creates a proxy using the DefaultHandler from the config
+func (c *Config) Build() (*Proxy, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		ServerAddr: c.ListenAddr,
+		Done:       make(chan struct{}),
+		Proxyhandler: DefaultHandler{
+			Timeout: time.Duration(c.DialTimeout),
+		},
+		Timeout:                  time.Duration(c.Timeout),
+		MaxConnections:           c.MaxConnections,
+		BlockPrivateDestinations: c.BlockPrivateDestinations,
+		AllowedPorts:             c.AllowedPorts,
+		AllowedPortRanges:        c.AllowedPortRanges,
+		EnableSessionResume:      c.EnableSessionResume,
+		SessionResumeTimeout:     time.Duration(c.SessionResumeTimeout),
+		EgressFamily:             c.EgressFamily,
+		MaxSessionDuration:       time.Duration(c.MaxSessionDuration),
+		LogSampleLimit:           c.LogSampleLimit,
+		HandshakeDeadline:        time.Duration(c.HandshakeDeadline),
+		ReusePort:                c.ReusePort,
+		MaxConcurrentHandshakes:  c.MaxConcurrentHandshakes,
+		WriteStallTimeout:        time.Duration(c.WriteStallTimeout),
+	}
+
+	if c.ACL != nil {
+		acl, err := c.ACL.build()
+		if err != nil {
+			return nil, err
+		}
+		p.ACL = acl
+	}
+
+	if err := p.SetRewriteRules(c.Rewrites); err != nil {
+		return nil, err
+	}
+
+	if c.AuthFile != "" {
+		creds, err := LoadCredentialsFile(c.AuthFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load auth_file: %w", err)
+		}
+		p.Credentials = creds
+	}
+
+	p.config = c
+	c.proxy = p
+	return p, nil
+}
+
+// Reload reads the config file again and replaces the ACL, credentials and
+// rewrite rules of the proxy created by Build. Established connections are
+// not affected. Other settings require a restart.
+func (c *Config) Reload() error {
+	if c.path == "" {
+		return fmt.Errorf("config was not loaded from a file")
+	}
+	if c.proxy == nil {
+		return fmt.Errorf("no proxy was built from this config")
+	}
+
+	n, err := LoadConfig(c.path)
+	if err != nil {
+		return err
+	}
+	if c.useEnv {
+		if err := n.ApplyEnv(); err != nil {
+			return err
+		}
+	}
+
+	var acl *IPListACL
+	if n.ACL != nil {
+		acl, err = n.ACL.build()
+		if err != nil {
+			return err
+		}
+	}
+	var creds CredentialStore
+	if n.AuthFile != "" {
+		creds, err = LoadCredentialsFile(n.AuthFile)
+		if err != nil {
+			return fmt.Errorf("could not load auth_file: %w", err)
+		}
+	}
+	if err := c.proxy.SetRewriteRules(n.Rewrites); err != nil {
+		return err
+	}
+	c.proxy.SetACL(acl)
+	c.proxy.SetCredentials(creds)
+
+	c.ACL = n.ACL
+	c.AuthFile = n.AuthFile
+	c.Rewrites = n.Rewrites
+	return nil
+}
+
+// ApplyEnv overrides config values with the corresponding GOSOCKS_*
+// environment variables if they are set. Unknown variables are ignored
+func (c *Config) ApplyEnv() error {
+	c.useEnv = true
+	if v, ok := os.LookupEnv("GOSOCKS_LISTEN_ADDR"); ok {
+		c.ListenAddr = v
+	}
+	if err := envDuration("GOSOCKS_TIMEOUT", &c.Timeout); err != nil {
+		return err
+	}
+	if err := envDuration("GOSOCKS_DIAL_TIMEOUT", &c.DialTimeout); err != nil {
+		return err
+	}
+	if v, ok := os.LookupEnv("GOSOCKS_MAX_CONNECTIONS"); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for GOSOCKS_MAX_CONNECTIONS: %w", err)
+		}
+		c.MaxConnections = i
+	}
+	if v, ok := os.LookupEnv("GOSOCKS_AUTH_FILE"); ok {
+		c.AuthFile = v
+	}
+	if err := envBool("GOSOCKS_BLOCK_PRIVATE_DESTINATIONS", &c.BlockPrivateDestinations); err != nil {
+		return err
+	}
+	if err := envBool("GOSOCKS_ENABLE_SESSION_RESUME", &c.EnableSessionResume); err != nil {
+		return err
+	}
+	if err := envDuration("GOSOCKS_SESSION_RESUME_TIMEOUT", &c.SessionResumeTimeout); err != nil {
+		return err
+	}
+	if err := envDuration("GOSOCKS_MAX_SESSION_DURATION", &c.MaxSessionDuration); err != nil {
+		return err
+	}
+	return nil
+}
+
+func envDuration(name string, d *Duration) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	if err := d.UnmarshalText([]byte(v)); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return nil
+}
+
+func envBool(name string, b *bool) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	*b = parsed
+	return nil
+}
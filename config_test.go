@@ -0,0 +1,148 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+func testConfig() Config {
+	return Config{
+		ListenAddr:     "127.0.0.1:1080",
+		Timeout:        Duration(5 * time.Second),
+		DialTimeout:    Duration(10 * time.Second),
+		MaxConnections: 100,
+		ACL: &ACLConfig{
+			DefaultAllow: true,
+			Allow:        []string{"10.1.0.0/16"},
+			Deny:         []string{"10.0.0.0/8", "fd00::/8"},
+		},
+		BlockPrivateDestinations: true,
+		AllowedPorts:             []int{80, 443},
+		AllowedPortRanges:        [][2]int{{8000, 8100}},
+		Rewrites:                 map[string]string{"old.example.com:80": "new.example.com:8080"},
+		EnableSessionResume:      true,
+		SessionResumeTimeout:     Duration(30 * time.Second),
+		EgressFamily:             FamilyIPv4,
+		MaxSessionDuration:       Duration(time.Hour),
+		HandshakeDeadline:        Duration(3 * time.Second),
+		LogSampleLimit:           10,
+		MaxConcurrentHandshakes:  50,
+		WriteStallTimeout:        Duration(time.Minute),
+		ReusePort:                2,
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	tests := []struct {
+		ext     string
+		marshal func(v interface{}) ([]byte, error)
+	}{
+		{".yaml", yaml.Marshal},
+		{".toml", func(v interface{}) ([]byte, error) {
+			var buf bytes.Buffer
+			err := toml.NewEncoder(&buf).Encode(v)
+			return buf.Bytes(), err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			want := testConfig()
+			content, err := tt.marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "config"+tt.ext)
+			if err := os.WriteFile(path, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want.path = path
+			if !reflect.DeepEqual(*got, want) {
+				t.Fatalf("got %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"missing listen addr", func(c *Config) { c.ListenAddr = "" }},
+		{"invalid listen addr", func(c *Config) { c.ListenAddr = "localhost" }},
+		{"negative timeout", func(c *Config) { c.Timeout = -1 }},
+		{"negative max connections", func(c *Config) { c.MaxConnections = -1 }},
+		{"invalid port", func(c *Config) { c.AllowedPorts = []int{0} }},
+		{"invalid port range", func(c *Config) { c.AllowedPortRanges = [][2]int{{90, 80}} }},
+		{"invalid acl", func(c *Config) { c.ACL.Deny = []string{"10.0.0.0/33"} }},
+	}
+	c := testConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			tt.modify(&c)
+			if err := c.Validate(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestConfigBuild(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(authFile, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.AuthFile = authFile
+	p, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxConnections != 100 || p.Timeout != 5*time.Second || p.EgressFamily != FamilyIPv4 {
+		t.Fatalf("settings not applied: %+v", p)
+	}
+	if h, ok := p.Proxyhandler.(DefaultHandler); !ok || h.Timeout != 10*time.Second {
+		t.Fatalf("dial timeout not applied: %+v", p.Proxyhandler)
+	}
+	if p.ACL == nil || p.ACL.Allowed(net.ParseIP("10.2.0.1")) || !p.ACL.Allowed(net.ParseIP("10.1.0.1")) {
+		t.Fatal("acl not applied")
+	}
+	if p.Credentials == nil || !p.Credentials.Valid("alice", "secret") {
+		t.Fatal("credentials not loaded")
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	t.Setenv("GOSOCKS_LISTEN_ADDR", "0.0.0.0:1081")
+	t.Setenv("GOSOCKS_MAX_CONNECTIONS", "7")
+	t.Setenv("GOSOCKS_DIAL_TIMEOUT", "2s")
+	t.Setenv("GOSOCKS_BLOCK_PRIVATE_DESTINATIONS", "false")
+	c := testConfig()
+	if err := c.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != "0.0.0.0:1081" || c.MaxConnections != 7 || c.DialTimeout != Duration(2*time.Second) || c.BlockPrivateDestinations {
+		t.Fatalf("environment not applied: %+v", c)
+	}
+
+	t.Setenv("GOSOCKS_TIMEOUT", "soon")
+	if err := c.ApplyEnv(); err == nil {
+		t.Fatal("invalid duration accepted")
+	}
+}
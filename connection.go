@@ -7,17 +7,24 @@ import (
 	"time"
 )
 
+// readDeadliner is implemented by connections supporting read deadlines
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
 // connectionRead reads all data from a connection
-func connectionRead(ctx context.Context, conn io.ReadCloser, timeout time.Duration) ([]byte, error) {
+func connectionRead(ctx context.Context, conn io.ReadCloser, timeout time.Duration, clock Clock) ([]byte, error) {
 	var ret []byte
 
-	ctx2, done := context.WithTimeout(ctx, timeout)
+	ctx2, done := withTimeout(ctx, clock, timeout)
 	defer done()
 
 	readDone := make(chan bool, 1)
 	errChannel := make(chan error, 1)
+	finished := make(chan struct{})
 
 	go func() {
+		defer close(finished)
 		bufLen := 1024
 		for {
 			buf := make([]byte, bufLen)
@@ -36,6 +43,11 @@ func connectionRead(ctx context.Context, conn io.ReadCloser, timeout time.Durati
 
 	select {
 	case <-ctx2.Done():
+		// unblock the read so the goroutine does not outlive the timeout.
+		// Other connections are unblocked when they are closed
+		if d, ok := conn.(readDeadliner); ok && d.SetReadDeadline(time.Now()) == nil {
+			<-finished
+		}
 		return nil, fmt.Errorf("timeout when reading on connection")
 	case err := <-errChannel:
 		return nil, err
@@ -45,14 +57,16 @@ func connectionRead(ctx context.Context, conn io.ReadCloser, timeout time.Durati
 }
 
 // connectionWrite makes sure to write all data to a connection
-func connectionWrite(ctx context.Context, conn io.WriteCloser, data []byte, timeout time.Duration) error {
-	ctx2, done := context.WithTimeout(ctx, timeout)
+func connectionWrite(ctx context.Context, conn io.WriteCloser, data []byte, timeout time.Duration, clock Clock) error {
+	ctx2, done := withTimeout(ctx, clock, timeout)
 	defer done()
 
 	writeDone := make(chan bool, 1)
 	errChannel := make(chan error, 1)
+	finished := make(chan struct{})
 
 	go func() {
+		defer close(finished)
 		toWriteLeft := len(data)
 		for {
 			written, err := conn.Write(data)
@@ -70,6 +84,9 @@ func connectionWrite(ctx context.Context, conn io.WriteCloser, data []byte, time
 
 	select {
 	case <-ctx2.Done():
+		if d, ok := conn.(writeDeadliner); ok && d.SetWriteDeadline(time.Now()) == nil {
+			<-finished
+		}
 		return fmt.Errorf("timeout when writing to connection")
 	case err := <-errChannel:
 		return err
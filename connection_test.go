@@ -0,0 +1,68 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// payload sizes of handshake packets. connectionRead waits for more data
+// after a full 1024 byte buffer, so the large payload stays below that
+const (
+	benchSmall  = 8
+	benchMedium = 64
+	benchLarge  = 1000
+)
+
+func benchmarkConnectionRead(b *testing.B, size int) {
+	r, w := io.Pipe()
+	defer r.Close()
+	payload := make([]byte, size)
+	go func() {
+		for {
+			if _, err := w.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+	clock := realClock{}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := connectionRead(context.Background(), r, time.Second, clock)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(buf) != size {
+			b.Fatalf("read %d bytes, want %d", len(buf), size)
+		}
+	}
+}
+
+func BenchmarkConnectionReadSmall(b *testing.B)  { benchmarkConnectionRead(b, benchSmall) }
+func BenchmarkConnectionReadMedium(b *testing.B) { benchmarkConnectionRead(b, benchMedium) }
+func BenchmarkConnectionReadLarge(b *testing.B)  { benchmarkConnectionRead(b, benchLarge) }
+
+func benchmarkConnectionWrite(b *testing.B, size int) {
+	r, w := io.Pipe()
+	defer w.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, r)
+	}()
+	payload := make([]byte, size)
+	clock := realClock{}
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := connectionWrite(context.Background(), w, payload, time.Second, clock); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnectionWriteSmall(b *testing.B)  { benchmarkConnectionWrite(b, benchSmall) }
+func BenchmarkConnectionWriteMedium(b *testing.B) { benchmarkConnectionWrite(b, benchMedium) }
+func BenchmarkConnectionWriteLarge(b *testing.B)  { benchmarkConnectionWrite(b, benchLarge) }
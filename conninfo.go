@@ -0,0 +1,75 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// ConnInfo describes a client connection that is not a net.Conn, like an ssh
+// channel or a websocket stream
+type ConnInfo struct {
+	// RemoteAddr is used as the address of the client for logging, filters
+	// and the session list
+	RemoteAddr net.Addr
+	// Username is used for sessions without username/password
+	// authentication, for example the user of the ssh connection
+	Username string
+	// Labels are added to the session list
+	Labels map[string]string
+}
+
+type connInfoKey struct{}
+
+type clientAddrKey struct{}
+
+// HandleConnWithInfo works like HandleConn and uses info instead of the
+// metadata of the connection
+func (p *Proxy) HandleConnWithInfo(ctx context.Context, conn io.ReadWriteCloser, info ConnInfo) {
+	atomic.AddInt64(&p.activeConnections, 1)
+	defer p.connectionDone()
+	p.handle(WithConnInfo(ctx, info), conn)
+}
+
+// WithConnInfo stores info in the context, for example for Relay
+func WithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ConnInfoFromContext returns the info passed to HandleConnWithInfo
+func ConnInfoFromContext(ctx context.Context) (ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(ConnInfo)
+	return info, ok
+}
+
+// WithClientAddr sets the address of the client, front-ends can use it for
+// connections without an address instead of a ConnInfo
+func WithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// withClientAddr stores the address of the client. The address from the
+// ConnInfo takes precedence over an address already set with WithClientAddr
+// and the address of the connection
+func withClientAddr(ctx context.Context, conn io.ReadWriteCloser) context.Context {
+	if info, ok := ConnInfoFromContext(ctx); ok && info.RemoteAddr != nil {
+		return WithClientAddr(ctx, info.RemoteAddr)
+	}
+	if _, ok := ClientAddrFromContext(ctx); ok {
+		return ctx
+	}
+	c, ok := extractNetConn(conn)
+	if !ok || c.RemoteAddr() == nil {
+		return ctx
+	}
+	return WithClientAddr(ctx, c.RemoteAddr())
+}
+
+// ClientAddrFromContext returns the address of the socks client. It is
+// available in policies and handlers if the client connection has an address
+// or one was passed to HandleConnWithInfo or WithClientAddr
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr, ok
+}
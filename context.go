@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type connIDKey struct{}
+
+type userKey struct{}
+
+type statsKey struct{}
+
+// WithConnID sets the ID of the client connection. The proxy numbers the
+// connections it serves itself, front-ends can set their own ID before
+// calling HandleConnWithInfo or Relay to correlate the logs
+func WithConnID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// ConnIDFromContext returns the ID of the client connection. It returns
+// false outside of a connection served by the proxy
+func ConnIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+// withConnID numbers the connection unless the front-end set an ID
+func (p *Proxy) withConnID(ctx context.Context) context.Context {
+	if _, ok := ConnIDFromContext(ctx); ok {
+		return ctx
+	}
+	return WithConnID(ctx, atomic.AddUint64(&p.connID, 1))
+}
+
+// WithUser sets the username of the client
+func WithUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, userKey{}, username)
+}
+
+// UserFromContext returns the username the client authenticated with or the
+// username of its ConnInfo. It is available in policies and handlers and
+// returns false for anonymous clients
+func UserFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(userKey{}).(string)
+	return username, ok
+}
+
+// WithStats sets the stats of the session
+func WithStats(ctx context.Context, stats *SessionStats) context.Context {
+	return context.WithValue(ctx, statsKey{}, stats)
+}
+
+// StatsFromContext returns the stats of the running session. The counters
+// are updated while the data is relayed and must be read atomically. It
+// returns false outside of a session
+func StatsFromContext(ctx context.Context) (*SessionStats, bool) {
+	stats, ok := ctx.Value(statsKey{}).(*SessionStats)
+	return stats, ok
+}
@@ -0,0 +1,51 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestContextAccessorsBareContext(t *testing.T) {
+	tests := []struct {
+		name string
+		get  func(context.Context) bool
+	}{
+		{"ConnIDFromContext", func(ctx context.Context) bool { _, ok := ConnIDFromContext(ctx); return ok }},
+		{"UserFromContext", func(ctx context.Context) bool { _, ok := UserFromContext(ctx); return ok }},
+		{"StatsFromContext", func(ctx context.Context) bool { _, ok := StatsFromContext(ctx); return ok }},
+		{"ClientAddrFromContext", func(ctx context.Context) bool { _, ok := ClientAddrFromContext(ctx); return ok }},
+		{"ConnInfoFromContext", func(ctx context.Context) bool { _, ok := ConnInfoFromContext(ctx); return ok }},
+		{"TenantFromContext", func(ctx context.Context) bool { _, ok := TenantFromContext(ctx); return ok }},
+		{"TLSStateFromContext", func(ctx context.Context) bool { _, ok := TLSStateFromContext(ctx); return ok }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.get(context.Background()) {
+				t.Fatal("got ok on a bare context")
+			}
+		})
+	}
+}
+
+func TestContextAccessors(t *testing.T) {
+	stats := &SessionStats{}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	ctx := WithConnID(context.Background(), 42)
+	ctx = WithUser(ctx, "alice")
+	ctx = WithStats(ctx, stats)
+	ctx = WithClientAddr(ctx, addr)
+
+	if id, ok := ConnIDFromContext(ctx); !ok || id != 42 {
+		t.Fatalf("got conn id %d, %t", id, ok)
+	}
+	if user, ok := UserFromContext(ctx); !ok || user != "alice" {
+		t.Fatalf("got user %q, %t", user, ok)
+	}
+	if got, ok := StatsFromContext(ctx); !ok || got != stats {
+		t.Fatalf("got stats %p, %t", got, ok)
+	}
+	if got, ok := ClientAddrFromContext(ctx); !ok || got != addr {
+		t.Fatalf("got client address %v, %t", got, ok)
+	}
+}
@@ -0,0 +1,186 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeduplicatingDialHandler wraps another handler and shares one remote
+// connection between identical requests of one client. Requests are
+// identical if they come from the same client ip, user and tenant and go to
+// the same destination. If such a request arrives while a connection is
+// being dialed or still used by the first session, the request waits for that
+// connection instead of dialing again. The entry is removed when the first session ends, later requests
+// dial a new connection.
+//
+// All sessions sharing a connection write to and read from the same remote
+// stream, so the data of the sessions is interleaved. Only use this for
+// clients with a retry bug that open several connections for the same
+// idempotent request, never for regular traffic.
+type DeduplicatingDialHandler struct {
+	ProxyHandler
+
+	// accessed atomically
+	shared int64
+
+	// pending maps the key of a request to the *pendingConn dialed for it
+	pending sync.Map
+}
+
+// pendingConn is a remote connection that is dialed or used by at least one
+// session
+type pendingConn struct {
+	key  string
+	done chan struct{}
+	conn io.ReadWriteCloser
+	err  *Error
+
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+// NewDeduplicatingDialHandler creates a DeduplicatingDialHandler dialing with
+// the inner handler
+func NewDeduplicatingDialHandler(inner ProxyHandler) *DeduplicatingDialHandler {
+	return &DeduplicatingDialHandler{ProxyHandler: inner}
+}
+
+// PreHandler returns the connection of an identical request in progress or
+// dials a new one using the inner handler
+func (h *DeduplicatingDialHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	key := dedupKey(ctx, request)
+	p := &pendingConn{key: key, done: make(chan struct{})}
+	actual, loaded := h.pending.LoadOrStore(key, p)
+	if loaded {
+		other := actual.(*pendingConn)
+		select {
+		case <-other.done:
+		case <-ctx.Done():
+			return nil, &Error{Reason: RequestReplyGeneralFailure, Err: ctx.Err()}
+		}
+		if other.err != nil {
+			return nil, other.err
+		}
+		if other.acquire() {
+			atomic.AddInt64(&h.shared, 1)
+			log.Debugf("sharing in-flight connection to %s", request.getDestinationString())
+			return &sharedConn{pending: other, handler: h}, nil
+		}
+		// the connection was closed in the meantime
+		return h.ProxyHandler.PreHandler(ctx, request)
+	}
+
+	p.conn, p.err = h.ProxyHandler.PreHandler(ctx, request)
+	if p.err != nil {
+		h.remove(p)
+		close(p.done)
+		return nil, p.err
+	}
+	p.refs = 1
+	close(p.done)
+	return &sharedConn{pending: p, handler: h}, nil
+}
+
+// dedupKey identifies identical requests. The port of the client address is
+// left out because the retries of a client use new connections
+func dedupKey(ctx context.Context, request Request) string {
+	var client string
+	if addr, ok := ClientAddrFromContext(ctx); ok && addr != nil {
+		client = addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	user, _ := UserFromContext(ctx)
+	tenant, _ := TenantFromContext(ctx)
+	return fmt.Sprintf("%s|%q|%q|%q", request.getDestinationString(), client, user, tenant)
+}
+
+// Shared returns the number of requests that were served with the
+// connection of another request
+func (h *DeduplicatingDialHandler) Shared() int64 {
+	return atomic.LoadInt64(&h.shared)
+}
+
+// remove deletes the entry of p so later requests dial a new connection
+func (h *DeduplicatingDialHandler) remove(p *pendingConn) {
+	if v, ok := h.pending.Load(p.key); ok && v == p {
+		h.pending.Delete(p.key)
+	}
+}
+
+// acquire adds a session to the connection. It returns false if the
+// connection was already closed
+func (p *pendingConn) acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.refs++
+	return true
+}
+
+// release removes a session and closes the connection after the last one
+func (p *pendingConn) release() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refs--
+	if p.refs > 0 {
+		return nil
+	}
+	p.closed = true
+	return p.conn.Close()
+}
+
+// sharedConn is the view of one session on a shared connection
+type sharedConn struct {
+	pending *pendingConn
+	handler *DeduplicatingDialHandler
+
+	once sync.Once
+}
+
+func (c *sharedConn) Read(b []byte) (int, error) {
+	return c.pending.conn.Read(b)
+}
+
+func (c *sharedConn) Write(b []byte) (int, error) {
+	return c.pending.conn.Write(b)
+}
+
+// BindAddr returns the address of the shared connection
+func (c *sharedConn) BindAddr() net.Addr {
+	return bindAddr(c.pending.conn)
+}
+
+// CloseWrite only half-closes the remote if no other session uses it
+func (c *sharedConn) CloseWrite() error {
+	c.pending.mu.Lock()
+	defer c.pending.mu.Unlock()
+	if c.pending.refs > 1 {
+		return nil
+	}
+	if cw, ok := c.pending.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close ends the session. The first session to end removes the entry, the
+// last one closes the remote connection
+func (c *sharedConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.handler.remove(c.pending)
+		err = c.pending.release()
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeduplicatingDialHandler(t *testing.T) {
+	addr := lineServer(t)
+	client := func(ip string, port int, user string) context.Context {
+		ctx := WithClientAddr(context.Background(), &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
+		if user != "" {
+			ctx = WithUser(ctx, user)
+		}
+		return ctx
+	}
+	tests := []struct {
+		name          string
+		first, second context.Context
+		shared        bool
+	}{
+		{"same client", client("127.0.0.1", 1000, ""), client("127.0.0.1", 1001, ""), true},
+		{"same user", client("127.0.0.1", 1000, "alice"), client("127.0.0.1", 1001, "alice"), true},
+		{"different clients", client("127.0.0.1", 1000, ""), client("127.0.0.2", 1000, ""), false},
+		{"different users", client("127.0.0.1", 1000, "alice"), client("127.0.0.1", 1001, "bob"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewDeduplicatingDialHandler(DefaultHandler{Timeout: time.Second})
+			first, err := h.PreHandler(tt.first, requestTo(t, addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			// the first session is still in progress
+			second, err := h.PreHandler(tt.second, requestTo(t, addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+
+			same := first.(*sharedConn).pending == second.(*sharedConn).pending
+			if same != tt.shared {
+				t.Fatalf("got shared connection %t, want %t", same, tt.shared)
+			}
+			want := int64(0)
+			if tt.shared {
+				want = 1
+			}
+			if shared := h.Shared(); shared != want {
+				t.Fatalf("got %d shared requests, want %d", shared, want)
+			}
+		})
+	}
+}
+
+func TestDeduplicatingDialHandlerAfterClose(t *testing.T) {
+	addr := lineServer(t)
+	h := NewDeduplicatingDialHandler(DefaultHandler{Timeout: time.Second})
+	ctx := WithClientAddr(context.Background(), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000})
+	first, err := h.PreHandler(ctx, requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the first session ended so the retry dials again
+	second, err := h.PreHandler(ctx, requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if shared := h.Shared(); shared != 0 {
+		t.Fatalf("got %d shared requests, want 0", shared)
+	}
+	roundTrip(t, second.(*sharedConn).pending.conn.(net.Conn))
+}
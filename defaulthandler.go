@@ -2,9 +2,13 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,30 +18,223 @@ import (
 type DefaultHandler struct {
 	// Timeout defines the connect timeout to the destination
 	Timeout time.Duration
+	// LocalAddr is used as the source address of outgoing connections
+	LocalAddr net.IP
+	// BindInterface binds outgoing connections to the network interface
+	// (SO_BINDTODEVICE). Only supported on linux
+	BindInterface string
+	// Fwmark sets SO_MARK on outgoing connections for policy routing. Only
+	// supported on linux and requires CAP_NET_ADMIN. 0 disables it
+	Fwmark uint32
+	// FastOpen enables TCP Fast Open on outgoing connections so the first
+	// data is sent with the SYN. Only supported on linux 4.11+, it is
+	// silently ignored if the kernel does not support it.
+	// The kernel defers the SYN until the first write, so connecting returns
+	// before the destination is reached: the client gets a success reply even
+	// for unreachable destinations, the error shows up on the first read or
+	// write instead, and DialRetries never fire
+	FastOpen bool
+	// DialRetries is the number of retries if connecting to the destination
+	// is refused or reset. 0 disables retries
+	DialRetries int
+	// DialRetryBackoff is the wait time before the first retry. It is
+	// doubled on every further retry
+	DialRetryBackoff time.Duration
+	// ProxyProtocol is the PROXY protocol header version sent to the
+	// destinations in ProxyProtocolDestinations
+	ProxyProtocol ProxyProtocolVersion
+	// ProxyProtocolDestinations are the destinations in host:port form that
+	// receive a PROXY protocol header with the client address. A policy can
+	// also request the header per session. PoolingHandler does not pool
+	// connections with a header
+	ProxyProtocolDestinations []string
 }
 
 // PreHandler is the default socks5 implementation
-func (s DefaultHandler) PreHandler(request Request) (io.ReadWriteCloser, error) {
-	target := fmt.Sprintf("%s:%d", request.DestinationAddress, request.DestinationPort)
-	log.Infof("Connecting to target %s", target)
-	remote, err := net.DialTimeout("tcp", target, s.Timeout)
-	if err != nil {
-		return nil, err
+func (s DefaultHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	target := request.getDestinationString()
+	attempt := 1
+	for {
+		remote, err := s.dial(ctx, request)
+		if err == nil {
+			if err := s.sendProxyProtocol(ctx, request, remote); err != nil {
+				remote.Close()
+				return nil, err
+			}
+			return remote, nil
+		}
+		if attempt > s.DialRetries || !retryableDialError(err) {
+			if attempt > 1 {
+				err = fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return nil, dialError(target, err)
+		}
+
+		backoff := s.DialRetryBackoff << (attempt - 1)
+		log.Debugf("connecting to %s failed (attempt %d), retrying in %s: %v", target, attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, dialError(target, fmt.Errorf("aborted after %d attempts: %w", attempt, err))
+		case <-timer.C:
+		}
+		attempt++
+	}
+}
+
+// dial connects to the destination of the request once
+func (s DefaultHandler) dial(ctx context.Context, request Request) (net.Conn, error) {
+	target := request.getDestinationString()
+	if request.AddressType == RequestAddressTypeUnixPath {
+		// the socket options only apply to ip sockets
+		d := &net.Dialer{Timeout: s.Timeout}
+		log.Infof("Connecting to unix socket %s", target)
+		return d.DialContext(ctx, "unix", target)
+	}
+	dialer := s.dialer()
+	if len(request.ResolvedAddresses) == 0 {
+		log.Infof("Connecting to target %s", target)
+		remote, err := dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("connected to %s from %s", target, remote.LocalAddr())
+		return remote, nil
+	}
+
+	// the proxy already resolved and vetted the addresses so we must not
+	// resolve the name again
+	var lastErr error
+	port := strconv.Itoa(int(request.DestinationPort))
+	for _, ip := range request.ResolvedAddresses {
+		addr := net.JoinHostPort(ip.String(), port)
+		log.Infof("Connecting to target %s (%s)", target, addr)
+		remote, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		log.Debugf("connected to %s from %s", addr, remote.LocalAddr())
+		return remote, nil
+	}
+	return nil, lastErr
+}
+
+// sendProxyProtocol writes the PROXY protocol header to the remote if the
+// policy requested it or the destination is configured. Nothing was relayed
+// yet so the header is always the first data the remote receives
+func (s DefaultHandler) sendProxyProtocol(ctx context.Context, request Request, remote net.Conn) *Error {
+	version := s.proxyProtocolVersion(ctx, request)
+	if version == ProxyProtocolNone {
+		return nil
+	}
+	src, _ := ClientAddrFromContext(ctx)
+	if err := writeProxyProtocolHeader(remote, version, src, remote.RemoteAddr()); err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send proxy protocol header to %s: %w", request.getDestinationString(), err)}
+	}
+	return nil
+}
+
+// proxyProtocolVersion returns the PROXY protocol version sent to the
+// destination of the request
+func (s DefaultHandler) proxyProtocolVersion(ctx context.Context, request Request) ProxyProtocolVersion {
+	if version := proxyProtocolFromContext(ctx); version != ProxyProtocolNone {
+		return version
+	}
+	target := request.getDestinationString()
+	for _, dest := range s.ProxyProtocolDestinations {
+		if dest == target {
+			return s.ProxyProtocol
+		}
+	}
+	return ProxyProtocolNone
+}
+
+// retryableDialError checks if the dial error is transient, like a refused
+// connection during a restart of the destination. DNS and permission errors
+// are never retried
+func retryableDialError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// dialError converts a dial error to an Error with a matching reply reason
+func dialError(target string, err error) *Error {
+	reason := RequestReplyHostUnreachable
+	if errors.Is(err, syscall.EPERM) {
+		// socket options like the fwmark need special permissions, this is
+		// a local problem and not related to the destination
+		reason = RequestReplyGeneralFailure
+	} else if ttlExpired(err) {
+		reason = RequestReplyTTLExpired
+	}
+	return &Error{Reason: reason, Err: fmt.Errorf("error on connecting to %s: %w", target, err)}
+}
+
+// ttlExpired checks if the dial failed because of an ICMP time exceeded
+// message, for example because of a routing loop. Linux reports these as
+// EHOSTUNREACH on tcp sockets, so only dial errors carrying the ICMP message
+// in their text are detected. EHOSTUNREACH stays host unreachable
+func ttlExpired(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err == nil {
+		return false
+	}
+	msg := strings.ToLower(opErr.Err.Error())
+	return strings.Contains(msg, "time exceeded") || strings.Contains(msg, "ttl expired") || strings.Contains(msg, "ttl exceeded")
+}
+
+// dialer returns the dialer used for outgoing connections
+func (s DefaultHandler) dialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout: s.Timeout,
+	}
+	if s.LocalAddr != nil {
+		d.LocalAddr = &net.TCPAddr{IP: s.LocalAddr}
+	}
+	controls := s.socketControls()
+	if s.FastOpen {
+		controls = append(controls, fastOpenConnect)
+	}
+	d.Control = chainControls(controls...)
+	return d
+}
+
+// socketControls returns the socket options for outgoing tcp and udp sockets
+func (s DefaultHandler) socketControls() []controlFunc {
+	var controls []controlFunc
+	if s.BindInterface != "" {
+		controls = append(controls, bindToDevice(s.BindInterface))
+	}
+	if s.Fwmark != 0 {
+		controls = append(controls, setMark(s.Fwmark))
+	}
+	return controls
+}
+
+// asDefaultHandler returns the DefaultHandler if h is one
+func asDefaultHandler(h ProxyHandler) (DefaultHandler, bool) {
+	switch d := h.(type) {
+	case DefaultHandler:
+		return d, true
+	case *DefaultHandler:
+		return *d, true
+	default:
+		return DefaultHandler{}, false
 	}
-	return remote, nil
 }
 
 // CopyFromClientToRemote is the default socks5 implementation
-func (s DefaultHandler) CopyFromClientToRemote(ctx context.Context, client, remote io.ReadWriteCloser) error {
-	if _, err := io.Copy(client, remote); err != nil {
+func (s DefaultHandler) CopyFromClientToRemote(ctx context.Context, client io.ReadCloser, remote io.WriteCloser) error {
+	if _, err := io.Copy(remote, client); err != nil {
 		return err
 	}
 	return nil
 }
 
 // CopyFromRemoteToClient is the default socks5 implementation
-func (s DefaultHandler) CopyFromRemoteToClient(ctx context.Context, remote, client io.ReadWriteCloser) error {
-	if _, err := io.Copy(remote, client); err != nil {
+func (s DefaultHandler) CopyFromRemoteToClient(ctx context.Context, remote io.ReadCloser, client io.WriteCloser) error {
+	if _, err := io.Copy(client, remote); err != nil {
 		return err
 	}
 	return nil
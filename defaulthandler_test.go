@@ -0,0 +1,132 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// closedAddr returns a local address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestDialRetry(t *testing.T) {
+	addr := closedAddr(t)
+	// attempts are made after 0, 200 and 600ms, the listener starts between
+	// the second and the third
+	h := DefaultHandler{Timeout: time.Second, DialRetries: 3, DialRetryBackoff: 200 * time.Millisecond}
+	listening := make(chan net.Listener, 1)
+	time.AfterFunc(400*time.Millisecond, func() {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			close(listening)
+			return
+		}
+		listening <- l
+	})
+	t.Cleanup(func() {
+		if l, ok := <-listening; ok {
+			l.Close()
+		}
+	})
+
+	start := time.Now()
+	remote, err := h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Fatalf("connected after %s, before the third attempt", elapsed)
+	}
+}
+
+func TestDialRetryGivesUp(t *testing.T) {
+	h := DefaultHandler{Timeout: time.Second, DialRetries: 2, DialRetryBackoff: 10 * time.Millisecond}
+	_, err := h.PreHandler(context.Background(), requestTo(t, closedAddr(t)))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if err.Reason != RequestReplyHostUnreachable {
+		t.Fatalf("got reason %s, want %s", err.Reason, RequestReplyHostUnreachable)
+	}
+	if !errors.Is(err.Err, syscall.ECONNREFUSED) {
+		t.Fatalf("error %v does not wrap the last attempt", err.Err)
+	}
+	if !strings.Contains(err.Err.Error(), "giving up after 3 attempts") {
+		t.Fatalf("error %v does not have the attempt count", err.Err)
+	}
+}
+
+func TestDialRetryAbortsOnCancel(t *testing.T) {
+	h := DefaultHandler{Timeout: time.Second, DialRetries: 5, DialRetryBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := h.PreHandler(ctx, requestTo(t, closedAddr(t)))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("retry was not aborted, returned after %s", elapsed)
+	}
+	if !strings.Contains(err.Err.Error(), "aborted after 1 attempts") {
+		t.Fatalf("got error %v", err.Err)
+	}
+}
+
+func TestRetryableDialError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"reset", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNRESET)}, true},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, false},
+		{"permission", &net.OpError{Op: "dial", Err: os.NewSyscallError("setsockopt", syscall.EPERM)}, false},
+		{"timeout", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableDialError(tt.err); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want RequestReplyReason
+	}{
+		{"time exceeded", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("ICMP time exceeded in transit")}, RequestReplyTTLExpired},
+		{"ttl expired", fmt.Errorf("giving up after 2 attempts: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("TTL expired in transit")}), RequestReplyTTLExpired},
+		{"unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, RequestReplyHostUnreachable},
+		{"permission", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("setsockopt", syscall.EPERM)}, RequestReplyGeneralFailure},
+		{"not an OpError", errors.New("time exceeded"), RequestReplyHostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dialError("example.com:443", tt.err).Reason; got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !js
+// +build !js
+
+package socks
+
+import "net"
+
+// defaultDialer returns the dialer used by Client if Dialer is not set
+func defaultDialer() ContextDialer {
+	return &net.Dialer{}
+}
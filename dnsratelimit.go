@@ -0,0 +1,57 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrDNSQueueFull is returned by DNSRateLimiter if too many lookups are
+// waiting
+var ErrDNSQueueFull = errors.New("too many pending dns lookups")
+
+// DNSRateLimiter is a Resolver limiting the number of lookups per second.
+// Lookups exceeding the rate wait in a queue, if the queue is full they fail
+// with ErrDNSQueueFull and the client gets a host unreachable reply
+type DNSRateLimiter struct {
+	// accessed atomically
+	waiting int64
+
+	resolver Resolver
+	limiter  *rate.Limiter
+	maxQueue int64
+}
+
+// NewDNSRateLimiter wraps resolver and allows perSecond lookups with bursts
+// of up to burst lookups. Up to maxQueue lookups wait for their turn.
+// net.DefaultResolver is used if resolver is nil
+func NewDNSRateLimiter(resolver Resolver, perSecond float64, burst, maxQueue int) *DNSRateLimiter {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNSRateLimiter{
+		resolver: resolver,
+		limiter:  rate.NewLimiter(rate.Limit(perSecond), burst),
+		maxQueue: int64(maxQueue),
+	}
+}
+
+// LookupIPAddr waits for the rate limit and resolves host
+func (d *DNSRateLimiter) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if !d.limiter.Allow() {
+		if atomic.AddInt64(&d.waiting, 1) > d.maxQueue {
+			atomic.AddInt64(&d.waiting, -1)
+			return nil, ErrDNSQueueFull
+		}
+		err := d.limiter.Wait(ctx)
+		atomic.AddInt64(&d.waiting, -1)
+		if err != nil {
+			return nil, fmt.Errorf("waiting for dns rate limit: %w", err)
+		}
+	}
+	return d.resolver.LookupIPAddr(ctx, host)
+}
@@ -0,0 +1,133 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingResolver resolves every name to 127.0.0.1 and records the time
+// of every lookup
+type countingResolver struct {
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (r *countingResolver) LookupIPAddr(_ context.Context, _ string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, time.Now())
+	r.mu.Unlock()
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+// lookupConcurrently starts n lookups at the same time and returns their
+// errors
+func lookupConcurrently(resolver Resolver, n int) []error {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = resolver.LookupIPAddr(context.Background(), "example.com")
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+func TestDNSRateLimiterThroughput(t *testing.T) {
+	const (
+		perSecond = 200
+		burst     = 10
+		lookups   = 100
+	)
+	upstream := &countingResolver{}
+	limiter := NewDNSRateLimiter(upstream, perSecond, burst, lookups)
+	for _, err := range lookupConcurrently(limiter, lookups) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	calls := upstream.calls
+	if len(calls) != lookups {
+		t.Fatalf("upstream got %d lookups, want %d", len(calls), lookups)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Before(calls[j]) })
+	// after the burst the lookups are spread at the configured rate. Allow
+	// one extra lookup for timer inaccuracy
+	for i := range calls {
+		for j := i + burst + 1; j < len(calls); j++ {
+			window := calls[j].Sub(calls[i])
+			allowed := burst + 1 + int(window.Seconds()*perSecond)
+			if j-i+1 > allowed {
+				t.Fatalf("%d lookups within %s, at most %d allowed", j-i+1, window, allowed)
+			}
+		}
+	}
+	want := time.Duration(lookups-burst) * time.Second / perSecond
+	if elapsed := calls[len(calls)-1].Sub(calls[0]); elapsed < want*9/10 {
+		t.Fatalf("%d lookups took %s, want at least %s", lookups, elapsed, want)
+	}
+}
+
+func TestDNSRateLimiterQueueFull(t *testing.T) {
+	const (
+		burst    = 10
+		maxQueue = 20
+		lookups  = 100
+	)
+	upstream := &countingResolver{}
+	limiter := NewDNSRateLimiter(upstream, 100, burst, maxQueue)
+	failed := 0
+	for _, err := range lookupConcurrently(limiter, lookups) {
+		switch {
+		case errors.Is(err, ErrDNSQueueFull):
+			failed++
+		case err != nil:
+			t.Fatal(err)
+		}
+	}
+	// the burst passes directly and maxQueue lookups wait, at most the
+	// tokens refilled while the lookups started pass in addition
+	if failed < lookups-burst-maxQueue-10 || failed > lookups-burst-maxQueue {
+		t.Fatalf("%d lookups failed, want about %d", failed, lookups-burst-maxQueue)
+	}
+	if len(upstream.calls) != lookups-failed {
+		t.Fatalf("upstream got %d lookups, want %d", len(upstream.calls), lookups-failed)
+	}
+}
+
+// TestDNSRateLimiterReply checks that a rejected lookup is answered with
+// host unreachable
+func TestDNSRateLimiterReply(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		// the first lookup uses the burst, nothing can wait
+		Resolver: NewDNSRateLimiter(&countingResolver{}, 0.001, 1, 0),
+	}
+	addr := serveProxy(t, p)
+	target := lineServer(t)
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialProxy(t, addr, "", "")
+	if reply := sendRequest(t, conn, net.JoinHostPort("localhost", port)); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	conn = dialProxy(t, addr, "", "")
+	if reply := sendRequest(t, conn, net.JoinHostPort("localhost", port)); reply != RequestReplyHostUnreachable {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplyHostUnreachable)
+	}
+}
@@ -0,0 +1,87 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+)
+
+// EgressFamily restricts the address family used for outgoing connections
+type EgressFamily int
+
+const (
+	// FamilyAny allows IPv4 and IPv6 destinations
+	FamilyAny EgressFamily = iota
+	// FamilyIPv4 only allows IPv4 destinations
+	FamilyIPv4
+	// FamilyIPv6 only allows IPv6 destinations
+	FamilyIPv6
+)
+
+// allows checks if the ip belongs to the allowed family
+func (f EgressFamily) allows(ip net.IP) bool {
+	switch f {
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// filter removes all addresses not belonging to the allowed family
+func (f EgressFamily) filter(ips []net.IP) []net.IP {
+	if f == FamilyAny {
+		return ips
+	}
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if f.allows(ip) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// checkEgressFamily rejects literal addresses of a forbidden family
+func (p *Proxy) checkEgressFamily(request *Request) *Error {
+	if p.EgressFamily == FamilyAny {
+		return nil
+	}
+	switch request.AddressType {
+	case RequestAddressTypeIPv4, RequestAddressTypeIPv6:
+		if !p.EgressFamily.allows(net.IP(request.DestinationAddress)) {
+			return &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("destination %s denied: address family is not allowed", request.getDestinationString())}
+		}
+	}
+	return nil
+}
+
+// UnmarshalText parses "any", "ipv4" or "ipv6"
+func (f *EgressFamily) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "any":
+		*f = FamilyAny
+	case "ipv4":
+		*f = FamilyIPv4
+	case "ipv6":
+		*f = FamilyIPv6
+	default:
+		return fmt.Errorf("invalid egress family %q", string(text))
+	}
+	return nil
+}
+
+// MarshalText formats the family like UnmarshalText expects it
+func (f EgressFamily) MarshalText() ([]byte, error) {
+	switch f {
+	case FamilyAny:
+		return []byte("any"), nil
+	case FamilyIPv4:
+		return []byte("ipv4"), nil
+	case FamilyIPv6:
+		return []byte("ipv6"), nil
+	default:
+		return nil, fmt.Errorf("invalid egress family %d", int(f))
+	}
+}
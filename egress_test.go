@@ -0,0 +1,83 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestEgressFamily(t *testing.T) {
+	v4 := net.ParseIP("93.184.216.34")
+	v6 := net.ParseIP("2606:2800:220:1::1")
+	resolver := staticResolver{
+		"dual.example": {v4, v6},
+		"v4.example":   {v4},
+		"v6.example":   {v6},
+	}
+	type result struct {
+		reason   RequestReplyReason
+		resolved []net.IP
+	}
+	allowed := func(ips ...net.IP) result { return result{RequestReplySucceeded, ips} }
+	denied := func(reason RequestReplyReason) result { return result{reason, nil} }
+	tests := []struct {
+		name    string
+		request Request
+		want    map[EgressFamily]result
+	}{
+		{"literal ipv4", ipRequest(v4.String()), map[EgressFamily]result{
+			FamilyAny:  allowed(v4),
+			FamilyIPv4: allowed(v4),
+			FamilyIPv6: denied(RequestReplyAddressTypeNotSupported),
+		}},
+		{"literal ipv6", ipRequest(v6.String()), map[EgressFamily]result{
+			FamilyAny:  allowed(v6),
+			FamilyIPv4: denied(RequestReplyAddressTypeNotSupported),
+			FamilyIPv6: allowed(v6),
+		}},
+		{"fqdn with both families", domainRequest("dual.example", 443), map[EgressFamily]result{
+			FamilyAny:  allowed(v4, v6),
+			FamilyIPv4: allowed(v4),
+			FamilyIPv6: allowed(v6),
+		}},
+		{"fqdn with ipv4 only", domainRequest("v4.example", 443), map[EgressFamily]result{
+			FamilyAny:  allowed(v4),
+			FamilyIPv4: allowed(v4),
+			FamilyIPv6: denied(RequestReplyHostUnreachable),
+		}},
+		{"fqdn with ipv6 only", domainRequest("v6.example", 443), map[EgressFamily]result{
+			FamilyAny:  allowed(v6),
+			FamilyIPv4: denied(RequestReplyHostUnreachable),
+			FamilyIPv6: allowed(v6),
+		}},
+	}
+	for _, tt := range tests {
+		for _, family := range []EgressFamily{FamilyAny, FamilyIPv4, FamilyIPv6} {
+			name, _ := family.MarshalText()
+			t.Run(tt.name+" "+string(name), func(t *testing.T) {
+				want := tt.want[family]
+				// the resolver makes the proxy resolve names in every mode
+				p := &Proxy{EgressFamily: family, Resolver: resolver}
+				request := tt.request
+				err := p.checkDestination(WithStats(context.Background(), &SessionStats{}), &request, nil)
+				if want.reason != RequestReplySucceeded {
+					if err == nil {
+						t.Fatal("destination was not denied")
+					}
+					if err.Reason != want.reason {
+						t.Fatalf("got reason %s, want %s", err.Reason, want.reason)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected denial: %v", err)
+				}
+				if request.AddressType == RequestAddressTypeDomainname && !reflect.DeepEqual(request.ResolvedAddresses, want.resolved) {
+					// the handler only dials these addresses
+					t.Fatalf("got resolved addresses %v, want %v", request.ResolvedAddresses, want.resolved)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// countryFilter is an example GeoIPFilter backed by a static CIDR to country
+// map. It denies destinations in a different country than the client
+type countryFilter map[string]string
+
+func (f countryFilter) country(ip net.IP) string {
+	for cidr, country := range f {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return country
+		}
+	}
+	return "unknown"
+}
+
+func (f countryFilter) filter(clientIP, destIP net.IP) (bool, string) {
+	client, dest := f.country(clientIP), f.country(destIP)
+	if client != dest {
+		return false, "destination in " + dest + " for client in " + client
+	}
+	return true, ""
+}
+
+func TestGeoIPFilter(t *testing.T) {
+	countries := countryFilter{
+		"192.0.2.0/24":    "AT",
+		"198.51.100.0/24": "AT",
+		"203.0.113.0/24":  "DE",
+	}
+	tests := []struct {
+		name       string
+		addrs      []net.IP
+		wantReason string
+	}{
+		{name: "same country", addrs: []net.IP{net.ParseIP("198.51.100.1")}},
+		{name: "other country", addrs: []net.IP{net.ParseIP("203.0.113.1")}, wantReason: "destination in DE for client in AT"},
+		{name: "second address in other country", addrs: []net.IP{net.ParseIP("198.51.100.1"), net.ParseIP("203.0.113.1")}, wantReason: "destination in DE for client in AT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checked []net.IP
+			p := &Proxy{
+				// the allowed requests fail in the handler, no packet leaves
+				Proxyhandler: failingHandler{},
+				Timeout:      time.Second,
+				Resolver:     staticResolver{"example.com": tt.addrs},
+				GeoIPFilter: func(clientIP, destIP net.IP) (bool, string) {
+					checked = append(checked, destIP)
+					return countries.filter(clientIP, destIP)
+				},
+			}
+			ctx := WithClientAddr(context.Background(), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234})
+			client, server := net.Pipe()
+			defer client.Close()
+			stats, _ := p.Relay(ctx, server, domainRequest("example.com", 443))
+
+			if stats.DenyReason != tt.wantReason {
+				t.Errorf("got deny reason %q, want %q", stats.DenyReason, tt.wantReason)
+			}
+			denied := stats.HandshakeReply == RequestReplyConnectionNotAllowed
+			if denied != (tt.wantReason != "") {
+				t.Errorf("got reply %s, denied %t", stats.HandshakeReply, denied)
+			}
+			if tt.wantReason == "" && len(checked) != len(tt.addrs) {
+				t.Errorf("checked %v, want all of %v", checked, tt.addrs)
+			}
+		})
+	}
+}
+
+func TestGeoIPFilterSkippedWithoutClientAddress(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: failingHandler{},
+		Timeout:      time.Second,
+		Resolver:     staticResolver{"example.com": {net.ParseIP("203.0.113.1")}},
+		GeoIPFilter: func(clientIP, destIP net.IP) (bool, string) {
+			t.Error("filter called without a client address")
+			return false, "no client"
+		},
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	stats, _ := p.Relay(context.Background(), server, domainRequest("example.com", 443))
+	if stats.DenyReason != "" {
+		t.Errorf("got deny reason %q", stats.DenyReason)
+	}
+}
@@ -1,8 +1,18 @@
 module github.com/firefart/gosocks
 
-go 1.16
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/hashicorp/yamux v0.1.1
 	github.com/sirupsen/logrus v1.8.1
-	golang.org/x/sys v0.0.0-20210423185535-09eb48e85fd7 // indirect
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
@@ -0,0 +1,162 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHandshakeQueueTimeout is used if Proxy.HandshakeQueueTimeout is not
+// set
+const defaultHandshakeQueueTimeout = time.Second
+
+// HandshakePhase is the step of the socks handshake a connection is in
+type HandshakePhase int32
+
+const (
+	// HandshakePhaseNone means the handshake did not start yet
+	HandshakePhaseNone HandshakePhase = iota
+	// HandshakePhaseMethodNegotiation is the method selection after the
+	// client greeting
+	HandshakePhaseMethodNegotiation
+	// HandshakePhaseAuth is the authentication with the selected method
+	HandshakePhaseAuth
+	// HandshakePhaseRequest covers parsing the request and connecting to the
+	// destination
+	HandshakePhaseRequest
+	// HandshakePhaseReplyWrite is sending the reply to the client
+	HandshakePhaseReplyWrite
+	// HandshakePhaseDone means the success reply was sent
+	HandshakePhaseDone
+)
+
+func (h HandshakePhase) String() string {
+	switch h {
+	case HandshakePhaseNone:
+		return "none"
+	case HandshakePhaseMethodNegotiation:
+		return "method negotiation"
+	case HandshakePhaseAuth:
+		return "auth"
+	case HandshakePhaseRequest:
+		return "request"
+	case HandshakePhaseReplyWrite:
+		return "reply write"
+	case HandshakePhaseDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// handshakeFailures counts failed handshakes by phase and reply reason
+type handshakeFailures struct {
+	counts [HandshakePhaseDone][256]uint64
+}
+
+func (h *handshakeFailures) inc(phase HandshakePhase, reason RequestReplyReason) {
+	if phase < HandshakePhaseNone || phase >= HandshakePhaseDone {
+		return
+	}
+	atomic.AddUint64(&h.counts[phase][reason], 1)
+}
+
+// snapshot returns the counters by phase and reason. Empty counters are left
+// out
+func (h *handshakeFailures) snapshot() map[string]map[string]uint64 {
+	result := make(map[string]map[string]uint64)
+	for phase := range h.counts {
+		for reason := range h.counts[phase] {
+			n := atomic.LoadUint64(&h.counts[phase][reason])
+			if n == 0 {
+				continue
+			}
+			name := HandshakePhase(phase).String()
+			if result[name] == nil {
+				result[name] = make(map[string]uint64)
+			}
+			result[name][RequestReplyReason(reason).String()] = n
+		}
+	}
+	return result
+}
+
+// handshakeQueueError is returned if no handshake slot became free in time.
+// The client did not send anything yet so no reply is sent
+type handshakeQueueError struct {
+	limit int
+	wait  time.Duration
+}
+
+func (e *handshakeQueueError) Error() string {
+	return fmt.Sprintf("handshake limit of %d reached, no slot free after %s", e.limit, e.wait)
+}
+
+// acquireHandshake waits for a free slot of MaxConcurrentHandshakes. The slot
+// is released by releaseHandshake once the reply was written
+func (p *Proxy) acquireHandshake(ctx context.Context, stats *SessionStats) *Error {
+	if p.MaxConcurrentHandshakes <= 0 {
+		return nil
+	}
+	p.handshakeSemOnce.Do(func() {
+		p.handshakeSem = make(chan struct{}, p.MaxConcurrentHandshakes)
+	})
+	wait := p.HandshakeQueueTimeout
+	if wait <= 0 {
+		wait = defaultHandshakeQueueTimeout
+	}
+	select {
+	case p.handshakeSem <- struct{}{}:
+	default:
+		timer := p.clock().NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case p.handshakeSem <- struct{}{}:
+		case <-timer.C():
+			atomic.AddInt64(&p.handshakeRejections, 1)
+			return &Error{Reason: RequestReplyGeneralFailure, Err: &handshakeQueueError{limit: p.MaxConcurrentHandshakes, wait: wait}}
+		case <-ctx.Done():
+			return &Error{Reason: RequestReplyGeneralFailure, Err: ctx.Err()}
+		}
+	}
+	stats.handshakeSlot = true
+	atomic.AddInt64(&p.handshakesInFlight, 1)
+	return nil
+}
+
+// releaseHandshake frees the handshake slot of the session if it holds one.
+// It is safe to call multiple times
+func (p *Proxy) releaseHandshake(stats *SessionStats) {
+	if !stats.handshakeSlot {
+		return
+	}
+	stats.handshakeSlot = false
+	atomic.AddInt64(&p.handshakesInFlight, -1)
+	<-p.handshakeSem
+}
+
+// setHandshakeDeadline limits the handshake on c to HandshakeDeadline and
+// returns a function clearing the limit. Like withTimeout the real clock
+// sets a deadline on c, other clocks expire the deadline when their timer
+// fires. Clearing fails if the timer already fired
+func (p *Proxy) setHandshakeDeadline(c net.Conn) (func() error, error) {
+	if _, ok := p.clock().(realClock); ok {
+		if err := c.SetDeadline(time.Now().Add(p.HandshakeDeadline)); err != nil {
+			return nil, err
+		}
+		return func() error { return c.SetDeadline(time.Time{}) }, nil
+	}
+	timer := p.clock().AfterFunc(p.HandshakeDeadline, func() {
+		// unblocks the pending read and fails all further ones
+		_ = c.SetDeadline(time.Unix(1, 0))
+	})
+	return func() error {
+		if !timer.Stop() {
+			return os.ErrDeadlineExceeded
+		}
+		return nil
+	}, nil
+}
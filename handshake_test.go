@@ -0,0 +1,141 @@
+package socks_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+// stillOpen checks that the proxy neither sent anything nor closed conn
+func stillOpen(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection was closed: %v", err)
+	}
+}
+
+func TestHandshakeDeadline(t *testing.T) {
+	clock := sockstest.NewFakeClock(time.Now())
+	p := &socks.Proxy{
+		Proxyhandler:      sockstest.NewMockHandler(),
+		Timeout:           time.Minute,
+		HandshakeDeadline: 50 * time.Millisecond,
+		Clock:             clock,
+	}
+	conn, err := net.Dial("tcp", serve(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// stall after the method selection. The handshake deadline and the read
+	// timeout of the request are pending
+	if _, err := conn.Write([]byte{byte(socks.Version5), 1, socks.MethodNoAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	clock.BlockUntil(2)
+	clock.Advance(49 * time.Millisecond)
+	stillOpen(t, conn)
+
+	clock.Advance(time.Millisecond)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("stalled client was not cut off after the handshake deadline")
+	}
+}
+
+func TestHandshakeDeadlineCleared(t *testing.T) {
+	clock := sockstest.NewFakeClock(time.Now())
+	p := &socks.Proxy{
+		Proxyhandler:      sockstest.NewMockHandler(),
+		Timeout:           time.Minute,
+		HandshakeDeadline: 50 * time.Millisecond,
+		Clock:             clock,
+	}
+	client := &socks.Client{ProxyAddr: serve(t, p), Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the deadline only limits the handshake
+	clock.Advance(time.Hour)
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+}
+
+func TestHandshakeFailureBuckets(t *testing.T) {
+	greeting := []byte{byte(socks.Version5), 1, socks.MethodNoAuthRequired}
+	request := func(cmd socks.RequestCmd, atyp socks.RequestAddressType) []byte {
+		return []byte{byte(socks.Version5), byte(cmd), 0x00, byte(atyp), 192, 0, 2, 1, 0x00, 0x50}
+	}
+	creds := socks.StaticCredentials{"user": "pass"}
+	tests := []struct {
+		name    string
+		creds   socks.CredentialStore
+		handler *sockstest.MockHandler
+		// messages sent by the client, each is answered by the proxy
+		send  [][]byte
+		phase socks.HandshakePhase
+		want  socks.RequestReplyReason
+	}{
+		{"no acceptable method", creds, sockstest.NewMockHandler(), [][]byte{greeting}, socks.HandshakePhaseMethodNegotiation, socks.RequestReplyMethodNotSupported},
+		{"invalid version", nil, sockstest.NewMockHandler(), [][]byte{{0x06, 1, 0x00}}, socks.HandshakePhaseMethodNegotiation, socks.RequestReplyConnectionRefused},
+		{"wrong password", creds, sockstest.NewMockHandler(), [][]byte{{byte(socks.Version5), 1, socks.MethodUsernamePassword}, append([]byte{0x01, 4}, "user\x05wrong"...)}, socks.HandshakePhaseAuth, socks.RequestReplyConnectionNotAllowed},
+		{"unsupported command", nil, sockstest.NewMockHandler(), [][]byte{greeting, request(socks.RequestCmdBind, socks.RequestAddressTypeIPv4)}, socks.HandshakePhaseRequest, socks.RequestReplyCommandNotSupported},
+		{"unsupported address type", nil, sockstest.NewMockHandler(), [][]byte{greeting, request(socks.RequestCmdConnect, 0x07)}, socks.HandshakePhaseRequest, socks.RequestReplyAddressTypeNotSupported},
+		{"unreachable", nil, sockstest.NewMockHandler(sockstest.WithPreHandlerError(&socks.Error{Reason: socks.RequestReplyHostUnreachable, Err: errors.New("unreachable")})), [][]byte{greeting, request(socks.RequestCmdConnect, socks.RequestAddressTypeIPv4)}, socks.HandshakePhaseRequest, socks.RequestReplyHostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &socks.Proxy{
+				Proxyhandler: tt.handler,
+				Timeout:      time.Second,
+				Credentials:  tt.creds,
+			}
+			conn, err := net.Dial("tcp", serve(t, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range tt.send {
+				if _, err := conn.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := conn.Read(make([]byte, 32)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the failure is counted before the proxy closes the connection
+			if _, err := io.ReadAll(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]map[string]uint64{tt.phase.String(): {tt.want.String(): 1}}
+			if got := p.Stats().HandshakeFailures; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got handshake failures %v, want %v", got, want)
+			}
+		})
+	}
+}
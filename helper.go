@@ -2,6 +2,7 @@ package socks
 
 import (
 	"fmt"
+	"io"
 	"net"
 )
 
@@ -20,3 +21,45 @@ func parseIP(ip string) (net.IP, error) {
 	}
 	return nil, fmt.Errorf("invalid ip address %s", ip)
 }
+
+// addrIP returns the ip address of addr. nil is returned if the address has
+// no ip address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// extractNetConn returns conn as net.Conn. Connections passed to HandleConn
+// or Relay can be any io.ReadWriteCloser, features that need addresses or
+// deadlines are skipped if it returns false
+func extractNetConn(conn io.ReadWriteCloser) (net.Conn, bool) {
+	c, ok := conn.(net.Conn)
+	return c, ok
+}
+
+// wrapIO returns conn as io.ReadWriteCloser without wrapping it, so
+// extractNetConn still returns the net.Conn
+func wrapIO(conn net.Conn) io.ReadWriteCloser {
+	return conn
+}
+
+// closeWriter is implemented by connections supporting half-close like
+// *net.TCPConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite signals the end of data to the peer of w while still allowing
+// reads from it. Writers without half-close support are closed completely,
+// this also signals EOF on pipes
+func closeWrite(w io.WriteCloser) error {
+	if cw, ok := w.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return w.Close()
+}
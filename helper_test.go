@@ -0,0 +1,251 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// requestTo returns a CONNECT request to the tcp address addr
+func requestTo(tb testing.TB, addr string) Request {
+	tb.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		tb.Fatalf("%s is not an ipv4 address", addr)
+	}
+	return Request{
+		Version:            Version5,
+		Command:            RequestCmdConnect,
+		AddressType:        RequestAddressTypeIPv4,
+		DestinationAddress: ip,
+		DestinationPort:    uint16(p),
+	}
+}
+
+// lineServer answers every line it receives with "ok" on the same
+// connection, like a keep-alive server. It returns the address
+func lineServer(tb testing.TB) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serveLines(tb, l)
+	return l.Addr().String()
+}
+
+// serveLines answers lines like lineServer on every connection accepted by
+// l until the test ends
+func serveLines(tb testing.TB, l net.Listener) {
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte("ok\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+}
+
+// roundTrip sends a line and reads the answer of a lineServer
+func roundTrip(tb testing.TB, conn net.Conn) {
+	tb.Helper()
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		tb.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// serveProxy serves p on a local listener until the test ends and returns
+// the address
+func serveProxy(tb testing.TB, p *Proxy) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go p.Serve(l)
+	tb.Cleanup(func() { p.Close() })
+	return l.Addr().String()
+}
+
+// dialProxy connects to the proxy and negotiates the method like the Client
+func dialProxy(tb testing.TB, proxyAddr, username, password string) net.Conn {
+	tb.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		tb.Fatal(err)
+	}
+	c := &Client{Username: username, Password: password}
+	if err := c.negotiateMethod(conn); err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// sendRequest sends a CONNECT to address and returns the reply code
+func sendRequest(tb testing.TB, conn net.Conn, address string) RequestReplyReason {
+	tb.Helper()
+	request, err := buildRequest(RequestCmdConnect, address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		tb.Fatal(err)
+	}
+	return readReplyReason(tb, conn)
+}
+
+// readReplyReason reads a reply with an ip address and returns the reply
+// code
+func readReplyReason(tb testing.TB, conn net.Conn) RequestReplyReason {
+	tb.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		tb.Fatalf("could not read reply: %v", err)
+	}
+	var addrLen int
+	switch RequestAddressType(header[3]) {
+	case RequestAddressTypeIPv4:
+		addrLen = net.IPv4len
+	case RequestAddressTypeIPv6:
+		addrLen = net.IPv6len
+	default:
+		tb.Fatalf("unexpected address type %#x in reply", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		tb.Fatalf("could not read reply address: %v", err)
+	}
+	return RequestReplyReason(header[1])
+}
+
+// recordingHandler is a DefaultHandler remembering the requests and users it
+// saw
+type recordingHandler struct {
+	DefaultHandler
+
+	mu       sync.Mutex
+	requests []Request
+	users    []string
+}
+
+func (h *recordingHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	user, _ := UserFromContext(ctx)
+	h.mu.Lock()
+	h.requests = append(h.requests, request)
+	h.users = append(h.users, user)
+	h.mu.Unlock()
+	return h.DefaultHandler.PreHandler(ctx, request)
+}
+
+// last returns the last request and user seen by the handler
+func (h *recordingHandler) last(tb testing.TB) (Request, string) {
+	tb.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.requests) == 0 {
+		tb.Fatal("handler saw no request")
+	}
+	return h.requests[len(h.requests)-1], h.users[len(h.users)-1]
+}
+
+// staticResolver resolves the names in the map and fails for all others
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+// domainRequest returns a CONNECT request to host:port
+func domainRequest(host string, port uint16) Request {
+	return Request{
+		Version:            Version5,
+		Command:            RequestCmdConnect,
+		AddressType:        RequestAddressTypeDomainname,
+		DestinationAddress: []byte(host),
+		DestinationPort:    port,
+	}
+}
+
+// failingHandler fails every request with host unreachable without dialing
+type failingHandler struct {
+	DefaultHandler
+}
+
+func (failingHandler) PreHandler(context.Context, Request) (io.ReadWriteCloser, *Error) {
+	return nil, &Error{Reason: RequestReplyHostUnreachable, Err: errors.New("failingHandler does not dial")}
+}
+
+// waitFor polls cond until it is true and fails the test after 5 seconds
+func waitFor(tb testing.TB, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal("condition not met after 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// captureLogs records the messages of the standard logger at level and
+// above until the test ends
+func captureLogs(tb testing.TB, level log.Level) *logtest.Hook {
+	tb.Helper()
+	logger := log.StandardLogger()
+	oldLevel := logger.GetLevel()
+	hook := &logtest.Hook{}
+	oldHooks := logger.ReplaceHooks(log.LevelHooks{})
+	logger.AddHook(hook)
+	logger.SetLevel(level)
+	tb.Cleanup(func() {
+		logger.SetLevel(oldLevel)
+		logger.ReplaceHooks(oldHooks)
+	})
+	return hook
+}
@@ -0,0 +1,118 @@
+package httpconnect_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/httpconnect"
+	log "github.com/sirupsen/logrus"
+)
+
+// The HTTP CONNECT front-end relays with the same proxy as the socks
+// listener, so the sessions of both protocols end up in one session list
+func ExampleHandler() {
+	// a destination answering "ok" to every line
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte("ok\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	p := &socks.Proxy{
+		Proxyhandler: &socks.DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  socks.StaticCredentials{"alice": "secret", "bob": "secret"},
+	}
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go p.Serve(socksListener)
+	defer p.Close()
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(httpListener, httpconnect.NewHandler(p))
+	defer httpListener.Close()
+
+	// alice uses HTTP CONNECT
+	httpConn, err := net.Dial("tcp", httpListener.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer httpConn.Close()
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	fmt.Fprintf(httpConn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic %s\r\n\r\n", target.Addr(), auth)
+	br := bufio.NewReader(httpConn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(strings.TrimSpace(status))
+	if _, err := br.ReadString('\n'); err != nil {
+		log.Fatal(err)
+	}
+
+	// bob uses socks
+	client := &socks.Client{ProxyAddr: socksListener.Addr().String(), Username: "bob", Password: "secret", Timeout: time.Second}
+	socksConn, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer socksConn.Close()
+
+	for _, r := range []io.ReadWriter{struct {
+		io.Reader
+		io.Writer
+	}{br, httpConn}, socksConn} {
+		if _, err := io.WriteString(r, "ping\n"); err != nil {
+			log.Fatal(err)
+		}
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(line)
+	}
+
+	var users []string
+	for _, s := range p.Sessions() {
+		users = append(users, s.Username)
+	}
+	sort.Strings(users)
+	fmt.Println(users)
+	// Output:
+	// HTTP/1.1 200 Connection established
+	// ok
+	// ok
+	// [alice bob]
+}
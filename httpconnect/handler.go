@@ -0,0 +1,255 @@
+// Package httpconnect serves HTTP CONNECT proxy requests with the rewrites,
+// policy, access lists, handler and session accounting of a socks proxy, so
+// one process can serve clients of both protocols with one configuration.
+package httpconnect
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler accepts CONNECT requests and relays them with the proxy. Other
+// methods are answered with 405 Method Not Allowed
+type Handler struct {
+	proxy *socks.Proxy
+}
+
+// NewHandler returns a handler relaying CONNECT requests with p. If the
+// proxy has credentials the clients must authenticate with the
+// Proxy-Authorization header using basic authentication
+func NewHandler(p *socks.Proxy) *Handler {
+	return &Handler{proxy: p}
+}
+
+// ServeHTTP hijacks the connection of CONNECT requests and relays it to the
+// requested destination
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, herr := h.prepare(r)
+	if herr != nil {
+		for k, v := range herr.header {
+			w.Header()[k] = v
+		}
+		http.Error(w, herr.msg, herr.status)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can not be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("could not hijack connection: %v", err)
+		return
+	}
+	h.relay(r.Context(), clientConn(conn, rw.Reader), request, r)
+}
+
+// ServeConn reads a single request from conn and relays it like ServeHTTP.
+// It is meant for socks.Proxy.HTTPConnect to serve socks and HTTP clients on
+// one listener. A deadline set on conn limits reading the request and is
+// cleared before the data is relayed. conn is closed afterwards
+func (h *Handler) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		log.Debugf("could not read HTTP request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+
+	request, herr := h.prepare(r)
+	if herr != nil {
+		resp := &http.Response{
+			StatusCode:    herr.status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        herr.header.Clone(),
+			Body:          io.NopCloser(strings.NewReader(herr.msg + "\n")),
+			ContentLength: int64(len(herr.msg) + 1),
+			Close:         true,
+		}
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if err := resp.Write(conn); err != nil {
+			log.Debugf("could not send HTTP response: %v", err)
+		}
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Debugf("could not clear deadline: %v", err)
+		return
+	}
+	h.relay(ctx, clientConn(conn, br), request, r)
+}
+
+// httpError is the response to a request that is not relayed
+type httpError struct {
+	status int
+	msg    string
+	header http.Header
+}
+
+// prepare checks the method and the authentication of r and returns the
+// connect request for its destination
+func (h *Handler) prepare(r *http.Request) (socks.Request, *httpError) {
+	if r.Method != http.MethodConnect {
+		return socks.Request{}, &httpError{
+			status: http.StatusMethodNotAllowed,
+			msg:    "only CONNECT is supported",
+			header: http.Header{"Allow": {http.MethodConnect}},
+		}
+	}
+
+	username, ok := h.authenticate(r)
+	if !ok {
+		return socks.Request{}, &httpError{
+			status: http.StatusProxyAuthRequired,
+			msg:    "proxy authentication required",
+			header: http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}},
+		}
+	}
+
+	request, err := parseDestination(r.Host)
+	if err != nil {
+		return socks.Request{}, &httpError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	request.Username = username
+	return request, nil
+}
+
+// relay relays the client connection of r with the proxy and answers with
+// the status of the request
+func (h *Handler) relay(ctx context.Context, client net.Conn, request socks.Request, r *http.Request) {
+	reply := func(reason socks.RequestReplyReason, _ net.Addr) error {
+		status := statusCode(reason)
+		_, err := fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n\r\n", status, statusText(status))
+		return err
+	}
+	if _, err := h.proxy.RelayWithReply(ctx, client, request, reply); err != nil {
+		log.Debugf("CONNECT %s from %s: %v", r.Host, r.RemoteAddr, err)
+	}
+}
+
+// authenticate checks the Proxy-Authorization header against the
+// credentials of the proxy and returns the username
+func (h *Handler) authenticate(r *http.Request) (string, bool) {
+	creds := h.proxy.CurrentCredentials()
+	if creds == nil {
+		return "", true
+	}
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !creds.Valid(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+// parseDestination creates the connect request for the host:port of the
+// CONNECT request
+func parseDestination(hostport string) (socks.Request, error) {
+	host, portString, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return socks.Request{}, fmt.Errorf("invalid destination %q: %w", hostport, err)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return socks.Request{}, fmt.Errorf("invalid port %q", portString)
+	}
+	r := socks.Request{
+		Version:         socks.Version5,
+		Command:         socks.RequestCmdConnect,
+		DestinationPort: uint16(port),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			r.AddressType = socks.RequestAddressTypeIPv4
+			r.DestinationAddress = ip4
+		} else {
+			r.AddressType = socks.RequestAddressTypeIPv6
+			r.DestinationAddress = ip.To16()
+		}
+	} else {
+		if len(host) > 255 {
+			return socks.Request{}, fmt.Errorf("hostname %s is too long", host)
+		}
+		r.AddressType = socks.RequestAddressTypeDomainname
+		r.DestinationAddress = []byte(host)
+	}
+	return r, nil
+}
+
+// statusCode maps the reply of a request to the status of the response
+func statusCode(reason socks.RequestReplyReason) int {
+	switch reason {
+	case socks.RequestReplySucceeded:
+		return http.StatusOK
+	case socks.RequestReplyConnectionNotAllowed:
+		return http.StatusForbidden
+	case socks.RequestReplyTTLExpired:
+		return http.StatusGatewayTimeout
+	case socks.RequestReplyCommandNotSupported, socks.RequestReplyAddressTypeNotSupported:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func statusText(status int) string {
+	if status == http.StatusOK {
+		return "Connection established"
+	}
+	return http.StatusText(status)
+}
+
+// clientConn returns the hijacked connection. Data the client sent after the
+// request and that was already read by the server is returned first
+func clientConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	buffered, _ := r.Peek(r.Buffered())
+	return &bufferedConn{Conn: conn, r: io.MultiReader(strings.NewReader(string(buffered)), conn)}
+}
+
+// bufferedConn reads the buffered data before the connection
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half-closes the connection if supported
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package httpconnect
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+)
+
+// countingMetrics counts the connections and the bytes reported by the
+// proxy
+type countingMetrics struct {
+	mu             sync.Mutex
+	connections    int
+	sessions       int
+	clientToRemote int64
+	remoteToClient int64
+}
+
+func (m *countingMetrics) IncConnections() {
+	m.mu.Lock()
+	m.connections++
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) AddBytes(clientToRemote, remoteToClient int64) {
+	m.mu.Lock()
+	m.sessions++
+	m.clientToRemote += clientToRemote
+	m.remoteToClient += remoteToClient
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) ObserveHandshakeDuration(time.Duration)   {}
+func (m *countingMetrics) ObserveDialDuration(time.Duration)        {}
+func (m *countingMetrics) IncMethodAdvertised(socks.Methods)        {}
+func (m *countingMetrics) IncMethodSelected(socks.Methods)          {}
+func (m *countingMetrics) IncError(reason socks.RequestReplyReason) {}
+
+// lineServer answers every line it receives with "ok" and returns the
+// address
+func lineServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte("ok\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// serveProxy serves p on a local listener until the test ends
+func serveProxy(t *testing.T, p *socks.Proxy) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+	t.Cleanup(func() { p.Close() })
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// expect reads len(want) bytes and compares them
+func expect(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("could not read %q: %v", want, err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func connectSOCKS4(t *testing.T, conn net.Conn, target *net.TCPAddr) {
+	t.Helper()
+	req := []byte{byte(socks.Version4), byte(socks.RequestCmdConnect), 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(target.Port))
+	req = append(req, target.IP.To4()...)
+	req = append(req, 0)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x5a {
+		t.Fatalf("socks4 request rejected with %#x", reply[1])
+	}
+}
+
+func connectSOCKS5(t *testing.T, conn net.Conn, target *net.TCPAddr) {
+	t.Helper()
+	if _, err := conn.Write([]byte{byte(socks.Version5), 1, byte(socks.MethodNoAuthRequired)}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, []byte{byte(socks.Version5), byte(socks.MethodNoAuthRequired)})
+	req := []byte{byte(socks.Version5), byte(socks.RequestCmdConnect), 0, byte(socks.RequestAddressTypeIPv4)}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if socks.RequestReplyReason(reply[1]) != socks.RequestReplySucceeded {
+		t.Fatalf("socks5 request rejected with %s", socks.RequestReplyReason(reply[1]))
+	}
+}
+
+// TestSharedListener serves socks4, socks5 and HTTP CONNECT clients on one
+// listener and checks that every connection is counted once
+func TestSharedListener(t *testing.T) {
+	target := lineServer(t)
+	metrics := &countingMetrics{}
+	p := &socks.Proxy{
+		Proxyhandler: &socks.DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		EnableSOCKS4: true,
+		Metrics:      metrics,
+	}
+	p.HTTPConnect = NewHandler(p).ServeConn
+	addr := serveProxy(t, p)
+
+	socks4 := dial(t, addr)
+	connectSOCKS4(t, socks4, target)
+	socks5 := dial(t, addr)
+	connectSOCKS5(t, socks5, target)
+	httpConn := dial(t, addr)
+	if _, err := httpConn.Write([]byte("CONNECT " + target.String() + " HTTP/1.1\r\nHost: " + target.String() + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, httpConn, []byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	for _, conn := range []net.Conn{socks4, socks5, httpConn} {
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, []byte("ok\n"))
+	}
+
+	stats := p.Stats()
+	if stats.ActiveConnections != 3 {
+		t.Errorf("got %d active connections, want 3", stats.ActiveConnections)
+	}
+	if stats.ActiveSessions != 3 {
+		t.Errorf("got %d active sessions, want 3", stats.ActiveSessions)
+	}
+
+	for _, conn := range []net.Conn{socks4, socks5, httpConn} {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still active", p.Stats().ActiveConnections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.connections != 3 {
+		t.Errorf("got %d connections, want 3", metrics.connections)
+	}
+	if metrics.sessions != 3 {
+		t.Errorf("bytes were reported for %d sessions, want 3", metrics.sessions)
+	}
+	if metrics.clientToRemote != 3*int64(len("ping\n")) || metrics.remoteToClient != 3*int64(len("ok\n")) {
+		t.Errorf("got %d bytes from client to remote and %d bytes from remote to client, want %d and %d",
+			metrics.clientToRemote, metrics.remoteToClient, 3*len("ping\n"), 3*len("ok\n"))
+	}
+}
+
+// connect sends a CONNECT request for target with the given
+// Proxy-Authorization header and returns the response
+func connect(t *testing.T, conn net.Conn, target string, auth string) *http.Response {
+	t.Helper()
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	target := lineServer(t)
+	p := &socks.Proxy{
+		Proxyhandler: &socks.DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  socks.StaticCredentials{"alice": "secret"},
+	}
+	server := httptest.NewServer(NewHandler(p))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		auth string
+		ok   bool
+	}{
+		{"valid", basicAuth("alice", "secret"), true},
+		{"missing", "", false},
+		{"wrong password", basicAuth("alice", "wrong"), false},
+		{"unknown user", basicAuth("bob", "secret"), false},
+		{"no colon", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice")), false},
+		{"invalid base64", "Basic !!!", false},
+		{"bearer", "Bearer secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, server.Listener.Addr().String())
+			resp := connect(t, conn, target.String(), tt.auth)
+			if !tt.ok {
+				if resp.StatusCode != http.StatusProxyAuthRequired {
+					t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+				}
+				if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="proxy"` {
+					t.Fatalf("got Proxy-Authenticate %q", got)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if _, err := conn.Write([]byte("ping\n")); err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte("ok\n"))
+			if sessions := p.Sessions(); len(sessions) != 1 || sessions[0].Username != "alice" {
+				t.Fatalf("got sessions %+v, want one session of alice", sessions)
+			}
+		})
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		reason socks.RequestReplyReason
+		status int
+	}{
+		{socks.RequestReplySucceeded, http.StatusOK},
+		{socks.RequestReplyGeneralFailure, http.StatusBadGateway},
+		{socks.RequestReplyConnectionNotAllowed, http.StatusForbidden},
+		{socks.RequestReplyNetworkUnreachable, http.StatusBadGateway},
+		{socks.RequestReplyHostUnreachable, http.StatusBadGateway},
+		{socks.RequestReplyConnectionRefused, http.StatusBadGateway},
+		{socks.RequestReplyTTLExpired, http.StatusGatewayTimeout},
+		{socks.RequestReplyCommandNotSupported, http.StatusBadRequest},
+		{socks.RequestReplyAddressTypeNotSupported, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason.String(), func(t *testing.T) {
+			if got := statusCode(tt.reason); got != tt.status {
+				t.Fatalf("got status %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
+
+// TestStatusCodeReply checks the status sent for a failed request
+func TestStatusCodeReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	p := &socks.Proxy{
+		Proxyhandler: &socks.DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	server := httptest.NewServer(NewHandler(p))
+	defer server.Close()
+
+	resp := connect(t, dial(t, server.Listener.Addr().String()), closed, "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	if resp.Status != "502 Bad Gateway" {
+		t.Fatalf("got status line %q", resp.Status)
+	}
+}
@@ -0,0 +1,55 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// httpMethods are the request line prefixes of HTTP requests
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+const httpErrorBody = "This is a SOCKS5 proxy, not an HTTP proxy. Configure your client to use SOCKS5.\n"
+
+// httpRequestError is returned if the client sent an HTTP request. No socks
+// error reply is sent in this case
+type httpRequestError struct {
+	method string
+}
+
+func (e *httpRequestError) Error() string {
+	return fmt.Sprintf("received an HTTP %s request on the socks port", e.method)
+}
+
+// looksLikeHTTP checks if the data starts with an HTTP request line and
+// returns the method
+func looksLikeHTTP(buf []byte) (string, bool) {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(buf, m) {
+			return string(m[:len(m)-1]), true
+		}
+	}
+	return "", false
+}
+
+// handleHTTPRequest optionally tells the client that this is not an HTTP proxy
+func (p *Proxy) handleHTTPRequest(ctx context.Context, conn io.ReadWriteCloser, method string) *Error {
+	if p.HTTPErrorResponse {
+		resp := fmt.Sprintf("HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(httpErrorBody), httpErrorBody)
+		if err := connectionWrite(ctx, conn, []byte(resp), p.Timeout, p.clock()); err != nil {
+			return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send HTTP error response: %w", err)}
+		}
+	}
+	return &Error{Reason: RequestReplyGeneralFailure, Err: &httpRequestError{method: method}}
+}
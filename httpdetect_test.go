@@ -0,0 +1,74 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPRequestDetection(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"GET", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{"CONNECT", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		for _, respond := range []bool{true, false} {
+			name := tt.name + " silent"
+			if respond {
+				name = tt.name + " with response"
+			}
+			t.Run(name, func(t *testing.T) {
+				p := &Proxy{
+					Proxyhandler:      &DefaultHandler{Timeout: time.Second},
+					Timeout:           time.Second,
+					HTTPErrorResponse: respond,
+				}
+				conn, err := net.Dial("tcp", serveProxy(t, p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := conn.Write([]byte(tt.request)); err != nil {
+					t.Fatal(err)
+				}
+				resp, err := io.ReadAll(conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !respond {
+					if len(resp) != 0 {
+						t.Fatalf("got response %q, want none", resp)
+					}
+					return
+				}
+				if !strings.HasPrefix(string(resp), "HTTP/1.1 400 Bad Request\r\n") || !strings.HasSuffix(string(resp), httpErrorBody) {
+					t.Fatalf("got response %q", resp)
+				}
+			})
+		}
+	}
+}
+
+// TestHTTPRequestDetectionSOCKS checks that socks clients are not affected
+// by the detection
+func TestHTTPRequestDetectionSOCKS(t *testing.T) {
+	target := lineServer(t)
+	p := &Proxy{
+		Proxyhandler:      &DefaultHandler{Timeout: time.Second},
+		Timeout:           time.Second,
+		HTTPErrorResponse: true,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+}
@@ -0,0 +1,223 @@
+package socks
+
+import (
+	"crypto/md5" // #nosec G501 JA3 is defined with md5
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxClientHelloSize limits the data buffered to find a ClientHello. It is
+// the maximum size of a TLS record with its header
+const maxClientHelloSize = 5 + 16384
+
+// JA3 computes the JA3 fingerprint of the TLS ClientHello at the start of
+// data. It returns the fingerprint string and its md5 hash. GREASE values are
+// ignored as defined by JA3
+func JA3(data []byte) (string, string, error) {
+	fingerprint, err := ja3String(data)
+	if err != nil {
+		return "", "", err
+	}
+	sum := md5.Sum([]byte(fingerprint)) // #nosec G401
+	return fingerprint, hex.EncodeToString(sum[:]), nil
+}
+
+// ja3String parses the ClientHello and builds the fingerprint in the form
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+func ja3String(data []byte) (string, error) {
+	// record header: type, version, length
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", fmt.Errorf("not a tls handshake record")
+	}
+	recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+recordLen {
+		return "", fmt.Errorf("incomplete tls record")
+	}
+	r := &helloReader{buf: data[5 : 5+recordLen]}
+
+	// handshake header: type, 3 byte length
+	if r.u8() != 0x01 {
+		return "", fmt.Errorf("not a client hello")
+	}
+	r.skip(3)
+	version := r.u16()
+	// random
+	r.skip(32)
+	r.skip(int(r.u8()))
+
+	var ciphers []string
+	cipherSuites := r.sub(int(r.u16()))
+	for cipherSuites.len() >= 2 {
+		if c := cipherSuites.u16(); !isGREASE(c) {
+			ciphers = append(ciphers, strconv.Itoa(int(c)))
+		}
+	}
+	// compression methods
+	r.skip(int(r.u8()))
+
+	var extensions, curves, pointFormats []string
+	if r.len() >= 2 {
+		exts := r.sub(int(r.u16()))
+		for exts.len() >= 4 {
+			typ := exts.u16()
+			body := exts.sub(int(exts.u16()))
+			if isGREASE(typ) {
+				continue
+			}
+			extensions = append(extensions, strconv.Itoa(int(typ)))
+			switch typ {
+			case 10:
+				// supported groups, called elliptic curves in JA3
+				list := body.sub(int(body.u16()))
+				for list.len() >= 2 {
+					if c := list.u16(); !isGREASE(c) {
+						curves = append(curves, strconv.Itoa(int(c)))
+					}
+				}
+			case 11:
+				list := body.sub(int(body.u8()))
+				for list.len() >= 1 {
+					pointFormats = append(pointFormats, strconv.Itoa(int(list.u8())))
+				}
+			}
+		}
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		strings.Join(ciphers, "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(pointFormats, "-"),
+	}, ","), nil
+}
+
+// isGREASE checks for the reserved GREASE values 0x0a0a, 0x1a1a ... 0xfafa
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloReader reads the fields of a ClientHello. Reads past the end set err
+// and return zero values
+type helloReader struct {
+	buf []byte
+	err error
+}
+
+func (r *helloReader) len() int {
+	return len(r.buf)
+}
+
+func (r *helloReader) take(n int) []byte {
+	if r.err != nil || n > len(r.buf) {
+		if r.err == nil {
+			r.err = fmt.Errorf("truncated client hello")
+		}
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *helloReader) skip(n int) {
+	r.take(n)
+}
+
+func (r *helloReader) u8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) u16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// sub returns a reader for the next n bytes
+func (r *helloReader) sub(n int) *helloReader {
+	b := r.take(n)
+	return &helloReader{buf: b, err: r.err}
+}
+
+// ja3Sniffer buffers the first bytes the client sends until a complete TLS
+// record is available and records the JA3 fingerprint of the ClientHello.
+// The data is passed through unchanged
+type ja3Sniffer struct {
+	io.ReadCloser
+	sess *session
+
+	buf  []byte
+	done bool
+}
+
+func (s *ja3Sniffer) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if !s.done && n > 0 {
+		s.sniff(p[:n])
+	}
+	return n, err
+}
+
+func (s *ja3Sniffer) sniff(data []byte) {
+	s.buf = append(s.buf, data...)
+	if s.buf[0] != 0x16 {
+		// not tls
+		s.finish()
+		return
+	}
+	if len(s.buf) < 5 {
+		return
+	}
+	recordLen := int(binary.BigEndian.Uint16(s.buf[3:5]))
+	if len(s.buf) < 5+recordLen && len(s.buf) < maxClientHelloSize {
+		return
+	}
+	fingerprint, hash, err := JA3(s.buf)
+	if err != nil {
+		log.Debugf("could not compute ja3 fingerprint for %s: %v", s.sess.clientAddr, err)
+	} else {
+		s.sess.setJA3(hash)
+		log.Infof("tls client hello from %s to %s: ja3 %s (%s)", s.sess.clientAddr, s.sess.destination, hash, fingerprint)
+	}
+	s.finish()
+}
+
+func (s *ja3Sniffer) finish() {
+	s.done = true
+	s.buf = nil
+}
+
+// ja3Value holds the fingerprint of a session
+type ja3Value struct {
+	mu   sync.Mutex
+	hash string
+}
+
+func (s *session) setJA3(hash string) {
+	s.ja3.mu.Lock()
+	defer s.ja3.mu.Unlock()
+	s.ja3.hash = hash
+}
+
+func (s *session) getJA3() string {
+	s.ja3.mu.Lock()
+	defer s.ja3.mu.Unlock()
+	return s.ja3.hash
+}
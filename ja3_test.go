@@ -0,0 +1,193 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello builds a TLS record with a ClientHello. extensions maps the
+// extension type to its body, the order is given by extensionOrder
+type clientHello struct {
+	version        uint16
+	ciphers        []uint16
+	extensionOrder []uint16
+	extensions     map[uint16][]byte
+}
+
+func u16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+// withLength prefixes b with its length in n bytes
+func withLength(n int, b []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(b)))
+	return append(length[4-n:], b...)
+}
+
+func (h clientHello) bytes() []byte {
+	var body []byte
+	body = append(body, u16(h.version)...)
+	body = append(body, make([]byte, 32)...)
+	// session id
+	body = append(body, 0)
+	var ciphers []byte
+	for _, c := range h.ciphers {
+		ciphers = append(ciphers, u16(c)...)
+	}
+	body = append(body, withLength(2, ciphers)...)
+	// compression methods: null
+	body = append(body, 1, 0)
+	var exts []byte
+	for _, typ := range h.extensionOrder {
+		exts = append(exts, u16(typ)...)
+		exts = append(exts, withLength(2, h.extensions[typ])...)
+	}
+	body = append(body, withLength(2, exts)...)
+
+	handshake := append([]byte{0x01}, withLength(3, body)...)
+	record := []byte{0x16, 0x03, 0x01}
+	return append(record, withLength(2, handshake)...)
+}
+
+// curves returns the body of a supported groups extension
+func curves(ids ...uint16) []byte {
+	var list []byte
+	for _, id := range ids {
+		list = append(list, u16(id)...)
+	}
+	return withLength(2, list)
+}
+
+// referenceHello matches the example of the JA3 readme:
+// 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+func referenceHello(grease bool) clientHello {
+	h := clientHello{
+		version:        0x0301,
+		ciphers:        []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		extensionOrder: []uint16{0, 10, 11},
+		extensions: map[uint16][]byte{
+			0:  withLength(2, append([]byte{0}, withLength(2, []byte("example.com"))...)),
+			10: curves(23, 24, 25),
+			11: withLength(1, []byte{0}),
+		},
+	}
+	if grease {
+		h.ciphers = append([]uint16{0x0a0a}, h.ciphers...)
+		h.extensionOrder = append([]uint16{0x1a1a}, append(h.extensionOrder, 0xfafa)...)
+		h.extensions[0x1a1a] = nil
+		h.extensions[0xfafa] = []byte{0}
+		h.extensions[10] = curves(0x2a2a, 23, 24, 25)
+	}
+	return h
+}
+
+func TestJA3Reference(t *testing.T) {
+	const (
+		wantString = "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"
+		wantHash   = "ada70206e40642a3e4461f35503241d5"
+	)
+	for _, grease := range []bool{false, true} {
+		fingerprint, hash, err := JA3(referenceHello(grease).bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fingerprint != wantString {
+			t.Errorf("grease %v: got fingerprint %s, want %s", grease, fingerprint, wantString)
+		}
+		if hash != wantHash {
+			t.Errorf("grease %v: got hash %s, want %s", grease, hash, wantHash)
+		}
+	}
+}
+
+func TestJA3Invalid(t *testing.T) {
+	hello := referenceHello(false).bytes()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not tls", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"short", hello[:3]},
+		{"incomplete record", hello[:len(hello)-1]},
+		{"not a client hello", append(append([]byte{}, hello[:5]...), append([]byte{0x02}, hello[6:]...)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := JA3(tt.data); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestJA3Session(t *testing.T) {
+	target := lineServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		LogJA3:       true,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	// sent in two parts so the sniffer has to buffer
+	hello := referenceHello(true).bytes()
+	for _, part := range [][]byte{hello[:10], hello[10:]} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sessions := p.Sessions()
+		if len(sessions) == 1 && sessions[0].JA3 != "" {
+			if got := sessions[0].JA3; got != "ada70206e40642a3e4461f35503241d5" {
+				t.Fatalf("session has ja3 %s", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ja3 not recorded in the session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestJA3SessionStats checks that the fingerprint is kept in the stats
+// returned at the end of the session
+func TestJA3SessionStats(t *testing.T) {
+	target := lineServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		LogJA3:       true,
+	}
+	client, server := net.Pipe()
+	done := make(chan SessionStats, 1)
+	go func() {
+		// the client closes the pipe before the remote, so the session may
+		// end with a copy error
+		stats, _ := p.Relay(context.Background(), server, requestTo(t, target))
+		done <- stats
+	}()
+	if _, err := client.Write(referenceHello(true).bytes()); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case stats := <-done:
+		if stats.JA3 != "ada70206e40642a3e4461f35503241d5" {
+			t.Fatalf("session ended with ja3 %q", stats.JA3)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+}
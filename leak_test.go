@@ -0,0 +1,73 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestHandshakeFailuresDoNotLeak checks that failing handshakes leave no
+// goroutines behind
+func TestHandshakeFailuresDoNotLeak(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  StaticCredentials{"user": "pass"},
+	}
+	addr := serveProxy(t, p)
+	failures := []struct {
+		name string
+		data []byte
+	}{
+		{"no acceptable method", []byte{0x05, 0x01, 0x00}},
+		{"invalid version", []byte{0x01, 0x02, 0x03}},
+		{"wrong password", []byte{0x05, 0x01, 0x02}},
+		{"closed during the handshake", nil},
+	}
+	fail := func(i int) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		f := failures[i%len(failures)]
+		if f.data == nil {
+			if _, err := conn.Write([]byte{0x05}); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		if _, err := conn.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+		if f.name == "wrong password" {
+			if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write([]byte{0x01, 4, 'u', 's', 'e', 'r', 5, 'w', 'r', 'o', 'n', 'g'}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+	}
+
+	// the first connections start the long running goroutines of the
+	// runtime and the proxy
+	for i := 0; i < len(failures); i++ {
+		fail(i)
+	}
+	waitFor(t, func() bool { return p.Stats().ActiveConnections == 0 })
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		fail(i)
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
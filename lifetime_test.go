@@ -0,0 +1,128 @@
+package socks_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+func TestMaxSessionDurationTCP(t *testing.T) {
+	clock := sockstest.NewFakeClock(time.Now())
+	p := &socks.Proxy{
+		Proxyhandler:       sockstest.NewMockHandler(),
+		Timeout:            time.Second,
+		MaxSessionDuration: time.Hour,
+		Clock:              clock,
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan socks.SessionStats, 1)
+	go func() {
+		// the session is closed by the proxy, the copy error is expected
+		stats, _ := p.Relay(context.Background(), server, socks.Request{
+			Version:            socks.Version5,
+			Command:            socks.RequestCmdConnect,
+			AddressType:        socks.RequestAddressTypeIPv4,
+			DestinationAddress: net.IPv4(127, 0, 0, 1).To4(),
+			DestinationPort:    80,
+		})
+		done <- stats
+	}()
+	echo(t, client)
+
+	clock.Advance(59 * time.Minute)
+	echo(t, client)
+	clock.Advance(time.Minute)
+
+	select {
+	case stats := <-done:
+		if stats.CloseReason != socks.CloseReasonMaxLifetime {
+			t.Fatalf("got close reason %s, want %s", stats.CloseReason, socks.CloseReasonMaxLifetime)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not closed after MaxSessionDuration")
+	}
+}
+
+// udpEchoServer echoes every datagram and returns the address
+func udpEchoServer(t *testing.T) net.Addr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteToUDP(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+func TestMaxSessionDurationUDP(t *testing.T) {
+	clock := sockstest.NewFakeClock(time.Now())
+	var mu sync.Mutex
+	var stats *socks.SessionStats
+	p := &socks.Proxy{
+		Proxyhandler:       &socks.DefaultHandler{Timeout: time.Second},
+		Timeout:            time.Second,
+		MaxSessionDuration: time.Hour,
+		// longer than the session so only the lifetime ends it
+		UDPIdleTimeout: 2 * time.Hour,
+		Clock:          clock,
+		// the policy runs in the context of the association
+		Policy: func(ctx context.Context, _ socks.Request) socks.PolicyDecision {
+			mu.Lock()
+			stats, _ = socks.StatsFromContext(ctx)
+			mu.Unlock()
+			return socks.PolicyAllow()
+		},
+	}
+	client := &socks.Client{ProxyAddr: serve(t, p), Timeout: 5 * time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	target := udpEchoServer(t)
+	if _, err := conn.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("association was not closed after MaxSessionDuration")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if stats == nil {
+		t.Fatal("policy was not called")
+	}
+	if stats.CloseReason != socks.CloseReasonMaxLifetime {
+		t.Fatalf("got close reason %s, want %s", stats.CloseReason, socks.CloseReasonMaxLifetime)
+	}
+}
@@ -0,0 +1,42 @@
+package socks
+
+import (
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultErrorReplyLinger is used if ErrorReplyLinger is not set
+const defaultErrorReplyLinger = 100 * time.Millisecond
+
+// maxLingerDrain limits the data read from the client while lingering
+const maxLingerDrain = 64 << 10
+
+// lingerAfterErrorReply half-closes the client connection after an error
+// reply and reads what the client still sends for up to ErrorReplyLinger.
+// Closing a socket with unread data sends a RST, which can make the client
+// drop the reply before reading it
+func (p *Proxy) lingerAfterErrorReply(conn io.ReadWriteCloser) {
+	linger := p.ErrorReplyLinger
+	if linger == 0 {
+		linger = defaultErrorReplyLinger
+	}
+	if linger < 0 {
+		return
+	}
+	c, ok := extractNetConn(conn)
+	if !ok {
+		return
+	}
+	if cw, ok := c.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			log.Debugf("could not half-close client connection: %v", err)
+		}
+	}
+	if err := c.SetReadDeadline(time.Now().Add(linger)); err != nil {
+		return
+	}
+	// ends with the deadline or when the client closes the connection
+	_, _ = io.Copy(io.Discard, io.LimitReader(c, maxLingerDrain))
+}
@@ -0,0 +1,44 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestErrorReplyLingerSlowReader sends more data after a request the proxy
+// rejects and reads the reply only later. Closing the connection with the
+// unread data would reset it and drop the reply
+func TestErrorReplyLingerSlowReader(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler:     &DefaultHandler{Timeout: time.Second},
+		Timeout:          time.Second,
+		ErrorReplyLinger: time.Second,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	bind := []byte{0x05, byte(RequestCmdBind), 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50}
+	if _, err := conn.Write(bind); err != nil {
+		t.Fatal(err)
+	}
+	// the data of the tunnel the client expected
+	time.Sleep(20 * time.Millisecond)
+	if _, err := conn.Write(bytes.Repeat([]byte("x"), 4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if reply := readReplyReason(t, conn); reply != RequestReplyCommandNotSupported {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplyCommandNotSupported)
+	}
+	// the proxy half-closed the connection after the reply
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(io.Discard, conn); n != 0 || err != nil {
+		t.Fatalf("got %d bytes and error %v after the reply, want EOF", n, err)
+	}
+	if _, err := conn.Write([]byte("more")); err != nil {
+		t.Fatalf("connection was closed during the linger: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultLogSampleInterval = 1 * time.Minute
+
+// logSampler counts identical log messages per interval
+type logSampler struct {
+	mu      sync.Mutex
+	entries map[string]*sampleEntry
+}
+
+type sampleEntry struct {
+	count      int
+	suppressed int
+}
+
+// logSampled logs the message unless the same format and reason were logged
+// more than LogSampleLimit times in the current interval. Suppressed messages
+// are summarized once the interval ends. Messages of different tenants are
+// counted separately
+func (p *Proxy) logSampled(ctx context.Context, level log.Level, reason interface{}, format string, args ...interface{}) {
+	entry := logEntry(ctx)
+	if p.LogSampleLimit <= 0 {
+		entry.Logf(level, format, args...)
+		return
+	}
+	tenant, _ := TenantFromContext(ctx)
+	key := fmt.Sprintf("%s|%v|%s", format, reason, tenant)
+
+	p.logSampler.mu.Lock()
+	if p.logSampler.entries == nil {
+		p.logSampler.entries = make(map[string]*sampleEntry)
+	}
+	sample, ok := p.logSampler.entries[key]
+	if !ok {
+		sample = &sampleEntry{}
+		p.logSampler.entries[key] = sample
+		// the entry is dropped at the end of the interval and a summary is
+		// logged if messages were suppressed
+		time.AfterFunc(p.logSampleInterval(), func() {
+			p.flushSampled(entry, level, key, format)
+		})
+	}
+	sample.count++
+	suppress := sample.count > p.LogSampleLimit
+	if suppress {
+		sample.suppressed++
+	}
+	p.logSampler.mu.Unlock()
+
+	if suppress {
+		atomic.AddInt64(&p.suppressedLogs, 1)
+		return
+	}
+	entry.Logf(level, format, args...)
+}
+
+func (p *Proxy) flushSampled(logger *log.Entry, level log.Level, key, format string) {
+	p.logSampler.mu.Lock()
+	sample := p.logSampler.entries[key]
+	delete(p.logSampler.entries, key)
+	p.logSampler.mu.Unlock()
+
+	if sample != nil && sample.suppressed > 0 {
+		logger.Logf(level, "suppressed %d similar messages: %q", sample.suppressed, format)
+	}
+}
+
+func (p *Proxy) logSampleInterval() time.Duration {
+	if p.LogSampleInterval > 0 {
+		return p.LogSampleInterval
+	}
+	return defaultLogSampleInterval
+}
@@ -0,0 +1,206 @@
+// Package http provides a JSON over HTTP management API for a socks proxy.
+// All requests need a bearer token in the Authorization header. Client
+// certificates can be required in addition by setting TLSConfig.
+//
+//	GET    /api/sessions             list the established sessions
+//	DELETE /api/sessions/{id}        close a session
+//	GET    /api/stats                proxy counters
+//	POST   /api/acl/reload           reload the ACL from ACLFile
+//	POST   /api/credentials/reload   reload the credentials from CredentialsFile
+package http
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server is the management API of a proxy
+type Server struct {
+	// Proxy is the managed proxy
+	Proxy *socks.Proxy
+	// Token is the bearer token required for all requests
+	Token string
+	// ACLFile is read on ACL reloads. Reloading is disabled if empty
+	ACLFile string
+	// CredentialsFile is read on credential reloads. Reloading is disabled
+	// if empty
+	CredentialsFile string
+	// TLSConfig enables TLS for ListenAndServe and Serve if set. Use
+	// ClientCertTLSConfig to only allow clients with a certificate
+	TLSConfig *tls.Config
+
+	mux *nethttp.ServeMux
+}
+
+// New creates a management API for the proxy. token must not be empty
+func New(p *socks.Proxy, token string) (*Server, error) {
+	if token == "" {
+		return nil, fmt.Errorf("a token is required")
+	}
+	s := &Server{
+		Proxy: p,
+		Token: token,
+	}
+	s.mux = nethttp.NewServeMux()
+	s.mux.HandleFunc("/api/sessions", s.handleSessions)
+	s.mux.HandleFunc("/api/sessions/", s.handleSession)
+	s.mux.HandleFunc("/api/stats", s.handleStats)
+	s.mux.HandleFunc("/api/acl/reload", s.handleACLReload)
+	s.mux.HandleFunc("/api/credentials/reload", s.handleCredentialsReload)
+	return s, nil
+}
+
+// ClientCertTLSConfig returns a tls config serving cert which requires a
+// client certificate signed by one of clientCAs
+func ClientCertTLSConfig(cert tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ListenAndServe serves the API on addr until an error occurs
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the API on l until an error occurs. The connections use TLS
+// if TLSConfig is set
+func (s *Server) Serve(l net.Listener) error {
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	srv := &nethttp.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return srv.Serve(l)
+}
+
+// ServeHTTP checks the token and dispatches the request
+func (s *Server) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, nethttp.StatusUnauthorized, "unauthorized")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *nethttp.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	token := strings.TrimPrefix(auth, prefix)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *Server) handleSessions(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodGet {
+		writeError(w, nethttp.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sessions := s.Proxy.Sessions()
+	if sessions == nil {
+		sessions = []socks.SessionInfo{}
+	}
+	writeJSON(w, nethttp.StatusOK, sessions)
+}
+
+func (s *Server) handleSession(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodDelete {
+		writeError(w, nethttp.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), 10, 64)
+	if err != nil {
+		writeError(w, nethttp.StatusBadRequest, "invalid session id")
+		return
+	}
+	if !s.Proxy.CloseSession(id) {
+		writeError(w, nethttp.StatusNotFound, "session not found")
+		return
+	}
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+func (s *Server) handleStats(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodGet {
+		writeError(w, nethttp.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, nethttp.StatusOK, s.Proxy.Stats())
+}
+
+func (s *Server) handleACLReload(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodPost {
+		writeError(w, nethttp.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.ACLFile == "" {
+		writeError(w, nethttp.StatusConflict, "no acl file configured")
+		return
+	}
+	acl, err := socks.LoadACLFile(s.ACLFile)
+	if err != nil {
+		log.Errorf("could not reload acl: %v", err)
+		writeError(w, nethttp.StatusInternalServerError, "could not load acl file")
+		return
+	}
+	s.Proxy.SetACL(acl)
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+func (s *Server) handleCredentialsReload(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodPost {
+		writeError(w, nethttp.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.CredentialsFile == "" {
+		writeError(w, nethttp.StatusConflict, "no credentials file configured")
+		return
+	}
+	creds, err := socks.LoadCredentialsFile(s.CredentialsFile)
+	if err != nil {
+		log.Errorf("could not reload credentials: %v", err)
+		writeError(w, nethttp.StatusInternalServerError, "could not load credentials file")
+		return
+	}
+	s.Proxy.SetCredentials(creds)
+	w.WriteHeader(nethttp.StatusNoContent)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w nethttp.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+func writeJSON(w nethttp.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("could not write management response: %v", err)
+	}
+}
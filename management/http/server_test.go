@@ -0,0 +1,372 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+// newTestServer serves the management API of p with the token "secret"
+func newTestServer(t *testing.T, p *socks.Proxy) (*Server, *httptest.Server) {
+	t.Helper()
+	s, err := New(p, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// call sends an authenticated request and decodes the JSON response into v
+// if v is not nil. It returns the status code
+func call(t *testing.T, ts *httptest.Server, method, path string, v interface{}) int {
+	t.Helper()
+	req, err := nethttp.NewRequest(method, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("got content type %q, want application/json", ct)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// startSession serves p and establishes a session through it
+func startSession(t *testing.T, p *socks.Proxy) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+	t.Cleanup(func() { p.Close() })
+
+	client := &socks.Client{ProxyAddr: l.Addr().String(), Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// the session is registered once data is relayed
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, ts := newTestServer(t, &socks.Proxy{})
+	for _, auth := range []string{"", "Bearer wrong", "Basic c2VjcmV0", "secret"} {
+		t.Run(auth, func(t *testing.T) {
+			req, err := nethttp.NewRequest(nethttp.MethodGet, ts.URL+"/api/stats", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != nethttp.StatusUnauthorized {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, nethttp.StatusUnauthorized)
+			}
+			if resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Fatalf("got WWW-Authenticate %q, want Bearer", resp.Header.Get("WWW-Authenticate"))
+			}
+			var e errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Error != "unauthorized" {
+				t.Fatalf("got error %q, want unauthorized", e.Error)
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	p := &socks.Proxy{Proxyhandler: sockstest.NewMockHandler(), Timeout: time.Second}
+	_, ts := newTestServer(t, p)
+
+	var sessions []socks.SessionInfo
+	if status := call(t, ts, nethttp.MethodGet, "/api/sessions", &sessions); status != nethttp.StatusOK {
+		t.Fatalf("got status %d, want %d", status, nethttp.StatusOK)
+	}
+	if sessions == nil || len(sessions) != 0 {
+		t.Fatalf("got sessions %v, want an empty list", sessions)
+	}
+
+	conn := startSession(t, p)
+	if status := call(t, ts, nethttp.MethodGet, "/api/sessions", &sessions); status != nethttp.StatusOK {
+		t.Fatalf("got status %d, want %d", status, nethttp.StatusOK)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if sessions[0].Destination != "127.0.0.1:80" || sessions[0].ClientAddr != conn.LocalAddr().String() {
+		t.Fatalf("got session %+v", sessions[0])
+	}
+	if sessions[0].BytesClientToRemote != 4 {
+		t.Fatalf("got %d bytes from the client, want 4", sessions[0].BytesClientToRemote)
+	}
+
+	if status := call(t, ts, nethttp.MethodPost, "/api/sessions", nil); status != nethttp.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, want %d", status, nethttp.StatusMethodNotAllowed)
+	}
+}
+
+func TestKillSession(t *testing.T) {
+	p := &socks.Proxy{Proxyhandler: sockstest.NewMockHandler(), Timeout: time.Second}
+	_, ts := newTestServer(t, p)
+	conn := startSession(t, p)
+	id := p.Sessions()[0].ID
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{nethttp.MethodGet, fmt.Sprintf("/api/sessions/%d", id), nethttp.StatusMethodNotAllowed},
+		{nethttp.MethodDelete, "/api/sessions/abc", nethttp.StatusBadRequest},
+		{nethttp.MethodDelete, fmt.Sprintf("/api/sessions/%d", id+1), nethttp.StatusNotFound},
+		{nethttp.MethodDelete, fmt.Sprintf("/api/sessions/%d", id), nethttp.StatusNoContent},
+	}
+	for _, tt := range tests {
+		var e errorResponse
+		var v interface{}
+		if tt.status != nethttp.StatusNoContent {
+			v = &e
+		}
+		if status := call(t, ts, tt.method, tt.path, v); status != tt.status {
+			t.Fatalf("%s %s: got status %d, want %d", tt.method, tt.path, status, tt.status)
+		}
+		if v != nil && e.Error == "" {
+			t.Fatalf("%s %s: no error message", tt.method, tt.path)
+		}
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v after killing the session, want EOF", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	p := &socks.Proxy{Proxyhandler: sockstest.NewMockHandler(), Timeout: time.Second}
+	_, ts := newTestServer(t, p)
+	startSession(t, p)
+
+	var raw map[string]json.RawMessage
+	if status := call(t, ts, nethttp.MethodGet, "/api/stats", &raw); status != nethttp.StatusOK {
+		t.Fatalf("got status %d, want %d", status, nethttp.StatusOK)
+	}
+	for _, key := range []string{"active_connections", "active_sessions", "total_sessions", "handshake_failures", "udp"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("stats have no %s", key)
+		}
+	}
+	var stats socks.ProxyStats
+	if status := call(t, ts, nethttp.MethodGet, "/api/stats", &stats); status != nethttp.StatusOK {
+		t.Fatalf("got status %d, want %d", status, nethttp.StatusOK)
+	}
+	if stats.ActiveSessions != 1 || stats.TotalSessions != 1 || stats.ActiveConnections != 1 {
+		t.Fatalf("got stats %+v, want one active session", stats)
+	}
+
+	if status := call(t, ts, nethttp.MethodDelete, "/api/stats", nil); status != nethttp.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, want %d", status, nethttp.StatusMethodNotAllowed)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	aclFile := filepath.Join(dir, "acl")
+	if err := os.WriteFile(aclFile, []byte("default deny\nallow 10.0.0.0/8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	credentialsFile := filepath.Join(dir, "users")
+	if err := os.WriteFile(credentialsFile, []byte("alice:secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &socks.Proxy{}
+	s, ts := newTestServer(t, p)
+	for _, path := range []string{"/api/acl/reload", "/api/credentials/reload"} {
+		var e errorResponse
+		if status := call(t, ts, nethttp.MethodPost, path, &e); status != nethttp.StatusConflict {
+			t.Fatalf("%s without file: got status %d, want %d", path, status, nethttp.StatusConflict)
+		}
+	}
+
+	s.ACLFile = aclFile
+	s.CredentialsFile = credentialsFile
+	for _, path := range []string{"/api/acl/reload", "/api/credentials/reload"} {
+		if status := call(t, ts, nethttp.MethodGet, path, nil); status != nethttp.StatusMethodNotAllowed {
+			t.Fatalf("GET %s: got status %d, want %d", path, status, nethttp.StatusMethodNotAllowed)
+		}
+		if status := call(t, ts, nethttp.MethodPost, path, nil); status != nethttp.StatusNoContent {
+			t.Fatalf("%s: got status %d, want %d", path, status, nethttp.StatusNoContent)
+		}
+	}
+	if p.ACL == nil || p.ACL.Allowed(net.ParseIP("192.0.2.1")) || !p.ACL.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Fatal("the acl was not reloaded")
+	}
+	if p.CurrentCredentials() == nil || !p.CurrentCredentials().Valid("alice", "secret") {
+		t.Fatal("the credentials were not reloaded")
+	}
+
+	if err := os.WriteFile(aclFile, []byte("permit everything\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var e errorResponse
+	if status := call(t, ts, nethttp.MethodPost, "/api/acl/reload", &e); status != nethttp.StatusInternalServerError {
+		t.Fatalf("invalid acl file: got status %d, want %d", status, nethttp.StatusInternalServerError)
+	}
+}
+
+// testCA signs certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate signed by the ca for 127.0.0.1 with the
+// given usage
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	s, err := New(&socks.Proxy{}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TLSConfig = ClientCertTLSConfig(ca.issue(t, "management", x509.ExtKeyUsageServerAuth), ca.pool)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	get := func(certs ...tls.Certificate) (*nethttp.Response, error) {
+		client := &nethttp.Client{
+			Timeout: 5 * time.Second,
+			Transport: &nethttp.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: ca.pool, Certificates: certs},
+			},
+		}
+		defer client.CloseIdleConnections()
+		req, err := nethttp.NewRequest(nethttp.MethodGet, "https://"+l.Addr().String()+"/api/stats", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		return client.Do(req)
+	}
+
+	resp, err := get(ca.issue(t, "operator", x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, nethttp.StatusOK)
+	}
+
+	if resp, err := get(); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request without client certificate got status %d", resp.StatusCode)
+	}
+
+	other := newTestCA(t)
+	if resp, err := get(other.issue(t, "operator", x509.ExtKeyUsageClientAuth)); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request with certificate of another ca got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,110 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natMapper maps every address to the same port on a documentation address
+// and remembers the addresses it was called with
+type natMapper struct {
+	mu    sync.Mutex
+	local []net.Addr
+	err   error
+}
+
+var natIP = net.IPv4(203, 0, 113, 5)
+
+func (m *natMapper) mapAddress(local net.Addr) (net.Addr, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.local = append(m.local, local)
+	if m.err != nil {
+		return nil, m.err
+	}
+	switch a := local.(type) {
+	case *net.TCPAddr:
+		return &net.TCPAddr{IP: natIP, Port: a.Port}, nil
+	case *net.UDPAddr:
+		return &net.UDPAddr{IP: natIP, Port: a.Port}, nil
+	default:
+		return nil, errors.New("unexpected address type")
+	}
+}
+
+func (m *natMapper) called(tb testing.TB) net.Addr {
+	tb.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.local) != 1 {
+		tb.Fatalf("mapper was called %d times, want once", len(m.local))
+	}
+	return m.local[0]
+}
+
+func TestAddressMapperConnect(t *testing.T) {
+	mapper := &natMapper{}
+	p := &Proxy{
+		Proxyhandler:  &DefaultHandler{Timeout: time.Second},
+		Timeout:       time.Second,
+		AddressMapper: mapper.mapAddress,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", lineServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	local, ok := mapper.called(t).(*net.TCPAddr)
+	if !ok || !local.IP.IsLoopback() {
+		t.Fatalf("mapper got %v, want the local address of the outgoing connection", mapper.called(t))
+	}
+	want := &net.TCPAddr{IP: natIP, Port: local.Port}
+	if got := conn.(*ClientConn).BoundAddr(); got.String() != want.String() {
+		t.Fatalf("got bound address %v, want %v", got, want)
+	}
+}
+
+func TestAddressMapperUDPAssociate(t *testing.T) {
+	mapper := &natMapper{}
+	p := &Proxy{
+		Proxyhandler:  &DefaultHandler{Timeout: time.Second},
+		Timeout:       time.Second,
+		AddressMapper: mapper.mapAddress,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: 5 * time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local, ok := mapper.called(t).(*net.UDPAddr)
+	if !ok || !local.IP.IsLoopback() {
+		t.Fatalf("mapper got %v, want the address of the udp relay", mapper.called(t))
+	}
+	want := &net.UDPAddr{IP: natIP, Port: local.Port}
+	if got := conn.(*ClientPacketConn).RelayAddr(); got.String() != want.String() {
+		t.Fatalf("got relay address %v, want %v", got, want)
+	}
+}
+
+func TestAddressMapperError(t *testing.T) {
+	mapper := &natMapper{err: errors.New("no external address")}
+	p := &Proxy{
+		Proxyhandler:  &DefaultHandler{Timeout: time.Second},
+		Timeout:       time.Second,
+		AddressMapper: mapper.mapAddress,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reason := sendRequest(t, conn, lineServer(t)); reason != RequestReplyGeneralFailure {
+		t.Fatalf("got reply %s, want %s", reason, RequestReplyGeneralFailure)
+	}
+	mapper.called(t)
+}
@@ -0,0 +1,104 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// selectMethod picks the authentication method from the methods offered by
+// the client. It uses AuthMethodSelector if set and checks that the proxy
+// can run the selected method
+func (p *Proxy) selectMethod(ctx context.Context, offered []Methods, creds CredentialStore) (Methods, error) {
+	client, _ := ClientAddrFromContext(ctx)
+	if p.AuthMethodSelector == nil {
+		if preference := p.methodPreference(client); preference != nil {
+			return preferredMethod(preference, offered, creds)
+		}
+		return defaultMethodSelector(offered, creds)
+	}
+
+	method, err := p.AuthMethodSelector(client, offered)
+	if err != nil {
+		return MethodNoAcceptableMethods, err
+	}
+	switch method {
+	case MethodNoAuthRequired:
+	case MethodUsernamePassword:
+		if creds == nil {
+			return MethodNoAcceptableMethods, fmt.Errorf("selected method %s but no credentials are configured", method)
+		}
+	case MethodNoAcceptableMethods:
+		return MethodNoAcceptableMethods, fmt.Errorf("selector accepted none of the offered methods %v", offered)
+	default:
+		return MethodNoAcceptableMethods, fmt.Errorf("selected method %s is not implemented", method)
+	}
+	if !containsMethod(offered, method) {
+		return MethodNoAcceptableMethods, fmt.Errorf("selected method %s was not offered by the client", method)
+	}
+	return method, nil
+}
+
+// defaultMethodSelector requires username/password authentication if
+// credentials are configured and no authentication otherwise
+func defaultMethodSelector(offered []Methods, creds CredentialStore) (Methods, error) {
+	var method Methods = MethodNoAuthRequired
+	if creds != nil {
+		method = MethodUsernamePassword
+	}
+	if !containsMethod(offered, method) {
+		return MethodNoAcceptableMethods, fmt.Errorf("client does not support method %s", method)
+	}
+	return method, nil
+}
+
+// methodPreference returns the method preference for the client. It is nil
+// if no preference is configured
+func (p *Proxy) methodPreference(client net.Addr) []Methods {
+	if p.ClientMethodPreference != nil {
+		if preference := p.ClientMethodPreference(client); preference != nil {
+			return preference
+		}
+	}
+	return p.MethodPreference
+}
+
+// preferredMethod picks the first method of the preference the client
+// offered. Username/password is skipped if no credentials are configured and
+// methods the proxy does not implement are ignored
+func preferredMethod(preference, offered []Methods, creds CredentialStore) (Methods, error) {
+	for _, method := range preference {
+		switch method {
+		case MethodNoAuthRequired:
+		case MethodUsernamePassword:
+			if creds == nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if containsMethod(offered, method) {
+			return method, nil
+		}
+	}
+	return MethodNoAcceptableMethods, fmt.Errorf("client offered none of the preferred methods %v", preference)
+}
+
+// PreferNoAuthFromLoopback is an AuthMethodSelector that lets clients on the
+// loopback interface skip the authentication if they offer it. Other clients
+// must use username/password authentication
+func PreferNoAuthFromLoopback(client net.Addr, offered []Methods) (Methods, error) {
+	if tcp, ok := client.(*net.TCPAddr); ok && tcp.IP.IsLoopback() && containsMethod(offered, MethodNoAuthRequired) {
+		return MethodNoAuthRequired, nil
+	}
+	return MethodUsernamePassword, nil
+}
+
+func containsMethod(methods []Methods, method Methods) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
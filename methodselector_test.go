@@ -0,0 +1,154 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// selectedMethod offers methods to the proxy at addr and returns the method
+// selected by the proxy
+func selectedMethod(t *testing.T, addr string, methods ...Methods) Methods {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	greeting := []byte{byte(Version5), byte(len(methods))}
+	for _, m := range methods {
+		greeting = append(greeting, byte(m))
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return Methods(reply[1])
+}
+
+func TestAuthMethodSelector(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		got     []Methods
+		gotAddr net.Addr
+	)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  StaticCredentials{"user": "pass"},
+		AuthMethodSelector: func(client net.Addr, offered []Methods) (Methods, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append([]Methods(nil), offered...)
+			gotAddr = client
+			return MethodNoAuthRequired, nil
+		},
+	}
+	addr := serveProxy(t, p)
+	if method := selectedMethod(t, addr, MethodUsernamePassword, MethodNoAuthRequired); method != MethodNoAuthRequired {
+		t.Fatalf("got method %s, want %s", method, Methods(MethodNoAuthRequired))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []Methods{MethodUsernamePassword, MethodNoAuthRequired}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("selector got offered methods %v, want %v", got, want)
+	}
+	if tcp, ok := gotAddr.(*net.TCPAddr); !ok || !tcp.IP.IsLoopback() {
+		t.Fatalf("selector got client address %v", gotAddr)
+	}
+}
+
+func TestAuthMethodSelectorRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector func(net.Addr, []Methods) (Methods, error)
+	}{
+		{"not offered", func(net.Addr, []Methods) (Methods, error) { return MethodUsernamePassword, nil }},
+		{"not implemented", func(net.Addr, []Methods) (Methods, error) { return MethodGSSAPI, nil }},
+		{"error", func(net.Addr, []Methods) (Methods, error) { return MethodNoAuthRequired, errors.New("denied") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{
+				Proxyhandler:       &DefaultHandler{Timeout: time.Second},
+				Timeout:            time.Second,
+				Credentials:        StaticCredentials{"user": "pass"},
+				AuthMethodSelector: tt.selector,
+			}
+			if method := selectedMethod(t, serveProxy(t, p), MethodNoAuthRequired, MethodGSSAPI); method != MethodNoAcceptableMethods {
+				t.Fatalf("got method %s, want %s", method, Methods(MethodNoAcceptableMethods))
+			}
+		})
+	}
+}
+
+func TestMethodPreference(t *testing.T) {
+	creds := StaticCredentials{"user": "pass"}
+	loopbackNeedsAuth := func(client net.Addr) []Methods {
+		if tcp, ok := client.(*net.TCPAddr); ok && tcp.IP.IsLoopback() {
+			return []Methods{MethodUsernamePassword}
+		}
+		return nil
+	}
+	noOverride := func(net.Addr) []Methods { return nil }
+	tests := []struct {
+		name       string
+		preference []Methods
+		override   func(net.Addr) []Methods
+		creds      CredentialStore
+		offered    []Methods
+		want       Methods
+	}{
+		{"prefer auth", []Methods{MethodUsernamePassword, MethodNoAuthRequired}, nil, creds, []Methods{MethodNoAuthRequired, MethodUsernamePassword}, MethodUsernamePassword},
+		{"prefer no auth", []Methods{MethodNoAuthRequired, MethodUsernamePassword}, nil, creds, []Methods{MethodUsernamePassword, MethodNoAuthRequired}, MethodNoAuthRequired},
+		{"fallback", []Methods{MethodUsernamePassword, MethodNoAuthRequired}, nil, creds, []Methods{MethodNoAuthRequired}, MethodNoAuthRequired},
+		{"auth without credentials", []Methods{MethodUsernamePassword, MethodNoAuthRequired}, nil, nil, []Methods{MethodNoAuthRequired, MethodUsernamePassword}, MethodNoAuthRequired},
+		{"nothing acceptable", []Methods{MethodUsernamePassword}, nil, creds, []Methods{MethodNoAuthRequired}, MethodNoAcceptableMethods},
+		{"client override", []Methods{MethodNoAuthRequired, MethodUsernamePassword}, loopbackNeedsAuth, creds, []Methods{MethodNoAuthRequired, MethodUsernamePassword}, MethodUsernamePassword},
+		{"client override rejects", []Methods{MethodNoAuthRequired}, loopbackNeedsAuth, creds, []Methods{MethodNoAuthRequired}, MethodNoAcceptableMethods},
+		{"no client override", []Methods{MethodNoAuthRequired, MethodUsernamePassword}, noOverride, creds, []Methods{MethodNoAuthRequired, MethodUsernamePassword}, MethodNoAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{
+				Proxyhandler:           &DefaultHandler{Timeout: time.Second},
+				Timeout:                time.Second,
+				Credentials:            tt.creds,
+				MethodPreference:       tt.preference,
+				ClientMethodPreference: tt.override,
+			}
+			if method := selectedMethod(t, serveProxy(t, p), tt.offered...); method != tt.want {
+				t.Fatalf("got method %s, want %s", method, tt.want)
+			}
+		})
+	}
+}
+
+// TestMethodPreferenceSession checks that the selected method is shown in
+// the session list
+func TestMethodPreferenceSession(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler:     &DefaultHandler{Timeout: time.Second},
+		Timeout:          time.Second,
+		Credentials:      StaticCredentials{"user": "pass"},
+		MethodPreference: []Methods{MethodUsernamePassword, MethodNoAuthRequired},
+	}
+	conn := dialProxy(t, serveProxy(t, p), "user", "pass")
+	if reply := sendRequest(t, conn, lineServer(t)); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	waitFor(t, func() bool { return len(p.Sessions()) == 1 })
+	if method, want := p.Sessions()[0].Method, Methods(MethodUsernamePassword).String(); method != want {
+		t.Fatalf("got method %q in the session list, want %q", method, want)
+	}
+}
@@ -0,0 +1,56 @@
+package socks
+
+import (
+	"time"
+)
+
+// Metrics receives the metrics of the proxy, for example to export them to a
+// monitoring system. Implementations must be safe for concurrent use and
+// should not block
+type Metrics interface {
+	// IncConnections is called for every accepted client connection
+	IncConnections()
+	// AddBytes is called with the transferred bytes when a session ends
+	AddBytes(clientToRemote, remoteToClient int64)
+	// ObserveHandshakeDuration is called with the time from the start of the
+	// session until the success reply was sent
+	ObserveHandshakeDuration(d time.Duration)
+	// ObserveDialDuration is called with the time the handler needed to
+	// connect to the destination, including failed attempts
+	ObserveDialDuration(d time.Duration)
+	// IncMethodAdvertised is called for every authentication method a
+	// client offers in its greeting
+	IncMethodAdvertised(method Methods)
+	// IncMethodSelected is called with the method the proxy selected,
+	// MethodNoAcceptableMethods if none of the offered methods is supported
+	IncMethodSelected(method Methods)
+	// IncError is called with the reason of every error reply sent to a
+	// client
+	IncError(reason RequestReplyReason)
+}
+
+// nopMetrics is used if Proxy.Metrics is not set
+type nopMetrics struct{}
+
+func (nopMetrics) IncConnections()                               {}
+func (nopMetrics) AddBytes(clientToRemote, remoteToClient int64) {}
+func (nopMetrics) ObserveHandshakeDuration(d time.Duration)      {}
+func (nopMetrics) ObserveDialDuration(d time.Duration)           {}
+func (nopMetrics) IncMethodAdvertised(method Methods)            {}
+func (nopMetrics) IncMethodSelected(method Methods)              {}
+func (nopMetrics) IncError(reason RequestReplyReason)            {}
+
+func (p *Proxy) metrics() Metrics {
+	if p.Metrics != nil {
+		return p.Metrics
+	}
+	return nopMetrics{}
+}
+
+// handshakeDone marks the handshake of the session as finished, releases the
+// handshake slot and records the duration
+func (p *Proxy) handshakeDone(stats *SessionStats) {
+	stats.HandshakePhase = HandshakePhaseDone
+	p.releaseHandshake(stats)
+	p.metrics().ObserveHandshakeDuration(p.clock().Now().Sub(stats.started))
+}
@@ -0,0 +1,142 @@
+// Package prometheus exports the metrics of a gosocks proxy to Prometheus.
+// It is a separate module so the Prometheus client is only needed if it is
+// used
+package prometheus
+
+import (
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultBuckets are the histogram buckets in seconds used for the
+// handshake and dial durations if Options does not set them
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Options configures the exported metrics
+type Options struct {
+	// Namespace is prepended to the metric names. Defaults to gosocks
+	Namespace string
+	// HandshakeBuckets are the buckets of the handshake duration histogram
+	// in seconds. Defaults to DefaultBuckets
+	HandshakeBuckets []float64
+	// DialBuckets are the buckets of the dial duration histogram in
+	// seconds. Defaults to DefaultBuckets
+	DialBuckets []float64
+}
+
+// Metrics implements socks.Metrics with Prometheus counters and histograms
+type Metrics struct {
+	connections       prom.Counter
+	bytes             *prom.CounterVec
+	handshakeDuration prom.Histogram
+	dialDuration      prom.Histogram
+	methodsAdvertised *prom.CounterVec
+	methodsSelected   *prom.CounterVec
+	errors            *prom.CounterVec
+}
+
+var _ socks.Metrics = (*Metrics)(nil)
+
+// New creates the metrics and registers them with reg. Use it as
+// Proxy.Metrics
+func New(reg prom.Registerer, opts *Options) (*Metrics, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = "gosocks"
+	}
+	handshakeBuckets := opts.HandshakeBuckets
+	if handshakeBuckets == nil {
+		handshakeBuckets = DefaultBuckets
+	}
+	dialBuckets := opts.DialBuckets
+	if dialBuckets == nil {
+		dialBuckets = DefaultBuckets
+	}
+
+	m := &Metrics{
+		connections: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_total",
+			Help:      "Accepted client connections.",
+		}),
+		bytes: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "transferred_bytes_total",
+			Help:      "Bytes relayed between clients and remotes by direction.",
+		}, []string{"direction"}),
+		handshakeDuration: prom.NewHistogram(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handshake_duration_seconds",
+			Help:      "Time from the start of a session until the success reply was sent.",
+			Buckets:   handshakeBuckets,
+		}),
+		dialDuration: prom.NewHistogram(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dial_duration_seconds",
+			Help:      "Time the handler needed to connect to the destination.",
+			Buckets:   dialBuckets,
+		}),
+		methodsAdvertised: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_methods_advertised_total",
+			Help:      "Authentication methods offered by clients.",
+		}, []string{"method"}),
+		methodsSelected: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_methods_selected_total",
+			Help:      "Authentication methods selected by the proxy.",
+		}, []string{"method"}),
+		errors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "error_replies_total",
+			Help:      "Error replies sent to clients by reason.",
+		}, []string{"reason"}),
+	}
+	for _, c := range []prom.Collector{m.connections, m.bytes, m.handshakeDuration, m.dialDuration, m.methodsAdvertised, m.methodsSelected, m.errors} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// IncConnections counts an accepted client connection
+func (m *Metrics) IncConnections() {
+	m.connections.Inc()
+}
+
+// AddBytes adds the transferred bytes of a session
+func (m *Metrics) AddBytes(clientToRemote, remoteToClient int64) {
+	m.bytes.WithLabelValues("client_to_remote").Add(float64(clientToRemote))
+	m.bytes.WithLabelValues("remote_to_client").Add(float64(remoteToClient))
+}
+
+// ObserveHandshakeDuration records the duration of a handshake
+func (m *Metrics) ObserveHandshakeDuration(d time.Duration) {
+	m.handshakeDuration.Observe(d.Seconds())
+}
+
+// ObserveDialDuration records the duration of a dial
+func (m *Metrics) ObserveDialDuration(d time.Duration) {
+	m.dialDuration.Observe(d.Seconds())
+}
+
+// IncMethodAdvertised counts a method offered by a client
+func (m *Metrics) IncMethodAdvertised(method socks.Methods) {
+	m.methodsAdvertised.WithLabelValues(method.String()).Inc()
+}
+
+// IncMethodSelected counts the method selected by the proxy
+func (m *Metrics) IncMethodSelected(method socks.Methods) {
+	m.methodsSelected.WithLabelValues(method.String()).Inc()
+}
+
+// IncError counts an error reply
+func (m *Metrics) IncError(reason socks.RequestReplyReason) {
+	m.errors.WithLabelValues(reason.String()).Inc()
+}
@@ -0,0 +1,119 @@
+package prometheus
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// echoServer sends back everything it receives and returns the address
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// gather returns the metric families of reg by name
+func gather(t *testing.T, reg *prom.Registry) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	return byName
+}
+
+func TestHandshake(t *testing.T) {
+	reg := prom.NewRegistry()
+	buckets := []float64{0.01, 0.1, 1}
+	m, err := New(reg, &Options{HandshakeBuckets: buckets, DialBuckets: buckets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := echoServer(t)
+	p := &socks.Proxy{
+		Proxyhandler: &socks.DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Metrics:      m,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+	defer p.Close()
+
+	client := &socks.Client{ProxyAddr: l.Addr().String(), Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the durations are observed before the data is relayed
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gather(t, reg)
+	for _, name := range []string{"gosocks_handshake_duration_seconds", "gosocks_dial_duration_seconds"} {
+		f, ok := families[name]
+		if !ok {
+			t.Fatalf("%s was not exported", name)
+		}
+		h := f.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 1 {
+			t.Errorf("%s has %d samples, want 1", name, h.GetSampleCount())
+		}
+		if len(h.GetBucket()) != len(buckets) {
+			t.Errorf("%s has %d buckets, want %d", name, len(h.GetBucket()), len(buckets))
+		}
+	}
+	if got := families["gosocks_connections_total"].GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Errorf("got %v connections, want 1", got)
+	}
+	selected := families["gosocks_auth_methods_selected_total"].GetMetric()
+	if len(selected) != 1 || selected[0].GetLabel()[0].GetValue() != socks.Methods(socks.MethodNoAuthRequired).String() {
+		t.Errorf("got selected methods %v, want %s", selected, socks.Methods(socks.MethodNoAuthRequired))
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	reg := prom.NewRegistry()
+	if _, err := New(reg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(reg, nil); err == nil {
+		t.Fatal("registered the metrics twice")
+	}
+	if _, err := New(reg, &Options{Namespace: "other"}); err != nil {
+		t.Fatalf("could not register metrics with another namespace: %v", err)
+	}
+}
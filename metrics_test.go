@@ -0,0 +1,213 @@
+package socks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+// recordingMetrics remembers everything the proxy reports
+type recordingMetrics struct {
+	mu         sync.Mutex
+	handshakes []time.Duration
+	dials      []time.Duration
+	advertised map[socks.Methods]int
+	selected   map[socks.Methods]int
+	errors     map[socks.RequestReplyReason]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		advertised: make(map[socks.Methods]int),
+		selected:   make(map[socks.Methods]int),
+		errors:     make(map[socks.RequestReplyReason]int),
+	}
+}
+
+func (m *recordingMetrics) IncConnections()                               {}
+func (m *recordingMetrics) AddBytes(clientToRemote, remoteToClient int64) {}
+
+func (m *recordingMetrics) ObserveHandshakeDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handshakes = append(m.handshakes, d)
+}
+
+func (m *recordingMetrics) ObserveDialDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dials = append(m.dials, d)
+}
+
+func (m *recordingMetrics) IncMethodAdvertised(method socks.Methods) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advertised[method]++
+}
+
+func (m *recordingMetrics) IncMethodSelected(method socks.Methods) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.selected[method]++
+}
+
+func (m *recordingMetrics) IncError(reason socks.RequestReplyReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[reason]++
+}
+
+// serve serves p on a local listener until the test ends and returns the
+// address
+func serve(t *testing.T, p *socks.Proxy) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+	t.Cleanup(func() { p.Close() })
+	return l.Addr().String()
+}
+
+// echo sends data through conn and reads it back from the echo connection
+// of a MockHandler
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsDurations(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	metrics := newRecordingMetrics()
+	p := &socks.Proxy{
+		Proxyhandler: sockstest.NewMockHandler(sockstest.WithPreHandlerDelay(delay)),
+		Timeout:      time.Second,
+		Metrics:      metrics,
+	}
+	client := &socks.Client{ProxyAddr: serve(t, p), Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the durations are recorded before the data is relayed
+	echo(t, conn)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if len(metrics.dials) != 1 || len(metrics.handshakes) != 1 {
+		t.Fatalf("got %d dial and %d handshake durations, want one of each", len(metrics.dials), len(metrics.handshakes))
+	}
+	if metrics.dials[0] < delay {
+		t.Errorf("dial duration %s is shorter than the dial delay %s", metrics.dials[0], delay)
+	}
+	if metrics.handshakes[0] < metrics.dials[0] {
+		t.Errorf("handshake duration %s is shorter than the dial duration %s", metrics.handshakes[0], metrics.dials[0])
+	}
+}
+
+// greet sends a greeting offering methods and returns the selected method
+func greet(t *testing.T, addr string, methods ...byte) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	greeting := append([]byte{byte(socks.Version5), byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		t.Fatal(err)
+	}
+	selection := make([]byte, 2)
+	if _, err := io.ReadFull(conn, selection); err != nil {
+		t.Fatal(err)
+	}
+	return selection[1]
+}
+
+func TestMetricsMethods(t *testing.T) {
+	metrics := newRecordingMetrics()
+	p := &socks.Proxy{
+		Proxyhandler: sockstest.NewMockHandler(),
+		Timeout:      time.Second,
+		Metrics:      metrics,
+	}
+	addr := serve(t, p)
+
+	if got := greet(t, addr, socks.MethodNoAuthRequired, socks.MethodGSSAPI, socks.MethodUsernamePassword); got != socks.MethodNoAuthRequired {
+		t.Fatalf("got method %#x, want %#x", got, socks.MethodNoAuthRequired)
+	}
+	if got := greet(t, addr, socks.MethodUsernamePassword); got != socks.MethodNoAcceptableMethods {
+		t.Fatalf("got method %#x, want %#x", got, socks.MethodNoAcceptableMethods)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	wantAdvertised := map[socks.Methods]int{
+		socks.MethodNoAuthRequired:   1,
+		socks.MethodGSSAPI:           1,
+		socks.MethodUsernamePassword: 2,
+	}
+	if !reflect.DeepEqual(metrics.advertised, wantAdvertised) {
+		t.Errorf("got advertised methods %v, want %v", metrics.advertised, wantAdvertised)
+	}
+	wantSelected := map[socks.Methods]int{
+		socks.MethodNoAuthRequired:      1,
+		socks.MethodNoAcceptableMethods: 1,
+	}
+	if !reflect.DeepEqual(metrics.selected, wantSelected) {
+		t.Errorf("got selected methods %v, want %v", metrics.selected, wantSelected)
+	}
+}
+
+func TestMetricsErrors(t *testing.T) {
+	metrics := newRecordingMetrics()
+	handler := sockstest.NewMockHandler(sockstest.WithPreHandlerError(&socks.Error{
+		Reason: socks.RequestReplyHostUnreachable,
+		Err:    errors.New("mock dial failed"),
+	}))
+	p := &socks.Proxy{
+		Proxyhandler: handler,
+		Timeout:      time.Second,
+		Metrics:      metrics,
+	}
+	client := &socks.Client{ProxyAddr: serve(t, p), Timeout: 5 * time.Second}
+	for i := 0; i < 2; i++ {
+		if _, err := client.Dial("tcp", "127.0.0.1:80"); err == nil {
+			t.Fatal("dial through a failing handler succeeded")
+		}
+	}
+	if _, err := client.Bind(context.Background(), "127.0.0.1:80"); err == nil {
+		t.Fatal("bind succeeded")
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	want := map[socks.RequestReplyReason]int{
+		socks.RequestReplyHostUnreachable:     2,
+		socks.RequestReplyCommandNotSupported: 1,
+	}
+	if !reflect.DeepEqual(metrics.errors, want) {
+		t.Errorf("got errors %v, want %v", metrics.errors, want)
+	}
+	if handler.PreHandlerCalls() != 2 {
+		t.Errorf("handler was called %d times, want 2", handler.PreHandlerCalls())
+	}
+}
@@ -0,0 +1,335 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+)
+
+// muxDrainInterval is how often a closed MuxListener checks if the streams of
+// a multiplexed connection are done
+const muxDrainInterval = 100 * time.Millisecond
+
+// muxConfig returns the yamux config used on both sides. Errors are returned
+// to the caller so the yamux logging is disabled
+func muxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = io.Discard
+	return cfg
+}
+
+// MuxListener accepts multiplexed connections and returns every stream as a
+// separate connection, so one tcp connection can carry many socks sessions.
+// Use it with Proxy.Serve and MuxClient on the client side.
+type MuxListener struct {
+	listener  net.Listener
+	streams   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMuxListener starts accepting multiplexed connections on the listener
+func NewMuxListener(listener net.Listener) *MuxListener {
+	m := &MuxListener{
+		listener: listener,
+		streams:  make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go m.acceptLoop()
+	return m
+}
+
+func (m *MuxListener) acceptLoop() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+			default:
+				log.Errorf("error accepting mux connection: %v", err)
+				m.Close()
+			}
+			return
+		}
+		go m.serveSession(conn)
+	}
+}
+
+func (m *MuxListener) serveSession(conn net.Conn) {
+	session, err := yamux.Server(conn, muxConfig())
+	if err != nil {
+		log.Errorf("could not start mux session with %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	go m.drainSession(session)
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			log.Debugf("mux session with %s ended: %v", conn.RemoteAddr(), err)
+			session.Close()
+			return
+		}
+		select {
+		case m.streams <- stream:
+		case <-m.done:
+			stream.Close()
+		}
+	}
+}
+
+// drainSession refuses new streams once the listener is closed and closes
+// the session after its established streams are done
+func (m *MuxListener) drainSession(session *yamux.Session) {
+	select {
+	case <-session.CloseChan():
+		return
+	case <-m.done:
+	}
+	if err := session.GoAway(); err != nil {
+		session.Close()
+		return
+	}
+	ticker := time.NewTicker(muxDrainInterval)
+	defer ticker.Stop()
+	for session.NumStreams() > 0 {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+	}
+	session.Close()
+}
+
+// Accept returns the next stream
+func (m *MuxListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-m.streams:
+		return stream, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and streams. Established streams keep
+// working, each multiplexed connection is closed once its streams are done
+func (m *MuxListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the address of the underlying listener
+func (m *MuxListener) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// ServeMuxConn serves every stream of a multiplexed connection as a separate
+// session and blocks until the connection is closed
+func (p *Proxy) ServeMuxConn(conn net.Conn) error {
+	session, err := NewMuxSession(conn, true)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return p.ServeStreams(context.Background(), session)
+}
+
+// MuxSession is a yamux session implementing StreamDialer and
+// StreamListener. The roles are independent of who dialed the connection, a
+// proxy connecting back to a rendezvous server is the server side
+type MuxSession struct {
+	session *yamux.Session
+}
+
+// NewMuxSession starts a yamux session on the connection. Exactly one side
+// of the connection must be the server
+func NewMuxSession(conn net.Conn, server bool) (*MuxSession, error) {
+	var session *yamux.Session
+	var err error
+	if server {
+		session, err = yamux.Server(conn, muxConfig())
+	} else {
+		session, err = yamux.Client(conn, muxConfig())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MuxSession{session: session}, nil
+}
+
+// OpenStream opens a new stream
+func (s *MuxSession) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stream, err := s.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the next stream opened by the other side. A stream
+// arriving after ctx ended is closed. net.ErrClosed is returned once the
+// session is closed
+func (s *MuxSession) AcceptStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	type result struct {
+		stream *yamux.Stream
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		stream, err := s.session.AcceptStream()
+		ch <- result{stream: stream, err: err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			if s.session.IsClosed() {
+				return nil, net.ErrClosed
+			}
+			return nil, r.err
+		}
+		return r.stream, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.stream != nil {
+				r.stream.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the session and all streams
+func (s *MuxSession) Close() error {
+	return s.session.Close()
+}
+
+// MuxClient opens socks sessions as streams of a single multiplexed
+// connection to a proxy served with MuxListener, ServeMuxConn or
+// ServeStreams
+type MuxClient struct {
+	client  *Client
+	streams StreamDialer
+}
+
+// NewMuxClient starts a multiplexed session on the connection to the proxy.
+// The credentials and timeout of client are used for every stream, the
+// ProxyAddr is ignored
+func NewMuxClient(conn net.Conn, client *Client) (*MuxClient, error) {
+	session, err := NewMuxSession(conn, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamClient(session, client), nil
+}
+
+// NewStreamClient opens socks sessions as streams of any multiplexed
+// transport. The credentials and timeout of client are used for every
+// stream, the ProxyAddr is ignored
+func NewStreamClient(streams StreamDialer, client *Client) *MuxClient {
+	if client == nil {
+		client = &Client{}
+	}
+	return &MuxClient{client: client, streams: streams}
+}
+
+// Dial connects to address through a new stream
+func (m *MuxClient) Dial(network, address string) (net.Conn, error) {
+	return m.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through a new stream. Only tcp networks
+// are supported
+func (m *MuxClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s not supported", network)
+	}
+
+	if m.client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.client.Timeout)
+		defer cancel()
+	}
+
+	s, err := m.streams.OpenStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not open stream: %w", err)
+	}
+	stream, ok := s.(net.Conn)
+	if !ok {
+		stream = &streamConn{ReadWriteCloser: s}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := stream.SetDeadline(deadline); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	bound, err := m.client.handshake(stream, RequestCmdConnect, address)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := stream.SetDeadline(time.Time{}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return &ClientConn{Conn: stream, boundAddr: bound}, nil
+}
+
+// Close closes the stream transport if it can be closed
+func (m *MuxClient) Close() error {
+	if c, ok := m.streams.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// streamConn adapts streams without deadlines and addresses to net.Conn.
+// Deadlines are emulated by closing the stream once they expire
+type streamConn struct {
+	io.ReadWriteCloser
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr { return streamAddr{} }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.ReadWriteCloser.Close() })
+	}
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+// streamAddr is the address of a stream
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
@@ -0,0 +1,165 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+func TestMuxListenerCloseKeepsStreams(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMuxListener(l)
+	defer m.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := yamux.Client(conn, muxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := m.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the established stream still works in both directions
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session is closed once the stream is done
+	stream.Close()
+	accepted.Close()
+	select {
+	case <-client.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("mux session not closed after its streams were done")
+	}
+}
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// TestMuxConcurrentSessions relays 10 concurrent sessions over one
+// multiplexed connection
+func TestMuxConcurrentSessions(t *testing.T) {
+	const sessions = 10
+	target := lineServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: l}
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	go p.Serve(NewMuxListener(counting))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewMuxClient(conn, &Client{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// all sessions are established before any data is sent, so they are
+	// open at the same time
+	var established, wg sync.WaitGroup
+	established.Add(sessions)
+	release := make(chan struct{})
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := client.Dial("tcp", target)
+			established.Done()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			<-release
+			if err := stream.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 10; j++ {
+				if _, err := fmt.Fprintf(stream, "session %d line %d\n", i, j); err != nil {
+					errs <- err
+					return
+				}
+				buf := make([]byte, 3)
+				if _, err := io.ReadFull(stream, buf); err != nil {
+					errs <- fmt.Errorf("session %d: %w", i, err)
+					return
+				}
+				if string(buf) != "ok\n" {
+					errs <- fmt.Errorf("session %d got %q", i, buf)
+					return
+				}
+			}
+		}(i)
+	}
+	established.Wait()
+	// the sessions are registered after the reply was sent
+	waitFor(t, func() bool { return p.Stats().ActiveSessions == sessions })
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt64(&counting.accepted); n != 1 {
+		t.Fatalf("proxy accepted %d tcp connections, want 1", n)
+	}
+	if total := p.Stats().TotalSessions; total != sessions {
+		t.Fatalf("got %d sessions, want %d", total, sessions)
+	}
+}
@@ -0,0 +1,140 @@
+package socks
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// ObfuscationKeySize is the size of the pre-shared key for ObfuscatedConn
+const ObfuscationKeySize = chacha20.KeySize
+
+// ObfuscatedConn encrypts all bytes on the wire with ChaCha20 so the socks
+// traffic looks like random data. Both sides need the same pre-shared key.
+// Every direction uses its own random nonce that is sent before the first
+// byte. The data is not authenticated, this only hides the protocol
+type ObfuscatedConn struct {
+	net.Conn
+	key []byte
+
+	readMu  sync.Mutex
+	reader  *chacha20.Cipher
+	writeMu sync.Mutex
+	writer  *chacha20.Cipher
+}
+
+// NewObfuscatedConn wraps conn. key must be ObfuscationKeySize bytes long
+func NewObfuscatedConn(conn net.Conn, key []byte) (*ObfuscatedConn, error) {
+	if len(key) != ObfuscationKeySize {
+		return nil, fmt.Errorf("invalid obfuscation key size %d, expected %d", len(key), ObfuscationKeySize)
+	}
+	return &ObfuscatedConn{Conn: conn, key: key}, nil
+}
+
+// Read reads the nonce of the peer on the first call and decrypts the data
+func (c *ObfuscatedConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.reader == nil {
+		nonce := make([]byte, chacha20.NonceSize)
+		if _, err := io.ReadFull(c.Conn, nonce); err != nil {
+			return 0, err
+		}
+		cipher, err := chacha20.NewUnauthenticatedCipher(c.key, nonce)
+		if err != nil {
+			return 0, err
+		}
+		c.reader = cipher
+	}
+	n, err := c.Conn.Read(b)
+	c.reader.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+// Write encrypts the data. The first call also sends a random nonce
+func (c *ObfuscatedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var nonce []byte
+	if c.writer == nil {
+		nonce = make([]byte, chacha20.NonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, fmt.Errorf("could not create nonce: %w", err)
+		}
+		cipher, err := chacha20.NewUnauthenticatedCipher(c.key, nonce)
+		if err != nil {
+			return 0, err
+		}
+		c.writer = cipher
+	}
+	buf := make([]byte, len(nonce)+len(b))
+	copy(buf, nonce)
+	c.writer.XORKeyStream(buf[len(nonce):], b)
+	n, err := c.Conn.Write(buf)
+	n -= len(nonce)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection if supported
+func (c *ObfuscatedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// ObfuscatedListener wraps accepted connections in an ObfuscatedConn. Use it
+// with Proxy.Serve
+type ObfuscatedListener struct {
+	net.Listener
+	key []byte
+}
+
+// NewObfuscatedListener wraps listener. key must be ObfuscationKeySize bytes
+// long
+func NewObfuscatedListener(listener net.Listener, key []byte) (*ObfuscatedListener, error) {
+	if len(key) != ObfuscationKeySize {
+		return nil, fmt.Errorf("invalid obfuscation key size %d, expected %d", len(key), ObfuscationKeySize)
+	}
+	return &ObfuscatedListener{Listener: listener, key: key}, nil
+}
+
+// Accept waits for the next connection and wraps it
+func (l *ObfuscatedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewObfuscatedConn(conn, l.key)
+}
+
+// ObfuscatingDialer connects to an obfuscated proxy. Set it as Client.Dialer
+type ObfuscatingDialer struct {
+	// Key is the pre-shared key of the proxy
+	Key []byte
+	// Dialer connects to the proxy. A net.Dialer is used if nil
+	Dialer ContextDialer
+}
+
+// DialContext connects to address and wraps the connection
+func (d *ObfuscatingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	obfs, err := NewObfuscatedConn(conn, d.Key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return obfs, nil
+}
@@ -0,0 +1,158 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapDialer records the raw bytes written to the connections it dials
+type tapDialer struct {
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (d *tapDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &tapConn{Conn: conn, dialer: d}, nil
+}
+
+func (d *tapDialer) bytes() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]byte(nil), d.written.Bytes()...)
+}
+
+type tapConn struct {
+	net.Conn
+	dialer *tapDialer
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	c.dialer.mu.Lock()
+	c.dialer.written.Write(b)
+	c.dialer.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func obfuscationKey() []byte {
+	return bytes.Repeat([]byte{0x42}, ObfuscationKeySize)
+}
+
+// serveObfuscatedProxy serves p on an obfuscated listener and returns the
+// address
+func serveObfuscatedProxy(t *testing.T, p *Proxy, key []byte) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewObfuscatedListener(l, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(listener)
+	t.Cleanup(func() { p.Close() })
+	return l.Addr().String()
+}
+
+func TestObfuscatedWireBytes(t *testing.T) {
+	target := lineServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Credentials:  StaticCredentials{"alice": "secret"},
+	}
+	addr := serveObfuscatedProxy(t, p, obfuscationKey())
+
+	tap := &tapDialer{}
+	client := &Client{
+		ProxyAddr: addr,
+		Username:  "alice",
+		Password:  "secret",
+		Timeout:   5 * time.Second,
+		Dialer:    &ObfuscatingDialer{Key: obfuscationKey(), Dialer: tap},
+	}
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	request, err := buildRequest(RequestCmdConnect, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := tap.bytes()
+	plaintext := [][]byte{
+		// greeting offering no authentication and username/password
+		{0x05, 0x02, 0x00, 0x02},
+		// username/password sub negotiation
+		append([]byte{0x01, 5}, "alice"...),
+		[]byte("secret"),
+		request,
+		[]byte("ping\n"),
+	}
+	for _, b := range plaintext {
+		if bytes.Contains(wire, b) {
+			t.Errorf("wire bytes contain the plaintext %x", b)
+		}
+	}
+}
+
+func TestObfuscatedConnNonce(t *testing.T) {
+	// the same plaintext looks different on every connection
+	var wire [2][]byte
+	for i := range wire {
+		client, server := net.Pipe()
+		obfs, err := NewObfuscatedConn(client, obfuscationKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, _ = obfs.Write([]byte{0x05, 0x01, 0x00})
+			obfs.Close()
+		}()
+		buf := make([]byte, 64)
+		n, err := io.ReadAtLeast(server, buf, 15)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		wire[i] = buf[:n]
+	}
+	if bytes.Equal(wire[0], wire[1]) {
+		t.Fatal("two connections produced the same wire bytes")
+	}
+}
+
+func TestObfuscatedWrongKey(t *testing.T) {
+	p := &Proxy{Proxyhandler: &DefaultHandler{Timeout: time.Second}, Timeout: time.Second}
+	addr := serveObfuscatedProxy(t, p, obfuscationKey())
+	client := &Client{
+		ProxyAddr: addr,
+		Timeout:   time.Second,
+		Dialer:    &ObfuscatingDialer{Key: bytes.Repeat([]byte{0x23}, ObfuscationKeySize)},
+	}
+	if conn, err := client.Dial("tcp", "127.0.0.1:80"); err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded with a wrong key")
+	}
+}
+
+func TestObfuscationKeySize(t *testing.T) {
+	if _, err := NewObfuscatedConn(nil, make([]byte, 16)); err == nil {
+		t.Fatal("short key accepted")
+	}
+	if _, err := NewObfuscatedListener(nil, make([]byte, 16)); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
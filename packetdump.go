@@ -0,0 +1,83 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dumpConn logs the data read from and written to the client connection
+// during phase if PacketDump is set. net.Conns are wrapped in a net.Conn so
+// deadlines and addresses stay available
+func (p *Proxy) dumpConn(conn io.ReadWriteCloser, phase string) io.ReadWriteCloser {
+	if !p.PacketDump {
+		return conn
+	}
+	if c, ok := extractNetConn(conn); ok {
+		return &dumpNetConn{Conn: c, phase: phase}
+	}
+	return &dumpRWC{ReadWriteCloser: conn, phase: phase}
+}
+
+type dumpRWC struct {
+	io.ReadWriteCloser
+	phase string
+}
+
+func (d *dumpRWC) Read(b []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Read(b)
+	dumpPacket(d.phase, true, b[:n])
+	return n, err
+}
+
+func (d *dumpRWC) Write(b []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Write(b)
+	dumpPacket(d.phase, false, b[:n])
+	return n, err
+}
+
+type dumpNetConn struct {
+	net.Conn
+	phase string
+}
+
+func (d *dumpNetConn) Read(b []byte) (int, error) {
+	n, err := d.Conn.Read(b)
+	dumpPacket(d.phase, true, b[:n])
+	return n, err
+}
+
+func (d *dumpNetConn) Write(b []byte) (int, error) {
+	n, err := d.Conn.Write(b)
+	dumpPacket(d.phase, false, b[:n])
+	return n, err
+}
+
+// dumpPacket logs data as hex dump in the format of od -Ax -tx1 which is
+// read by text2pcap -D. Every line holds up to 16 bytes and starts with the
+// direction, I for data received from the client and O for data sent to it
+func dumpPacket(phase string, received bool, data []byte) {
+	if len(data) == 0 || !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	direction, label := "O", phase+"→client"
+	if received {
+		direction, label = "I", "client→"+phase
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "packet dump %s (%d bytes)", label, len(data))
+	for offset := 0; offset < len(data); offset += 16 {
+		end := offset + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		fmt.Fprintf(&sb, "\n%s %06x", direction, offset)
+		for _, b := range data[offset:end] {
+			fmt.Fprintf(&sb, " %02x", b)
+		}
+	}
+	log.Debug(sb.String())
+}
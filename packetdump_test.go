@@ -0,0 +1,91 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// packetDumps returns the packet dumps logged so far
+func packetDumps(entries []*log.Entry) []string {
+	var dumps []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Message, "packet dump ") {
+			dumps = append(dumps, e.Message)
+		}
+	}
+	return dumps
+}
+
+func TestPacketDump(t *testing.T) {
+	hook := captureLogs(t, log.DebugLevel)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		PacketDump:   true,
+	}
+	target := lineServer(t)
+	port := requestTo(t, target).DestinationPort
+	conn, err := net.Dial("tcp", serveProxy(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+
+	portHex := fmt.Sprintf("%02x %02x", port>>8, port&0xff)
+	want := []string{
+		"packet dump client→handleConnect (3 bytes)\nI 000000 05 01 00",
+		"packet dump handleConnect→client (2 bytes)\nO 000000 05 00",
+		"packet dump client→handleRequest (10 bytes)\nI 000000 05 01 00 01 7f 00 00 01 " + portHex,
+		"packet dump handleRequestReply→client (10 bytes)\nO 000000 05 00 00 01 7f 00 00 01",
+	}
+	waitFor(t, func() bool { return len(packetDumps(hook.AllEntries())) >= len(want) })
+	dumps := packetDumps(hook.AllEntries())
+	if len(dumps) != len(want) {
+		t.Fatalf("got %d packet dumps, want %d: %q", len(dumps), len(want), dumps)
+	}
+	for i := range want {
+		// the bound port of the reply is not known
+		if !strings.HasPrefix(dumps[i], want[i]) {
+			t.Fatalf("got dump %q, want %q", dumps[i], want[i])
+		}
+	}
+}
+
+func TestDumpPacketLines(t *testing.T) {
+	hook := captureLogs(t, log.DebugLevel)
+	data := make([]byte, 20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	dumpPacket("handleRequest", true, data)
+	want := "packet dump client→handleRequest (20 bytes)\n" +
+		"I 000000 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f\n" +
+		"I 000010 10 11 12 13"
+	if got := hook.LastEntry().Message; got != want {
+		t.Fatalf("got dump\n%s\nwant\n%s", got, want)
+	}
+
+	// nothing is logged above the debug level
+	hook.Reset()
+	log.SetLevel(log.InfoLevel)
+	dumpPacket("handleRequest", true, data)
+	if entries := hook.AllEntries(); len(entries) != 0 {
+		t.Fatalf("got %d log entries at info level", len(entries))
+	}
+}
@@ -48,18 +48,20 @@ func parseRequest(buf []byte) (*Request, *Error) {
 	case byte(Version5):
 		r.Version = Version5
 	default:
-		return nil, &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("Invalid Socks version %#x", version)}
+		return nil, &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("invalid socks version %s", Version(version))}
 	}
 	cmd := buf[1]
 	switch cmd {
 	case byte(RequestCmdConnect):
 		r.Command = RequestCmdConnect
+	case byte(RequestCmdResume):
+		r.Command = RequestCmdResume
+	case byte(RequestCmdAssociate):
+		r.Command = RequestCmdAssociate
 	// case byte(RequestCmdBind):
 	// 	r.Command = RequestCmdBind
-	// case byte(RequestCmdAssociate):
-	// 	r.Command = RequestCmdAssociate
 	default:
-		return nil, &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("Command %#x not supported", cmd)}
+		return nil, &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("command %s not supported", RequestCmd(cmd))}
 	}
 	addresstype := buf[3]
 	switch addresstype {
@@ -69,26 +71,47 @@ func parseRequest(buf []byte) (*Request, *Error) {
 		r.AddressType = RequestAddressTypeIPv6
 	case byte(RequestAddressTypeDomainname):
 		r.AddressType = RequestAddressTypeDomainname
+	case byte(RequestAddressTypeSessionToken):
+		r.AddressType = RequestAddressTypeSessionToken
+	case byte(RequestAddressTypeUnixPath):
+		r.AddressType = RequestAddressTypeUnixPath
 	default:
-		return nil, &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("AddressType %#x not supported", addresstype)}
+		return nil, &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("address type %s not supported", RequestAddressType(addresstype))}
 	}
 
 	switch r.AddressType {
 	case RequestAddressTypeIPv4:
+		if len(buf) < 10 {
+			return nil, &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("invalid request header length (%d)", len(buf))}
+		}
 		r.DestinationAddress = buf[4:8]
 		p := buf[8:10]
 		r.DestinationPort = binary.BigEndian.Uint16(p)
 	case RequestAddressTypeIPv6:
+		if len(buf) < 22 {
+			return nil, &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("invalid request header length (%d)", len(buf))}
+		}
 		r.DestinationAddress = buf[4:20]
 		p := buf[20:22]
 		r.DestinationPort = binary.BigEndian.Uint16(p)
-	case RequestAddressTypeDomainname:
-		addrLen := buf[4]
+		r.normalizeMappedIPv4()
+	case RequestAddressTypeDomainname, RequestAddressTypeSessionToken:
+		addrLen := int(buf[4])
+		if len(buf) < 7+addrLen {
+			return nil, &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("invalid request header length (%d)", len(buf))}
+		}
 		r.DestinationAddress = buf[5 : 5+addrLen]
 		p := buf[5+addrLen : 5+addrLen+2]
 		r.DestinationPort = binary.BigEndian.Uint16(p)
+	case RequestAddressTypeUnixPath:
+		path, port, err := parseUnixPath(buf[4:])
+		if err != nil {
+			return nil, &Error{Reason: RequestReplyAddressTypeNotSupported, Err: err}
+		}
+		r.DestinationAddress = path
+		r.DestinationPort = port
 	default:
-		return nil, &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("AddressType %#x not supported", addresstype)}
+		return nil, &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("address type %s not supported", RequestAddressType(addresstype))}
 	}
 
 	return r, nil
@@ -112,7 +135,7 @@ func parseHeader(buf []byte) (Header, error) {
 	if len(buf) < int(numMethods)+2 {
 		return h, fmt.Errorf("invalid socks header")
 	}
-	h.Methods = make([]byte, numMethods)
+	h.Methods = make([]byte, 0, numMethods)
 	for i := 0; i < int(numMethods); i++ {
 		meth := buf[2+i]
 		h.Methods = append(h.Methods, meth)
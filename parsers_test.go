@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		buf     []byte
+		methods []byte
+	}{
+		{"no authentication", []byte{0x05, 0x01, 0x00}, []byte{0x00}},
+		{"username/password", []byte{0x05, 0x01, 0x02}, []byte{0x02}},
+		{"two methods", []byte{0x05, 0x02, 0x02, 0x80}, []byte{0x02, 0x80}},
+		{"no methods", []byte{0x05, 0x00, 0x00}, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseHeader(tt.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(h.Methods, tt.methods) {
+				t.Fatalf("got methods % x, want % x", h.Methods, tt.methods)
+			}
+		})
+	}
+}
+
+func TestParseRequestTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"ipv4", []byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0}},
+		{"ipv6", []byte{0x05, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"domain", []byte{0x05, 0x01, 0x00, 0x03, 0x0b, 'e', 'x', 'a', 'm', 'p', 'l', 'e'}},
+		{"domain without port", []byte{0x05, 0x01, 0x00, 0x03, 0x03, 'f', 'o', 'o'}},
+		{"session token", []byte{0x05, 0xf0, 0x00, 0xf0, 0x10, 1, 2, 3}},
+		{"unix path", []byte{0x05, 0x01, 0x00, 0xfe, '/', 't', 'm', 'p', 0x00, 0x00}},
+		{"unix path without port", []byte{0x05, 0x01, 0x00, 0xfe, '/', 't', 'm', 'p', 0x00}},
+		{"unix path without terminator", []byte{0x05, 0x01, 0x00, 0xfe, '/', 't', 'm', 'p'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseRequest(tt.buf); err == nil {
+				t.Fatalf("parsed truncated request % x", tt.buf)
+			}
+		})
+	}
+}
+
+func TestNormalizeMappedIPv4(t *testing.T) {
+	tests := []struct {
+		name        string
+		ip          string
+		addressType RequestAddressType
+		want        net.IP
+	}{
+		{"mapped ipv4", "::ffff:127.0.0.1", RequestAddressTypeIPv4, net.IP{127, 0, 0, 1}},
+		{"translated ipv4", "::ffff:0:0:127.0.0.1", RequestAddressTypeIPv6, net.ParseIP("::ffff:0:0:127.0.0.1")},
+		{"ipv6", "::1", RequestAddressTypeIPv6, net.IPv6loopback},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip).To16()
+		check := func(t *testing.T, r *Request) {
+			t.Helper()
+			if r.AddressType != tt.addressType {
+				t.Fatalf("got address type %s, want %s", r.AddressType, tt.addressType)
+			}
+			if !bytes.Equal(r.DestinationAddress, tt.want) {
+				t.Fatalf("got address %s, want %s", net.IP(r.DestinationAddress), tt.want)
+			}
+			if r.DestinationPort != 80 {
+				t.Fatalf("got port %d, want 80", r.DestinationPort)
+			}
+		}
+		t.Run(tt.name+" request", func(t *testing.T) {
+			buf := append([]byte{0x05, 0x01, 0x00, 0x04}, ip...)
+			r, err := parseRequest(append(buf, 0x00, 0x50))
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, r)
+		})
+		t.Run(tt.name+" udp header", func(t *testing.T) {
+			buf := append([]byte{0x00, 0x00, 0x00, 0x04}, ip...)
+			r, data, err := parseUDPHeader(append(buf, 0x00, 0x50, 'x'))
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, r)
+			if string(data) != "x" {
+				t.Fatalf("got data %q, want %q", data, "x")
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// defaultIdleTimeout is used if IdleTimeout is not set
+const defaultIdleTimeout = 30 * time.Second
+
+// pipelineConn returns the client connection if pipelining is enabled and
+// supported by the connection. Pipelining needs read deadlines to end the
+// session without consuming the next request.
+func (p *Proxy) pipelineConn(client io.Closer) (net.Conn, bool) {
+	if !p.EnablePipelining {
+		return nil, false
+	}
+	c, ok := client.(net.Conn)
+	return c, ok
+}
+
+// waitForPipelinedRequest waits up to IdleTimeout for the client to start the
+// next session on the connection. The received data is returned by the first
+// read of the returned connection.
+func (p *Proxy) waitForPipelinedRequest(conn net.Conn) (net.Conn, error) {
+	if pc, ok := conn.(*prefixConn); ok {
+		conn = pc.Conn
+	}
+	timeout := p.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultIdleTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &prefixConn{Conn: conn, prefix: buf[:n]}, nil
+}
+
+// prefixConn returns already received data before reading from the
+// connection
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+	// clearDeadline is called when the deadline is cleared, it stops the
+	// timer of the HandshakeDeadline of other clocks
+	clearDeadline func() error
+}
+
+// SetDeadline also clears the HandshakeDeadline if t is zero
+func (c *prefixConn) SetDeadline(t time.Time) error {
+	if t.IsZero() && c.clearDeadline != nil {
+		if err := c.clearDeadline(); err != nil {
+			return err
+		}
+		c.clearDeadline = nil
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,108 @@
+package socks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// byeServer answers the first line of every connection with "bye <line>"
+// and closes the connection
+func byeServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("bye " + line))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPipelining(t *testing.T) {
+	target := byeServer(t)
+	p := &Proxy{
+		Proxyhandler:     &DefaultHandler{Timeout: time.Second},
+		Timeout:          time.Second,
+		EnablePipelining: true,
+	}
+	conn, err := net.Dial("tcp", serveProxy(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n"} {
+		c := &Client{}
+		if err := c.negotiateMethod(conn); err != nil {
+			t.Fatal(err)
+		}
+		if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+			t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+		}
+		if _, err := conn.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		want := "bye " + line
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != want {
+			t.Fatalf("got %q, want %q", buf, want)
+		}
+		// the next session may only start after the remote ended this one
+		waitFor(t, func() bool { return p.Stats().ActiveSessions == 0 })
+	}
+
+	stats := p.Stats()
+	if stats.TotalSessions != 2 {
+		t.Fatalf("got %d sessions, want 2", stats.TotalSessions)
+	}
+	if stats.ActiveConnections != 1 {
+		t.Fatalf("got %d active connections, want the pipelined one", stats.ActiveConnections)
+	}
+}
+
+func TestPipeliningDisabled(t *testing.T) {
+	target := byeServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	if _, err := conn.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the connection is closed after the remote ended the session
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bye first\n" {
+		t.Fatalf("got %q, want %q", data, "bye first\n")
+	}
+}
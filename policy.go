@@ -0,0 +1,82 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PolicyFunc is called for every parsed request before the destination is
+// dialed
+type PolicyFunc func(ctx context.Context, req Request) PolicyDecision
+
+// PolicyAction is the action the proxy takes for a request
+type PolicyAction uint8
+
+const (
+	// PolicyActionAllow lets the request pass unchanged
+	PolicyActionAllow PolicyAction = iota
+	// PolicyActionDeny rejects the request
+	PolicyActionDeny
+	// PolicyActionRedirect rewrites the destination of the request
+	PolicyActionRedirect
+)
+
+// PolicyDecision is returned by a PolicyFunc
+type PolicyDecision struct {
+	Action PolicyAction
+	// Reason is sent to the client if the request is denied. Defaults to
+	// RequestReplyConnectionNotAllowed
+	Reason RequestReplyReason
+	// Host and Port hold the new destination on a redirect
+	Host string
+	Port uint16
+	// TOS overrides Proxy.TOS for this session if not 0
+	TOS int
+	// ProxyProtocol makes the DefaultHandler send a PROXY protocol header
+	// with the client address to the remote if not ProxyProtocolNone
+	ProxyProtocol ProxyProtocolVersion
+}
+
+// PolicyAllow allows the request
+func PolicyAllow() PolicyDecision {
+	return PolicyDecision{Action: PolicyActionAllow}
+}
+
+// PolicyDeny denies the request and sends reason to the client
+func PolicyDeny(reason RequestReplyReason) PolicyDecision {
+	return PolicyDecision{Action: PolicyActionDeny, Reason: reason}
+}
+
+// PolicyRedirect sends the request to host:port instead of the requested
+// destination. The handler only sees the new destination.
+func PolicyRedirect(host string, port uint16) PolicyDecision {
+	return PolicyDecision{Action: PolicyActionRedirect, Host: host, Port: port}
+}
+
+// applyPolicy runs the configured policy and modifies the request on
+// redirects. The decision is returned so per session settings can be applied
+func (p *Proxy) applyPolicy(ctx context.Context, request *Request) (PolicyDecision, *Error) {
+	if p.Policy == nil {
+		return PolicyAllow(), nil
+	}
+	decision := p.Policy(ctx, *request)
+	switch decision.Action {
+	case PolicyActionAllow:
+		return decision, nil
+	case PolicyActionDeny:
+		if decision.Reason == RequestReplySucceeded {
+			// never send a success reply for a denied request
+			decision.Reason = RequestReplyConnectionNotAllowed
+		}
+		return decision, &Error{Reason: decision.Reason, Err: fmt.Errorf("request to %s denied by policy", request.getDestinationString())}
+	case PolicyActionRedirect:
+		original := request.getDestinationString()
+		request.setDestination(decision.Host, decision.Port)
+		log.Infof("policy redirected %s to %s", original, request.getDestinationString())
+		return decision, nil
+	default:
+		return decision, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("invalid policy action %d", decision.Action)}
+	}
+}
@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	target := lineServer(t)
+	mirror := lineServer(t)
+	mirrorHost, mirrorPort, _ := net.SplitHostPort(mirror)
+	port, _ := strconv.Atoi(mirrorPort)
+
+	tests := []struct {
+		name      string
+		decision  PolicyDecision
+		wantReply RequestReplyReason
+		wantDest  string
+	}{
+		{name: "allow", decision: PolicyAllow(), wantReply: RequestReplySucceeded, wantDest: target},
+		{name: "deny", decision: PolicyDeny(RequestReplyHostUnreachable), wantReply: RequestReplyHostUnreachable},
+		{name: "deny without reason", decision: PolicyDecision{Action: PolicyActionDeny}, wantReply: RequestReplyConnectionNotAllowed},
+		{name: "deny with zero reason", decision: PolicyDeny(0), wantReply: RequestReplyConnectionNotAllowed},
+		{name: "redirect", decision: PolicyRedirect(mirrorHost, uint16(port)), wantReply: RequestReplySucceeded, wantDest: mirror},
+		{name: "invalid action", decision: PolicyDecision{Action: 42}, wantReply: RequestReplyGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &recordingHandler{DefaultHandler: DefaultHandler{Timeout: time.Second}}
+			users := make(chan string, 1)
+			p := &Proxy{
+				Proxyhandler: handler,
+				Timeout:      time.Second,
+				Credentials:  StaticCredentials{"alice": "secret"},
+				Policy: func(ctx context.Context, req Request) PolicyDecision {
+					users <- req.Username
+					return tt.decision
+				},
+			}
+			conn := dialProxy(t, serveProxy(t, p), "alice", "secret")
+			if reply := sendRequest(t, conn, target); reply != tt.wantReply {
+				t.Fatalf("got reply %s, want %s", reply, tt.wantReply)
+			}
+			if user := <-users; user != "alice" {
+				t.Errorf("policy saw user %q, want alice", user)
+			}
+			if tt.wantDest == "" {
+				return
+			}
+			request, _ := handler.last(t)
+			if dest := request.getDestinationString(); dest != tt.wantDest {
+				t.Errorf("handler saw destination %s, want %s", dest, tt.wantDest)
+			}
+			roundTrip(t, conn)
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PoolingHandler wraps another handler and keeps remote connections open after
+// a session ended so they can be reused by later requests to the same
+// destination from the same user and tenant. This only makes sense for
+// protocols where the remote accepts multiple requests on one connection like
+// HTTP keep-alive.
+//
+// A connection is only put back into the pool if it is released as clean,
+// see Releaser, and was never half-closed and never failed. The relay cannot
+// see where a response ends, so connections that were half-closed by the
+// client or read to EOF are closed. Connections sending a PROXY protocol
+// header are never pooled. Connections are health checked before they are
+// reused.
+type PoolingHandler struct {
+	ProxyHandler
+
+	// accessed atomically
+	hits     int64
+	misses   int64
+	bypassed int64
+
+	maxIdlePerDest int
+	idleTTL        time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]idleConn
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// PoolStats holds the counters of a PoolingHandler
+type PoolStats struct {
+	// Hits is the number of requests served with a pooled connection
+	Hits int64
+	// Misses is the number of requests that needed a new connection
+	Misses int64
+	// Bypassed is the number of connections that could not be pooled because
+	// the inner handler did not return a net.Conn or a PROXY protocol header
+	// was sent
+	Bypassed int64
+	// Idle is the number of connections currently in the pool
+	Idle int
+}
+
+// NewPoolingHandler creates a PoolingHandler keeping up to maxIdlePerDest idle
+// connections per destination for at most idleTTL
+func NewPoolingHandler(inner ProxyHandler, maxIdlePerDest int, idleTTL time.Duration) *PoolingHandler {
+	return &PoolingHandler{
+		ProxyHandler:   inner,
+		maxIdlePerDest: maxIdlePerDest,
+		idleTTL:        idleTTL,
+		idle:           make(map[string][]idleConn),
+	}
+}
+
+// PreHandler returns a pooled connection to the destination if one is
+// available and creates a new one using the inner handler otherwise
+func (h *PoolingHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	if sendsProxyProtocol(ctx, h.ProxyHandler, request) {
+		// the header carries the address of this client
+		atomic.AddInt64(&h.bypassed, 1)
+		return h.ProxyHandler.PreHandler(ctx, request)
+	}
+	key := poolKey(ctx, request)
+	if conn := h.get(key); conn != nil {
+		atomic.AddInt64(&h.hits, 1)
+		log.Debugf("reusing pooled connection to %s", key)
+		return &pooledConn{Conn: conn, pool: h, key: key}, nil
+	}
+	atomic.AddInt64(&h.misses, 1)
+
+	remote, err := h.ProxyHandler.PreHandler(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := extractNetConn(remote)
+	if !ok {
+		atomic.AddInt64(&h.bypassed, 1)
+		return remote, nil
+	}
+	return &pooledConn{Conn: conn, pool: h, key: key}, nil
+}
+
+// poolKey separates the pooled connections by destination, user and tenant
+// so a connection is never shared between clients of different users
+func poolKey(ctx context.Context, request Request) string {
+	user, _ := UserFromContext(ctx)
+	tenant, _ := TenantFromContext(ctx)
+	return fmt.Sprintf("%s|%q|%q", request.getDestinationString(), user, tenant)
+}
+
+// sendsProxyProtocol checks if the inner handler sends a PROXY protocol
+// header for the request
+func sendsProxyProtocol(ctx context.Context, handler ProxyHandler, request Request) bool {
+	if d, ok := asDefaultHandler(handler); ok {
+		return d.proxyProtocolVersion(ctx, request) != ProxyProtocolNone
+	}
+	return proxyProtocolFromContext(ctx) != ProxyProtocolNone
+}
+
+// Stats returns the current pool counters
+func (h *PoolingHandler) Stats() PoolStats {
+	h.mu.Lock()
+	idle := 0
+	for _, conns := range h.idle {
+		idle += len(conns)
+	}
+	h.mu.Unlock()
+	return PoolStats{
+		Hits:     atomic.LoadInt64(&h.hits),
+		Misses:   atomic.LoadInt64(&h.misses),
+		Bypassed: atomic.LoadInt64(&h.bypassed),
+		Idle:     idle,
+	}
+}
+
+// CloseIdle closes all pooled connections
+func (h *PoolingHandler) CloseIdle() {
+	h.mu.Lock()
+	idle := h.idle
+	h.idle = make(map[string][]idleConn)
+	h.mu.Unlock()
+	for _, conns := range idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+}
+
+// get returns a healthy idle connection to the destination or nil
+func (h *PoolingHandler) get(key string) net.Conn {
+	for {
+		h.mu.Lock()
+		conns := h.idle[key]
+		if len(conns) == 0 {
+			h.mu.Unlock()
+			return nil
+		}
+		// use the most recently returned connection first
+		c := conns[len(conns)-1]
+		h.idle[key] = conns[:len(conns)-1]
+		if len(h.idle[key]) == 0 {
+			delete(h.idle, key)
+		}
+		h.mu.Unlock()
+
+		if time.Since(c.since) < h.idleTTL && healthy(c.conn) {
+			return c.conn
+		}
+		c.conn.Close()
+	}
+}
+
+// put returns the connection to the pool. The connection is closed if the
+// pool for the destination is full
+func (h *PoolingHandler) put(key string, conn net.Conn) {
+	now := time.Now()
+	h.mu.Lock()
+	conns := h.idle[key]
+	// drop expired connections, the oldest are at the start
+	expired := 0
+	for expired < len(conns) && now.Sub(conns[expired].since) >= h.idleTTL {
+		conns[expired].conn.Close()
+		expired++
+	}
+	conns = conns[expired:]
+	if len(conns) >= h.maxIdlePerDest {
+		h.idle[key] = conns
+		h.mu.Unlock()
+		conn.Close()
+		return
+	}
+	h.idle[key] = append(conns, idleConn{conn: conn, since: now})
+	h.mu.Unlock()
+}
+
+// healthy checks that the remote did not close the connection and did not
+// send any unexpected data while the connection was idle
+func healthy(conn net.Conn) bool {
+	if sc, ok := conn.(syscall.Conn); ok {
+		if raw, err := sc.SyscallConn(); err == nil {
+			if ok, err := idleRaw(raw); err == nil {
+				return ok
+			}
+		}
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	buf := make([]byte, 1)
+	n, err := conn.Read(buf)
+	if n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// pooledConn returns the remote connection to the pool when it is released
+// as clean and can be reused
+type pooledConn struct {
+	net.Conn
+	pool *PoolingHandler
+	key  string
+
+	mu         sync.Mutex
+	broken     bool
+	halfClosed bool
+	done       bool
+}
+
+func (c *pooledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.setBroken()
+	}
+	return n, err
+}
+
+func (c *pooledConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.setBroken()
+	}
+	return n, err
+}
+
+func (c *pooledConn) setBroken() {
+	c.mu.Lock()
+	c.broken = true
+	c.mu.Unlock()
+}
+
+// CloseWrite half-closes the remote connection. It can not be reused after
+// that
+func (c *pooledConn) CloseWrite() error {
+	c.mu.Lock()
+	c.halfClosed = true
+	c.mu.Unlock()
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Release puts the connection back into the pool if clean is set and the
+// connection is still usable. It is closed otherwise
+func (c *pooledConn) Release(clean bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return nil
+	}
+	c.done = true
+	if !clean || c.broken || c.halfClosed {
+		return c.Conn.Close()
+	}
+	c.pool.put(c.key, c.Conn)
+	return nil
+}
+
+// Close closes the connection without returning it to the pool
+func (c *pooledConn) Close() error {
+	return c.Release(false)
+}
@@ -0,0 +1,159 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoolingHandlerReusesCleanConnections(t *testing.T) {
+	addr := lineServer(t)
+	h := NewPoolingHandler(DefaultHandler{Timeout: time.Second}, 1, time.Minute)
+	defer h.CloseIdle()
+
+	remote, err := h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, remote.(net.Conn))
+	if err := remote.(Releaser).Release(true); err != nil {
+		t.Fatal(err)
+	}
+	remote, err = h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if stats := h.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("got %d hits and %d misses, want 1 and 1", stats.Hits, stats.Misses)
+	}
+}
+
+func TestPoolingHandlerReleaseKeepsConnectionOpen(t *testing.T) {
+	addr := lineServer(t)
+	h := NewPoolingHandler(DefaultHandler{Timeout: time.Second}, 1, time.Minute)
+	defer h.CloseIdle()
+
+	remote, err := h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := remote.(*pooledConn).Conn
+	if err := remote.(Releaser).Release(true); err != nil {
+		t.Fatal(err)
+	}
+	if idle := h.Stats().Idle; idle != 1 {
+		t.Fatalf("got %d idle connections, want 1", idle)
+	}
+	remote, err = h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if remote.(*pooledConn).Conn != conn {
+		t.Fatal("got a new connection, want the released one")
+	}
+	// the released connection was not closed
+	roundTrip(t, remote.(net.Conn))
+}
+
+func TestPoolingHandlerDoesNotPoolHalfClosedConnections(t *testing.T) {
+	addr := lineServer(t)
+	h := NewPoolingHandler(DefaultHandler{Timeout: time.Second}, 1, time.Minute)
+	defer h.CloseIdle()
+
+	remote, err := h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the answer is still on its way when the client finished sending
+	if err := remote.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.(Releaser).Release(true); err != nil {
+		t.Fatal(err)
+	}
+	if idle := h.Stats().Idle; idle != 0 {
+		t.Fatalf("half-closed connection was pooled, %d idle connections", idle)
+	}
+}
+
+func TestPoolingHandlerSeparatesUsers(t *testing.T) {
+	addr := lineServer(t)
+	h := NewPoolingHandler(DefaultHandler{Timeout: time.Second}, 1, time.Minute)
+	defer h.CloseIdle()
+
+	remote, err := h.PreHandler(WithUser(context.Background(), "alice"), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.(Releaser).Release(true); err != nil {
+		t.Fatal(err)
+	}
+	remote, err = h.PreHandler(WithUser(context.Background(), "bob"), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if hits := h.Stats().Hits; hits != 0 {
+		t.Fatalf("connection of alice was reused for bob")
+	}
+}
+
+func TestPoolingHandlerBypassesProxyProtocol(t *testing.T) {
+	addr := lineServer(t)
+	inner := DefaultHandler{Timeout: time.Second, ProxyProtocol: ProxyProtocolV1, ProxyProtocolDestinations: []string{addr}}
+	h := NewPoolingHandler(inner, 1, time.Minute)
+	defer h.CloseIdle()
+
+	remote, err := h.PreHandler(context.Background(), requestTo(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if _, ok := remote.(Releaser); ok {
+		t.Fatal("connection with a PROXY protocol header can be pooled")
+	}
+	if bypassed := h.Stats().Bypassed; bypassed != 1 {
+		t.Fatalf("got %d bypassed connections, want 1", bypassed)
+	}
+}
+
+// BenchmarkRequestWithoutPool measures a request on a new connection
+func BenchmarkRequestWithoutPool(b *testing.B) {
+	addr := lineServer(b)
+	h := DefaultHandler{Timeout: time.Second}
+	request := requestTo(b, addr)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		remote, err := h.PreHandler(context.Background(), request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		roundTrip(b, remote.(net.Conn))
+		remote.Close()
+	}
+}
+
+// BenchmarkRequestWithPool measures a request on a pooled connection
+func BenchmarkRequestWithPool(b *testing.B) {
+	addr := lineServer(b)
+	h := NewPoolingHandler(DefaultHandler{Timeout: time.Second}, 1, time.Minute)
+	defer h.CloseIdle()
+	request := requestTo(b, addr)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		remote, err := h.PreHandler(context.Background(), request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		roundTrip(b, remote.(net.Conn))
+		if err := remote.(Releaser).Release(true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package socks
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// idleRaw is not supported on this platform, healthy falls back to a short
+// read
+func idleRaw(c syscall.RawConn) (bool, error) {
+	return false, fmt.Errorf("non blocking socket checks are not supported on %s", runtime.GOOS)
+}
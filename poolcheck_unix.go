@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package socks
+
+import (
+	"errors"
+	"syscall"
+)
+
+// idleRaw checks without blocking that nothing can be read from the socket.
+// A closed connection or unexpected data make the connection unusable
+func idleRaw(c syscall.RawConn) (bool, error) {
+	idle := false
+	var sysErr error
+	buf := make([]byte, 1)
+	err := c.Read(func(fd uintptr) bool {
+		// n is 0 on EOF and 1 if the remote sent data
+		_, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case errors.Is(err, syscall.EAGAIN):
+			idle = true
+		case err != nil:
+			sysErr = err
+		}
+		// never wait for the socket to become readable
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	if sysErr != nil {
+		return false, nil
+	}
+	return idle, nil
+}
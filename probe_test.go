@@ -0,0 +1,67 @@
+package socks
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestProbes(t *testing.T) {
+	hook := captureLogs(t, log.DebugLevel)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		PacketDump:   true,
+	}
+	addr := serveProxy(t, p)
+
+	// a health check closing the connection and a port scanner resetting it
+	for _, reset := range []bool{false, true} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reset {
+			if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.Close()
+	}
+	waitFor(t, func() bool { return p.Stats().Probes == 2 })
+	waitFor(t, func() bool { return p.Stats().ActiveConnections == 0 })
+	for _, e := range hook.AllEntries() {
+		if e.Level <= log.WarnLevel {
+			t.Fatalf("probe logged %q at level %s", e.Message, e.Level)
+		}
+		if strings.HasPrefix(e.Message, "packet dump socksErrorReply") {
+			t.Fatal("an error reply was sent to a probe")
+		}
+	}
+
+	// garbage is a protocol failure logged as error and no probe
+	hook.Reset()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{0x01, 0x02, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitFor(t, func() bool {
+		for _, e := range hook.AllEntries() {
+			if e.Level == log.ErrorLevel {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, func() bool { return p.Stats().ActiveConnections == 0 })
+	if probes := p.Stats().Probes; probes != 2 {
+		t.Fatalf("got %d probes, want the garbage not counted", probes)
+	}
+}
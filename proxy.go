@@ -2,8 +2,12 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,51 +15,382 @@ import (
 
 // ProxyHandler is the interface for handling the proxy requests
 type ProxyHandler interface {
-	PreHandler(Request) (io.ReadWriteCloser, *Error)
+	PreHandler(context.Context, Request) (io.ReadWriteCloser, *Error)
 	CopyFromClientToRemote(context.Context, io.ReadCloser, io.WriteCloser) error
 	CopyFromRemoteToClient(context.Context, io.ReadCloser, io.WriteCloser) error
 	Cleanup() error
+	// Refresh is called in its own goroutine for every established session
+	// and must return when the context ends, the session waits for it
 	Refresh(context.Context)
 }
 
 // Proxy is the main struct
 type Proxy struct {
+	// accessed atomically, kept first for 64bit alignment on 32bit platforms
+	activeConnections int64
+	sessionID         uint64
+	connID            uint64
+	probes            int64
+	suppressedLogs    int64
+	// handshakesInFlight and handshakeRejections track
+	// MaxConcurrentHandshakes
+	handshakesInFlight  int64
+	handshakeRejections int64
+	// handshakeFailures counts failed handshakes by phase and reason
+	handshakeFailures handshakeFailures
+	// udp counts the relayed and dropped datagrams of all associations
+	udp udpCounters
+
 	ClientAddr   string
 	ServerAddr   string
 	Done         chan struct{}
 	Proxyhandler ProxyHandler
 	Timeout      time.Duration
+	// HandshakeDeadline limits the time for the whole handshake including
+	// authentication and the request, Timeout only limits single reads and
+	// writes. It runs on the Clock. 0 disables it
+	HandshakeDeadline time.Duration
+	// ACL is checked against the requested destination if set
+	ACL *IPListACL
+	// Policy is called for every request before connecting to the destination
+	Policy PolicyFunc
+	// EnableSessionResume enables the experimental session resume extension
+	EnableSessionResume bool
+	// SessionResumeTimeout is the time a session with a broken client
+	// connection waits to be resumed. Defaults to 30 seconds
+	SessionResumeTimeout time.Duration
+	// Credentials enables username/password authentication if set
+	Credentials CredentialStore
+	// MaxConnections limits the number of concurrent client connections.
+	// 0 means no limit
+	MaxConnections int
+	// BlockPrivateDestinations denies requests to private, loopback, link
+	// local and cloud metadata addresses. Domain names are denied if any of
+	// their addresses is private
+	BlockPrivateDestinations bool
+	// AllowedPorts restricts the destination ports. All ports are allowed if
+	// AllowedPorts and AllowedPortRanges are empty
+	AllowedPorts []int
+	// AllowedPortRanges restricts the destination ports to the inclusive
+	// ranges
+	AllowedPortRanges [][2]int
+	// GeoIPFilter is called with the client address and every resolved
+	// destination address of a request. The request is denied if any
+	// address is denied, the reason is stored in SessionStats.DenyReason.
+	// It is skipped if the client address is unknown
+	GeoIPFilter func(clientIP, destIP net.IP) (allow bool, reason string)
+	// TOS sets the IP TOS / IPv6 traffic class on remote connections. A
+	// policy can override it per session. 0 leaves it unchanged
+	TOS int
+	// TOSClient also applies the TOS to the client connection
+	TOSClient bool
+	// Resolver is used to resolve domain names. Uses net.DefaultResolver if
+	// nil. If set, domain names are always resolved by the proxy
+	Resolver Resolver
+	// EgressFamily restricts destinations to IPv4 or IPv6. Domain names are
+	// only resolved to addresses of the allowed family. Defaults to FamilyAny
+	EgressFamily EgressFamily
+	// MaxSessionDuration closes sessions that are open longer than the
+	// duration, including UDP associations. The time starts after the
+	// success reply. The context passed to the handler ends at the same
+	// time. 0 disables it
+	MaxSessionDuration time.Duration
+	// SelfCheckAddr is the destination used by SelfCheck. It must echo the
+	// received data. A built-in echo target is used if empty
+	SelfCheckAddr string
+	// EnablePipelining keeps the client connection open after the remote
+	// closed the session so the client can start another session on it. The
+	// client must not send the next request before the previous session
+	// ended, earlier data is still forwarded to the old remote
+	EnablePipelining bool
+	// IdleTimeout is the time to wait for the next session on a pipelined
+	// connection. Defaults to 30 seconds
+	IdleTimeout time.Duration
+	// HTTPErrorResponse replies with an HTTP error to clients sending HTTP
+	// requests to the proxy. Disabled by default so the proxy does not
+	// reveal itself to scanners
+	HTTPErrorResponse bool
+	// HTTPConnect serves clients sending HTTP requests on the socks port,
+	// for example with httpconnect.Handler.ServeConn, so one listener
+	// accepts socks and HTTP CONNECT clients. conn returns the already read
+	// data first and still has the HandshakeDeadline set. HTTPErrorResponse
+	// is ignored if set. Connections that are not a net.Conn are not passed
+	HTTPConnect func(ctx context.Context, conn net.Conn)
+	// EnableSOCKS4 accepts socks4 and socks4a CONNECT requests. socks4 has
+	// no authentication so the requests are denied if Credentials are set
+	EnableSOCKS4 bool
+	// DisableSOCKS5 rejects socks5 clients, for listeners only serving
+	// socks4 or HTTPConnect
+	DisableSOCKS5 bool
+	// ErrorReplyLinger is the time the client connection stays half-closed
+	// after an error reply. Data the client still sends is read and
+	// discarded, so the client receives the reply before the connection is
+	// reset. Only used for connections with deadlines. Defaults to 100
+	// milliseconds, a negative duration closes the connection immediately
+	ErrorReplyLinger time.Duration
+	// LogSampleLimit is the number of identical failure messages logged per
+	// LogSampleInterval. Further messages are counted and summarized at the
+	// end of the interval. 0 logs every message
+	LogSampleLimit int
+	// LogSampleInterval is the interval for LogSampleLimit. Defaults to one
+	// minute
+	LogSampleInterval time.Duration
+	// AddressMapper maps the bound address of a session to the address sent
+	// in the reply, for example to the external address of a NAT. It is
+	// called once per reply with the address of the socket. An error fails
+	// the request with a general failure reply
+	AddressMapper func(local net.Addr) (net.Addr, error)
+	// PacketDump logs the data exchanged with the client during the
+	// handshake and the replies as hex dump on the debug level, annotated
+	// with the phase. The dumps can be converted to pcap files with
+	// text2pcap -D. The relayed data is not logged but passwords are, only
+	// enable it for debugging
+	PacketDump bool
+	// Debug enables features meant for development only, like Banner. Never
+	// set it in production
+	Debug bool
+	// Banner identifies the proxy to clients offering the vendor method
+	// MethodBanner in addition to no authentication. It is sent after the
+	// method selection and only if Debug is set and no authentication is
+	// required. Longer banners are cut to 255 bytes
+	Banner string
+	// AuthMethodSelector picks the authentication method from the methods
+	// offered by the client, for example to let some clients skip the
+	// authentication. Only no authentication and username/password, which
+	// requires Credentials, are supported. The client address is nil for
+	// connections without an address. By default username/password is
+	// required if Credentials are set and no authentication otherwise
+	AuthMethodSelector func(client net.Addr, offered []Methods) (Methods, error)
+	// MethodPreference lists the authentication methods the proxy accepts,
+	// most preferred first. The first method offered by the client is
+	// selected, username/password only if Credentials are set. Only used
+	// if AuthMethodSelector is not set. By default username/password is
+	// required if Credentials are set and no authentication otherwise
+	MethodPreference []Methods
+	// ClientMethodPreference overrides MethodPreference for a client, for
+	// example to require authentication from some networks. A nil result
+	// uses MethodPreference. The client address is nil for connections
+	// without an address
+	ClientMethodPreference func(client net.Addr) []Methods
+	// TenantResolver returns the tenant of a client. The tenant is added to
+	// the log messages and the session list and selects the tenant rules of
+	// the ACL. Connections are rejected if it returns an error. The address
+	// is nil for connections without an address
+	TenantResolver func(addr net.Addr) (tenantID string, err error)
+	// UDPRelayAddr is the address the udp relay of UDP ASSOCIATE binds to.
+	// Defaults to the address the client connected to
+	UDPRelayAddr net.IP
+	// UDPPortRange restricts the udp relay to the inclusive port range. Any
+	// free port is used if not set
+	UDPPortRange [2]int
+	// UDPIdleTimeout closes UDP associations without datagrams in either
+	// direction for the duration. Defaults to two minutes
+	UDPIdleTimeout time.Duration
+	// UnixSocketMode are the permissions of the socket created by
+	// ListenUnix. Defaults to 0660
+	UnixSocketMode os.FileMode
+	// MaxConcurrentHandshakes limits the number of connections in the
+	// handshake independent of MaxConnections. Further connections wait up
+	// to HandshakeQueueTimeout for a free slot and are closed afterwards. 0
+	// disables the limit
+	MaxConcurrentHandshakes int
+	// HandshakeQueueTimeout is the maximum wait for a handshake slot.
+	// Defaults to one second
+	HandshakeQueueTimeout time.Duration
+	// WriteStallTimeout closes a session if a single write to the client or
+	// the remote does not finish within the duration, for example because
+	// the client stopped reading. Only connections supporting write
+	// deadlines are checked. 0 disables it
+	WriteStallTimeout time.Duration
+	// LogJA3 logs the JA3 fingerprint of TLS clients. The first data the
+	// client sends in a session is checked for a TLS ClientHello, the hash is
+	// also shown in the session list
+	LogJA3 bool
+	// AllowUnixTargets allows CONNECT requests to unix domain sockets on the
+	// proxy host with the RequestAddressTypeUnixPath extension. Disabled by
+	// default as clients can reach any socket the proxy can open
+	AllowUnixTargets bool
+	// Metrics receives the connection, byte and latency metrics if set
+	Metrics Metrics
+	// Clock is the time source of the timeouts, see Clock. Defaults to the
+	// system clock
+	Clock Clock
+	// ReusePort is the number of listeners Start opens on ServerAddr using
+	// SO_REUSEPORT, each with its own accept loop so the kernel spreads new
+	// connections over them. Only supported on linux and the BSDs, other
+	// platforms use a single listener. 0 or 1 opens a single listener
+	ReusePort int
+
+	resumableSessions sync.Map
+	sessions          sync.Map
+	// selfChecks holds the client addresses of running self checks
+	selfChecks sync.Map
+	logSampler logSampler
+	// handshakeSem holds a token for every running handshake
+	handshakeSem     chan struct{}
+	handshakeSemOnce sync.Once
+	rewrites         atomic.Value
+	// configMu protects ACL and Credentials when they are replaced at runtime
+	configMu sync.RWMutex
+	config   *Config
+	// mu protects the listeners
+	mu        sync.Mutex
+	listeners []net.Listener
+
+	// hooksMu protects the shutdown hooks
+	hooksMu      sync.Mutex
+	onShutdown   []func()
+	onDrained    []func()
+	shutdownOnce sync.Once
+	drainedOnce  sync.Once
+	shuttingDown int32
+	// closed is set by Stop, Shutdown and Close, accessed atomically
+	closed int32
+	// conns holds the open client connections for Close
+	conns sync.Map
 }
 
 // Start is the main function to start a proxy
 func (p *Proxy) Start() error {
-	listener, err := net.Listen("tcp", p.ServerAddr)
+	listeners, err := p.listenTCP(p.ServerAddr)
 	if err != nil {
 		return err
 	}
-	go p.run(listener)
+	for _, listener := range listeners {
+		go p.Serve(listener)
+	}
 	return nil
 }
 
-func (p *Proxy) run(listener net.Listener) {
+// Serve accepts connections on the listener and blocks until the listener is
+// closed. Use this to serve on custom listeners like tls.Listen. Serve can be
+// called for multiple listeners, they share the limits and stats. It returns
+// ErrProxyClosed if the proxy was stopped or closed, otherwise the error
+// of the listener
+func (p *Proxy) Serve(listener net.Listener) error {
+	p.mu.Lock()
+	if p.isClosed() {
+		p.mu.Unlock()
+		listener.Close()
+		return ErrProxyClosed
+	}
+	p.listeners = append(p.listeners, listener)
+	p.mu.Unlock()
+	return p.run(listener)
+}
+
+// primaryListener returns the first listener the proxy serves on or nil if it
+// is not listening
+func (p *Proxy) primaryListener() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.listeners) == 0 {
+		return nil
+	}
+	return p.listeners[0]
+}
+
+func (p *Proxy) run(listener net.Listener) error {
+	done := p.done()
 	for {
 		select {
-		case <-p.Done:
-			return
+		case <-done:
+			return ErrProxyClosed
 		default:
 			connection, err := listener.Accept()
-			if err == nil {
-				go p.handle(connection)
-			} else {
-				log.Errorf("Error accepting conn: %v", err)
+			if err != nil {
+				if p.isClosed() {
+					return ErrProxyClosed
+				}
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				p.logSampled(context.Background(), log.ErrorLevel, nil, "Error accepting conn: %v", err)
+				continue
 			}
+			if p.MaxConnections > 0 && atomic.LoadInt64(&p.activeConnections) >= int64(p.MaxConnections) {
+				p.logSampled(context.Background(), log.WarnLevel, nil, "connection limit of %d reached, dropping connection from %s", p.MaxConnections, connection.RemoteAddr())
+				connection.Close()
+				continue
+			}
+			atomic.AddInt64(&p.activeConnections, 1)
+			go func() {
+				defer p.connectionDone()
+				p.handle(context.Background(), wrapIO(connection))
+			}()
 		}
 	}
 }
 
+// ListenAndServe starts the proxy and blocks until it is stopped. If the
+// proxy was created from a Config, the config is reloaded on SIGHUP. It
+// returns ErrProxyClosed after Stop, Shutdown or Close
+func (p *Proxy) ListenAndServe() error {
+	p.mu.Lock()
+	if p.Done == nil {
+		p.Done = make(chan struct{})
+	}
+	done := p.Done
+	p.mu.Unlock()
+	if err := p.Start(); err != nil {
+		return err
+	}
+	if p.config != nil {
+		go p.reloadOnSIGHUP(done)
+	}
+	<-done
+	return ErrProxyClosed
+}
+
+// SetACL replaces the ACL. Safe to call while the proxy is running
+func (p *Proxy) SetACL(acl *IPListACL) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	p.ACL = acl
+}
+
+func (p *Proxy) getACL() *IPListACL {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.ACL
+}
+
+// SetCredentials replaces the credentials. Safe to call while the proxy is
+// running
+func (p *Proxy) SetCredentials(creds CredentialStore) {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	p.Credentials = creds
+}
+
+// CurrentCredentials returns the credentials in use, for example to
+// authenticate the clients of another front-end. It is nil if no
+// authentication is required
+func (p *Proxy) CurrentCredentials() CredentialStore {
+	return p.getCredentials()
+}
+
+func (p *Proxy) getCredentials() CredentialStore {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.Credentials
+}
+
+// done returns the Done channel. Stop and Close set it to nil after closing
+// it, so it must only be read with the lock held
+func (p *Proxy) done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Done
+}
+
 // Stop stops the proxy
 func (p *Proxy) Stop() {
 	log.Warn("Stopping proxy")
+	atomic.StoreInt32(&p.closed, 1)
+	p.closeListener()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if p.Done == nil {
 		return
 	}
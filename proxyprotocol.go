@@ -0,0 +1,121 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ProxyProtocolVersion is the version of the PROXY protocol header sent to
+// the remote
+type ProxyProtocolVersion int
+
+const (
+	// ProxyProtocolNone sends no header
+	ProxyProtocolNone ProxyProtocolVersion = iota
+	// ProxyProtocolV1 sends the human readable header
+	ProxyProtocolV1
+	// ProxyProtocolV2 sends the binary header
+	ProxyProtocolV2
+)
+
+// proxyProtocolV2Signature starts every v2 header
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+type proxyProtocolKey struct{}
+
+func withProxyProtocol(ctx context.Context, version ProxyProtocolVersion) context.Context {
+	return context.WithValue(ctx, proxyProtocolKey{}, version)
+}
+
+// proxyProtocolFromContext returns the version requested by the policy
+func proxyProtocolFromContext(ctx context.Context) ProxyProtocolVersion {
+	version, _ := ctx.Value(proxyProtocolKey{}).(ProxyProtocolVersion)
+	return version
+}
+
+// writeProxyProtocolHeader writes the header for a connection from src to
+// dst. Addresses that are not tcp addresses are sent as unknown
+func writeProxyProtocolHeader(w io.Writer, version ProxyProtocolVersion, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyProtocolV1Header(src, dst)
+	case ProxyProtocolV2:
+		header = proxyProtocolV2Header(src, dst)
+	default:
+		return fmt.Errorf("invalid proxy protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyProtocolAddrs returns the tcp addresses of src and dst. Both addresses
+// are returned in the same length, ipv4 addresses are mapped to ipv6 if the
+// other address is ipv6
+func proxyProtocolAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	srcIP, dstIP := s.IP.To4(), d.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+	}
+	return &net.TCPAddr{IP: srcIP, Port: s.Port}, &net.TCPAddr{IP: dstIP, Port: d.Port}, true
+}
+
+func proxyProtocolV1Header(src, dst net.Addr) []byte {
+	s, d, ok := proxyProtocolAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if len(s.IP) == net.IPv6len {
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyProtocolV6String(s.IP), proxyProtocolV6String(d.IP), s.Port, d.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+}
+
+// proxyProtocolV6String formats ip for a TCP6 line. net.IP prints mapped
+// ipv4 addresses in the ipv4 form which is not allowed there
+func proxyProtocolV6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyProtocolV2Header(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+	s, d, ok := proxyProtocolAddrs(src, dst)
+	if !ok {
+		// unspecified family without addresses
+		buf.Write([]byte{0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	family := byte(0x11)
+	if len(s.IP) == net.IPv6len {
+		family = 0x21
+	}
+	buf.WriteByte(family)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(2*len(s.IP)+4))
+	buf.Write(length)
+	buf.Write(s.IP)
+	buf.Write(d.IP)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(s.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(d.Port))
+	buf.Write(ports)
+	return buf.Bytes()
+}
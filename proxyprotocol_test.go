@@ -0,0 +1,122 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v2 := func(b ...byte) []byte {
+		return append(append([]byte{}, proxyProtocolV2Signature...), b...)
+	}
+	tests := []struct {
+		name     string
+		version  ProxyProtocolVersion
+		src, dst net.Addr
+		want     []byte
+	}{
+		{"v1 ipv4", ProxyProtocolV1, v4src, v4dst, []byte("PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n")},
+		{"v1 ipv6", ProxyProtocolV1, v6src, v4dst, []byte("PROXY TCP6 2001:db8::1 ::ffff:198.51.100.7 56324 443\r\n")},
+		{"v1 unknown", ProxyProtocolV1, nil, v4dst, []byte("PROXY UNKNOWN\r\n")},
+		{"v2 ipv4", ProxyProtocolV2, v4src, v4dst, v2(0x21, 0x11, 0x00, 0x0C, 192, 0, 2, 1, 198, 51, 100, 7, 0xDC, 0x04, 0x01, 0xBB)},
+		{"v2 ipv6", ProxyProtocolV2, v6src, v4dst, v2(0x21, 0x21, 0x00, 0x24,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 198, 51, 100, 7,
+			0xDC, 0x04, 0x01, 0xBB)},
+		{"v2 unknown", ProxyProtocolV2, &net.UnixAddr{Name: "/tmp/socks.sock", Net: "unix"}, v4dst, v2(0x21, 0x00, 0x00, 0x00)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyProtocolHeader(&buf, tt.version, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Fatalf("got header %q, want %q", buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// headerServer accepts one connection, reads until the first "ping\n" and
+// returns everything received before it, like a PROXY protocol aware backend
+func headerServer(tb testing.TB) (string, <-chan []byte) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var data []byte
+		buf := make([]byte, 256)
+		for !bytes.HasSuffix(data, []byte("ping\n")) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			data = append(data, buf[:n]...)
+		}
+		received <- bytes.TrimSuffix(data, []byte("ping\n"))
+		_, _ = conn.Write([]byte("ok\n"))
+	}()
+	return l.Addr().String(), received
+}
+
+func TestProxyProtocolDestinations(t *testing.T) {
+	tests := []struct {
+		name         string
+		destinations bool
+		policy       ProxyProtocolVersion
+		want         func(src, dst net.Addr) []byte
+	}{
+		{"configured destination", true, ProxyProtocolNone, proxyProtocolV1Header},
+		{"policy", false, ProxyProtocolV2, proxyProtocolV2Header},
+		{"other destination", false, ProxyProtocolNone, func(net.Addr, net.Addr) []byte { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, received := headerServer(t)
+			handler := &DefaultHandler{Timeout: time.Second, ProxyProtocol: ProxyProtocolV1}
+			if tt.destinations {
+				handler.ProxyProtocolDestinations = []string{backend}
+			}
+			p := &Proxy{
+				Proxyhandler: handler,
+				Timeout:      time.Second,
+				Policy: func(context.Context, Request) PolicyDecision {
+					return PolicyDecision{Action: PolicyActionAllow, ProxyProtocol: tt.policy}
+				},
+			}
+			client := &Client{ProxyAddr: serveProxy(t, p), Timeout: 5 * time.Second}
+			conn, err := client.Dial("tcp", backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			roundTrip(t, conn)
+
+			backendAddr, err := net.ResolveTCPAddr("tcp", backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the header carries the address of the socks client
+			want := tt.want(conn.LocalAddr(), backendAddr)
+			if got := <-received; !bytes.Equal(got, want) {
+				t.Fatalf("backend got %q before the data, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+// Package quic implements the stream transport interfaces of gosocks over
+// QUIC. It is a separate module so quic-go is only needed if it is used
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol negotiated on QUIC connections
+const ALPN = "socks"
+
+// defaultIdleTimeout is used if Options.IdleTimeout is not set
+const defaultIdleTimeout = 30 * time.Second
+
+// Options configures QUIC connections
+type Options struct {
+	// IdleTimeout closes the connection if no packets were received for the
+	// duration. Defaults to 30 seconds
+	IdleTimeout time.Duration
+	// KeepAlivePeriod sends keep-alive packets to keep NAT mappings open.
+	// Defaults to half of IdleTimeout, a negative value disables it
+	KeepAlivePeriod time.Duration
+	// Allow0RTT enables 0-RTT. 0-RTT data can be replayed by an attacker, so
+	// it is disabled by default
+	Allow0RTT bool
+}
+
+// ProxyOptions returns options with the idle timeout of the proxy, so idle
+// QUIC connections are closed like idle pipelined connections
+func ProxyOptions(p *socks.Proxy) *Options {
+	return &Options{IdleTimeout: p.IdleTimeout}
+}
+
+func (o *Options) config() *quicgo.Config {
+	if o == nil {
+		o = &Options{}
+	}
+	idle := o.IdleTimeout
+	if idle <= 0 {
+		idle = defaultIdleTimeout
+	}
+	keepAlive := o.KeepAlivePeriod
+	if keepAlive == 0 {
+		keepAlive = idle / 2
+	} else if keepAlive < 0 {
+		keepAlive = 0
+	}
+	return &quicgo.Config{
+		MaxIdleTimeout:  idle,
+		KeepAlivePeriod: keepAlive,
+		Allow0RTT:       o.Allow0RTT,
+	}
+}
+
+// tlsConfig sets the ALPN of the config
+func tlsConfig(c *tls.Config) *tls.Config {
+	if c == nil {
+		c = &tls.Config{MinVersion: tls.VersionTLS13}
+	} else {
+		c = c.Clone()
+	}
+	c.NextProtos = []string{ALPN}
+	return c
+}
+
+// Session is a QUIC connection implementing socks.StreamDialer and
+// socks.StreamListener. Every stream carries one socks connection
+type Session struct {
+	conn quicgo.Connection
+}
+
+var (
+	_ socks.StreamDialer   = (*Session)(nil)
+	_ socks.StreamListener = (*Session)(nil)
+)
+
+// Dial connects to a QUIC server. The ALPN is set on the tls config
+func Dial(ctx context.Context, addr string, tlsConf *tls.Config, opts *Options) (*Session, error) {
+	cfg := opts.config()
+	var conn quicgo.Connection
+	var err error
+	if cfg.Allow0RTT {
+		conn, err = quicgo.DialAddrEarly(ctx, addr, tlsConfig(tlsConf), cfg)
+	} else {
+		conn, err = quicgo.DialAddr(ctx, addr, tlsConfig(tlsConf), cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Session{conn: conn}, nil
+}
+
+// OpenStream opens a new stream. It waits if the peer does not allow more
+// streams yet
+func (s *Session) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, s.mapError(err)
+	}
+	return s.wrap(stream), nil
+}
+
+// AcceptStream waits for the next stream opened by the peer
+func (s *Session) AcceptStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	stream, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, s.mapError(err)
+	}
+	return s.wrap(stream), nil
+}
+
+// Close closes the connection and all streams
+func (s *Session) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+// mapError returns net.ErrClosed once the connection is closed so
+// ServeStreams ends without an error
+func (s *Session) mapError(err error) error {
+	var appErr *quicgo.ApplicationError
+	var idleErr *quicgo.IdleTimeoutError
+	if errors.As(err, &appErr) || errors.As(err, &idleErr) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (s *Session) wrap(stream quicgo.Stream) *streamConn {
+	return &streamConn{Stream: stream, local: s.conn.LocalAddr(), remote: s.conn.RemoteAddr()}
+}
+
+// Listener accepts QUIC connections
+type Listener struct {
+	accept func(ctx context.Context) (quicgo.Connection, error)
+	close  func() error
+	addr   net.Addr
+}
+
+// Listen listens for QUIC connections on the udp address. The ALPN is set
+// on the tls config
+func Listen(addr string, tlsConf *tls.Config, opts *Options) (*Listener, error) {
+	cfg := opts.config()
+	if cfg.Allow0RTT {
+		l, err := quicgo.ListenAddrEarly(addr, tlsConfig(tlsConf), cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Listener{
+			accept: func(ctx context.Context) (quicgo.Connection, error) { return l.Accept(ctx) },
+			close:  l.Close,
+			addr:   l.Addr(),
+		}, nil
+	}
+	l, err := quicgo.ListenAddr(addr, tlsConfig(tlsConf), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{accept: l.Accept, close: l.Close, addr: l.Addr()}, nil
+}
+
+// Accept waits for the next connection
+func (l *Listener) Accept(ctx context.Context) (*Session, error) {
+	conn, err := l.accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{conn: conn}, nil
+}
+
+// Close stops accepting connections
+func (l *Listener) Close() error {
+	return l.close()
+}
+
+// Addr returns the udp address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Serve serves the streams of every accepted connection with the proxy. It
+// blocks until the listener is closed
+func Serve(ctx context.Context, p *socks.Proxy, l *Listener) error {
+	for {
+		session, err := l.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quicgo.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer session.Close()
+			_ = p.ServeStreams(ctx, session)
+		}()
+	}
+}
+
+// streamConn is a QUIC stream with the addresses of its connection so it
+// can be used as a net.Conn
+type streamConn struct {
+	quicgo.Stream
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// CloseWrite closes the send direction of the stream
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close closes both directions. Close of a QUIC stream only closes the send
+// direction
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
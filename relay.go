@@ -0,0 +1,152 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Relay serves a request that was received by another front-end, like the
+// direct-tcpip channels of an ssh server used for dynamic forwarding. The
+// socks handshake and the replies are skipped, everything behind them is
+// the same as for socks clients: the rewrites, policy and access lists are
+// applied, the destination is dialed with the handler and the data is
+// relayed and accounted in the session list. Only CONNECT requests are
+// supported. Pass the client address and username with WithConnInfo. Relay
+// blocks until the session ends, closes clientStream and returns the stats
+// of the session. If the destination could not be connected CloseReason is
+// CloseReasonHandshakeFailure and HandshakeReply holds the reply a socks
+// client would have received
+func (p *Proxy) Relay(ctx context.Context, clientStream io.ReadWriteCloser, req Request) (SessionStats, error) {
+	return p.RelayWithReply(ctx, clientStream, req, nil)
+}
+
+// ReplyFunc sends the reply of a front-end to its client. It is called
+// once per session before the data is relayed, either with
+// RequestReplySucceeded and the bound address after the destination was
+// connected or with the reason the request failed. The session ends if it
+// returns an error
+type ReplyFunc func(reason RequestReplyReason, bindAddr net.Addr) error
+
+// RelayWithReply works like Relay and lets front-ends answer their clients
+// with reply, like the status line of an HTTP CONNECT response
+func (p *Proxy) RelayWithReply(ctx context.Context, clientStream io.ReadWriteCloser, req Request, reply ReplyFunc) (SessionStats, error) {
+	defer clientStream.Close()
+	if stats, ok := ctx.Value(acceptedKey{}).(*SessionStats); ok {
+		// the connection was accepted by the proxy and handed to the
+		// HTTPConnect front-end, it is already counted and has a tenant
+		if err := p.relayWithReply(ctx, clientStream, req, reply, stats); err != nil {
+			return *stats, err
+		}
+		return *stats, nil
+	}
+
+	atomic.AddInt64(&p.activeConnections, 1)
+	defer p.connectionDone()
+	p.conns.Store(clientStream, struct{}{})
+	defer p.conns.Delete(clientStream)
+	p.metrics().IncConnections()
+
+	stats := &SessionStats{started: p.clock().Now()}
+	ctx = WithStats(p.withConnID(ctx), stats)
+	ctx = withClientAddr(ctx, clientStream)
+	ctx, err := p.resolveTenant(ctx)
+	if err != nil {
+		stats.CloseReason = CloseReasonHandshakeFailure
+		stats.HandshakeReply = RequestReplyConnectionNotAllowed
+		if reply != nil {
+			if err := reply(stats.HandshakeReply, nil); err != nil {
+				log.Debugf("could not send reply: %v", err)
+			}
+		}
+		return *stats, fmt.Errorf("could not resolve tenant: %w", err)
+	}
+
+	defer func() {
+		p.metrics().AddBytes(atomic.LoadInt64(&stats.BytesClientToRemote), atomic.LoadInt64(&stats.BytesRemoteToClient))
+		log.Debugf("relayed %d bytes from client to remote and %d bytes from remote to client, session closed: %s",
+			atomic.LoadInt64(&stats.BytesClientToRemote), atomic.LoadInt64(&stats.BytesRemoteToClient), stats.CloseReason)
+	}()
+	if err := p.relayWithReply(ctx, clientStream, req, reply, stats); err != nil {
+		return *stats, err
+	}
+	return *stats, nil
+}
+
+// acceptedKey marks the context of connections the proxy accepted itself
+// and passed to HTTPConnect. It holds the stats of the session
+type acceptedKey struct{}
+
+// relayWithReply relays the request without the connection accounting and
+// the tenant resolution, which are done by the caller
+func (p *Proxy) relayWithReply(ctx context.Context, clientStream io.ReadWriteCloser, req Request, reply ReplyFunc, stats *SessionStats) *Error {
+	// replied is set once reply was called so failures after the success
+	// reply are not answered again
+	replied := false
+	sendReply := func(reason RequestReplyReason, addr net.Addr) error {
+		if reply == nil || replied {
+			return nil
+		}
+		replied = true
+		return reply(reason, addr)
+	}
+
+	if info, ok := ConnInfoFromContext(ctx); ok && req.Username == "" {
+		req.Username = info.Username
+	}
+	if req.Username != "" {
+		ctx = WithUser(ctx, req.Username)
+	}
+
+	connected := func(remote io.ReadWriteCloser) (io.ReadWriteCloser, func(), *Error) {
+		addr, mapErr := p.mapAddress(bindAddr(remote))
+		if mapErr != nil {
+			return nil, nil, mapErr
+		}
+		if err := sendReply(RequestReplySucceeded, addr); err != nil {
+			return nil, nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send reply: %w", err)}
+		}
+		stats.HandshakePhase = HandshakePhaseDone
+		return clientStream, nil, nil
+	}
+	if serr := p.relay(ctx, clientStream, &req, stats, connected); serr != nil {
+		if stats.CloseReason == CloseReasonNone {
+			stats.CloseReason = CloseReasonHandshakeFailure
+			stats.HandshakeReply = serr.Reason
+			if err := sendReply(serr.Reason, nil); err != nil {
+				log.Debugf("could not send reply: %v", err)
+			}
+		}
+		return serr
+	}
+	return nil
+}
+
+// relay checks the request, connects it and relays the data
+func (p *Proxy) relay(ctx context.Context, client io.ReadWriteCloser, request *Request, stats *SessionStats, connected connectedFunc) *Error {
+	defer func() {
+		if err := p.Proxyhandler.Cleanup(); err != nil {
+			log.Errorf("error on cleanup: %v", err)
+		}
+	}()
+
+	if request.Command != RequestCmdConnect {
+		return &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("command %s not supported for relayed requests", request.Command)}
+	}
+	switch request.AddressType {
+	case RequestAddressTypeIPv4, RequestAddressTypeIPv6, RequestAddressTypeDomainname:
+	case RequestAddressTypeUnixPath:
+		if !p.AllowUnixTargets {
+			return &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("unix destination %s denied: unix targets are not enabled", request.getDestinationString())}
+		}
+	default:
+		return &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("address type %s not supported", request.AddressType)}
+	}
+	request.normalizeMappedIPv4()
+
+	return p.relayRequest(ctx, client, request, stats, connected)
+}
@@ -0,0 +1,80 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Releaser is implemented by remote connections the proxy does not own, for
+// example connections borrowed from a pool. The proxy calls Release instead
+// of Close when the session ends and never calls both. clean is true if the
+// session ended normally and the connection can be reused. Implement
+// CloseWrite as well, otherwise the connection is released as not clean when
+// the client finished sending
+type Releaser interface {
+	Release(clean bool) error
+}
+
+// releasingConn calls Release exactly once instead of Close. Closing the
+// connection to unblock the relay releases it as not clean
+type releasingConn struct {
+	io.ReadWriteCloser
+	releaser Releaser
+
+	once sync.Once
+	err  error
+}
+
+// wrapReleaser wraps remote if it implements Releaser
+func wrapReleaser(remote io.ReadWriteCloser) io.ReadWriteCloser {
+	r, ok := remote.(Releaser)
+	if !ok {
+		return remote
+	}
+	return &releasingConn{ReadWriteCloser: remote, releaser: r}
+}
+
+// finishRemote ends the use of the remote connection by the session
+func finishRemote(remote io.ReadWriteCloser, clean bool) error {
+	if c, ok := remote.(*releasingConn); ok {
+		return c.release(clean)
+	}
+	return remote.Close()
+}
+
+func (c *releasingConn) release(clean bool) error {
+	c.once.Do(func() {
+		c.err = c.releaser.Release(clean)
+	})
+	return c.err
+}
+
+// Close releases the connection as not clean
+func (c *releasingConn) Close() error {
+	return c.release(false)
+}
+
+// CloseWrite half-closes the connection if supported. Otherwise the
+// connection is released as not clean, like closeWrite closes other
+// connections, so the relay does not wait for the remote forever
+func (c *releasingConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.release(false)
+}
+
+// BindAddr returns the bind address of the wrapped connection
+func (c *releasingConn) BindAddr() net.Addr {
+	return bindAddr(c.ReadWriteCloser)
+}
+
+// SetWriteDeadline sets the deadline of the wrapped connection if supported
+func (c *releasingConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
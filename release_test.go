@@ -0,0 +1,120 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// borrowedConn records how the proxy ends the use of a remote connection
+type borrowedConn struct {
+	net.Conn
+	readErr error
+
+	mu       sync.Mutex
+	releases []bool
+	closes   int
+}
+
+func (c *borrowedConn) Read(b []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *borrowedConn) CloseWrite() error {
+	return c.Conn.(closeWriter).CloseWrite()
+}
+
+func (c *borrowedConn) Release(clean bool) error {
+	c.mu.Lock()
+	c.releases = append(c.releases, clean)
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *borrowedConn) Close() error {
+	c.mu.Lock()
+	c.closes++
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *borrowedConn) calls() ([]bool, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bool(nil), c.releases...), c.closes
+}
+
+// borrowingHandler hands out the dialed connections as borrowedConn
+type borrowingHandler struct {
+	DefaultHandler
+	readErr error
+	conns   chan *borrowedConn
+}
+
+func (h *borrowingHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	remote, err := h.DefaultHandler.PreHandler(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	c := &borrowedConn{Conn: remote.(net.Conn), readErr: h.readErr}
+	h.conns <- c
+	return c, nil
+}
+
+func TestReleaser(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapper  func(net.Addr) (net.Addr, error)
+		readErr error
+		reply   RequestReplyReason
+		clean   bool
+	}{
+		{"success", nil, nil, RequestReplySucceeded, true},
+		{"handshake failure after dial", func(net.Addr) (net.Addr, error) { return nil, errors.New("no mapping") }, nil, RequestReplyGeneralFailure, false},
+		{"relay error", nil, errors.New("remote failed"), RequestReplySucceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &borrowingHandler{
+				DefaultHandler: DefaultHandler{Timeout: time.Second},
+				readErr:        tt.readErr,
+				conns:          make(chan *borrowedConn, 1),
+			}
+			p := &Proxy{
+				Proxyhandler:  handler,
+				Timeout:       time.Second,
+				AddressMapper: tt.mapper,
+			}
+			conn := dialProxy(t, serveProxy(t, p), "", "")
+			if reply := sendRequest(t, conn, lineServer(t)); reply != tt.reply {
+				t.Fatalf("got reply %s, want %s", reply, tt.reply)
+			}
+			if tt.reply == RequestReplySucceeded && tt.readErr == nil {
+				roundTrip(t, conn)
+			}
+			conn.Close()
+
+			remote := <-handler.conns
+			waitFor(t, func() bool {
+				releases, _ := remote.calls()
+				return len(releases) > 0
+			})
+			// the session may still be cleaned up
+			time.Sleep(10 * time.Millisecond)
+			releases, closes := remote.calls()
+			if len(releases) != 1 || closes != 0 {
+				t.Fatalf("got %d releases and %d closes, want one release", len(releases), closes)
+			}
+			if releases[0] != tt.clean {
+				t.Fatalf("got clean %t, want %t", releases[0], tt.clean)
+			}
+		})
+	}
+}
@@ -87,8 +87,8 @@ func requestReply(in net.Addr, reply RequestReplyReason) ([]byte, error) {
 	} else {
 		// type
 		buf = append(buf, RequestAddressTypeIPv4.Value())
-		// error reply
-		buf = append(buf, []byte{0, 0, 0, 0, 0}...)
+		// error reply, empty ipv4 address and port
+		buf = append(buf, []byte{0, 0, 0, 0, 0, 0}...)
 	}
 	return buf, nil
 }
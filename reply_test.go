@@ -0,0 +1,165 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedConn is a client connection that sends the handshake and records
+// everything the proxy writes, also after it was closed, so a reply written
+// into a closed tunnel shows up. Message i of the handshake is sent after
+// the proxy wrote i times, like a client waiting for the answers
+type scriptedConn struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	messages [][]byte
+	sent     int
+	writes   int
+	written  bytes.Buffer
+	closed   bool
+}
+
+func newScriptedConn(messages ...[]byte) *scriptedConn {
+	c := &scriptedConn{messages: messages}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.sent < len(c.messages) && c.writes >= c.sent {
+			n := copy(b, c.messages[c.sent])
+			c.messages[c.sent] = c.messages[c.sent][n:]
+			if len(c.messages[c.sent]) == 0 {
+				c.sent++
+			}
+			return n, nil
+		}
+		if c.closed {
+			return 0, io.EOF
+		}
+		// the client keeps the connection open until the proxy closes it
+		c.cond.Wait()
+	}
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	c.cond.Broadcast()
+	return c.written.Write(b)
+}
+
+func (c *scriptedConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *scriptedConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+// idleRemote is a remote connection that never sends anything
+type idleRemote struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *idleRemote) Read([]byte) (int, error) {
+	<-r.closed
+	return 0, io.EOF
+}
+
+func (r *idleRemote) Write(b []byte) (int, error) { return len(b), nil }
+
+func (r *idleRemote) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+// brokenRelayHandler sends payload to the client and then fails the relay
+// like a reset remote. Cleanup panics if panicOnCleanup is set
+type brokenRelayHandler struct {
+	DefaultHandler
+	payload        []byte
+	panicOnCleanup bool
+}
+
+func (h *brokenRelayHandler) PreHandler(context.Context, Request) (io.ReadWriteCloser, *Error) {
+	return &idleRemote{closed: make(chan struct{})}, nil
+}
+
+func (h *brokenRelayHandler) CopyFromRemoteToClient(_ context.Context, _ io.ReadCloser, client io.WriteCloser) error {
+	if _, err := client.Write(h.payload); err != nil {
+		return err
+	}
+	return errors.New("connection reset by peer")
+}
+
+func (h *brokenRelayHandler) Cleanup() error {
+	if h.panicOnCleanup {
+		panic("cleanup failed")
+	}
+	return nil
+}
+
+func TestNoReplyAfterTunnelEstablished(t *testing.T) {
+	payload := []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhel")
+	for _, panicOnCleanup := range []bool{false, true} {
+		name := "relay error"
+		if panicOnCleanup {
+			name = "panic after relay"
+		}
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{
+				Proxyhandler: &brokenRelayHandler{payload: payload, panicOnCleanup: panicOnCleanup},
+				Timeout:      time.Second,
+			}
+			request, err := buildRequest(RequestCmdConnect, "192.0.2.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := newScriptedConn([]byte{0x05, 0x01, MethodNoAuthRequired}, request)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.HandleConn(conn)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("session did not end")
+			}
+
+			r := bytes.NewReader(conn.bytes())
+			selection := make([]byte, 2)
+			if _, err := io.ReadFull(r, selection); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readReply(r); err != nil {
+				t.Fatalf("no success reply: %v", err)
+			}
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, payload) {
+				t.Fatalf("client got %q after the reply, want exactly %q", rest, payload)
+			}
+		})
+	}
+}
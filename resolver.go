@@ -0,0 +1,56 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolver resolves domain names. net.Resolver implements this interface
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func (p *Proxy) resolver() Resolver {
+	if p.Resolver != nil {
+		return p.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// resolveDestination returns the addresses of the requested destination.
+// Domain names are only resolved once per request, the result is stored in
+// request.ResolvedAddresses
+func (p *Proxy) resolveDestination(ctx context.Context, request *Request) ([]net.IP, *Error) {
+	switch request.AddressType {
+	case RequestAddressTypeIPv4, RequestAddressTypeIPv6:
+		return []net.IP{net.IP(request.DestinationAddress)}, nil
+	case RequestAddressTypeDomainname:
+		if len(request.ResolvedAddresses) > 0 {
+			return request.ResolvedAddresses, nil
+		}
+		host := string(request.DestinationAddress)
+		addrs, err := p.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &Error{Reason: RequestReplyHostUnreachable, Err: fmt.Errorf("could not resolve %s: %w", host, err)}
+		}
+		if len(addrs) == 0 {
+			return nil, &Error{Reason: RequestReplyHostUnreachable, Err: fmt.Errorf("no addresses found for %s", host)}
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		ips = p.EgressFamily.filter(ips)
+		if len(ips) == 0 {
+			return nil, &Error{Reason: RequestReplyHostUnreachable, Err: fmt.Errorf("no addresses of the allowed family found for %s", host)}
+		}
+		log.Debugf("resolved %s to %v", host, ips)
+		request.ResolvedAddresses = ips
+		return ips, nil
+	default:
+		return nil, &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("address type %s not supported", request.AddressType)}
+	}
+}
@@ -0,0 +1,63 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rebindingResolver returns a different address on every lookup like a
+// malicious authoritative server
+type rebindingResolver struct {
+	mu      sync.Mutex
+	answers []net.IP
+	lookups int
+}
+
+func (r *rebindingResolver) LookupIPAddr(_ context.Context, _ string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ip := r.answers[r.lookups%len(r.answers)]
+	r.lookups++
+	return []net.IPAddr{{IP: ip}}, nil
+}
+
+func TestDialUsesVettedAddress(t *testing.T) {
+	target := lineServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	resolver := &rebindingResolver{answers: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}}
+	handler := &recordingHandler{DefaultHandler: DefaultHandler{Timeout: time.Second}}
+	p := &Proxy{
+		Proxyhandler: handler,
+		Timeout:      time.Second,
+		Resolver:     resolver,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, net.JoinHostPort("rebind.example", port)); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+
+	request, _ := handler.last(t)
+	if len(request.ResolvedAddresses) != 1 || !request.ResolvedAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("handler got resolved addresses %v, want the first answer", request.ResolvedAddresses)
+	}
+	resolver.mu.Lock()
+	lookups := resolver.lookups
+	resolver.mu.Unlock()
+	if lookups != 1 {
+		t.Errorf("name was resolved %d times, want once", lookups)
+	}
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if got := sessions[0].RemoteAddr; got != target {
+		t.Errorf("session dialed %s, want %s", got, target)
+	}
+	if got := sessions[0].ResolvedAddrs; len(got) != 1 || got[0] != "127.0.0.1" {
+		t.Errorf("session has resolved addresses %v, want [127.0.0.1]", got)
+	}
+}
@@ -0,0 +1,237 @@
+package socks
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Experimental session resumption (vendor extension)
+
+	A client requests a resumable session by sending RequestCmdResume (0xF0)
+	instead of CONNECT with a normal destination address. On success the
+	server sends the normal success reply followed by
+
+	+-----+----------+
+	| LEN |  TOKEN   |
+	+-----+----------+
+	|  1  | Variable |
+	+-----+----------+
+
+	If the client connection breaks, the client can open a new connection,
+	do the method negotiation and send RequestCmdResume with the address
+	type RequestAddressTypeSessionToken. The address field has the same
+	layout as a domain name (1 byte length followed by the token) and the
+	port is ignored. If the session is still alive the server sends a success
+	reply and the data transfer continues on the new connection. Only the
+	user and tenant that started the session can resume it, others get
+	RequestReplyConnectionNotAllowed.
+*/
+
+const sessionTokenLength = 16
+
+// resumableSession holds a session that can be reattached to a new client
+// connection
+type resumableSession struct {
+	conn *resumableConn
+	done chan struct{}
+	// username and tenant of the client that started the session
+	username string
+	tenant   string
+}
+
+// resumableConn is a client connection that can be swapped while the copy
+// goroutines are running. Reads and writes that fail on a broken connection
+// wait until a new connection is attached or the timeout expires.
+type resumableConn struct {
+	mu       sync.Mutex
+	conn     io.ReadWriteCloser
+	gen      uint64
+	attached chan struct{}
+	closed   bool
+	timeout  time.Duration
+	clock    Clock
+}
+
+func newResumableConn(conn io.ReadWriteCloser, timeout time.Duration, clock Clock) *resumableConn {
+	return &resumableConn{
+		conn:     conn,
+		attached: make(chan struct{}),
+		timeout:  timeout,
+		clock:    clock,
+	}
+}
+
+func (r *resumableConn) current() (io.ReadWriteCloser, uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, 0, io.ErrClosedPipe
+	}
+	return r.conn, r.gen, nil
+}
+
+// waitForResume blocks until a new connection replaced the connection of
+// generation gen
+func (r *resumableConn) waitForResume(gen uint64, cause error) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return cause
+	}
+	if r.gen != gen {
+		// already replaced
+		r.mu.Unlock()
+		return nil
+	}
+	attached := r.attached
+	r.mu.Unlock()
+
+	log.Debugf("client connection broken, waiting %s for session resume: %v", r.timeout, cause)
+	timer := r.clock.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case <-attached:
+		return nil
+	case <-timer.C():
+		return fmt.Errorf("session was not resumed in time: %w", cause)
+	}
+}
+
+// attach replaces the current client connection
+func (r *resumableConn) attach(conn io.ReadWriteCloser) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+	r.conn.Close()
+	r.conn = conn
+	r.gen++
+	close(r.attached)
+	r.attached = make(chan struct{})
+	return nil
+}
+
+func (r *resumableConn) Read(b []byte) (int, error) {
+	for {
+		conn, gen, err := r.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(b)
+		if err == nil || n > 0 || errors.Is(err, io.EOF) {
+			return n, err
+		}
+		if err := r.waitForResume(gen, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *resumableConn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		conn, gen, err := r.current()
+		if err != nil {
+			return written, err
+		}
+		n, err := conn.Write(b[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if err := r.waitForResume(gen, err); err != nil {
+			return written, err
+		}
+	}
+}
+
+// CloseWrite half-closes the current client connection if it is supported
+func (r *resumableConn) CloseWrite() error {
+	conn, _, err := r.current()
+	if err != nil {
+		return err
+	}
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (r *resumableConn) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.conn.Close()
+}
+
+// registerResumableSession wraps the client connection and sends the session
+// token to the client
+func (p *Proxy) registerResumableSession(ctx context.Context, conn io.ReadWriteCloser) (*resumableSession, []byte, *Error) {
+	token := make([]byte, sessionTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return nil, nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not generate session token: %w", err)}
+	}
+	reply := append([]byte{byte(len(token))}, token...)
+	if err := connectionWrite(ctx, conn, reply, p.Timeout, p.clock()); err != nil {
+		return nil, nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send session token: %w", err)}
+	}
+
+	timeout := p.SessionResumeTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	session := &resumableSession{
+		conn: newResumableConn(conn, timeout, p.clock()),
+		done: make(chan struct{}),
+	}
+	session.username, _ = UserFromContext(ctx)
+	session.tenant, _ = TenantFromContext(ctx)
+	p.resumableSessions.Store(string(token), session)
+	return session, token, nil
+}
+
+// unregisterResumableSession removes the session once the data transfer ended
+func (p *Proxy) unregisterResumableSession(token []byte, session *resumableSession) {
+	p.resumableSessions.Delete(string(token))
+	close(session.done)
+}
+
+// resumeSession attaches the client connection to an existing session and
+// blocks until the session ends
+func (p *Proxy) resumeSession(ctx context.Context, conn io.ReadWriteCloser, token []byte, stats *SessionStats) *Error {
+	s, ok := p.resumableSessions.Load(string(token))
+	if !ok {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("unknown session token")}
+	}
+	session := s.(*resumableSession)
+	username, _ := UserFromContext(ctx)
+	tenant, _ := TenantFromContext(ctx)
+	if username != session.username || tenant != session.tenant {
+		return &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("session token belongs to another client")}
+	}
+
+	stats.HandshakePhase = HandshakePhaseReplyWrite
+	if err := p.handleRequestReply(ctx, conn, nil); err != nil {
+		return err
+	}
+	p.handshakeDone(stats)
+	if err := session.conn.attach(conn); err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not resume session: %w", err)}
+	}
+	log.Debug("session resumed")
+	// the connection is now used by the copy goroutines of the session
+	<-session.done
+	return nil
+}
@@ -0,0 +1,123 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startResumable requests a resumable session to target and returns the
+// session token
+func startResumable(t *testing.T, conn net.Conn, target string) []byte {
+	t.Helper()
+	request, err := buildRequest(RequestCmdResume, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readReplyReason(t, conn); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		t.Fatal(err)
+	}
+	token := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// resume sends a resume request with token and returns the reply code
+func resume(t *testing.T, conn net.Conn, token []byte) RequestReplyReason {
+	t.Helper()
+	request := []byte{Version5.Value(), byte(RequestCmdResume), 0x00, RequestAddressTypeSessionToken.Value(), byte(len(token))}
+	request = append(request, token...)
+	request = append(request, 0, 0)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	return readReplyReason(t, conn)
+}
+
+// breakConn resets the connection so the proxy sees an error instead of
+// the end of the stream
+func breakConn(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func resumeProxy() *Proxy {
+	return &Proxy{
+		Proxyhandler:         &DefaultHandler{Timeout: time.Second},
+		Timeout:              time.Second,
+		Credentials:          StaticCredentials{"alice": "secret", "bob": "secret"},
+		EnableSessionResume:  true,
+		SessionResumeTimeout: 5 * time.Second,
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	target := lineServer(t)
+	addr := serveProxy(t, resumeProxy())
+
+	conn := dialProxy(t, addr, "alice", "secret")
+	token := startResumable(t, conn, target)
+	roundTrip(t, conn)
+	breakConn(t, conn)
+
+	conn = dialProxy(t, addr, "alice", "secret")
+	if reply := resume(t, conn, token); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+}
+
+func TestResumeSessionOfOtherUser(t *testing.T) {
+	target := lineServer(t)
+	addr := serveProxy(t, resumeProxy())
+
+	conn := dialProxy(t, addr, "alice", "secret")
+	token := startResumable(t, conn, target)
+
+	other := dialProxy(t, addr, "bob", "secret")
+	if reply := resume(t, other, token); reply != RequestReplyConnectionNotAllowed {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplyConnectionNotAllowed)
+	}
+	// the session still belongs to alice
+	roundTrip(t, conn)
+}
+
+func TestResumeSessionExpired(t *testing.T) {
+	target := lineServer(t)
+	p := resumeProxy()
+	p.SessionResumeTimeout = 50 * time.Millisecond
+	addr := serveProxy(t, p)
+
+	conn := dialProxy(t, addr, "alice", "secret")
+	token := startResumable(t, conn, target)
+	breakConn(t, conn)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := p.resumableSessions.Load(string(token)); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session was not removed after the resume timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn = dialProxy(t, addr, "alice", "secret")
+	if reply := resume(t, conn, token); reply != RequestReplyGeneralFailure {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplyGeneralFailure)
+	}
+}
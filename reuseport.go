@@ -0,0 +1,48 @@
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenTCP opens the listeners for Start. If ReusePort is set, all
+// listeners are bound to the same address with SO_REUSEPORT
+func (p *Proxy) listenTCP(addr string) ([]net.Listener, error) {
+	n := p.ReusePort
+	if n > 1 && !reusePortSupported {
+		log.Warnf("SO_REUSEPORT is not supported on %s, using a single listener", runtime.GOOS)
+		n = 1
+	}
+	if n <= 1 {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	first, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// use the port of the first listener in case addr has port 0
+	addr = first.Addr().String()
+	listeners := []net.Listener{first}
+	for i := 1; i < n; i++ {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("could not open listener %d of %d on %s: %w", i+1, n, addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	log.Debugf("listening on %s with %d listeners", addr, n)
+	return listeners, nil
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package socks
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEPORT so multiple sockets can listen on the same
+// address
+func reusePort(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd uintptr) error {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("could not set SO_REUSEPORT: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,122 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RewriteRules maps requested destinations to new destinations. Keys and
+// values are in the host:port format.
+//
+// The host of a key can be an exact host, a wildcard like *.example.com
+// matching all subdomains or * matching every host. The port of a key can be
+// * to match every port.
+// An empty host or port in the value keeps the requested host or port, so
+// {"*:8080": ":80"} only overrides the port.
+//
+// The most specific rule wins: exact hosts before wildcard hosts (longest
+// suffix first) before *, and exact ports before * for the same host.
+type RewriteRules map[string]string
+
+type rewriteTarget struct {
+	host string
+	// 0 keeps the original port
+	port uint16
+}
+
+type rewriteTable map[string]rewriteTarget
+
+// SetRewriteRules validates and atomically replaces the rewrite rules. New
+// requests use the new rules immediately. Passing nil removes all rules
+func (p *Proxy) SetRewriteRules(rules RewriteRules) error {
+	table := make(rewriteTable, len(rules))
+	for from, to := range rules {
+		fromHost, fromPort, err := net.SplitHostPort(from)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite source %q: %w", from, err)
+		}
+		if fromHost == "" {
+			fromHost = "*"
+		}
+		if fromPort != "*" {
+			if _, err := strconv.ParseUint(fromPort, 10, 16); err != nil {
+				return fmt.Errorf("invalid port in rewrite source %q: %w", from, err)
+			}
+		}
+
+		toHost, toPort, err := net.SplitHostPort(to)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite destination %q: %w", to, err)
+		}
+		target := rewriteTarget{host: toHost}
+		if toPort != "" && toPort != "*" {
+			port, err := strconv.ParseUint(toPort, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port in rewrite destination %q: %w", to, err)
+			}
+			target.port = uint16(port)
+		}
+		table[net.JoinHostPort(strings.ToLower(fromHost), fromPort)] = target
+	}
+	p.rewrites.Store(table)
+	return nil
+}
+
+// lookup returns the matching rule for the destination
+func (t rewriteTable) lookup(host string, port uint16) (rewriteTarget, bool) {
+	host = strings.ToLower(host)
+	portString := strconv.FormatUint(uint64(port), 10)
+	hosts := []string{host}
+	for h := host; strings.Contains(h, "."); {
+		h = h[strings.Index(h, ".")+1:]
+		hosts = append(hosts, "*."+h)
+	}
+	hosts = append(hosts, "*")
+	for _, h := range hosts {
+		for _, p := range []string{portString, "*"} {
+			if target, ok := t[net.JoinHostPort(h, p)]; ok {
+				return target, true
+			}
+		}
+	}
+	return rewriteTarget{}, false
+}
+
+// applyRewrites rewrites the destination of the request if a rule matches.
+// Unix socket paths are never rewritten
+func (p *Proxy) applyRewrites(request *Request) {
+	if request.AddressType == RequestAddressTypeUnixPath {
+		return
+	}
+	table, ok := p.rewrites.Load().(rewriteTable)
+	if !ok || len(table) == 0 {
+		return
+	}
+	var host string
+	switch request.AddressType {
+	case RequestAddressTypeIPv4, RequestAddressTypeIPv6:
+		host = net.IP(request.DestinationAddress).String()
+	default:
+		host = string(request.DestinationAddress)
+	}
+	target, ok := table.lookup(host, request.DestinationPort)
+	if !ok {
+		return
+	}
+
+	original := request.getDestinationString()
+	newHost := target.host
+	if newHost == "" {
+		newHost = host
+	}
+	newPort := target.port
+	if newPort == 0 {
+		newPort = request.DestinationPort
+	}
+	request.setDestination(newHost, newPort)
+	log.Infof("rewrote destination %s to %s", original, request.getDestinationString())
+}
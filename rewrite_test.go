@@ -0,0 +1,44 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRewriteRecordsOriginalDestination(t *testing.T) {
+	target := lineServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	if err := p.SetRewriteRules(RewriteRules{"registry.example.com:443": "127.0.0.1:" + port}); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, "registry.example.com:443"); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if sessions[0].Destination != target || sessions[0].OriginalDestination != "registry.example.com:443" {
+		t.Fatalf("got destination %s and original destination %s", sessions[0].Destination, sessions[0].OriginalDestination)
+	}
+}
+
+func TestRewriteSkipsUnixTargets(t *testing.T) {
+	p := &Proxy{}
+	if err := p.SetRewriteRules(RewriteRules{"*:*": "127.0.0.1:80"}); err != nil {
+		t.Fatal(err)
+	}
+	request := Request{AddressType: RequestAddressTypeUnixPath, DestinationAddress: []byte("/run/app.sock")}
+	p.applyRewrites(&request)
+	if got := request.getDestinationString(); got != "/run/app.sock" {
+		t.Fatalf("unix target was rewritten to %s", got)
+	}
+}
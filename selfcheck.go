@@ -0,0 +1,140 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// selfCheckTarget is the built-in echo destination of self checks. It is only
+// available to sessions started by SelfCheck
+const selfCheckTarget = "gosocks-selfcheck.invalid:7"
+
+// selfCheckTimeout is used if the context passed to SelfCheck has no deadline
+const selfCheckTimeout = 10 * time.Second
+
+type selfCheckKey struct{}
+
+func withSelfCheck(ctx context.Context) context.Context {
+	return context.WithValue(ctx, selfCheckKey{}, true)
+}
+
+// isSelfCheck checks if the client connection was opened by SelfCheck. It must
+// be called after the first read from the connection as the client address of
+// self checks over the listener is registered asynchronously
+func (p *Proxy) isSelfCheck(ctx context.Context, conn io.ReadWriteCloser) bool {
+	if v, _ := ctx.Value(selfCheckKey{}).(bool); v {
+		return true
+	}
+	if c, ok := extractNetConn(conn); ok && c.RemoteAddr() != nil {
+		_, found := p.selfChecks.Load(c.RemoteAddr().String())
+		return found
+	}
+	return false
+}
+
+// echoConn is an in-memory connection that sends back everything written to
+// it. It supports half-close so the data written is still read back after
+// CloseWrite
+type echoConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func newEchoConn() *echoConn {
+	r, w := io.Pipe()
+	return &echoConn{r: r, w: w}
+}
+
+func (e *echoConn) Read(b []byte) (int, error)  { return e.r.Read(b) }
+func (e *echoConn) Write(b []byte) (int, error) { return e.w.Write(b) }
+func (e *echoConn) CloseWrite() error           { return e.w.Close() }
+
+func (e *echoConn) Close() error {
+	e.w.Close()
+	return e.r.Close()
+}
+
+// SelfCheck runs a full socks session against the proxy and returns nil if
+// some data could be sent through it and was received back. It connects to
+// the listener of the proxy or serves an in-memory connection if the proxy is
+// not listening. The session uses SelfCheckAddr as destination or a built-in
+// echo target if it is empty. Self checks skip authentication and are not
+// listed in Sessions.
+func (p *Proxy) SelfCheck(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, selfCheckTimeout)
+		defer cancel()
+	}
+
+	conn, err := p.selfCheckConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	target := p.SelfCheckAddr
+	if target == "" {
+		target = selfCheckTarget
+	}
+	client := &Client{}
+	if _, err := client.handshake(conn, RequestCmdConnect, target); err != nil {
+		return fmt.Errorf("self check handshake failed: %w", err)
+	}
+
+	payload := []byte("gosocks self check")
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("self check could not send data: %w", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("self check could not read data: %w", err)
+	}
+	if !bytes.Equal(buf, payload) {
+		return fmt.Errorf("self check received unexpected data")
+	}
+	return nil
+}
+
+// selfCheckConn connects to the listener of the proxy or starts an in-memory
+// session if the proxy is not listening
+func (p *Proxy) selfCheckConn(ctx context.Context) (net.Conn, error) {
+	listener := p.primaryListener()
+	if listener == nil {
+		client, server := net.Pipe()
+		go p.handle(withSelfCheck(ctx), wrapIO(server))
+		return client, nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, listener.Addr().Network(), listener.Addr().String())
+	if err != nil {
+		return nil, fmt.Errorf("self check could not connect to proxy: %w", err)
+	}
+	// the address is registered before any data is sent so the proxy can
+	// identify the self check after reading the first packet
+	addr := conn.LocalAddr().String()
+	p.selfChecks.Store(addr, struct{}{})
+	return &selfCheckConn{Conn: conn, proxy: p, addr: addr}, nil
+}
+
+// selfCheckConn removes the client address from the self checks on close
+type selfCheckConn struct {
+	net.Conn
+	proxy *Proxy
+	addr  string
+}
+
+func (c *selfCheckConn) Close() error {
+	c.proxy.selfChecks.Delete(c.addr)
+	return c.Conn.Close()
+}
@@ -0,0 +1,286 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Session types of SessionInfo
+const (
+	SessionTypeTCP = "tcp"
+	SessionTypeUDP = "udp"
+)
+
+// SessionInfo is a snapshot of an established session
+type SessionInfo struct {
+	ID uint64 `json:"id"`
+	// Type is SessionTypeUDP for UDP ASSOCIATE sessions and SessionTypeTCP
+	// for all other sessions
+	Type                string    `json:"type"`
+	ClientAddr          string    `json:"client_addr"`
+	Destination         string    `json:"destination"`
+	OriginalDestination string    `json:"original_destination,omitempty"`
+	Username            string    `json:"username,omitempty"`
+	Tenant              string    `json:"tenant,omitempty"`
+	Method              string    `json:"method,omitempty"`
+	Started             time.Time `json:"started"`
+	BytesClientToRemote int64     `json:"bytes_client_to_remote"`
+	BytesRemoteToClient int64     `json:"bytes_remote_to_client"`
+	// Datagram counters of UDP ASSOCIATE sessions, see SessionStats
+	DatagramsClientToRemote int64 `json:"datagrams_client_to_remote,omitempty"`
+	DatagramsRemoteToClient int64 `json:"datagrams_remote_to_client,omitempty"`
+	DatagramsDenied         int64 `json:"datagrams_denied,omitempty"`
+	DatagramsDropped        int64 `json:"datagrams_dropped,omitempty"`
+	UDPDestinations         int64 `json:"udp_destinations,omitempty"`
+	UDPRelayPort            int   `json:"udp_relay_port,omitempty"`
+	// ResolvedAddrs are the vetted addresses of a domain name destination,
+	// the handler only dials one of them
+	ResolvedAddrs []string `json:"resolved_addrs,omitempty"`
+	// RemoteAddr is the address of the remote connection, see
+	// SessionStats.RemoteAddr
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// LocalAddr is the source address of the remote connection, see
+	// SessionStats.LocalAddr
+	LocalAddr string `json:"local_addr,omitempty"`
+	// TOS is the TOS set on the remote connection
+	TOS int `json:"tos,omitempty"`
+	// JA3 is the JA3 hash of the TLS ClientHello of the client if LogJA3 is
+	// set
+	JA3 string `json:"ja3,omitempty"`
+	// Labels are the labels passed to HandleConnWithInfo
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ProxyStats is a snapshot of the proxy counters
+type ProxyStats struct {
+	// ActiveConnections is the number of open client connections including
+	// connections still in the handshake
+	ActiveConnections int64 `json:"active_connections"`
+	// ActiveSessions is the number of established sessions
+	ActiveSessions int `json:"active_sessions"`
+	// TotalSessions is the number of sessions established since the start
+	TotalSessions uint64 `json:"total_sessions"`
+	// Probes is the number of connections closed by the client before
+	// sending anything, like port scans and tcp health checks
+	Probes int64 `json:"probes"`
+	// HandshakesInFlight is the number of connections holding a slot of
+	// MaxConcurrentHandshakes
+	HandshakesInFlight int64 `json:"handshakes_in_flight"`
+	// HandshakeQueueRejections is the number of connections closed because
+	// no handshake slot became free in time
+	HandshakeQueueRejections int64 `json:"handshake_queue_rejections"`
+	// SuppressedLogs is the number of log messages dropped by log sampling
+	SuppressedLogs int64 `json:"suppressed_logs"`
+	// HandshakeFailures is the number of failed handshakes by phase and the
+	// reply sent to the client
+	HandshakeFailures map[string]map[string]uint64 `json:"handshake_failures"`
+	// UDP holds the counters of UDP ASSOCIATE sessions
+	UDP UDPStats `json:"udp"`
+}
+
+// session is an established session tracked by the proxy
+type session struct {
+	id          uint64
+	kind        string
+	clientAddr  string
+	destination string
+	original    string
+	username    string
+	tenant      string
+	method      string
+	resolved    []string
+	remoteAddr  string
+	localAddr   string
+	labels      map[string]string
+	started     time.Time
+	stats       *SessionStats
+	client      io.Closer
+	remote      io.Closer
+	ja3         ja3Value
+	// done is the Done channel of the proxy when the session started
+	done <-chan struct{}
+
+	// accessed atomically
+	reason    int32
+	closeOnce sync.Once
+}
+
+// setReason records why the session ended. Only the first reason is kept
+func (s *session) setReason(reason CloseReason) {
+	atomic.CompareAndSwapInt32(&s.reason, int32(CloseReasonNone), int32(reason))
+}
+
+// closeReason returns the first recorded reason
+func (s *session) closeReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&s.reason))
+}
+
+// close records the reason and closes both connections of the session. The
+// reason is recorded first so it wins over the copy errors caused by closing
+// the connections
+func (s *session) close(reason CloseReason) {
+	s.setReason(reason)
+	s.closeOnce.Do(func() {
+		s.client.Close()
+		s.remote.Close()
+	})
+}
+
+// withSessionDeadline returns the context of an established session. It
+// ends after MaxSessionDuration and the session is closed then
+func (p *Proxy) withSessionDeadline(ctx context.Context, s *session) (context.Context, context.CancelFunc) {
+	if p.MaxSessionDuration <= 0 {
+		return context.WithCancel(ctx)
+	}
+	sessCtx, cancel := withTimeout(ctx, p.clock(), p.MaxSessionDuration)
+	go func() {
+		<-sessCtx.Done()
+		// a deadline of the parent context is not ours
+		if errors.Is(sessCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			log.Infof("closing session to %s: session duration exceeded", s.destination)
+			s.close(CloseReasonMaxLifetime)
+		}
+	}()
+	return sessCtx, cancel
+}
+
+// closeOnStop closes the session when the proxy is stopped while the data
+// is relayed, so the copy goroutines do not outlive the proxy. It returns
+// when ctx ends
+func (p *Proxy) closeOnStop(ctx context.Context, s *session) {
+	if s.done == nil {
+		return
+	}
+	select {
+	case <-s.done:
+		s.close(CloseReasonShutdown)
+	case <-ctx.Done():
+	}
+}
+
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		ID:                      s.id,
+		Type:                    s.kind,
+		ClientAddr:              s.clientAddr,
+		Destination:             s.destination,
+		OriginalDestination:     s.original,
+		Username:                s.username,
+		Tenant:                  s.tenant,
+		Method:                  s.method,
+		ResolvedAddrs:           s.resolved,
+		RemoteAddr:              s.remoteAddr,
+		LocalAddr:               s.localAddr,
+		TOS:                     s.stats.TOS,
+		Started:                 s.started,
+		BytesClientToRemote:     atomic.LoadInt64(&s.stats.BytesClientToRemote),
+		BytesRemoteToClient:     atomic.LoadInt64(&s.stats.BytesRemoteToClient),
+		DatagramsClientToRemote: atomic.LoadInt64(&s.stats.DatagramsClientToRemote),
+		DatagramsRemoteToClient: atomic.LoadInt64(&s.stats.DatagramsRemoteToClient),
+		DatagramsDenied:         atomic.LoadInt64(&s.stats.DatagramsDenied),
+		DatagramsDropped:        atomic.LoadInt64(&s.stats.DatagramsDropped),
+		UDPDestinations:         atomic.LoadInt64(&s.stats.UDPDestinations),
+		UDPRelayPort:            s.stats.UDPRelayPort,
+		JA3:                     s.getJA3(),
+		Labels:                  s.labels,
+	}
+}
+
+// registerSession adds an established session to the registry. Self checks
+// are not added
+func (p *Proxy) registerSession(ctx context.Context, request *Request, clientConn io.ReadWriteCloser, client, remote io.Closer, stats *SessionStats) *session {
+	s := &session{
+		kind:        SessionTypeTCP,
+		destination: request.getDestinationString(),
+		original:    stats.OriginalDestination,
+		username:    request.Username,
+		started:     p.clock().Now(),
+		stats:       stats,
+		client:      client,
+		remote:      remote,
+		done:        p.done(),
+	}
+	if request.Command == RequestCmdAssociate {
+		s.kind = SessionTypeUDP
+	}
+	if stats.version == Version5 {
+		s.method = stats.Method.String()
+	}
+	for _, ip := range request.ResolvedAddresses {
+		s.resolved = append(s.resolved, ip.String())
+	}
+	if stats.RemoteAddr != nil {
+		s.remoteAddr = stats.RemoteAddr.String()
+	}
+	if stats.LocalAddr != nil {
+		s.localAddr = stats.LocalAddr.String()
+	}
+	if addr, ok := ClientAddrFromContext(ctx); ok {
+		s.clientAddr = addr.String()
+	}
+	if info, ok := ConnInfoFromContext(ctx); ok {
+		s.labels = info.Labels
+	}
+	s.tenant, _ = TenantFromContext(ctx)
+	if p.isSelfCheck(ctx, clientConn) {
+		return s
+	}
+	s.id = atomic.AddUint64(&p.sessionID, 1)
+	p.sessions.Store(s.id, s)
+	return s
+}
+
+func (p *Proxy) unregisterSession(s *session) {
+	p.sessions.Delete(s.id)
+}
+
+// Sessions returns a snapshot of all established sessions ordered by ID
+func (p *Proxy) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	p.sessions.Range(func(_, value interface{}) bool {
+		sessions = append(sessions, value.(*session).info())
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// CloseSession closes the session with the given ID. It returns false if no
+// such session exists
+func (p *Proxy) CloseSession(id uint64) bool {
+	s, ok := p.sessions.Load(id)
+	if !ok {
+		return false
+	}
+	s.(*session).close(CloseReasonKilledByAdmin)
+	return true
+}
+
+// Stats returns a snapshot of the proxy counters
+func (p *Proxy) Stats() ProxyStats {
+	active := 0
+	p.sessions.Range(func(_, _ interface{}) bool {
+		active++
+		return true
+	})
+	return ProxyStats{
+		ActiveConnections:        atomic.LoadInt64(&p.activeConnections),
+		ActiveSessions:           active,
+		TotalSessions:            atomic.LoadUint64(&p.sessionID),
+		Probes:                   atomic.LoadInt64(&p.probes),
+		SuppressedLogs:           atomic.LoadInt64(&p.suppressedLogs),
+		HandshakesInFlight:       atomic.LoadInt64(&p.handshakesInFlight),
+		HandshakeQueueRejections: atomic.LoadInt64(&p.handshakeRejections),
+		HandshakeFailures:        p.handshakeFailures.snapshot(),
+		UDP:                      p.udp.snapshot(),
+	}
+}
@@ -0,0 +1,47 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// establishSession connects through the proxy to a lineServer and returns
+// the info of the session
+func establishSession(t *testing.T, p *Proxy) SessionInfo {
+	t.Helper()
+	target := lineServer(t)
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	return sessions[0]
+}
+
+func TestSessionInfoLocalAddr(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second, LocalAddr: net.ParseIP("127.0.0.2")},
+		Timeout:      time.Second,
+	}
+	info := establishSession(t, p)
+	host, _, err := net.SplitHostPort(info.LocalAddr)
+	if err != nil || host != "127.0.0.2" {
+		t.Fatalf("got local address %q, want 127.0.0.2", info.LocalAddr)
+	}
+}
+
+func TestSessionInfoTOS(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		TOS:          0x10,
+	}
+	if info := establishSession(t, p); info.TOS != 0x10 {
+		t.Fatalf("got tos %#x, want 0x10", info.TOS)
+	}
+}
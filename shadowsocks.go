@@ -0,0 +1,233 @@
+package socks
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// shadowsocksMaxPayload is the maximum payload size of one chunk
+const shadowsocksMaxPayload = 0x3FFF
+
+// shadowsocksCipher holds the master key and the AEAD of a method
+type shadowsocksCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newShadowsocksCipher(method, password string) (*shadowsocksCipher, error) {
+	switch method {
+	case "aes-128-gcm":
+		return &shadowsocksCipher{key: shadowsocksKey(password, 16), newAEAD: newGCM}, nil
+	case "aes-256-gcm":
+		return &shadowsocksCipher{key: shadowsocksKey(password, 32), newAEAD: newGCM}, nil
+	case "chacha20-ietf-poly1305":
+		return &shadowsocksCipher{key: shadowsocksKey(password, chacha20poly1305.KeySize), newAEAD: chacha20poly1305.New}, nil
+	default:
+		return nil, fmt.Errorf("shadowsocks method %q not supported", method)
+	}
+}
+
+// shadowsocksKey derives the master key from the password like
+// EVP_BytesToKey with MD5
+func shadowsocksKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
+
+// sessionAEAD derives the subkey for one direction from the salt
+func (c *shadowsocksCipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// shadowsocksConn encrypts the data in length prefixed chunks. Every direction
+// starts with a random salt and uses a counter as nonce
+type shadowsocksConn struct {
+	net.Conn
+	cipher *shadowsocksCipher
+
+	readMu   sync.Mutex
+	reader   cipher.AEAD
+	rnonce   []byte
+	readBuf  []byte
+	leftover []byte
+
+	writeMu sync.Mutex
+	writer  cipher.AEAD
+	wnonce  []byte
+}
+
+// incNonce increments the little endian counter
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *shadowsocksConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var buf []byte
+	if c.writer == nil {
+		salt := make([]byte, len(c.cipher.key))
+		if _, err := rand.Read(salt); err != nil {
+			return 0, fmt.Errorf("could not create salt: %w", err)
+		}
+		aead, err := c.cipher.sessionAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writer = aead
+		c.wnonce = make([]byte, aead.NonceSize())
+		buf = append(buf, salt...)
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > shadowsocksMaxPayload {
+			chunk = chunk[:shadowsocksMaxPayload]
+		}
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(chunk)))
+		buf = c.writer.Seal(buf, c.wnonce, length, nil)
+		incNonce(c.wnonce)
+		buf = c.writer.Seal(buf, c.wnonce, chunk, nil)
+		incNonce(c.wnonce)
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+		buf = buf[:0]
+	}
+	return written, nil
+}
+
+func (c *shadowsocksConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	if c.reader == nil {
+		salt := make([]byte, len(c.cipher.key))
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.sessionAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.reader = aead
+		c.rnonce = make([]byte, aead.NonceSize())
+		c.readBuf = make([]byte, shadowsocksMaxPayload+aead.Overhead())
+	}
+
+	overhead := c.reader.Overhead()
+	header := c.readBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return 0, err
+	}
+	length, err := c.reader.Open(header[:0], c.rnonce, header, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not decrypt chunk length: %w", err)
+	}
+	incNonce(c.rnonce)
+	size := int(binary.BigEndian.Uint16(length)) & shadowsocksMaxPayload
+
+	payload := c.readBuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return 0, err
+	}
+	plain, err := c.reader.Open(payload[:0], c.rnonce, payload, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not decrypt chunk: %w", err)
+	}
+	incNonce(c.rnonce)
+	n := copy(b, plain)
+	c.leftover = plain[n:]
+	return n, nil
+}
+
+// CloseWrite half-closes the underlying connection if supported
+func (c *shadowsocksConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// ShadowsocksDialHandler connects to destinations through a shadowsocks
+// server using an AEAD cipher. The dial settings of the embedded
+// DefaultHandler are used for the connection to the server
+type ShadowsocksDialHandler struct {
+	DefaultHandler
+	// Server is the address of the shadowsocks server
+	Server string
+
+	cipher *shadowsocksCipher
+}
+
+// NewShadowsocksDialer creates a handler for the server. Supported methods
+// are aes-128-gcm, aes-256-gcm and chacha20-ietf-poly1305
+func NewShadowsocksDialer(server, password, method string) (*ShadowsocksDialHandler, error) {
+	c, err := newShadowsocksCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowsocksDialHandler{Server: server, cipher: c}, nil
+}
+
+// PreHandler connects to the shadowsocks server and sends the destination
+func (s *ShadowsocksDialHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	target := request.getDestinationString()
+	// the address is sent in the same format as in socks requests
+	addr, err := buildRequest(RequestCmdConnect, target)
+	if err != nil {
+		return nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("invalid destination %s: %w", target, err)}
+	}
+
+	conn, err := s.dialer().DialContext(ctx, "tcp", s.Server)
+	if err != nil {
+		return nil, dialError(s.Server, err)
+	}
+	remote := &shadowsocksConn{Conn: conn, cipher: s.cipher}
+	if _, err := remote.Write(addr[3:]); err != nil {
+		conn.Close()
+		return nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send destination to shadowsocks server: %w", err)}
+	}
+	return remote, nil
+}
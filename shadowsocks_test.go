@@ -0,0 +1,246 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ssMockServer is a minimal shadowsocks AEAD server written against the
+// protocol description. It records the destination and the chunk sizes it
+// received and echoes the payload back
+type ssMockServer struct {
+	t       *testing.T
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	addr    string
+	// target receives the address sent in the first chunk
+	target chan []byte
+	// chunks receives the payload size of every further chunk
+	chunks chan int
+	// badKey is set if the client uses another key, errors are expected
+	badKey bool
+}
+
+func newSSMockServer(t *testing.T, method string, key []byte, badKey bool) *ssMockServer {
+	t.Helper()
+	s := &ssMockServer{t: t, key: key, target: make(chan []byte, 1), chunks: make(chan int, 64), badKey: badKey}
+	switch method {
+	case "aes-128-gcm", "aes-256-gcm":
+		s.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	case "chacha20-ietf-poly1305":
+		s.newAEAD = chacha20poly1305.New
+	default:
+		t.Fatalf("unknown method %s", method)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.serve(conn)
+	}()
+	return s
+}
+
+func (s *ssMockServer) aead(salt []byte) cipher.AEAD {
+	subkey := make([]byte, len(s.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, s.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	aead, err := s.newAEAD(subkey)
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	return aead
+}
+
+// readChunk reads one length prefixed chunk. The nonce is a little endian
+// counter incremented after every seal
+func readChunk(r io.Reader, aead cipher.AEAD, nonce []byte) ([]byte, error) {
+	header := make([]byte, 2+aead.Overhead())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length, err := aead.Open(nil, nonce, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	incNonce(nonce)
+	payload := make([]byte, int(binary.BigEndian.Uint16(length))+aead.Overhead())
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, payload, nil)
+	if err != nil {
+		return nil, err
+	}
+	incNonce(nonce)
+	return plain, nil
+}
+
+func (s *ssMockServer) serve(conn net.Conn) {
+	salt := make([]byte, len(s.key))
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		s.t.Error(err)
+		return
+	}
+	reader := s.aead(salt)
+	if reader == nil {
+		return
+	}
+	rnonce := make([]byte, reader.NonceSize())
+	target, err := readChunk(conn, reader, rnonce)
+	if err != nil {
+		if !s.badKey {
+			s.t.Errorf("could not read the destination: %v", err)
+		}
+		return
+	}
+	s.target <- target
+
+	wsalt := make([]byte, len(s.key))
+	if _, err := rand.Read(wsalt); err != nil {
+		s.t.Error(err)
+		return
+	}
+	writer := s.aead(wsalt)
+	if writer == nil {
+		return
+	}
+	wnonce := make([]byte, writer.NonceSize())
+	if _, err := conn.Write(wsalt); err != nil {
+		return
+	}
+	for {
+		payload, err := readChunk(conn, reader, rnonce)
+		if err != nil {
+			return
+		}
+		s.chunks <- len(payload)
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(payload)))
+		out := writer.Seal(nil, wnonce, length, nil)
+		incNonce(wnonce)
+		out = writer.Seal(out, wnonce, payload, nil)
+		incNonce(wnonce)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func TestShadowsocksKey(t *testing.T) {
+	// EVP_BytesToKey with MD5 and no salt: the first block is md5("foobar")
+	key := shadowsocksKey("foobar", 32)
+	if got := hex.EncodeToString(key[:16]); got != "3858f62230ac3c915f300c664312c63f" {
+		t.Fatalf("got key %s", got)
+	}
+	if bytes.Equal(key[:16], key[16:]) {
+		t.Fatal("second block repeats the first")
+	}
+}
+
+func TestShadowsocksFraming(t *testing.T) {
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		t.Run(method, func(t *testing.T) {
+			h, err := NewShadowsocksDialer("", "secret", method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newSSMockServer(t, method, shadowsocksKey("secret", len(h.cipher.key)), false)
+			h.Server = server.addr
+			h.Timeout = time.Second
+
+			remote, serr := h.PreHandler(context.Background(), requestTo(t, "192.0.2.1:443"))
+			if serr != nil {
+				t.Fatal(serr)
+			}
+			defer remote.Close()
+
+			select {
+			case target := <-server.target:
+				want := []byte{byte(RequestAddressTypeIPv4), 192, 0, 2, 1, 0x01, 0xbb}
+				if !bytes.Equal(target, want) {
+					t.Fatalf("server got destination %x, want %x", target, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not receive the destination")
+			}
+
+			// larger than one chunk so the payload is split
+			payload := make([]byte, shadowsocksMaxPayload+100)
+			if _, err := rand.Read(payload); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := remote.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []int{shadowsocksMaxPayload, 100} {
+				if got := <-server.chunks; got != want {
+					t.Fatalf("got chunk of %d bytes, want %d", got, want)
+				}
+			}
+			echoed := make([]byte, len(payload))
+			if _, err := io.ReadFull(remote, echoed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echoed, payload) {
+				t.Fatal("decrypted payload does not match")
+			}
+		})
+	}
+}
+
+func TestShadowsocksWrongPassword(t *testing.T) {
+	h, err := NewShadowsocksDialer("", "secret", "aes-256-gcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSSMockServer(t, "aes-256-gcm", shadowsocksKey("other", 32), true)
+	h.Server = server.addr
+	h.Timeout = time.Second
+	remote, serr := h.PreHandler(context.Background(), requestTo(t, "192.0.2.1:443"))
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	defer remote.Close()
+	select {
+	case target := <-server.target:
+		t.Fatalf("server decrypted destination %x with a wrong key", target)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestShadowsocksUnknownMethod(t *testing.T) {
+	if _, err := NewShadowsocksDialer("127.0.0.1:8388", "secret", "rc4-md5"); err == nil {
+		t.Fatal("unsupported method accepted")
+	}
+}
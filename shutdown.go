@@ -0,0 +1,150 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownPollInterval is the interval Shutdown checks for active connections
+const shutdownPollInterval = 50 * time.Millisecond
+
+// ErrProxyClosed is returned by Serve and ListenAndServe after the proxy was
+// stopped with Stop, Shutdown or Close
+var ErrProxyClosed = errors.New("proxy closed")
+
+func (p *Proxy) isClosed() bool {
+	return atomic.LoadInt32(&p.closed) == 1
+}
+
+// closeListener closes all listeners so no new connections are accepted
+func (p *Proxy) closeListener() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, listener := range p.listeners {
+		if err := listener.Close(); err != nil {
+			log.Errorf("error on closing listener: %v", err)
+		}
+	}
+	p.listeners = nil
+}
+
+// Shutdown gracefully stops the proxy. It closes the listener so new
+// connections are rejected and waits until all active connections are
+// finished before stopping the proxy. If the context expires first, the
+// context error is returned and the remaining connections stay open.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.shutdownOnce.Do(func() {
+		log.Info("shutting down proxy")
+		p.hooksMu.Lock()
+		hooks := p.onShutdown
+		p.hooksMu.Unlock()
+		for _, f := range hooks {
+			f()
+		}
+		atomic.StoreInt32(&p.shuttingDown, 1)
+		atomic.StoreInt32(&p.closed, 1)
+	})
+	p.closeListener()
+	if atomic.LoadInt64(&p.activeConnections) == 0 {
+		p.drained()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt64(&p.activeConnections) == 0 {
+			p.Stop()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// OnShutdown registers a function that is called once at the start of
+// Shutdown before the listener is closed. Functions are called in the order
+// they were registered
+func (p *Proxy) OnShutdown(f func()) {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+	p.onShutdown = append(p.onShutdown, f)
+}
+
+// OnDrained registers a function that is called once when the last active
+// connection ended after Shutdown was called
+func (p *Proxy) OnDrained(f func()) {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+	p.onDrained = append(p.onDrained, f)
+}
+
+// connectionDone decrements the active connections and runs the drained
+// hooks if this was the last connection during a shutdown
+func (p *Proxy) connectionDone() {
+	if atomic.AddInt64(&p.activeConnections, -1) == 0 && atomic.LoadInt32(&p.shuttingDown) == 1 {
+		p.drained()
+	}
+}
+
+func (p *Proxy) drained() {
+	p.drainedOnce.Do(func() {
+		p.hooksMu.Lock()
+		hooks := p.onDrained
+		p.hooksMu.Unlock()
+		for _, f := range hooks {
+			f()
+		}
+	})
+}
+
+// HandleSignals blocks until SIGTERM or SIGINT is received and then shuts down
+// the proxy, waiting at most drainTimeout for active connections to finish
+func (p *Proxy) HandleSignals(drainTimeout time.Duration) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(ch)
+
+	sig := <-ch
+	log.Infof("received %s, draining connections for up to %s", sig, drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	return p.Shutdown(ctx)
+}
+
+// Close immediately closes all listeners, sessions and client connections
+// without draining. It is safe to call multiple times and concurrently,
+// also during or after Shutdown
+func (p *Proxy) Close() error {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		log.Warn("closing proxy")
+	}
+	p.closeListener()
+	p.sessions.Range(func(_, value interface{}) bool {
+		value.(*session).close(CloseReasonShutdown)
+		return true
+	})
+	// connections still in the handshake
+	p.conns.Range(func(key, _ interface{}) bool {
+		key.(io.Closer).Close()
+		return true
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Done != nil {
+		close(p.Done)
+		p.Done = nil
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStopDuringSession stops the proxy while a session relays data. Run
+// with -race, Stop replaces Done while the session reads it
+func TestStopDuringSession(t *testing.T) {
+	target := lineServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		Done:         make(chan struct{}),
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+
+	p.Stop()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("session was not closed on Stop: %v", err)
+	}
+}
+
+// TestShutdownConcurrent calls Shutdown concurrently with and without an
+// active session. Run with -race
+func TestShutdownConcurrent(t *testing.T) {
+	for _, active := range []bool{false, true} {
+		name := "idle"
+		if active {
+			name = "active session"
+		}
+		t.Run(name, func(t *testing.T) {
+			target := lineServer(t)
+			p := &Proxy{
+				Proxyhandler: &DefaultHandler{Timeout: time.Second},
+				Timeout:      time.Second,
+			}
+			var shutdowns, drained int32
+			p.OnShutdown(func() { atomic.AddInt32(&shutdowns, 1) })
+			p.OnDrained(func() { atomic.AddInt32(&drained, 1) })
+			addr := serveProxy(t, p)
+
+			conn := dialProxy(t, addr, "", "")
+			if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+				t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+			}
+			roundTrip(t, conn)
+			if !active {
+				conn.Close()
+				waitFor(t, func() bool { return p.Stats().ActiveConnections == 0 })
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- p.Shutdown(ctx)
+				}()
+			}
+			if active {
+				waitFor(t, func() bool { return atomic.LoadInt32(&shutdowns) == 1 })
+				roundTrip(t, conn)
+				conn.Close()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("Shutdown returned %v", err)
+				}
+			}
+			if n := atomic.LoadInt32(&shutdowns); n != 1 {
+				t.Errorf("OnShutdown hook ran %d times, want 1", n)
+			}
+			if n := atomic.LoadInt32(&drained); n != 1 {
+				t.Errorf("OnDrained hook ran %d times, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !js
+// +build !js
+
+package socks
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadOnSIGHUP reloads the config on every SIGHUP until done is closed
+func (p *Proxy) reloadOnSIGHUP(done <-chan struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ch:
+			log.Info("received SIGHUP, reloading config")
+			if err := p.config.Reload(); err != nil {
+				log.Errorf("could not reload config: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package socks
+
+// reloadOnSIGHUP does nothing, there are no signals in the browser
+func (p *Proxy) reloadOnSIGHUP(done <-chan struct{}) {}
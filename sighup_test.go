@@ -0,0 +1,85 @@
+//go:build !js && !windows
+// +build !js,!windows
+
+package socks
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	target := lineServer(t)
+	dir := t.TempDir()
+	authFile := filepath.Join(dir, "users")
+	configFile := filepath.Join(dir, "config.yaml")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(authFile, "alice:old\n")
+	write(configFile, "listen_addr: 127.0.0.1:0\ntimeout: 1s\nauth_file: "+authFile+"\nacl:\n  default_allow: true\n  deny: [127.0.0.0/8]\n")
+
+	c, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.ListenAndServe()
+	defer p.Stop()
+
+	var addr string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if l := p.primaryListener(); l != nil {
+			addr = l.Addr().String()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("proxy is not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn := dialProxy(t, addr, "alice", "old")
+	if reply := sendRequest(t, conn, target); reply != RequestReplyConnectionNotAllowed {
+		t.Fatalf("got reply %s before the reload, want %s", reply, RequestReplyConnectionNotAllowed)
+	}
+
+	write(authFile, "alice:new\n")
+	write(configFile, "listen_addr: 127.0.0.1:0\ntimeout: 1s\nauth_file: "+authFile+"\nacl:\n  default_allow: true\n  deny: [10.0.0.0/8]\n")
+
+	// without a handler registered SIGHUP would terminate the test binary if
+	// it is sent before the proxy called signal.Notify
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	deadline = time.Now().Add(5 * time.Second)
+	for !p.getCredentials().Valid("alice", "new") {
+		if time.Now().After(deadline) {
+			t.Fatal("config was not reloaded after SIGHUP")
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if p.getCredentials().Valid("alice", "old") {
+		t.Fatal("old password is still valid")
+	}
+	conn = dialProxy(t, addr, "alice", "new")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s after the reload, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+}
@@ -0,0 +1,140 @@
+//go:build !js && !windows
+// +build !js,!windows
+
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sendSIGTERM signals the test binary until the proxy started to shut down.
+// A handler is registered first so an early signal does not terminate the
+// test binary
+func sendSIGTERM(t *testing.T, p *Proxy) {
+	t.Helper()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	t.Cleanup(func() { signal.Stop(ch) })
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&p.shuttingDown) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy did not shut down after SIGTERM")
+		}
+		if err := self.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// signalProxy serves p, establishes a session to a line server and calls
+// HandleSignals. It returns the session, the address of the proxy and the
+// results of Serve and HandleSignals
+func signalProxy(t *testing.T, p *Proxy, drainTimeout time.Duration) (net.Conn, string, <-chan error, <-chan error) {
+	t.Helper()
+	target := lineServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(l) }()
+	t.Cleanup(func() { p.Close() })
+
+	conn := dialProxy(t, l.Addr().String(), "", "")
+	if reply := sendRequest(t, conn, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, conn)
+
+	handled := make(chan error, 1)
+	go func() { handled <- p.HandleSignals(drainTimeout) }()
+	sendSIGTERM(t, p)
+	return conn, l.Addr().String(), served, handled
+}
+
+// checkRejected checks that the proxy does not accept new connections
+func checkRejected(t *testing.T, p *Proxy, addr string, served <-chan error) {
+	t.Helper()
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrProxyClosed) {
+			t.Fatalf("Serve returned %v, want %v", err, ErrProxyClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after SIGTERM")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("new connection was accepted during the shutdown")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Serve(l); !errors.Is(err, ErrProxyClosed) {
+		t.Fatalf("Serve on a new listener returned %v, want %v", err, ErrProxyClosed)
+	}
+}
+
+func TestHandleSignalsDrain(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	conn, addr, served, handled := signalProxy(t, p, 5*time.Second)
+	checkRejected(t, p, addr, served)
+
+	// the in-flight session keeps working until the client ends it
+	roundTrip(t, conn)
+	select {
+	case err := <-handled:
+		t.Fatalf("HandleSignals returned %v with an active session", err)
+	default:
+	}
+	conn.Close()
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatalf("HandleSignals returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleSignals did not return after the last session ended")
+	}
+}
+
+func TestHandleSignalsDeadline(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	start := time.Now()
+	conn, addr, served, handled := signalProxy(t, p, 200*time.Millisecond)
+	checkRejected(t, p, addr, served)
+
+	select {
+	case err := <-handled:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("HandleSignals returned %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleSignals did not return after the drain timeout")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("HandleSignals returned after %s, before the drain timeout", d)
+	}
+	// the session survives the drain timeout, it is closed by Close
+	roundTrip(t, conn)
+}
@@ -0,0 +1,36 @@
+package socks
+
+import (
+	"syscall"
+)
+
+// controlFunc is the signature of net.Dialer.Control and
+// net.ListenConfig.Control
+type controlFunc func(network, address string, c syscall.RawConn) error
+
+// chainControls runs all control functions in order and stops on the first
+// error. nil is returned if no functions are passed
+func chainControls(controls ...controlFunc) controlFunc {
+	if len(controls) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rawControl runs f on the file descriptor and returns the error of f
+func rawControl(c syscall.RawConn, f func(fd uintptr) error) error {
+	var innerErr error
+	if err := c.Control(func(fd uintptr) {
+		innerErr = f(fd)
+	}); err != nil {
+		return err
+	}
+	return innerErr
+}
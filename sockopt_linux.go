@@ -0,0 +1,53 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT which is missing in the syscall
+// package
+const tcpFastOpenConnect = 0x1e
+
+// bindToDevice binds the socket to the network interface using
+// SO_BINDTODEVICE
+func bindToDevice(name string) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return rawControl(c, func(fd uintptr) error {
+			if err := syscall.BindToDevice(int(fd), name); err != nil {
+				return fmt.Errorf("could not bind to interface %s: %w", name, err)
+			}
+			return nil
+		})
+	}
+}
+
+// setMark sets SO_MARK on the socket. This requires CAP_NET_ADMIN
+func setMark(mark uint32) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return rawControl(c, func(fd uintptr) error {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+				if errors.Is(err, syscall.EPERM) {
+					return fmt.Errorf("could not set fwmark %d, CAP_NET_ADMIN is required: %w", mark, err)
+				}
+				return fmt.Errorf("could not set fwmark %d: %w", mark, err)
+			}
+			return nil
+		})
+	}
+}
+
+// fastOpenConnect enables TCP Fast Open on outgoing connections. Kernels
+// before 4.11 do not know the option, the connection is then made without
+// fast open. With the option connect returns without sending the SYN
+func fastOpenConnect(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd uintptr) error {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+			log.Debugf("tcp fast open is not available for %s: %v", address, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fdConn is a syscall.RawConn for a plain socket
+type fdConn struct {
+	fd int
+}
+
+func (c fdConn) Control(f func(fd uintptr)) error {
+	f(uintptr(c.fd))
+	return nil
+}
+
+func (c fdConn) Read(func(fd uintptr) bool) error {
+	return errors.New("not supported")
+}
+
+func (c fdConn) Write(func(fd uintptr) bool) error {
+	return errors.New("not supported")
+}
+
+func TestSetMark(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	err = setMark(42)("tcp4", "127.0.0.1:80", fdConn{fd: fd})
+	if errors.Is(err, syscall.EPERM) {
+		// without CAP_NET_ADMIN the error must tell what is missing
+		if !strings.Contains(err.Error(), "CAP_NET_ADMIN") {
+			t.Fatalf("got error %q, want a hint to CAP_NET_ADMIN", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mark, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != 42 {
+		t.Fatalf("got mark %d, want 42", mark)
+	}
+}
+
+func TestDefaultHandlerFwmark(t *testing.T) {
+	h := DefaultHandler{Timeout: time.Second, Fwmark: 42}
+	remote, err := h.dialer().Dial("tcp", lineServer(t))
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting the fwmark requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	raw, err := remote.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	err = rawControl(raw, func(fd uintptr) error {
+		var err error
+		mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != 42 {
+		t.Fatalf("got mark %d on the remote connection, want 42", mark)
+	}
+}
+
+// benchmarkShortLived opens a new connection through the handler for every
+// request and closes it afterwards. Run with -benchtime 1000x for 1000
+// sequential connections. Loopback only uses fast open if the
+// net.ipv4.tcp_fastopen sysctl enables both client and server
+func benchmarkShortLived(b *testing.B, h DefaultHandler) {
+	addr := lineServer(b)
+	request := requestTo(b, addr)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		remote, err := h.PreHandler(context.Background(), request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		roundTrip(b, remote.(net.Conn))
+		remote.Close()
+	}
+}
+
+func BenchmarkShortLivedConnections(b *testing.B) {
+	benchmarkShortLived(b, DefaultHandler{Timeout: time.Second})
+}
+
+func BenchmarkShortLivedConnectionsFastOpen(b *testing.B) {
+	benchmarkShortLived(b, DefaultHandler{Timeout: time.Second, FastOpen: true})
+}
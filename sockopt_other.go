@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package socks
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// bindToDevice is only supported on linux
+func bindToDevice(name string) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("binding to interface %s is not supported on %s", name, runtime.GOOS)
+	}
+}
+
+// setMark is only supported on linux
+func setMark(mark uint32) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("fwmark is not supported on %s", runtime.GOOS)
+	}
+}
+
+// fastOpenConnect is only supported on linux and does nothing on other
+// platforms
+func fastOpenConnect(network, address string, c syscall.RawConn) error {
+	return nil
+}
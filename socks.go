@@ -4,145 +4,564 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func (p *Proxy) handle(conn io.ReadWriteCloser) {
+// HandleConn serves a single client connection and blocks until the session
+// ends. Use this to serve connections that are not accepted by the proxy like
+// in-memory pipes. The connection is closed afterwards.
+func (p *Proxy) HandleConn(conn io.ReadWriteCloser) {
+	atomic.AddInt64(&p.activeConnections, 1)
+	defer p.connectionDone()
+	p.handle(context.Background(), conn)
+}
+
+// ServeConn serves a connection that was accepted by another server, like a
+// protocol multiplexer, in the goroutine of the caller. It blocks until the
+// session ends and closes the connection afterwards
+func (p *Proxy) ServeConn(conn net.Conn) {
+	p.HandleConn(wrapIO(conn))
+}
+
+func (p *Proxy) handle(parent context.Context, conn io.ReadWriteCloser) {
 	defer conn.Close()
+	p.conns.Store(conn, struct{}{})
+	defer p.conns.Delete(conn)
 	defer func() {
 		log.Debugln("client connection closed")
 	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
-	if c, ok := conn.(net.Conn); ok {
-		log.Debugf("got connection from %s", c.RemoteAddr().String())
+	p.metrics().IncConnections()
+	ctx = p.withConnID(ctx)
+	ctx = withClientAddr(ctx, conn)
+	if addr, ok := ClientAddrFromContext(ctx); ok {
+		log.Debugf("got connection from %s", addr)
 	} else {
 		log.Debug("got connection")
 	}
-	if err := p.socks(ctx, conn); err != nil {
-		// send error reply
-		log.Errorf("socks error: %v", err.Err)
-		if err := p.socksErrorReply(ctx, conn, err.Reason); err != nil {
-			log.Error(err)
+
+	ctx, err := p.withTLSState(ctx, conn)
+	if err != nil {
+		p.logSampled(ctx, log.WarnLevel, nil, "tls handshake failed: %v", err)
+		return
+	}
+
+	ctx, err = p.resolveTenant(ctx)
+	if err != nil {
+		p.logSampled(ctx, log.WarnLevel, nil, "rejecting connection, could not resolve tenant: %v", err)
+		return
+	}
+
+	for p.serveSession(ctx, conn) {
+		c, ok := extractNetConn(conn)
+		if !ok {
+			log.Debugf("connection of type %T does not support pipelining", conn)
 			return
 		}
+		next, err := p.waitForPipelinedRequest(c)
+		if err != nil {
+			log.Debugf("no pipelined request: %v", err)
+			return
+		}
+		conn = next
+	}
+}
+
+// serveSession handles one socks session on the connection. It returns true
+// if the remote ended the session and the connection can be reused for the
+// next session
+func (p *Proxy) serveSession(ctx context.Context, conn io.ReadWriteCloser) bool {
+	stats := &SessionStats{started: p.clock().Now()}
+	// releases the handshake slot after the error reply was written
+	defer p.releaseHandshake(stats)
+	defer func() {
+		p.metrics().AddBytes(atomic.LoadInt64(&stats.BytesClientToRemote), atomic.LoadInt64(&stats.BytesRemoteToClient))
+		log.Debugf("transferred %d bytes from client to remote and %d bytes from remote to client", atomic.LoadInt64(&stats.BytesClientToRemote), atomic.LoadInt64(&stats.BytesRemoteToClient))
+		if stats.DenyReason != "" {
+			log.Debugf("session closed: %s (reply %s, denied: %s)", stats.CloseReason, stats.HandshakeReply, stats.DenyReason)
+		} else if stats.CloseReason == CloseReasonHandshakeFailure {
+			log.Debugf("session closed: %s (reply %s)", stats.CloseReason, stats.HandshakeReply)
+		} else if stats.JA3 != "" {
+			log.Debugf("session closed: %s (ja3 %s)", stats.CloseReason, stats.JA3)
+		} else {
+			log.Debugf("session closed: %s", stats.CloseReason)
+		}
+	}()
+	if err := p.socksRecover(WithStats(ctx, stats), conn, stats); err != nil {
+		var probe *probeError
+		if errors.As(err.Err, &probe) {
+			// port scanners and health checks, there is nobody to reply to
+			atomic.AddInt64(&p.probes, 1)
+			stats.CloseReason = CloseReasonClientEOF
+			log.Debugf("connection closed before handshake: %v", probe.err)
+			return false
+		}
+		var queueErr *handshakeQueueError
+		if errors.As(err.Err, &queueErr) {
+			// nothing was read yet so the client would not expect a reply
+			stats.CloseReason = CloseReasonHandshakeFailure
+			stats.HandshakeReply = err.Reason
+			p.logSampled(ctx, log.WarnLevel, nil, "dropping connection: %v", queueErr)
+			return false
+		}
+		var httpErr *httpRequestError
+		if errors.As(err.Err, &httpErr) {
+			stats.CloseReason = CloseReasonHandshakeFailure
+			stats.HandshakeReply = err.Reason
+			p.handshakeFailures.inc(stats.HandshakePhase, err.Reason)
+			if addr, ok := ClientAddrFromContext(ctx); ok {
+				p.logSampled(ctx, log.WarnLevel, nil, "%v from %s, is the client configured to use an HTTP proxy?", httpErr, addr)
+			} else {
+				p.logSampled(ctx, log.WarnLevel, nil, "%v, is the client configured to use an HTTP proxy?", httpErr)
+			}
+			return false
+		}
+		handshakeFailed := stats.CloseReason == CloseReasonNone
+		if handshakeFailed {
+			stats.CloseReason = CloseReasonHandshakeFailure
+			stats.HandshakeReply = err.Reason
+		}
+		p.logSampled(ctx, log.ErrorLevel, err.Reason, "socks error (%s): %v", err.Reason, err.Err)
+		if stats.HandshakePhase == HandshakePhaseDone {
+			// the client reads the data of the tunnel since the success
+			// reply, an error reply would be mistaken for data
+			log.Debugf("tunnel already established, not sending error reply %s", err.Reason)
+			return false
+		}
+		phase := stats.HandshakePhase
+		if phase == HandshakePhaseAuth {
+			// rfc1929 requires closing the connection after the failure
+			// status of the subnegotiation, a reply would be read as garbage
+			log.Debugf("authentication failed, not sending error reply %s", err.Reason)
+			if handshakeFailed {
+				p.handshakeFailures.inc(phase, err.Reason)
+			}
+			p.releaseHandshake(stats)
+			p.lingerAfterErrorReply(conn)
+			return false
+		}
+		// send error reply
+		replyErr := p.socksErrorReply(ctx, conn, stats.version, err.Reason)
+		if replyErr != nil {
+			p.logSampled(ctx, log.ErrorLevel, nil, "%v", replyErr)
+			phase = HandshakePhaseReplyWrite
+		}
+		if handshakeFailed {
+			p.handshakeFailures.inc(phase, err.Reason)
+		}
+		if replyErr == nil {
+			p.releaseHandshake(stats)
+			p.lingerAfterErrorReply(conn)
+		}
+		return false
 	}
+	_, pipelined := p.pipelineConn(conn)
+	return pipelined && stats.CloseReason == CloseReasonRemoteEOF
 }
 
-func (p *Proxy) socks(ctx context.Context, conn io.ReadWriteCloser) *Error {
+// socksRecover runs socks and turns a panic, usually of a handler or a
+// policy, into a general failure so only the session ends
+func (p *Proxy) socksRecover(ctx context.Context, conn io.ReadWriteCloser, stats *SessionStats) (err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("panic while serving session: %v\n%s", r, debug.Stack())
+			err = &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+	return p.socks(ctx, conn, stats)
+}
+
+// socks handles a single client connection. The number of transferred bytes is
+// stored in stats
+func (p *Proxy) socks(ctx context.Context, conn io.ReadWriteCloser, stats *SessionStats) *Error {
 	defer func() {
 		if err := p.Proxyhandler.Cleanup(); err != nil {
 			log.Errorf("error on cleanup: %v", err)
 		}
 	}()
 
-	if err := p.handleConnect(ctx, conn); err != nil {
-		return err
+	// the deadline limits the whole handshake so clients can not keep the
+	// connection open by sending the handshake byte by byte
+	c, hasDeadline := extractNetConn(conn)
+	clearDeadline := func() error { return nil }
+	if hasDeadline && p.HandshakeDeadline > 0 {
+		var err error
+		if clearDeadline, err = p.setHandshakeDeadline(c); err != nil {
+			return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not set handshake deadline: %w", err)}
+		}
 	}
 
-	request, err := p.handleRequest(ctx, conn)
+	buf, err := p.readGreeting(ctx, conn, stats)
 	if err != nil {
 		return err
 	}
+	if method, ok := looksLikeHTTP(buf); ok {
+		if p.HTTPConnect == nil || !hasDeadline {
+			return p.handleHTTPRequest(ctx, conn, method)
+		}
+		p.releaseHandshake(stats)
+		p.HTTPConnect(context.WithValue(ctx, acceptedKey{}, stats), &prefixConn{Conn: c, prefix: buf, clearDeadline: clearDeadline})
+		return nil
+	}
+	switch Version(buf[0]) {
+	case Version4:
+		if p.EnableSOCKS4 {
+			return p.socks4(ctx, conn, buf, stats, clearDeadline)
+		}
+	case Version5:
+		if p.DisableSOCKS5 {
+			return &Error{Reason: RequestReplyMethodNotSupported, Err: fmt.Errorf("socks5 is disabled")}
+		}
+	}
 
-	log.Infof("Connecting to %s", request.getDestinationString())
+	username, err := p.handleConnect(ctx, conn, buf, stats)
+	if err != nil {
+		return err
+	}
 
-	// Should we assume connection succeed here?
-	remote, err := p.Proxyhandler.PreHandler(*request)
+	request, err := p.handleRequest(ctx, conn, stats)
 	if err != nil {
 		return err
 	}
-	defer remote.Close()
 
-	var ip net.Addr
-	if r, ok := remote.(net.Conn); ok {
-		ip = r.LocalAddr()
+	if err := clearDeadline(); err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not clear handshake deadline: %w", err)}
+	}
+	request.Username = username
+	if info, ok := ConnInfoFromContext(ctx); ok && username == "" {
+		request.Username = info.Username
+	}
+	if request.Username != "" {
+		ctx = WithUser(ctx, request.Username)
+	}
+
+	if request.Command == RequestCmdResume {
+		if !p.EnableSessionResume {
+			return &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("session resume is not enabled")}
+		}
+		if request.AddressType == RequestAddressTypeSessionToken {
+			return p.resumeSession(ctx, conn, request.DestinationAddress, stats)
+		}
+	} else if request.AddressType == RequestAddressTypeSessionToken {
+		return &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("session token is only valid for resume requests")}
+	}
+	if request.AddressType == RequestAddressTypeUnixPath {
+		if !p.AllowUnixTargets {
+			return &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("unix destination %s denied: unix targets are not enabled", request.getDestinationString())}
+		}
+		if request.Command != RequestCmdConnect {
+			return &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("unix destinations are only supported for connect requests")}
+		}
+	}
+
+	if request.Command == RequestCmdAssociate {
+		return p.handleAssociate(ctx, conn, request, stats)
+	}
+
+	return p.relayRequest(ctx, conn, request, stats, func(remote io.ReadWriteCloser) (io.ReadWriteCloser, func(), *Error) {
+		stats.HandshakePhase = HandshakePhaseReplyWrite
+		if err := p.handleRequestReply(ctx, conn, bindAddr(remote)); err != nil {
+			return nil, nil, err
+		}
+		p.handshakeDone(stats)
+
+		if request.Command != RequestCmdResume {
+			return conn, nil, nil
+		}
+		session, token, err := p.registerResumableSession(ctx, conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return session.conn, func() { p.unregisterResumableSession(token, session) }, nil
+	})
+}
+
+// connectedFunc is called by relayRequest once the remote is connected. It
+// returns the connection to relay the data to and an optional function
+// called when the session ended
+type connectedFunc func(remote io.ReadWriteCloser) (io.ReadWriteCloser, func(), *Error)
+
+// relayRequest connects to the destination of the request and relays the
+// data between the client and the remote. This is the part shared by the
+// socks path, which sends the success reply in connected, and Relay
+func (p *Proxy) relayRequest(ctx context.Context, conn io.ReadWriteCloser, request *Request, stats *SessionStats, connected connectedFunc) *Error {
+	var remote io.ReadWriteCloser
+	var decision PolicyDecision
+	var err *Error
+	if p.isSelfCheck(ctx, conn) && request.getDestinationString() == selfCheckTarget {
+		remote = newEchoConn()
 	} else {
-		ip = nil
+		remote, decision, err = p.connect(ctx, conn, request)
+		if err != nil {
+			return err
+		}
+		if r, ok := extractNetConn(remote); ok {
+			stats.RemoteAddr = r.RemoteAddr()
+			stats.LocalAddr = r.LocalAddr()
+		}
 	}
-	err = p.handleRequestReply(ctx, conn, ip)
-	if err != nil {
-		return err
+	// clean is set if the session ended normally so a borrowed remote can be
+	// reused
+	clean := false
+	remote = wrapReleaser(remote)
+	defer func() {
+		if err := finishRemote(remote, clean); err != nil {
+			log.Debugf("error on releasing remote connection: %v", err)
+		}
+	}()
+
+	tos := p.TOS
+	if decision.TOS != 0 {
+		tos = decision.TOS
+	}
+	if tos != 0 && p.applyTOS(conn, remote, tos) {
+		stats.TOS = tos
+	}
+
+	client := conn
+	if connected != nil {
+		c, done, err := connected(remote)
+		if err != nil {
+			return err
+		}
+		if done != nil {
+			defer done()
+		}
+		client = c
 	}
 
+	clean, err = p.relayData(ctx, request, conn, client, remote, stats)
+	return err
+}
+
+// relayData copies the data between the client and the remote until the
+// session ends. conn is the connection the request was read from, client is
+// the connection the data is relayed to. It returns true if the session
+// ended normally so a borrowed remote can be reused
+func (p *Proxy) relayData(ctx context.Context, request *Request, conn, client, remote io.ReadWriteCloser, stats *SessionStats) (bool, *Error) {
 	log.Debug("beginning of data copy")
 
+	sess := p.registerSession(ctx, request, conn, client, remote, stats)
+	defer p.unregisterSession(sess)
+
 	wg := &sync.WaitGroup{}
 	errChannel1 := make(chan error, 1)
 	errChannel2 := make(chan error, 1)
-	ctx2, cancel := context.WithCancel(ctx)
+	ctx2, cancel := p.withSessionDeadline(ctx, sess)
 	defer cancel()
 	wg.Add(2)
 
-	go p.copyClientToRemote(ctx2, conn, remote, wg, errChannel1)
-	go p.copyRemoteToClient(ctx2, remote, conn, wg, errChannel2)
-	go p.Proxyhandler.Refresh(ctx2)
+	var clientReader io.ReadCloser = &countingReader{ReadCloser: client, n: &stats.BytesClientToRemote}
+	if p.LogJA3 {
+		clientReader = &ja3Sniffer{ReadCloser: clientReader, sess: sess}
+	}
+	remoteReader := &countingReader{ReadCloser: remote, n: &stats.BytesRemoteToClient}
+	go p.copyClientToRemote(ctx2, sess, clientReader, remote, wg, errChannel1)
+	go p.copyRemoteToClient(ctx2, sess, remoteReader, client, wg, errChannel2)
+	go p.closeOnStop(ctx2, sess)
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		p.Proxyhandler.Refresh(ctx2)
+	}()
 
 	log.Debug("waiting for copy to finish")
 	wg.Wait()
 	// stop refreshing the connection
 	cancel()
+	<-refreshDone
+	stats.CloseReason = sess.closeReason()
+	stats.JA3 = sess.getJA3()
+	if stats.CloseReason.byProxy() {
+		// the tunnel is already established so no error reply is sent
+		return false, nil
+	}
+	if c, ok := p.pipelineConn(client); ok && stats.CloseReason == CloseReasonRemoteEOF {
+		if err := c.SetReadDeadline(time.Time{}); err != nil {
+			return false, &Error{Reason: RequestReplyGeneralFailure, Err: err}
+		}
+		return true, nil
+	}
 	if err := <-errChannel1; err != nil {
-		return &Error{Reason: RequestReplyHostUnreachable, Err: err}
+		return false, &Error{Reason: RequestReplyHostUnreachable, Err: err}
 	}
 	if err := <-errChannel2; err != nil {
-		return &Error{Reason: RequestReplyHostUnreachable, Err: err}
+		return false, &Error{Reason: RequestReplyHostUnreachable, Err: err}
 	}
 	log.Debug("end of connection handling")
+	return true, nil
+}
+
+// BindAddresser is implemented by remote connections that know the address
+// to send in the reply, like virtual connections tunneled through another
+// protocol
+type BindAddresser interface {
+	BindAddr() net.Addr
+}
 
+// bindAddr returns the address sent in the success reply. Only ip addresses
+// can be sent, in-memory connections like pipes get the empty address
+func bindAddr(remote io.ReadWriteCloser) net.Addr {
+	if b, ok := remote.(BindAddresser); ok {
+		return b.BindAddr()
+	}
+	if r, ok := extractNetConn(remote); ok {
+		if addr, ok := r.LocalAddr().(*net.TCPAddr); ok {
+			return addr
+		}
+	}
 	return nil
 }
 
-func (p *Proxy) copyClientToRemote(ctx context.Context, client io.ReadCloser, remote io.WriteCloser, wg *sync.WaitGroup, errChannel chan<- error) {
+// probeError is returned if the client closed the connection before sending
+// anything
+type probeError struct {
+	err error
+}
+
+func (e *probeError) Error() string {
+	return fmt.Sprintf("client closed the connection before the handshake: %v", e.err)
+}
+
+func (e *probeError) Unwrap() error { return e.err }
+
+// connect applies the rewrites, policy and access lists to the request and
+// connects to the destination using the handler
+func (p *Proxy) connect(ctx context.Context, conn io.ReadWriteCloser, request *Request) (io.ReadWriteCloser, PolicyDecision, *Error) {
+	requested := request.getDestinationString()
+	p.applyRewrites(request)
+
+	decision, err := p.applyPolicy(ctx, request)
+	if err != nil {
+		return nil, decision, err
+	}
+	if stats, ok := StatsFromContext(ctx); ok && request.getDestinationString() != requested {
+		stats.OriginalDestination = requested
+	}
+
+	clientAddr, _ := ClientAddrFromContext(ctx)
+	if err := p.checkDestination(ctx, request, addrIP(clientAddr)); err != nil {
+		return nil, decision, err
+	}
+
+	if decision.ProxyProtocol != ProxyProtocolNone {
+		ctx = withProxyProtocol(ctx, decision.ProxyProtocol)
+	}
+
+	logEntry(ctx).Infof("Connecting to %s", request.getDestinationString())
+
+	// Should we assume connection succeed here?
+	start := time.Now()
+	remote, err := p.Proxyhandler.PreHandler(ctx, *request)
+	p.metrics().ObserveDialDuration(time.Since(start))
+	if err != nil {
+		return nil, decision, err
+	}
+	return remote, decision, nil
+}
+
+func (p *Proxy) copyClientToRemote(ctx context.Context, sess *session, client io.ReadCloser, remote io.WriteCloser, wg *sync.WaitGroup, errChannel chan<- error) {
 	defer wg.Done()
 	defer close(errChannel)
 
 	select {
-	case <-p.Done:
+	case <-sess.done:
+		sess.setReason(CloseReasonShutdown)
 		errChannel <- nil
 		return
 	default:
-		if err := p.Proxyhandler.CopyFromClientToRemote(ctx, client, remote); err != nil {
+		dst := p.stallWriter(sess, remote)
+		err := p.Proxyhandler.CopyFromClientToRemote(ctx, client, dst)
+		clearStallDeadline(dst)
+		if err != nil {
+			if _, ok := p.pipelineConn(sess.client); ok && sess.closeReason() == CloseReasonRemoteEOF && errors.Is(err, os.ErrDeadlineExceeded) {
+				// interrupted to end a pipelined session
+				remote.Close()
+				errChannel <- nil
+				return
+			}
+			sess.setReason(CloseReasonCopyErrorClientToRemote)
+			// unblock the other direction
+			client.Close()
+			remote.Close()
 			errChannel <- fmt.Errorf("error on copy from Client to Remote: %v", err)
 			return
 		}
+		sess.setReason(CloseReasonClientEOF)
+		// the client finished sending, pass the FIN on to the remote but keep
+		// reading its response
+		if err := closeWrite(remote); err != nil {
+			log.Debugf("could not half-close remote connection: %v", err)
+		}
 		errChannel <- nil
 		return
 	}
 }
 
-func (p *Proxy) copyRemoteToClient(ctx context.Context, remote io.ReadCloser, client io.WriteCloser, wg *sync.WaitGroup, errChannel chan<- error) {
+func (p *Proxy) copyRemoteToClient(ctx context.Context, sess *session, remote io.ReadCloser, client io.WriteCloser, wg *sync.WaitGroup, errChannel chan<- error) {
 	defer wg.Done()
 	defer close(errChannel)
 
 	select {
-	case <-p.Done:
+	case <-sess.done:
+		sess.setReason(CloseReasonShutdown)
 		errChannel <- nil
 		return
 	default:
-		if err := p.Proxyhandler.CopyFromRemoteToClient(ctx, remote, client); err != nil {
+		dst := p.stallWriter(sess, client)
+		err := p.Proxyhandler.CopyFromRemoteToClient(ctx, remote, dst)
+		clearStallDeadline(dst)
+		if err != nil {
+			sess.setReason(CloseReasonCopyErrorRemoteToClient)
+			// unblock the other direction
+			remote.Close()
+			client.Close()
 			errChannel <- fmt.Errorf("error on copy from Remote to Client: %v", err)
 			return
 		}
+		sess.setReason(CloseReasonRemoteEOF)
+		if c, ok := p.pipelineConn(client); ok {
+			// keep the client connection open for the next session and stop
+			// reading the client data for this session
+			if err := c.SetReadDeadline(time.Now()); err != nil {
+				log.Debugf("could not interrupt client read: %v", err)
+			}
+		} else if err := closeWrite(client); err != nil {
+			log.Debugf("could not half-close client connection: %v", err)
+		}
 		errChannel <- nil
 		return
 	}
 }
 
-func (p *Proxy) socksErrorReply(ctx context.Context, conn io.ReadWriteCloser, reason RequestReplyReason) error {
+func (p *Proxy) socksErrorReply(ctx context.Context, conn io.ReadWriteCloser, version Version, reason RequestReplyReason) error {
+	p.metrics().IncError(reason)
 	// send error reply
-	repl, err := requestReply(nil, reason)
-	if err != nil {
-		return err
+	var repl []byte
+	if version == Version4 {
+		repl = socks4Reply(reason)
+	} else {
+		var err error
+		repl, err = requestReply(nil, reason)
+		if err != nil {
+			return err
+		}
 	}
-	err = connectionWrite(ctx, conn, repl, p.Timeout)
+	err := connectionWrite(ctx, p.dumpConn(conn, "socksErrorReply"), repl, p.Timeout, p.clock())
 	if err != nil {
 		return err
 	}
@@ -150,45 +569,82 @@ func (p *Proxy) socksErrorReply(ctx context.Context, conn io.ReadWriteCloser, re
 	return nil
 }
 
-func (p *Proxy) handleConnect(ctx context.Context, conn io.ReadWriteCloser) *Error {
-	buf, err := connectionRead(ctx, conn, p.Timeout)
+// readGreeting waits for a handshake slot and reads the first message of the
+// client. It is used to detect the protocol before the handshake
+func (p *Proxy) readGreeting(ctx context.Context, conn io.ReadWriteCloser, stats *SessionStats) ([]byte, *Error) {
+	if err := p.acquireHandshake(ctx, stats); err != nil {
+		return nil, err
+	}
+	stats.HandshakePhase = HandshakePhaseMethodNegotiation
+	buf, err := connectionRead(ctx, p.dumpConn(conn, "handleConnect"), p.Timeout, p.clock())
 	if err != nil {
-		return &Error{Reason: RequestReplyConnectionRefused, Err: err}
+		if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+			return nil, &Error{Reason: RequestReplyConnectionRefused, Err: &probeError{err: err}}
+		}
+		return nil, &Error{Reason: RequestReplyConnectionRefused, Err: err}
 	}
+	if len(buf) == 0 {
+		return nil, &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("empty client greeting")}
+	}
+	return buf, nil
+}
+
+func (p *Proxy) handleConnect(ctx context.Context, conn io.ReadWriteCloser, buf []byte, stats *SessionStats) (string, *Error) {
 	header, err := parseHeader(buf)
 	if err != nil {
-		return &Error{Reason: RequestReplyConnectionRefused, Err: err}
+		return "", &Error{Reason: RequestReplyConnectionRefused, Err: err}
 	}
 	switch header.Version {
 	case Version4:
-		return &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("socks4 not yet implemented")}
+		return "", &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("socks4 is not enabled")}
 	case Version5:
 	default:
-		return &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("version %#x not yet implemented", byte(header.Version))}
+		return "", &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("version %s not yet implemented", header.Version)}
 	}
 
-	methodSupported := false
+	creds := p.getCredentials()
+	offered := make([]Methods, 0, len(header.Methods))
 	for _, x := range header.Methods {
-		if x == MethodNoAuthRequired {
-			methodSupported = true
-			break
-		}
+		p.metrics().IncMethodAdvertised(Methods(x))
+		offered = append(offered, Methods(x))
 	}
-	if !methodSupported {
-		return &Error{Reason: RequestReplyMethodNotSupported, Err: fmt.Errorf("we currently only support no authentication")}
+	var method Methods
+	if p.isSelfCheck(ctx, conn) {
+		// self checks are started by the proxy itself and have no credentials
+		creds = nil
+		method, err = defaultMethodSelector(offered, nil)
+	} else {
+		method, err = p.selectMethod(ctx, offered, creds)
 	}
+	if err != nil {
+		p.metrics().IncMethodSelected(MethodNoAcceptableMethods)
+		return "", &Error{Reason: RequestReplyMethodNotSupported, Err: err}
+	}
+	method = p.withBanner(method, offered)
+	p.metrics().IncMethodSelected(method)
+	stats.version = Version5
+	stats.Method = method
 	reply := make([]byte, 2)
 	reply[0] = byte(Version5)
-	reply[1] = byte(MethodNoAuthRequired)
-	err = connectionWrite(ctx, conn, reply, p.Timeout)
+	reply[1] = byte(method)
+	err = connectionWrite(ctx, p.dumpConn(conn, "handleConnect"), reply, p.Timeout, p.clock())
 	if err != nil {
-		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send connect reply: %w", err)}
+		return "", &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send connect reply: %w", err)}
 	}
-	return nil
+
+	if method == MethodBanner {
+		return "", p.sendBanner(ctx, p.dumpConn(conn, "sendBanner"))
+	}
+	if method == MethodUsernamePassword {
+		stats.HandshakePhase = HandshakePhaseAuth
+		return p.handleUsernamePasswordAuth(ctx, p.dumpConn(conn, "handleUsernamePasswordAuth"), creds)
+	}
+	return "", nil
 }
 
-func (p *Proxy) handleRequest(ctx context.Context, conn io.ReadWriteCloser) (*Request, *Error) {
-	buf, err := connectionRead(ctx, conn, p.Timeout)
+func (p *Proxy) handleRequest(ctx context.Context, conn io.ReadWriteCloser, stats *SessionStats) (*Request, *Error) {
+	stats.HandshakePhase = HandshakePhaseRequest
+	buf, err := connectionRead(ctx, p.dumpConn(conn, "handleRequest"), p.Timeout, p.clock())
 	if err != nil {
 		return nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("error on ConnectionRead: %w", err)}
 	}
@@ -200,14 +656,31 @@ func (p *Proxy) handleRequest(ctx context.Context, conn io.ReadWriteCloser) (*Re
 }
 
 func (p *Proxy) handleRequestReply(ctx context.Context, conn io.ReadWriteCloser, addr net.Addr) *Error {
+	addr, mapErr := p.mapAddress(addr)
+	if mapErr != nil {
+		return mapErr
+	}
 	repl, err := requestReply(addr, RequestReplySucceeded)
 	if err != nil {
 		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("error on requestReply: %w", err)}
 	}
-	err = connectionWrite(ctx, conn, repl, p.Timeout)
+	err = connectionWrite(ctx, p.dumpConn(conn, "handleRequestReply"), repl, p.Timeout, p.clock())
 	if err != nil {
 		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("error on RequestResponse: %w", err)}
 	}
 
 	return nil
 }
+
+// mapAddress returns the address to send in a reply for the bound address
+// addr. Nil addresses are not mapped
+func (p *Proxy) mapAddress(addr net.Addr) (net.Addr, *Error) {
+	if addr == nil || p.AddressMapper == nil {
+		return addr, nil
+	}
+	mapped, err := p.AddressMapper(addr)
+	if err != nil {
+		return nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not map address %s: %w", addr, err)}
+	}
+	return mapped, nil
+}
@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// socks4 reply codes
+const (
+	socks4Granted  byte = 0x5a
+	socks4Rejected byte = 0x5b
+)
+
+/*
+	+----+----+----+----+----+----+----+----+----+----+....+----+
+	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	+----+----+----+----+----+----+----+----+----+----+....+----+
+	   1    1      2              4           variable       1
+
+socks4a clients that can not resolve the destination send the ip 0.0.0.x
+with x != 0 followed by the domain name and another NULL after the userid.
+*/
+func parseSocks4Request(buf []byte) (*Request, string, *Error) {
+	if len(buf) < 9 {
+		return nil, "", &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("invalid socks4 request length (%d)", len(buf))}
+	}
+	if buf[1] != byte(RequestCmdConnect) {
+		return nil, "", &Error{Reason: RequestReplyCommandNotSupported, Err: fmt.Errorf("socks4 command %s not supported", RequestCmd(buf[1]))}
+	}
+	r := &Request{
+		Version:         Version4,
+		Command:         RequestCmdConnect,
+		AddressType:     RequestAddressTypeIPv4,
+		DestinationPort: binary.BigEndian.Uint16(buf[2:4]),
+	}
+	ip := buf[4:8]
+	rest := buf[8:]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 {
+		return nil, "", &Error{Reason: RequestReplyConnectionRefused, Err: fmt.Errorf("socks4 userid is not terminated")}
+	}
+	userID := string(rest[:end])
+	rest = rest[end+1:]
+
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		end = bytes.IndexByte(rest, 0)
+		if end <= 0 || end > 255 {
+			return nil, "", &Error{Reason: RequestReplyAddressTypeNotSupported, Err: fmt.Errorf("invalid socks4a domain name")}
+		}
+		r.AddressType = RequestAddressTypeDomainname
+		r.DestinationAddress = rest[:end]
+		return r, userID, nil
+	}
+	r.DestinationAddress = ip
+	return r, userID, nil
+}
+
+// socks4Reply returns the reply to a socks4 request. The destination fields
+// are ignored by clients of CONNECT requests and left empty
+func socks4Reply(reason RequestReplyReason) []byte {
+	code := socks4Rejected
+	if reason == RequestReplySucceeded {
+		code = socks4Granted
+	}
+	return []byte{0x00, code, 0, 0, 0, 0, 0, 0}
+}
+
+// socks4 serves a socks4 or socks4a CONNECT request. buf holds the request
+// read during the protocol detection. socks4 has no authentication so the
+// request is denied if the proxy requires credentials. clearDeadline clears
+// the HandshakeDeadline once the request was read
+func (p *Proxy) socks4(ctx context.Context, conn io.ReadWriteCloser, buf []byte, stats *SessionStats, clearDeadline func() error) *Error {
+	stats.version = Version4
+	stats.HandshakePhase = HandshakePhaseRequest
+	request, userID, err := parseSocks4Request(buf)
+	if err != nil {
+		return err
+	}
+	if p.getCredentials() != nil {
+		return &Error{Reason: RequestReplyConnectionNotAllowed, Err: fmt.Errorf("socks4 request denied: authentication is required")}
+	}
+	if userID != "" {
+		logEntry(ctx).Debugf("socks4 request with userid %q", userID)
+	}
+
+	if err := clearDeadline(); err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not clear handshake deadline: %w", err)}
+	}
+
+	return p.relayRequest(ctx, conn, request, stats, func(remote io.ReadWriteCloser) (io.ReadWriteCloser, func(), *Error) {
+		stats.HandshakePhase = HandshakePhaseReplyWrite
+		if err := connectionWrite(ctx, p.dumpConn(conn, "socks4"), socks4Reply(RequestReplySucceeded), p.Timeout, p.clock()); err != nil {
+			return nil, nil, &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not send socks4 reply: %w", err)}
+		}
+		p.handshakeDone(stats)
+		return conn, nil, nil
+	})
+}
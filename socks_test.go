@@ -0,0 +1,90 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestHalfClose closes the write side of the client and checks that the
+// response the remote sends after the end of the request still arrives
+func TestHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		// answer only after the FIN of the client was passed on
+		time.Sleep(50 * time.Millisecond)
+		_, _ = conn.Write(append([]byte("got "), request...))
+	}()
+
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, l.Addr().String()); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "got request" {
+		t.Fatalf("got response %q, want %q", response, "got request")
+	}
+}
+
+func TestServeConnPipe(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.ServeConn(server)
+	}()
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Client{}).negotiateMethod(client); err != nil {
+		t.Fatal(err)
+	}
+	if reply := sendRequest(t, client, lineServer(t)); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	roundTrip(t, client)
+	if stats := p.Stats(); stats.ActiveSessions != 1 {
+		t.Fatalf("got %d active sessions, want 1", stats.ActiveSessions)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return after the client closed the connection")
+	}
+	if stats := p.Stats(); stats.ActiveConnections != 0 || stats.TotalSessions != 1 {
+		t.Fatalf("got %d active connections and %d sessions, want 0 and 1", stats.ActiveConnections, stats.TotalSessions)
+	}
+}
@@ -0,0 +1,151 @@
+package sockstest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+)
+
+// FakeClock is a socks.Clock that only moves when Advance is called. Set it
+// as Proxy.Clock to test timeouts without sleeping
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a clock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer firing once the clock advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) socks.Timer {
+	return c.add(d, nil)
+}
+
+// After returns the channel of a new timer
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, nil).C()
+}
+
+// AfterFunc calls f once the clock advanced by d. f is called by Advance
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) socks.Timer {
+	return c.add(d, f)
+}
+
+func (c *FakeClock) add(d time.Duration, f func()) *fakeTimer {
+	t := &fakeTimer{clock: c, f: f}
+	if f == nil {
+		t.c = make(chan time.Time, 1)
+	}
+	c.mu.Lock()
+	t.schedule(d)
+	c.mu.Unlock()
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers that expired in
+// order of their expiry
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if !t.when.After(c.now) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].when.Before(due[j].when)
+	})
+	for _, t := range due {
+		t.remove()
+	}
+	now := c.now
+	c.mu.Unlock()
+
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+// BlockUntil waits until n timers are pending, for example until the proxy
+// started waiting for the timeout that should be triggered with Advance
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// Pending returns the number of pending timers
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	f     func()
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.remove()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.remove()
+	t.schedule(d)
+	return active
+}
+
+// schedule adds the timer to the clock. The clock must be locked
+func (t *fakeTimer) schedule(d time.Duration) {
+	t.when = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	t.clock.cond.Broadcast()
+}
+
+// remove removes the timer from the clock and returns true if it was
+// pending. The clock must be locked
+func (t *fakeTimer) remove() bool {
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package sockstest
+
+import (
+	"fmt"
+	"testing"
+)
+
+// AssertCompliantV5Handshake checks that the transcript of a client side
+// RecordingConn contains a socks5 handshake conforming to rfc1928 (and
+// rfc1929 if username/password authentication was selected). Reads and
+// writes are checked as continuous streams so the result does not depend on
+// how the data was split into packets.
+func AssertCompliantV5Handshake(t testing.TB, transcript []Packet) {
+	t.Helper()
+	if err := CheckV5Handshake(transcript); err != nil {
+		t.Errorf("non compliant socks5 handshake: %v", err)
+	}
+}
+
+// CheckV5Handshake is like AssertCompliantV5Handshake but returns the first
+// violation as an error
+func CheckV5Handshake(transcript []Packet) error {
+	var written, read []byte
+	for _, p := range transcript {
+		switch p.Direction {
+		case DirectionWrite:
+			written = append(written, p.Data...)
+		case DirectionRead:
+			read = append(read, p.Data...)
+		}
+	}
+	w := &stream{name: "client", buf: written}
+	r := &stream{name: "server", buf: read}
+
+	// method negotiation
+	hello, err := w.next(2)
+	if err != nil {
+		return err
+	}
+	if hello[0] != 0x05 {
+		return fmt.Errorf("client hello has invalid version %#x", hello[0])
+	}
+	if hello[1] == 0 {
+		return fmt.Errorf("client hello offers no methods")
+	}
+	methods, err := w.next(int(hello[1]))
+	if err != nil {
+		return err
+	}
+	selection, err := r.next(2)
+	if err != nil {
+		return err
+	}
+	if selection[0] != 0x05 {
+		return fmt.Errorf("method selection has invalid version %#x", selection[0])
+	}
+	selected := selection[1]
+	if selected == 0xff {
+		if len(r.buf) > 0 || len(w.buf) > 0 {
+			return fmt.Errorf("data exchanged after no acceptable method was selected")
+		}
+		return nil
+	}
+	offered := false
+	for _, m := range methods {
+		if m == selected {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		return fmt.Errorf("server selected method %#x which was not offered by the client", selected)
+	}
+
+	// username/password sub negotiation
+	if selected == 0x02 {
+		auth, err := w.next(2)
+		if err != nil {
+			return err
+		}
+		if auth[0] != 0x01 {
+			return fmt.Errorf("authentication request has invalid version %#x", auth[0])
+		}
+		if _, err := w.next(int(auth[1])); err != nil {
+			return err
+		}
+		passLen, err := w.next(1)
+		if err != nil {
+			return err
+		}
+		if _, err := w.next(int(passLen[0])); err != nil {
+			return err
+		}
+		status, err := r.next(2)
+		if err != nil {
+			return err
+		}
+		if status[0] != 0x01 {
+			return fmt.Errorf("authentication reply has invalid version %#x", status[0])
+		}
+		if status[1] != 0x00 {
+			if len(r.buf) > 0 {
+				return fmt.Errorf("server sent data after failed authentication")
+			}
+			return nil
+		}
+	}
+
+	// request
+	request, err := w.next(3)
+	if err != nil {
+		return err
+	}
+	if request[0] != 0x05 {
+		return fmt.Errorf("request has invalid version %#x", request[0])
+	}
+	if request[1] < 0x01 || request[1] > 0x03 {
+		return fmt.Errorf("request has invalid command %#x", request[1])
+	}
+	if request[2] != 0x00 {
+		return fmt.Errorf("request reserved field is %#x instead of 0x00", request[2])
+	}
+	if err := w.address("request"); err != nil {
+		return err
+	}
+
+	// reply
+	reply, err := r.next(3)
+	if err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("reply has invalid version %#x", reply[0])
+	}
+	if reply[1] > 0x08 {
+		return fmt.Errorf("reply has invalid reply code %#x", reply[1])
+	}
+	if reply[2] != 0x00 {
+		return fmt.Errorf("reply reserved field is %#x instead of 0x00", reply[2])
+	}
+	if err := r.address("reply"); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 && len(r.buf) > 0 {
+		return fmt.Errorf("server sent %d bytes after an error reply", len(r.buf))
+	}
+	return nil
+}
+
+// stream is used to consume a recorded byte stream
+type stream struct {
+	name string
+	buf  []byte
+}
+
+func (s *stream) next(n int) ([]byte, error) {
+	if len(s.buf) < n {
+		return nil, fmt.Errorf("%s sent %d bytes, expected at least %d", s.name, len(s.buf), n)
+	}
+	ret := s.buf[:n]
+	s.buf = s.buf[n:]
+	return ret, nil
+}
+
+// address consumes ATYP, the address and the port
+func (s *stream) address(packet string) error {
+	atyp, err := s.next(1)
+	if err != nil {
+		return err
+	}
+	switch atyp[0] {
+	case 0x01:
+		_, err = s.next(4)
+	case 0x04:
+		_, err = s.next(16)
+	case 0x03:
+		var l []byte
+		l, err = s.next(1)
+		if err == nil {
+			if l[0] == 0 {
+				return fmt.Errorf("%s contains an empty domain name", packet)
+			}
+			_, err = s.next(int(l[0]))
+		}
+	default:
+		return fmt.Errorf("%s has invalid address type %#x", packet, atyp[0])
+	}
+	if err != nil {
+		return err
+	}
+	// port
+	_, err = s.next(2)
+	return err
+}
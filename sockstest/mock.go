@@ -0,0 +1,124 @@
+package sockstest
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+)
+
+// MockOption configures a MockHandler
+type MockOption func(*MockHandler)
+
+// WithPreHandlerError makes PreHandler fail with err
+func WithPreHandlerError(err *socks.Error) MockOption {
+	return func(m *MockHandler) {
+		m.err = err
+	}
+}
+
+// WithPreHandlerDelay makes PreHandler wait before returning. The wait is
+// aborted if the context is cancelled
+func WithPreHandlerDelay(d time.Duration) MockOption {
+	return func(m *MockHandler) {
+		m.delay = d
+	}
+}
+
+// WithConnection makes PreHandler return conn instead of an echo connection.
+// The same connection is returned on every call
+func WithConnection(conn io.ReadWriteCloser) MockOption {
+	return func(m *MockHandler) {
+		m.conn = conn
+	}
+}
+
+// MockHandler is a socks.ProxyHandler for tests. By default every request is
+// connected to an in-memory echo server. All requests are recorded
+type MockHandler struct {
+	socks.DefaultHandler
+
+	err   *socks.Error
+	delay time.Duration
+	conn  io.ReadWriteCloser
+
+	mu       sync.Mutex
+	requests []socks.Request
+}
+
+// NewMockHandler returns a MockHandler configured by opts
+func NewMockHandler(opts ...MockOption) *MockHandler {
+	m := &MockHandler{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// PreHandler records the request and returns the configured result
+func (m *MockHandler) PreHandler(ctx context.Context, request socks.Request) (io.ReadWriteCloser, *socks.Error) {
+	// the address points into the read buffer of the proxy
+	request.DestinationAddress = append([]byte(nil), request.DestinationAddress...)
+	m.mu.Lock()
+	m.requests = append(m.requests, request)
+	m.mu.Unlock()
+
+	if m.delay > 0 {
+		timer := time.NewTimer(m.delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &socks.Error{Reason: socks.RequestReplyGeneralFailure, Err: ctx.Err()}
+		case <-timer.C:
+		}
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.conn != nil {
+		return m.conn, nil
+	}
+	return newEchoConn(), nil
+}
+
+// PreHandlerCalls returns the number of PreHandler calls
+func (m *MockHandler) PreHandlerCalls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.requests)
+}
+
+// Requests returns the requests passed to PreHandler
+func (m *MockHandler) Requests() []socks.Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	requests := make([]socks.Request, len(m.requests))
+	copy(requests, m.requests)
+	return requests
+}
+
+// echoConn sends back everything written to it. It supports half-close so
+// the written data is still read back after CloseWrite
+type echoConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func newEchoConn() *echoConn {
+	r, w := io.Pipe()
+	return &echoConn{r: r, w: w}
+}
+
+func (e *echoConn) Read(b []byte) (int, error)  { return e.r.Read(b) }
+func (e *echoConn) Write(b []byte) (int, error) { return e.w.Write(b) }
+
+// CloseWrite signals EOF to the reader after the written data
+func (e *echoConn) CloseWrite() error { return e.w.Close() }
+
+// Close closes both directions
+func (e *echoConn) Close() error {
+	e.w.Close()
+	return e.r.Close()
+}
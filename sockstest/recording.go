@@ -0,0 +1,89 @@
+// Package sockstest provides helpers for testing socks proxies and handlers
+package sockstest
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Direction is the direction of a recorded packet
+type Direction uint8
+
+const (
+	// DirectionRead means the data was read from the connection
+	DirectionRead Direction = iota
+	// DirectionWrite means the data was written to the connection
+	DirectionWrite
+)
+
+// String returns the name of the direction
+func (d Direction) String() string {
+	switch d {
+	case DirectionRead:
+		return "read"
+	case DirectionWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// Packet holds the data of a single Read or Write call
+type Packet struct {
+	Time      time.Time
+	Direction Direction
+	Data      []byte
+}
+
+// RecordingConn wraps a net.Conn and records all data read from and written
+// to it
+type RecordingConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	packets []Packet
+}
+
+// NewRecordingConn returns a RecordingConn wrapping conn
+func NewRecordingConn(conn net.Conn) *RecordingConn {
+	return &RecordingConn{Conn: conn}
+}
+
+func (r *RecordingConn) record(direction Direction, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	p := Packet{
+		Time:      time.Now(),
+		Direction: direction,
+		Data:      make([]byte, len(data)),
+	}
+	copy(p.Data, data)
+	r.mu.Lock()
+	r.packets = append(r.packets, p)
+	r.mu.Unlock()
+}
+
+// Read reads from the underlying connection and records the data
+func (r *RecordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.record(DirectionRead, b[:n])
+	return n, err
+}
+
+// Write writes to the underlying connection and records the written data
+func (r *RecordingConn) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	r.record(DirectionWrite, b[:n])
+	return n, err
+}
+
+// Transcript returns a copy of all recorded packets in order
+func (r *RecordingConn) Transcript() []Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]Packet, len(r.packets))
+	copy(ret, r.packets)
+	return ret
+}
@@ -0,0 +1,44 @@
+package sockstest
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// SingleStream is a socks.StreamListener and socks.StreamDialer handing out
+// a single stream. Later calls return io.EOF, so ServeStreams returns after
+// the stream was accepted
+type SingleStream struct {
+	mu     sync.Mutex
+	stream io.ReadWriteCloser
+}
+
+// NewSingleStream returns a SingleStream handing out stream
+func NewSingleStream(stream io.ReadWriteCloser) *SingleStream {
+	return &SingleStream{stream: stream}
+}
+
+// AcceptStream returns the stream on the first call and io.EOF afterwards
+func (s *SingleStream) AcceptStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return s.take(ctx)
+}
+
+// OpenStream returns the stream on the first call and io.EOF afterwards
+func (s *SingleStream) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return s.take(ctx)
+}
+
+func (s *SingleStream) take(ctx context.Context) (io.ReadWriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream == nil {
+		return nil, io.EOF
+	}
+	stream := s.stream
+	s.stream = nil
+	return stream, nil
+}
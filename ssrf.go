@@ -0,0 +1,47 @@
+package socks
+
+import (
+	"net"
+)
+
+// privateRanges holds all ranges blocked by BlockPrivateDestinations
+var privateRanges = []string{
+	// "this" network
+	"0.0.0.0/8",
+	// rfc1918
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	// carrier grade nat, also used for cloud metadata services
+	"100.64.0.0/10",
+	// loopback
+	"127.0.0.0/8",
+	// link local including the 169.254.169.254 metadata service
+	"169.254.0.0/16",
+	// ipv6 unspecified and loopback
+	"::/128",
+	"::1/128",
+	// ipv6 link local
+	"fe80::/10",
+	// ipv6 unique local addresses including fd00:ec2::254
+	"fc00::/7",
+}
+
+var privateTrie = func() *CIDRTrie {
+	t := &CIDRTrie{}
+	for _, r := range privateRanges {
+		_, network, err := net.ParseCIDR(r)
+		if err != nil {
+			panic(err)
+		}
+		t.Insert(network, false)
+	}
+	return t
+}()
+
+// isPrivateIP checks if the ip is in one of the private, loopback, link local
+// or metadata ranges
+func isPrivateIP(ip net.IP) bool {
+	_, matched := privateTrie.Lookup(ip)
+	return matched
+}
@@ -0,0 +1,79 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBlockPrivateDestinations(t *testing.T) {
+	p := &Proxy{
+		BlockPrivateDestinations: true,
+		Resolver: staticResolver{
+			"public.example":  {net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1")},
+			"mixed.example":   {net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.1")},
+			"mixed6.example":  {net.ParseIP("2606:2800:220:1::1"), net.ParseIP("fd00:ec2::254")},
+			"private.example": {net.ParseIP("127.0.0.1")},
+		},
+	}
+	tests := []struct {
+		name    string
+		request Request
+		denied  bool
+	}{
+		{"public ipv4", ipRequest("93.184.216.34"), false},
+		{"public ipv6", ipRequest("2606:2800:220:1::1"), false},
+		{"loopback", ipRequest("127.0.0.1"), true},
+		{"rfc1918", ipRequest("192.168.1.1"), true},
+		{"metadata", ipRequest("169.254.169.254"), true},
+		{"carrier grade nat", ipRequest("100.100.100.200"), true},
+		{"ipv6 loopback", ipRequest("::1"), true},
+		{"ipv6 unique local", ipRequest("fd00:ec2::254"), true},
+		{"ipv6 link local", ipRequest("fe80::1"), true},
+		{"ipv4 mapped loopback", ipRequest("::ffff:127.0.0.1"), true},
+		{"fqdn public", domainRequest("public.example", 443), false},
+		{"fqdn private", domainRequest("private.example", 443), true},
+		{"fqdn public and private record", domainRequest("mixed.example", 443), true},
+		{"fqdn public and private ipv6 record", domainRequest("mixed6.example", 443), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := tt.request
+			stats := &SessionStats{}
+			err := p.checkDestination(WithStats(context.Background(), stats), &request, nil)
+			if !tt.denied {
+				if err != nil {
+					t.Fatalf("unexpected denial: %v", err)
+				}
+				if stats.DenyReason != "" {
+					t.Fatalf("got deny reason %q for an allowed destination", stats.DenyReason)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("destination was not denied")
+			}
+			if err.Reason != RequestReplyConnectionNotAllowed {
+				t.Fatalf("got reason %s, want %s", err.Reason, RequestReplyConnectionNotAllowed)
+			}
+			if stats.DenyReason != "private address" {
+				t.Fatalf("got deny reason %q, want %q", stats.DenyReason, "private address")
+			}
+		})
+	}
+}
+
+// ipRequest returns a CONNECT request to the literal ip on port 443. IPv4
+// mapped addresses are sent as IPv6
+func ipRequest(ip string) Request {
+	request := Request{Version: Version5, Command: RequestCmdConnect, DestinationPort: 443}
+	if strings.Contains(ip, ":") {
+		request.AddressType = RequestAddressTypeIPv6
+		request.DestinationAddress = net.ParseIP(ip).To16()
+	} else {
+		request.AddressType = RequestAddressTypeIPv4
+		request.DestinationAddress = net.ParseIP(ip).To4()
+	}
+	return request
+}
@@ -0,0 +1,117 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats holds the number of bytes transferred in a session and why it
+// ended
+type SessionStats struct {
+	// BytesClientToRemote is the number of bytes read from the client
+	BytesClientToRemote int64
+	// BytesRemoteToClient is the number of bytes read from the remote
+	BytesRemoteToClient int64
+	// DatagramsClientToRemote is the number of datagrams relayed from the
+	// client of an UDP ASSOCIATE session
+	DatagramsClientToRemote int64
+	// DatagramsRemoteToClient is the number of datagrams relayed to the
+	// client of an UDP ASSOCIATE session
+	DatagramsRemoteToClient int64
+	// DatagramsDenied is the number of datagrams of an UDP ASSOCIATE session
+	// dropped because the destination was denied or could not be resolved
+	DatagramsDenied int64
+	// DatagramsDropped is the number of datagrams of an UDP ASSOCIATE session
+	// dropped because they were malformed, oversize or not sent by the client
+	DatagramsDropped int64
+	// UDPDestinations is the number of distinct destinations datagrams of an
+	// UDP ASSOCIATE session were sent to
+	UDPDestinations int64
+	// CloseReason is the first cause that ended the session
+	CloseReason CloseReason
+	// HandshakeReply is the reply sent to the client if the handshake failed
+	HandshakeReply RequestReplyReason
+	// LocalAddr is the source address of the remote connection if the
+	// handler returned a network connection, for example the address chosen
+	// with DefaultHandler.LocalAddr or BindInterface
+	LocalAddr net.Addr
+	// TOS is the TOS set on the remote connection, 0 if none was set
+	TOS int
+	// OriginalDestination is the destination requested by the client if
+	// a rewrite rule or the policy changed it
+	OriginalDestination string
+	// RemoteAddr is the address of the remote connection if the handler
+	// returned a network connection. For the DefaultHandler this is the
+	// dialed address, one of Request.ResolvedAddresses for domain names
+	RemoteAddr net.Addr
+	// DenyReason is the reason returned by GeoIPFilter if it denied the
+	// request, "private address" if BlockPrivateDestinations did or
+	// "port not allowed" for ports outside of AllowedPorts and
+	// AllowedPortRanges
+	DenyReason string
+	// HandshakePhase is the last handshake phase the session reached
+	HandshakePhase HandshakePhase
+	// Method is the authentication method selected for a socks5 client
+	Method Methods
+	// UDPRelayPort is the port of the udp relay of an UDP ASSOCIATE session
+	UDPRelayPort int
+	// JA3 is the JA3 hash of the TLS ClientHello of the client if LogJA3 is
+	// set. It is set when the session ended
+	JA3 string
+
+	// started is the start of the session for the handshake duration
+	started time.Time
+	// handshakeSlot is set while the session holds a slot of
+	// MaxConcurrentHandshakes
+	handshakeSlot bool
+	// version is the socks version of the client, it selects the format of
+	// the error reply
+	version Version
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countChunkSize is the amount of data copied by one ReadFrom call of the
+// fast path before the counter is updated
+const countChunkSize = 1 << 20
+
+// WriteTo keeps the fast path of io.Copy. Wrapping the connection hides the
+// underlying *net.TCPConn from the ReadFrom of the destination, which would
+// fall back to copying through a user space buffer instead of using splice.
+// The data is passed to ReadFrom in chunks so the counter is still updated
+// while the copy runs
+func (c *countingReader) WriteTo(w io.Writer) (int64, error) {
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(w, readerOnly{c})
+	}
+	var total int64
+	for {
+		lr := &io.LimitedReader{R: c.ReadCloser, N: countChunkSize}
+		n, err := rf.ReadFrom(lr)
+		atomic.AddInt64(c.n, n)
+		total += n
+		// the chunk was not used up so the reader reached EOF
+		if err != nil || lr.N > 0 {
+			return total, err
+		}
+	}
+}
+
+// readerOnly hides all methods but Read so io.Copy does not call WriteTo
+// again
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,192 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a tcp connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	server, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { server.Close() })
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// echoServer sends back everything it receives and closes the connection
+// after the end of the stream
+func echoServer(tb testing.TB) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestRelayByteCounters relays 1 MB over tcp connections, so the data is
+// copied by countingReader.WriteTo, and checks both counters
+func TestRelayByteCounters(t *testing.T) {
+	const size = 1 << 20
+	target := echoServer(t)
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	client, server := tcpPair(t)
+	done := make(chan SessionStats, 1)
+	go func() {
+		stats, err := p.Relay(context.Background(), server, requestTo(t, target))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- stats
+	}()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	go func() {
+		if _, err := client.Write(data); err != nil {
+			t.Error(err)
+		}
+		if err := client.CloseWrite(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := client.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	received, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("got %d bytes back, want the %d bytes sent", len(received), len(data))
+	}
+
+	var stats SessionStats
+	select {
+	case stats = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+	if stats.BytesClientToRemote != size {
+		t.Errorf("got %d bytes from client to remote, want %d", stats.BytesClientToRemote, size)
+	}
+	if stats.BytesRemoteToClient != size {
+		t.Errorf("got %d bytes from remote to client, want %d", stats.BytesRemoteToClient, size)
+	}
+}
+
+// readFromRecorder records the readers passed to ReadFrom of the tcp
+// connection and the value of a counter at every call
+type readFromRecorder struct {
+	*net.TCPConn
+	counter *int64
+	readers []io.Reader
+	counts  []int64
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readers = append(r.readers, src)
+	r.counts = append(r.counts, atomic.LoadInt64(r.counter))
+	return r.TCPConn.ReadFrom(src)
+}
+
+// TestCountingReaderWriteTo checks that the destination gets the underlying
+// connection for the splice fast path and that the counter is updated
+// after every chunk
+func TestCountingReaderWriteTo(t *testing.T) {
+	const size = 3*countChunkSize + 100
+	srcWriter, src := tcpPair(t)
+	dst, dstReader := tcpPair(t)
+
+	go func() {
+		if _, err := srcWriter.Write(make([]byte, size)); err != nil {
+			t.Error(err)
+		}
+		srcWriter.Close()
+	}()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, dstReader)
+		received <- n
+	}()
+
+	var counter int64
+	recorder := &readFromRecorder{TCPConn: dst, counter: &counter}
+	n, err := io.Copy(recorder, &countingReader{ReadCloser: src, n: &counter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+	if n != size || counter != size {
+		t.Fatalf("copied %d bytes and counted %d, want %d", n, counter, size)
+	}
+	if got := <-received; got != size {
+		t.Fatalf("destination received %d bytes, want %d", got, size)
+	}
+
+	// three full chunks and the rest until EOF
+	if len(recorder.readers) != 4 {
+		t.Fatalf("ReadFrom was called %d times, want 4", len(recorder.readers))
+	}
+	for i, r := range recorder.readers {
+		lr, ok := r.(*io.LimitedReader)
+		if !ok {
+			t.Fatalf("ReadFrom got %T, want *io.LimitedReader", r)
+		}
+		if lr.R != io.Reader(src) {
+			t.Fatalf("ReadFrom got a reader of %T, want the *net.TCPConn", lr.R)
+		}
+		if want := int64(i) * countChunkSize; recorder.counts[i] != want {
+			t.Errorf("counter was %d before chunk %d, want %d", recorder.counts[i], i, want)
+		}
+	}
+}
+
+// TestCountingReaderWriteToWriter checks the copy to a destination without
+// ReadFrom
+func TestCountingReaderWriteToWriter(t *testing.T) {
+	var counter int64
+	var dst bytes.Buffer
+	src := &countingReader{ReadCloser: io.NopCloser(bytes.NewReader(make([]byte, 1000))), n: &counter}
+	// bytes.Buffer implements ReadFrom, hide it
+	n, err := src.WriteTo(struct{ io.Writer }{&dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 || counter != 1000 || dst.Len() != 1000 {
+		t.Fatalf("copied %d bytes, counted %d and received %d, want 1000", n, counter, dst.Len())
+	}
+}
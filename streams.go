@@ -0,0 +1,41 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StreamDialer opens streams of a multiplexed transport like yamux, smux,
+// QUIC or ssh channels. Every stream carries one socks connection
+type StreamDialer interface {
+	OpenStream(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// StreamListener accepts streams of a multiplexed transport. It returns
+// io.EOF or net.ErrClosed once no more streams will arrive
+type StreamListener interface {
+	AcceptStream(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// ServeStreams serves every stream accepted from the listener as a separate
+// connection with HandleConn. It blocks until the listener returns an error
+// or ctx ends. io.EOF, net.ErrClosed and the end of ctx are not returned as
+// errors. This allows serving clients over a connection the proxy dialed
+// itself, like a connect-back tunnel to a rendezvous server
+func (p *Proxy) ServeStreams(ctx context.Context, l StreamListener) error {
+	for {
+		stream, err := l.AcceptStream(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		log.Debug("accepted stream")
+		go p.HandleConn(stream)
+	}
+}
@@ -0,0 +1,39 @@
+package socks
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type tenantKey struct{}
+
+// TenantFromContext returns the tenant of the client resolved by
+// Proxy.TenantResolver
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// resolveTenant stores the tenant of the client in the context. The
+// connection must be rejected if an error is returned
+func (p *Proxy) resolveTenant(ctx context.Context) (context.Context, error) {
+	if p.TenantResolver == nil {
+		return ctx, nil
+	}
+	addr, _ := ClientAddrFromContext(ctx)
+	tenant, err := p.TenantResolver(addr)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant), nil
+}
+
+// logEntry returns a log entry with the tenant of the connection
+func logEntry(ctx context.Context) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if tenant, ok := TenantFromContext(ctx); ok {
+		entry = entry.WithField("tenant", tenant)
+	}
+	return entry
+}
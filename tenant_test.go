@@ -0,0 +1,108 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// lineServerOn is a lineServer listening on ip
+func lineServerOn(tb testing.TB, ip string) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serveLines(tb, l)
+	return l.Addr().String()
+}
+
+// dialProxyFrom is dialProxy with the client bound to ip
+func dialProxyFrom(tb testing.TB, proxyAddr, ip string) net.Conn {
+	tb.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	conn, err := d.Dial("tcp", proxyAddr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := (&Client{}).negotiateMethod(conn); err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+func TestTenantACL(t *testing.T) {
+	tenantACL := func(cidr string) *IPListACL {
+		acl := &IPListACL{}
+		if err := acl.Allow(cidr); err != nil {
+			t.Fatal(err)
+		}
+		return acl
+	}
+	// clients without their own rules are denied everything
+	acl := &IPListACL{}
+	acl.SetTenantACL("a", tenantACL("127.0.0.1/32"))
+	acl.SetTenantACL("b", tenantACL("127.0.0.3/32"))
+	tenants := map[string]string{"127.0.0.1": "a", "127.0.0.2": "b", "127.0.0.4": "c"}
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		ACL:          acl,
+		TenantResolver: func(addr net.Addr) (string, error) {
+			return tenants[addr.(*net.TCPAddr).IP.String()], nil
+		},
+	}
+	proxyAddr := serveProxy(t, p)
+	first, second := lineServerOn(t, "127.0.0.1"), lineServerOn(t, "127.0.0.3")
+
+	tests := []struct {
+		name   string
+		client string
+		dest   string
+		want   RequestReplyReason
+	}{
+		{"a own destination", "127.0.0.1", first, RequestReplySucceeded},
+		{"a other destination", "127.0.0.1", second, RequestReplyConnectionNotAllowed},
+		{"b own destination", "127.0.0.2", second, RequestReplySucceeded},
+		{"b other destination", "127.0.0.2", first, RequestReplyConnectionNotAllowed},
+		{"no rules", "127.0.0.4", first, RequestReplyConnectionNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialProxyFrom(t, proxyAddr, tt.client)
+			if reason := sendRequest(t, conn, tt.dest); reason != tt.want {
+				t.Fatalf("got reply %s, want %s", reason, tt.want)
+			}
+			if tt.want == RequestReplySucceeded {
+				roundTrip(t, conn)
+			}
+		})
+	}
+}
+
+func TestTenantResolverError(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		TenantResolver: func(net.Addr) (string, error) {
+			return "", errors.New("unknown client")
+		},
+	}
+	conn, err := net.Dial("tcp", serveProxy(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// the connection is closed before the greeting is answered
+	if err := (&Client{}).negotiateMethod(conn); err == nil {
+		t.Fatal("connection of a client without tenant was accepted")
+	}
+}
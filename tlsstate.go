@@ -0,0 +1,39 @@
+package socks
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+)
+
+type tlsStateKey struct{}
+
+// TLSStateFromContext returns the tls state of the client connection if the
+// proxy is served on a tls listener. With mutual tls PeerCertificates holds
+// the certificate of the client, handlers can use it for routing or
+// authorization in PreHandler
+func TLSStateFromContext(ctx context.Context) (*tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state, ok
+}
+
+// withTLSState completes the tls handshake of the client connection and
+// stores the connection state in the context. The connection must be closed
+// if an error is returned
+func (p *Proxy) withTLSState(ctx context.Context, conn io.ReadWriteCloser) (context.Context, error) {
+	c, ok := conn.(*tls.Conn)
+	if !ok {
+		return ctx, nil
+	}
+	handshakeCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = withTimeout(ctx, p.clock(), p.Timeout)
+		defer cancel()
+	}
+	if err := c.HandshakeContext(handshakeCtx); err != nil {
+		return ctx, err
+	}
+	state := c.ConnectionState()
+	return context.WithValue(ctx, tlsStateKey{}, &state), nil
+}
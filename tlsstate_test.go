@@ -0,0 +1,144 @@
+package socks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate signed by the ca for 127.0.0.1 with the
+// given usage
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTLSProxy serves p on a local tls listener until the test ends and
+// returns the address
+func serveTLSProxy(t *testing.T, p *Proxy, config *tls.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(tls.NewListener(l, config))
+	t.Cleanup(func() { p.Close() })
+	return l.Addr().String()
+}
+
+// tlsStateHandler records the common name of the client certificate
+type tlsStateHandler struct {
+	DefaultHandler
+	names chan string
+}
+
+func (h *tlsStateHandler) PreHandler(ctx context.Context, request Request) (io.ReadWriteCloser, *Error) {
+	name := ""
+	if state, ok := TLSStateFromContext(ctx); ok && len(state.PeerCertificates) > 0 {
+		name = state.PeerCertificates[0].Subject.CommonName
+	}
+	h.names <- name
+	return h.DefaultHandler.PreHandler(ctx, request)
+}
+
+func TestTLSStateFromContext(t *testing.T) {
+	ca := newTestCA(t)
+	handler := &tlsStateHandler{DefaultHandler: DefaultHandler{Timeout: time.Second}, names: make(chan string, 1)}
+	p := &Proxy{Proxyhandler: handler, Timeout: time.Second}
+	addr := serveTLSProxy(t, p, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "proxy", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	client := &Client{
+		ProxyAddr: addr,
+		Timeout:   5 * time.Second,
+		TLSConfig: &tls.Config{
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+		},
+	}
+	conn, err := client.Dial("tcp", lineServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+	if name := <-handler.names; name != "alice" {
+		t.Fatalf("handler got client certificate %q, want %q", name, "alice")
+	}
+}
+
+func TestTLSStateFromContextPlain(t *testing.T) {
+	handler := &tlsStateHandler{DefaultHandler: DefaultHandler{Timeout: time.Second}, names: make(chan string, 1)}
+	p := &Proxy{Proxyhandler: handler, Timeout: time.Second}
+	conn := dialProxy(t, serveProxy(t, p), "", "")
+	if reply := sendRequest(t, conn, lineServer(t)); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+	if name := <-handler.names; name != "" {
+		t.Fatalf("handler got client certificate %q without tls", name)
+	}
+}
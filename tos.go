@@ -0,0 +1,70 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// setTOS sets the TOS / traffic class on tcp connections. Other connections
+// are skipped and false is returned
+func setTOS(conn io.ReadWriteCloser, tos int) (bool, error) {
+	c, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	addr, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return false, nil
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	if err := setTOSRaw(raw, addr.IP.To4() == nil, tos); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// applyTOS sets the TOS on the remote connection and on the client
+// connection if TOSClient is set. Errors are only logged. It returns true if
+// the TOS was set on the remote connection
+func (p *Proxy) applyTOS(client, remote io.ReadWriteCloser, tos int) bool {
+	remoteApplied, err := setTOS(remote, tos)
+	if err != nil {
+		log.Warnf("could not set tos on remote connection: %v", err)
+	} else if remoteApplied {
+		log.Debugf("set tos %#x on remote connection", tos)
+	}
+	if !p.TOSClient {
+		return remoteApplied
+	}
+	applied, err := setTOS(client, tos)
+	if err != nil {
+		log.Warnf("could not set tos on client connection: %v", err)
+	} else if applied {
+		log.Debugf("set tos %#x on client connection", tos)
+	}
+	return remoteApplied
+}
+
+// tosControl sets the TOS on sockets created with a net.ListenConfig. Dual
+// stack sockets get the IPv4 TOS as well. Errors are only logged like for tcp
+// connections
+func tosControl(tos int) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		ipv6 := strings.HasSuffix(network, "6")
+		if err := setTOSRaw(c, ipv6, tos); err != nil {
+			log.Warnf("could not set tos on %s socket: %v", network, err)
+			return nil
+		}
+		if ipv6 {
+			_ = setTOSRaw(c, false, tos)
+		}
+		return nil
+	}
+}
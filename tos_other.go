@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package socks
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// setTOSRaw is not supported on this platform
+func setTOSRaw(c syscall.RawConn, ipv6 bool, tos int) error {
+	return fmt.Errorf("setting tos is not supported on %s", runtime.GOOS)
+}
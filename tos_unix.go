@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package socks
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setTOSRaw sets IP_TOS for ipv4 and IPV6_TCLASS for ipv6 sockets
+func setTOSRaw(c syscall.RawConn, ipv6 bool, tos int) error {
+	return rawControl(c, func(fd uintptr) error {
+		level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+		if ipv6 {
+			level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+		}
+		if err := syscall.SetsockoptInt(int(fd), level, opt, tos); err != nil {
+			return fmt.Errorf("could not set tos %#x: %w", tos, err)
+		}
+		return nil
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 )
 
 // Header holds a Socks5 header
@@ -20,24 +21,64 @@ type Request struct {
 	AddressType        RequestAddressType
 	DestinationAddress []byte
 	DestinationPort    uint16
+	// Username holds the authenticated user if username/password
+	// authentication was used or the username passed to HandleConnWithInfo
+	Username string
+	// ResolvedAddresses holds the vetted addresses of a domain name if the
+	// proxy already resolved it. Handlers should dial one of these instead
+	// of resolving the name again
+	ResolvedAddresses []net.IP
 }
 
 func (r Request) getDestinationString() string {
+	port := strconv.Itoa(int(r.DestinationPort))
 	switch r.AddressType {
 	case RequestAddressTypeDomainname:
-		return fmt.Sprintf("%s:%d", r.DestinationAddress, r.DestinationPort)
-	case RequestAddressTypeIPv4:
-		ip := net.IP(r.DestinationAddress)
-		return fmt.Sprintf("%s:%d", ip.String(), r.DestinationPort)
-	case RequestAddressTypeIPv6:
+		return net.JoinHostPort(string(r.DestinationAddress), port)
+	case RequestAddressTypeIPv4, RequestAddressTypeIPv6:
 		ip := net.IP(r.DestinationAddress)
-		return fmt.Sprintf("%s:%d", ip.String(), r.DestinationPort)
+		return net.JoinHostPort(ip.String(), port)
+	case RequestAddressTypeUnixPath:
+		// the port is ignored for unix destinations
+		return string(r.DestinationAddress)
 	default:
 		log.Fatalf("Address type not implemented")
 	}
 	return ""
 }
 
+// setDestination replaces the destination of the request. host can either
+// be an ip address or a domain name
+func (r *Request) setDestination(host string, port uint16) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			r.AddressType = RequestAddressTypeIPv4
+			r.DestinationAddress = ip4
+		} else {
+			r.AddressType = RequestAddressTypeIPv6
+			r.DestinationAddress = ip.To16()
+		}
+	} else {
+		r.AddressType = RequestAddressTypeDomainname
+		r.DestinationAddress = []byte(host)
+	}
+	r.DestinationPort = port
+	r.ResolvedAddresses = nil
+}
+
+// normalizeMappedIPv4 turns IPv4-mapped IPv6 destinations like
+// ::ffff:127.0.0.1 into IPv4 destinations so the rules only have to handle
+// one form of the address
+func (r *Request) normalizeMappedIPv4() {
+	if r.AddressType != RequestAddressTypeIPv6 {
+		return
+	}
+	if ip4 := net.IP(r.DestinationAddress).To4(); ip4 != nil {
+		r.AddressType = RequestAddressTypeIPv4
+		r.DestinationAddress = ip4
+	}
+}
+
 // Methods holds the socks5 msethod
 type Methods uint8
 
@@ -48,6 +89,9 @@ const (
 	MethodGSSAPI = 0x01
 	// MethodUsernamePassword means the socks proxy requires authentication with username and passowrd
 	MethodUsernamePassword = 0x02
+	// MethodBanner means the socks proxy sends a banner identifying it
+	// before the request (vendor extension, only if Proxy.Debug is set)
+	MethodBanner = 0x80
 	// MethodNoAcceptableMethods means the socks proxy does not implement any of the requested methods
 	MethodNoAcceptableMethods = 0xff
 )
@@ -77,6 +121,8 @@ const (
 	RequestCmdBind RequestCmd = 0x02
 	// RequestCmdAssociate represents the ASSOCIATE command
 	RequestCmdAssociate RequestCmd = 0x03
+	// RequestCmdResume represents the experimental session resume extension
+	RequestCmdResume RequestCmd = 0xF0
 )
 
 // RequestAddressType is the Address Type from the socks communications
@@ -89,6 +135,12 @@ const (
 	RequestAddressTypeDomainname RequestAddressType = 0x03
 	// RequestAddressTypeIPv6 represents IPv6
 	RequestAddressTypeIPv6 RequestAddressType = 0x04
+	// RequestAddressTypeSessionToken represents a session token used to
+	// resume a session (experimental)
+	RequestAddressTypeSessionToken RequestAddressType = 0xF0
+	// RequestAddressTypeUnixPath represents the path of a unix domain socket
+	// on the proxy host (vendor extension)
+	RequestAddressTypeUnixPath RequestAddressType = 0xFE
 )
 
 // Value gets the real value of the RequestAddressType
@@ -144,3 +196,95 @@ type Error struct {
 
 // Error returns the underying error string
 func (e *Error) Error() string { return e.Err.Error() }
+
+// unknownValue formats values without a name
+func unknownValue(v uint8) string {
+	return fmt.Sprintf("%#04x", v)
+}
+
+func (m Methods) String() string {
+	switch m {
+	case MethodNoAuthRequired:
+		return "no authentication required"
+	case MethodGSSAPI:
+		return "gssapi"
+	case MethodUsernamePassword:
+		return "username/password"
+	case MethodBanner:
+		return "banner"
+	case MethodNoAcceptableMethods:
+		return "no acceptable methods"
+	default:
+		return unknownValue(uint8(m))
+	}
+}
+
+func (v Version) String() string {
+	switch v {
+	case Version4:
+		return "socks4"
+	case Version5:
+		return "socks5"
+	default:
+		return unknownValue(uint8(v))
+	}
+}
+
+func (c RequestCmd) String() string {
+	switch c {
+	case RequestCmdConnect:
+		return "connect"
+	case RequestCmdBind:
+		return "bind"
+	case RequestCmdAssociate:
+		return "udp associate"
+	case RequestCmdResume:
+		return "resume"
+	default:
+		return unknownValue(uint8(c))
+	}
+}
+
+func (t RequestAddressType) String() string {
+	switch t {
+	case RequestAddressTypeIPv4:
+		return "ipv4"
+	case RequestAddressTypeDomainname:
+		return "domain name"
+	case RequestAddressTypeIPv6:
+		return "ipv6"
+	case RequestAddressTypeSessionToken:
+		return "session token"
+	case RequestAddressTypeUnixPath:
+		return "unix path"
+	default:
+		return unknownValue(uint8(t))
+	}
+}
+
+func (r RequestReplyReason) String() string {
+	switch r {
+	case RequestReplySucceeded:
+		return "succeeded"
+	case RequestReplyGeneralFailure:
+		return "general socks server failure"
+	case RequestReplyConnectionNotAllowed:
+		return "connection not allowed by ruleset"
+	case RequestReplyNetworkUnreachable:
+		return "network unreachable"
+	case RequestReplyHostUnreachable:
+		return "host unreachable"
+	case RequestReplyConnectionRefused:
+		return "connection refused"
+	case RequestReplyTTLExpired:
+		return "ttl expired"
+	case RequestReplyCommandNotSupported:
+		return "command not supported"
+	case RequestReplyAddressTypeNotSupported:
+		return "address type not supported"
+	case RequestReplyMethodNotSupported:
+		return "no acceptable methods"
+	default:
+		return unknownValue(uint8(r))
+	}
+}
@@ -0,0 +1,79 @@
+package socks
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestStringRoundTrip checks that every byte value has a distinct name and
+// that values without a name are formatted so they can be parsed back
+func TestStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		str    func(b uint8) string
+		values map[uint8]string
+	}{
+		{"Methods", func(b uint8) string { return Methods(b).String() }, map[uint8]string{
+			MethodNoAuthRequired:      "no authentication required",
+			MethodGSSAPI:              "gssapi",
+			MethodUsernamePassword:    "username/password",
+			MethodBanner:              "banner",
+			MethodNoAcceptableMethods: "no acceptable methods",
+		}},
+		{"Version", func(b uint8) string { return Version(b).String() }, map[uint8]string{
+			uint8(Version4): "socks4",
+			uint8(Version5): "socks5",
+		}},
+		{"RequestCmd", func(b uint8) string { return RequestCmd(b).String() }, map[uint8]string{
+			uint8(RequestCmdConnect):   "connect",
+			uint8(RequestCmdBind):      "bind",
+			uint8(RequestCmdAssociate): "udp associate",
+			uint8(RequestCmdResume):    "resume",
+		}},
+		{"RequestAddressType", func(b uint8) string { return RequestAddressType(b).String() }, map[uint8]string{
+			uint8(RequestAddressTypeIPv4):         "ipv4",
+			uint8(RequestAddressTypeDomainname):   "domain name",
+			uint8(RequestAddressTypeIPv6):         "ipv6",
+			uint8(RequestAddressTypeSessionToken): "session token",
+			uint8(RequestAddressTypeUnixPath):     "unix path",
+		}},
+		{"RequestReplyReason", func(b uint8) string { return RequestReplyReason(b).String() }, map[uint8]string{
+			uint8(RequestReplySucceeded):               "succeeded",
+			uint8(RequestReplyGeneralFailure):          "general socks server failure",
+			uint8(RequestReplyConnectionNotAllowed):    "connection not allowed by ruleset",
+			uint8(RequestReplyNetworkUnreachable):      "network unreachable",
+			uint8(RequestReplyHostUnreachable):         "host unreachable",
+			uint8(RequestReplyConnectionRefused):       "connection refused",
+			uint8(RequestReplyTTLExpired):              "ttl expired",
+			uint8(RequestReplyCommandNotSupported):     "command not supported",
+			uint8(RequestReplyAddressTypeNotSupported): "address type not supported",
+			uint8(RequestReplyMethodNotSupported):      "no acceptable methods",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]uint8)
+			for i := 0; i <= 0xff; i++ {
+				b := uint8(i)
+				s := tt.str(b)
+				if other, ok := seen[s]; ok {
+					t.Fatalf("%#04x and %#04x are both formatted as %q", other, b, s)
+				}
+				seen[s] = b
+				if name, ok := tt.values[b]; ok {
+					if s != name {
+						t.Fatalf("got %q for %#04x, want %q", s, b, name)
+					}
+					continue
+				}
+				parsed, err := strconv.ParseUint(s, 0, 8)
+				if err != nil {
+					t.Fatalf("could not parse %q of unknown value %#04x: %v", s, b, err)
+				}
+				if uint8(parsed) != b {
+					t.Fatalf("%q parsed as %#04x, want %#04x", s, parsed, b)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDatagramSize is the largest datagram the relay reads
+const maxDatagramSize = 65535
+
+// defaultUDPIdleTimeout is used if Proxy.UDPIdleTimeout is not set
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// maxUDPVerdicts limits the cached verdicts per association. Further
+// destinations are checked for every datagram
+const maxUDPVerdicts = 1024
+
+/*
++----+------+------+----------+----------+----------+
+|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
++----+------+------+----------+----------+----------+
+| 2  |  1   |  1   | Variable |    2     | Variable |
++----+------+------+----------+----------+----------+
+*/
+func parseUDPHeader(buf []byte) (*Request, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("invalid udp header length (%d)", len(buf))
+	}
+	if buf[2] != 0 {
+		return nil, nil, fmt.Errorf("udp fragmentation is not supported")
+	}
+	r := &Request{Version: Version5, Command: RequestCmdAssociate, AddressType: RequestAddressType(buf[3])}
+	var addrEnd int
+	switch r.AddressType {
+	case RequestAddressTypeIPv4:
+		addrEnd = 4 + net.IPv4len
+	case RequestAddressTypeIPv6:
+		addrEnd = 4 + net.IPv6len
+	case RequestAddressTypeDomainname:
+		if len(buf) < 5 {
+			return nil, nil, fmt.Errorf("invalid udp header length (%d)", len(buf))
+		}
+		addrEnd = 5 + int(buf[4])
+	default:
+		return nil, nil, fmt.Errorf("address type %s not supported", r.AddressType)
+	}
+	if len(buf) < addrEnd+2 {
+		return nil, nil, fmt.Errorf("invalid udp header length (%d)", len(buf))
+	}
+	if r.AddressType == RequestAddressTypeDomainname {
+		r.DestinationAddress = buf[5:addrEnd]
+	} else {
+		r.DestinationAddress = buf[4:addrEnd]
+	}
+	r.DestinationPort = binary.BigEndian.Uint16(buf[addrEnd : addrEnd+2])
+	r.normalizeMappedIPv4()
+	return r, buf[addrEnd+2:], nil
+}
+
+// buildUDPHeader prepends the header with the source address to data
+func buildUDPHeader(src *net.UDPAddr, data []byte) ([]byte, error) {
+	// the reply contains the address in the same format after the first
+	// three bytes
+	repl, err := requestReply(src, RequestReplySucceeded)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(repl)+len(data))
+	buf = append(buf, 0, 0, 0)
+	buf = append(buf, repl[3:]...)
+	return append(buf, data...), nil
+}
+
+// listenUDPRelay binds the relay socket for an association. The port is
+// taken from UDPPortRange if set
+func (p *Proxy) listenUDPRelay(conn io.ReadWriteCloser) (*net.UDPConn, error) {
+	ip := p.UDPRelayAddr
+	if ip == nil {
+		// bind to the address the client already reached
+		if c, ok := extractNetConn(conn); ok {
+			ip = addrIP(c.LocalAddr())
+		}
+	}
+
+	lo, hi := p.UDPPortRange[0], p.UDPPortRange[1]
+	lc := p.udpListenConfig(false)
+	if lo == 0 && hi == 0 {
+		return listenUDP(lc, &net.UDPAddr{IP: ip})
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return nil, fmt.Errorf("invalid udp port range %d-%d", lo, hi)
+	}
+	// start at a random port so concurrent associations do not all race for
+	// the first ports
+	n := hi - lo + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := lo + (start+i)%n
+		relay, err := listenUDP(lc, &net.UDPAddr{IP: ip, Port: port})
+		if err == nil {
+			return relay, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free udp port in range %d-%d", lo, hi)
+}
+
+// listenUDPRemote binds the socket datagrams are sent to the destinations
+// from. It gets the same socket options and local address as tcp connections
+// of the DefaultHandler
+func (p *Proxy) listenUDPRemote() (*net.UDPConn, error) {
+	var laddr net.UDPAddr
+	if h, ok := asDefaultHandler(p.Proxyhandler); ok {
+		laddr.IP = h.LocalAddr
+	}
+	return listenUDP(p.udpListenConfig(true), &laddr)
+}
+
+// udpListenConfig returns the config for the sockets of an association. The
+// remote socket gets the socket options of the DefaultHandler and the TOS,
+// the relay socket only gets the TOS if TOSClient is set
+func (p *Proxy) udpListenConfig(remote bool) *net.ListenConfig {
+	var controls []controlFunc
+	if remote {
+		if h, ok := asDefaultHandler(p.Proxyhandler); ok {
+			controls = append(controls, h.socketControls()...)
+		}
+	}
+	if p.TOS != 0 && (remote || p.TOSClient) {
+		controls = append(controls, tosControl(p.TOS))
+	}
+	return &net.ListenConfig{Control: chainControls(controls...)}
+}
+
+func listenUDP(lc *net.ListenConfig, addr *net.UDPAddr) (*net.UDPConn, error) {
+	host := ""
+	if addr.IP != nil {
+		host = addr.IP.String()
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// udpAssociation relays datagrams between one client and any number of
+// destinations
+type udpAssociation struct {
+	// accessed atomically
+	lastActivity int64
+
+	proxy  *Proxy
+	relay  *net.UDPConn
+	remote *net.UDPConn
+	stats  *SessionStats
+
+	// clientIP is the address of the control connection. Datagrams from
+	// other addresses are dropped
+	clientIP net.IP
+	// mu protects client, verdicts and contacted
+	mu       sync.Mutex
+	client   *net.UDPAddr
+	verdicts map[string]udpVerdict
+	// contacted holds the distinct destinations datagrams were sent to
+	contacted []string
+}
+
+// udpVerdict is the cached result of checking a destination. err is set if
+// datagrams to the destination are dropped. acl is the ACL the verdict was
+// made with, verdicts of a replaced ACL are checked again
+type udpVerdict struct {
+	addr *net.UDPAddr
+	err  error
+	acl  *IPListACL
+}
+
+// handleAssociate serves an UDP ASSOCIATE request. The association lasts until
+// the control connection is closed
+func (p *Proxy) handleAssociate(ctx context.Context, conn io.ReadWriteCloser, request *Request, stats *SessionStats) *Error {
+	relay, err := p.listenUDPRelay(conn)
+	if err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not bind udp relay: %w", err)}
+	}
+	defer relay.Close()
+	remote, err := p.listenUDPRemote()
+	if err != nil {
+		return &Error{Reason: RequestReplyGeneralFailure, Err: fmt.Errorf("could not bind udp socket: %w", err)}
+	}
+	defer remote.Close()
+
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	stats.UDPRelayPort = relayAddr.Port
+	replyAddr := &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port}
+	if replyAddr.IP.IsUnspecified() {
+		// the client can not send to the unspecified address
+		if c, ok := extractNetConn(conn); ok {
+			replyAddr.IP = addrIP(c.LocalAddr())
+		}
+	}
+
+	clientAddr, _ := ClientAddrFromContext(ctx)
+	a := &udpAssociation{
+		proxy:    p,
+		relay:    relay,
+		remote:   remote,
+		stats:    stats,
+		clientIP: addrIP(clientAddr),
+		verdicts: make(map[string]udpVerdict),
+	}
+	// the request holds the address the client will send from if known
+	if request.AddressType != RequestAddressTypeDomainname && request.DestinationPort != 0 {
+		ip := net.IP(request.DestinationAddress)
+		if !ip.IsUnspecified() {
+			a.client = &net.UDPAddr{IP: ip, Port: int(request.DestinationPort)}
+		}
+	}
+
+	stats.HandshakePhase = HandshakePhaseReplyWrite
+	if err := p.handleRequestReply(ctx, conn, replyAddr); err != nil {
+		return err
+	}
+	p.handshakeDone(stats)
+	log.Debugf("udp relay listening on %s", relayAddr)
+
+	sess := p.registerSession(ctx, request, conn, conn, relay, stats)
+	defer p.unregisterSession(sess)
+	ctx, cancel := p.withSessionDeadline(ctx, sess)
+	defer cancel()
+	go p.closeOnStop(ctx, sess)
+	atomic.AddInt64(&p.udp.active, 1)
+	defer func() {
+		atomic.AddInt64(&p.udp.active, -1)
+		p.udp.observeDuration(p.clock().Now().Sub(sess.started))
+	}()
+
+	a.touch()
+	idle := a.watchIdle(p.udpIdleTimeout(), sess)
+	defer idle.Stop()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go a.clientToRemote(ctx, wg)
+	go a.remoteToClient(wg)
+
+	// the association ends when the client closes the control connection.
+	// The idle timer and CloseSession close the control connection too
+	_, _ = io.Copy(io.Discard, conn)
+	sess.setReason(CloseReasonClientEOF)
+	relay.Close()
+	remote.Close()
+	// the relay goroutines are done after this so the counters are final
+	wg.Wait()
+	a.mu.Lock()
+	a.verdicts = nil
+	contacted := a.contacted
+	a.mu.Unlock()
+
+	stats.CloseReason = sess.closeReason()
+	log.Infof("udp association %s closed: %s, %d datagrams (%d bytes) from the client, %d datagrams (%d bytes) to the client, %d datagrams denied, %d datagrams dropped, destinations %v",
+		relayAddr, stats.CloseReason,
+		atomic.LoadInt64(&stats.DatagramsClientToRemote), atomic.LoadInt64(&stats.BytesClientToRemote),
+		atomic.LoadInt64(&stats.DatagramsRemoteToClient), atomic.LoadInt64(&stats.BytesRemoteToClient),
+		atomic.LoadInt64(&stats.DatagramsDenied), atomic.LoadInt64(&stats.DatagramsDropped), contacted)
+	return nil
+}
+
+func (p *Proxy) udpIdleTimeout() time.Duration {
+	if p.UDPIdleTimeout > 0 {
+		return p.UDPIdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+// touch records datagram activity
+func (a *udpAssociation) touch() {
+	atomic.StoreInt64(&a.lastActivity, a.proxy.clock().Now().UnixNano())
+}
+
+// watchIdle closes the session if no datagram was relayed in either direction
+// for timeout. The timer is rescheduled for the remaining time on activity
+// instead of being reset for every datagram
+func (a *udpAssociation) watchIdle(timeout time.Duration, sess *session) Timer {
+	clock := a.proxy.clock()
+	var timer Timer
+	timer = clock.AfterFunc(timeout, func() {
+		idle := clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&a.lastActivity)))
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+		log.Debugf("closing udp association %s: idle for %s", a.relay.LocalAddr(), idle)
+		sess.close(CloseReasonIdleTimeout)
+	})
+	return timer
+}
+
+// acceptClient checks if the datagram was sent by the client of the
+// association. The first datagram from the client ip fixes the client port
+func (a *udpAssociation) acceptClient(from *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client.IP.Equal(from.IP) && a.client.Port == from.Port
+	}
+	if a.clientIP != nil && !a.clientIP.Equal(from.IP) {
+		return false
+	}
+	a.client = from
+	return true
+}
+
+// drop counts a dropped datagram for the association and the proxy
+func (a *udpAssociation) drop(cause UDPDropCause) {
+	if cause == UDPDropDenied {
+		atomic.AddInt64(&a.stats.DatagramsDenied, 1)
+	} else {
+		atomic.AddInt64(&a.stats.DatagramsDropped, 1)
+	}
+	a.proxy.udp.drop(cause)
+}
+
+func (a *udpAssociation) clientAddr() *net.UDPAddr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client
+}
+
+// destination applies the rewrites, policy and access lists to the
+// destination of the datagram and returns the address to send it to. The
+// verdict is cached so the rules are evaluated once per destination and
+// association until the ACL is replaced
+func (a *udpAssociation) destination(ctx context.Context, request *Request) (*net.UDPAddr, error) {
+	key := request.getDestinationString()
+	acl := a.proxy.getACL()
+	a.mu.Lock()
+	verdict, seen := a.verdicts[key]
+	a.mu.Unlock()
+	if seen && verdict.acl == acl {
+		return verdict.addr, verdict.err
+	}
+	counted := seen && verdict.err == nil
+
+	verdict.addr, verdict.err = a.check(ctx, request)
+	verdict.acl = acl
+	a.mu.Lock()
+	if seen || len(a.verdicts) < maxUDPVerdicts {
+		a.verdicts[key] = verdict
+	}
+	if verdict.err == nil && !counted {
+		a.contacted = append(a.contacted, key)
+		atomic.StoreInt64(&a.stats.UDPDestinations, int64(len(a.contacted)))
+	}
+	a.mu.Unlock()
+	return verdict.addr, verdict.err
+}
+
+// check runs the same checks as for CONNECT requests
+func (a *udpAssociation) check(ctx context.Context, request *Request) (*net.UDPAddr, error) {
+	p := a.proxy
+	p.applyRewrites(request)
+	if _, err := p.applyPolicy(ctx, request); err != nil {
+		return nil, err
+	}
+	if err := p.checkDestination(ctx, request, a.clientIP); err != nil {
+		return nil, err
+	}
+	ips, err := p.resolveDestination(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	// the address of ip destinations points into the read buffer
+	ip := make(net.IP, len(ips[0]))
+	copy(ip, ips[0])
+	return &net.UDPAddr{IP: ip, Port: int(request.DestinationPort)}, nil
+}
+
+func (a *udpAssociation) clientToRemote(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptClient(from) {
+			a.drop(UDPDropUnknownPeer)
+			log.Debugf("dropping datagram from unknown peer %s", from)
+			continue
+		}
+		request, data, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			a.drop(UDPDropMalformed)
+			log.Debugf("dropping datagram from %s: %v", from, err)
+			continue
+		}
+		dst, err := a.destination(ctx, request)
+		if err != nil {
+			a.drop(UDPDropDenied)
+			log.Debugf("dropping datagram: %v", err)
+			continue
+		}
+		if _, err := a.remote.WriteToUDP(data, dst); err != nil {
+			log.Debugf("could not send datagram to %s: %v", dst, err)
+			continue
+		}
+		a.touch()
+		atomic.AddInt64(&a.stats.DatagramsClientToRemote, 1)
+		atomic.AddInt64(&a.stats.BytesClientToRemote, int64(len(data)))
+		atomic.AddInt64(&a.proxy.udp.datagramsClientToRemote, 1)
+		atomic.AddInt64(&a.proxy.udp.bytesClientToRemote, int64(len(data)))
+	}
+}
+
+func (a *udpAssociation) remoteToClient(wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.remote.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		client := a.clientAddr()
+		if client == nil {
+			// nobody sent anything yet so this can not be a reply
+			continue
+		}
+		datagram, err := buildUDPHeader(from, buf[:n])
+		if err != nil {
+			log.Debugf("dropping datagram from %s: %v", from, err)
+			continue
+		}
+		if len(datagram) > maxUDPPayload {
+			a.drop(UDPDropOversize)
+			log.Debugf("dropping datagram from %s: %d bytes with header", from, len(datagram))
+			continue
+		}
+		if _, err := a.relay.WriteToUDP(datagram, client); err != nil {
+			log.Debugf("could not send datagram to client %s: %v", client, err)
+			continue
+		}
+		a.touch()
+		atomic.AddInt64(&a.stats.DatagramsRemoteToClient, 1)
+		atomic.AddInt64(&a.stats.BytesRemoteToClient, int64(n))
+		atomic.AddInt64(&a.proxy.udp.datagramsRemoteToClient, 1)
+		atomic.AddInt64(&a.proxy.udp.bytesRemoteToClient, int64(n))
+	}
+}
@@ -0,0 +1,223 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// udpEchoServer echoes every datagram and returns the address
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteToUDP(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// echo sends a datagram to addr through the association and waits for the
+// answer
+func echo(t *testing.T, conn net.PacketConn, addr net.Addr) {
+	t.Helper()
+	if _, err := conn.WriteTo([]byte("ping"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPAssociationCountsDestinations(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	first, second := udpEchoServer(t), udpEchoServer(t)
+	echo(t, conn, first)
+	echo(t, conn, second)
+	echo(t, conn, first)
+
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if got := sessions[0].UDPDestinations; got != 2 {
+		t.Fatalf("got %d destinations, want 2", got)
+	}
+}
+
+func TestUDPAssociationACLReload(t *testing.T) {
+	acl := &IPListACL{}
+	if err := acl.Allow("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		ACL:          acl,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server := udpEchoServer(t)
+	echo(t, conn, server)
+
+	p.SetACL(&IPListACL{})
+	if _, err := conn.WriteTo([]byte("ping"), server); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(make([]byte, 16)); err == nil {
+		t.Fatal("datagram was relayed after the acl denied the destination")
+	}
+	if got := p.Sessions()[0].DatagramsDenied; got != 1 {
+		t.Fatalf("got %d denied datagrams, want 1", got)
+	}
+}
+
+func TestUDPAssociationSockets(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second, LocalAddr: net.IPv4(127, 0, 0, 2)},
+		Timeout:      time.Second,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := conn.WriteTo([]byte("ping"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, from, err := server.ReadFromUDP(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("datagram sent from %s, want 127.0.0.2", from.IP)
+	}
+
+	relay := conn.(*ClientPacketConn).relay
+	if got := p.Sessions()[0].UDPRelayPort; got != relay.Port {
+		t.Fatalf("got relay port %d, want %d", got, relay.Port)
+	}
+}
+
+func TestClientPacketConnShortBuffer(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server := udpEchoServer(t)
+	if _, err := conn.WriteTo([]byte("ping"), server); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	n, _, err := conn.ReadFrom(buf)
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatalf("got error %v, want %v", err, io.ErrShortBuffer)
+	}
+	if got := string(buf[:n]); got != "pi" {
+		t.Fatalf("got %q, want the truncated payload", got)
+	}
+}
+
+func TestUDPAssociationIdleTimeout(t *testing.T) {
+	hook := captureLogs(t, log.InfoLevel)
+	p := &Proxy{
+		Proxyhandler:   &DefaultHandler{Timeout: time.Second},
+		Timeout:        time.Second,
+		UDPIdleTimeout: 200 * time.Millisecond,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// datagrams keep the association open past the timeout
+	server := udpEchoServer(t)
+	for i := 0; i < 6; i++ {
+		echo(t, conn, server)
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := len(p.Sessions()); n != 1 {
+		t.Fatalf("got %d sessions, want the active association", n)
+	}
+
+	// the control connection is still open, only the idle timer ends the
+	// association. The client closes its socket once the proxy closed the
+	// control connection
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(make([]byte, 16)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got error %v, want the closed association", err)
+	}
+	waitFor(t, func() bool { return len(p.Sessions()) == 0 })
+	waitFor(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if strings.Contains(entry.Message, "closed: "+CloseReasonIdleTimeout.String()) {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,122 @@
+package socks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxUDPPayload is the largest payload of an ipv4 datagram. Replies that do
+// not fit after adding the socks header are dropped
+const maxUDPPayload = 65507
+
+// UDPDropCause is the reason a datagram was not relayed
+type UDPDropCause int
+
+const (
+	// UDPDropDenied is a datagram to a destination denied by the rewrites,
+	// policy or access lists or that could not be resolved
+	UDPDropDenied UDPDropCause = iota
+	// UDPDropOversize is a reply that does not fit into a datagram after
+	// adding the socks header
+	UDPDropOversize
+	// UDPDropMalformed is a datagram with an invalid socks header
+	UDPDropMalformed
+	// UDPDropUnknownPeer is a datagram not sent by the client of the
+	// association
+	UDPDropUnknownPeer
+	udpDropCauses
+)
+
+func (c UDPDropCause) String() string {
+	switch c {
+	case UDPDropDenied:
+		return "denied"
+	case UDPDropOversize:
+		return "oversize"
+	case UDPDropMalformed:
+		return "malformed"
+	case UDPDropUnknownPeer:
+		return "unknown_peer"
+	default:
+		return unknownValue(uint8(c))
+	}
+}
+
+// udpDurationBuckets are the upper bounds of the association duration
+// histogram. Longer associations are counted in an extra bucket
+var udpDurationBuckets = [...]time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// DurationBucket is a bucket of a duration histogram. Count is the number of
+// values up to UpperBound that are not counted in a smaller bucket. The last
+// bucket has no upper bound and UpperBound is 0
+type DurationBucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      int64         `json:"count"`
+}
+
+// UDPStats is a snapshot of the UDP ASSOCIATE counters
+type UDPStats struct {
+	// ActiveAssociations is the number of open associations
+	ActiveAssociations      int64 `json:"active_associations"`
+	DatagramsClientToRemote int64 `json:"datagrams_client_to_remote"`
+	DatagramsRemoteToClient int64 `json:"datagrams_remote_to_client"`
+	BytesClientToRemote     int64 `json:"bytes_client_to_remote"`
+	BytesRemoteToClient     int64 `json:"bytes_remote_to_client"`
+	// Dropped is the number of dropped datagrams by cause
+	Dropped map[string]int64 `json:"dropped"`
+	// AssociationDurations is the histogram of the duration of closed
+	// associations
+	AssociationDurations []DurationBucket `json:"association_durations"`
+}
+
+// udpCounters are the proxy wide UDP ASSOCIATE counters. All fields are
+// accessed atomically so counting does not lock or allocate
+type udpCounters struct {
+	active                  int64
+	datagramsClientToRemote int64
+	datagramsRemoteToClient int64
+	bytesClientToRemote     int64
+	bytesRemoteToClient     int64
+	dropped                 [udpDropCauses]int64
+	durations               [len(udpDurationBuckets) + 1]int64
+}
+
+func (c *udpCounters) drop(cause UDPDropCause) {
+	atomic.AddInt64(&c.dropped[cause], 1)
+}
+
+func (c *udpCounters) observeDuration(d time.Duration) {
+	i := 0
+	for i < len(udpDurationBuckets) && d > udpDurationBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&c.durations[i], 1)
+}
+
+func (c *udpCounters) snapshot() UDPStats {
+	s := UDPStats{
+		ActiveAssociations:      atomic.LoadInt64(&c.active),
+		DatagramsClientToRemote: atomic.LoadInt64(&c.datagramsClientToRemote),
+		DatagramsRemoteToClient: atomic.LoadInt64(&c.datagramsRemoteToClient),
+		BytesClientToRemote:     atomic.LoadInt64(&c.bytesClientToRemote),
+		BytesRemoteToClient:     atomic.LoadInt64(&c.bytesRemoteToClient),
+		Dropped:                 make(map[string]int64, udpDropCauses),
+	}
+	for cause := range c.dropped {
+		s.Dropped[UDPDropCause(cause).String()] = atomic.LoadInt64(&c.dropped[cause])
+	}
+	for i := range c.durations {
+		var bound time.Duration
+		if i < len(udpDurationBuckets) {
+			bound = udpDurationBuckets[i]
+		}
+		s.AssociationDurations = append(s.AssociationDurations, DurationBucket{UpperBound: bound, Count: atomic.LoadInt64(&c.durations[i])})
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// oversizeServer answers every datagram with the largest payload that fits
+// into an ipv4 datagram, which leaves no room for the socks header
+func oversizeServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteToUDP(make([]byte, maxUDPPayload), addr); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPStats(t *testing.T) {
+	acl := &IPListACL{}
+	if err := acl.Allow("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+		ACL:          acl,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pc := conn.(*ClientPacketConn)
+
+	server := udpEchoServer(t)
+	for i := 0; i < 3; i++ {
+		echo(t, conn, server)
+	}
+	if _, err := conn.WriteTo([]byte("big"), oversizeServer(t)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.conn.WriteToUDP([]byte{0x00, 0x00}, pc.relay); err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.WriteToUDP([]byte("ping"), pc.relay); err != nil {
+		t.Fatal(err)
+	}
+
+	wantDropped := map[string]int64{"denied": 1, "oversize": 1, "malformed": 1, "unknown_peer": 1}
+	waitFor(t, func() bool { return reflect.DeepEqual(p.Stats().UDP.Dropped, wantDropped) })
+	stats := p.Stats().UDP
+	if stats.ActiveAssociations != 1 {
+		t.Fatalf("got %d active associations, want 1", stats.ActiveAssociations)
+	}
+	// the oversize reply was relayed to the proxy but not to the client
+	if stats.DatagramsClientToRemote != 4 || stats.BytesClientToRemote != 15 {
+		t.Fatalf("got %d datagrams (%d bytes) from the client, want 4 (15 bytes)", stats.DatagramsClientToRemote, stats.BytesClientToRemote)
+	}
+	if stats.DatagramsRemoteToClient != 3 || stats.BytesRemoteToClient != 12 {
+		t.Fatalf("got %d datagrams (%d bytes) to the client, want 3 (12 bytes)", stats.DatagramsRemoteToClient, stats.BytesRemoteToClient)
+	}
+
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	info := sessions[0]
+	if info.Type != SessionTypeUDP {
+		t.Fatalf("got session type %q, want %q", info.Type, SessionTypeUDP)
+	}
+	if info.DatagramsClientToRemote != 4 || info.DatagramsRemoteToClient != 3 || info.DatagramsDenied != 1 || info.DatagramsDropped != 3 {
+		t.Fatalf("got session datagrams %d/%d, %d denied, %d dropped, want 4/3, 1 denied, 3 dropped",
+			info.DatagramsClientToRemote, info.DatagramsRemoteToClient, info.DatagramsDenied, info.DatagramsDropped)
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return p.Stats().UDP.ActiveAssociations == 0 })
+	if got := p.Stats().UDP.AssociationDurations[0].Count; got != 1 {
+		t.Fatalf("got %d associations up to %s, want 1", got, udpDurationBuckets[0])
+	}
+}
+
+func TestSessionType(t *testing.T) {
+	p := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	client := &Client{ProxyAddr: serveProxy(t, p), Timeout: time.Second}
+	conn, err := client.Dial("tcp", lineServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if sessions[0].Type != SessionTypeTCP {
+		t.Fatalf("got session type %q, want %q", sessions[0].Type, SessionTypeTCP)
+	}
+	if udp := p.Stats().UDP; udp.ActiveAssociations != 0 || udp.DatagramsClientToRemote != 0 {
+		t.Fatalf("tcp session counted as udp association: %+v", udp)
+	}
+}
@@ -0,0 +1,92 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultUnixSocketMode is used if Proxy.UnixSocketMode is not set
+const defaultUnixSocketMode os.FileMode = 0660
+
+// ListenUnix starts the proxy on a unix domain socket at path. A stale socket
+// left by a previous run is replaced, a socket another process still accepts
+// on and other files are never overwritten.
+// Clients on unix sockets have no ip address so filters on the client
+// address are skipped for them
+func (p *Proxy) ListenUnix(path string) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := checkStaleSocket(path); err != nil {
+			return err
+		}
+	}
+
+	// the socket is created in a private directory and moved into place once
+	// it has its permissions, so it is never reachable with the permissions
+	// of the umask
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gosocks-")
+	if err != nil {
+		return fmt.Errorf("could not create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// the temporary name is gone after the rename, path is removed instead
+	listener.SetUnlinkOnClose(false)
+	mode := p.UnixSocketMode
+	if mode == 0 {
+		mode = defaultUnixSocketMode
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		listener.Close()
+		return fmt.Errorf("could not set permissions on %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return fmt.Errorf("could not move socket to %s: %w", path, err)
+	}
+	go p.Serve(&unixListener{UnixListener: listener, path: path})
+	return nil
+}
+
+// checkStaleSocket returns an error unless nothing accepts connections on the
+// socket at path
+func checkStaleSocket(path string) error {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("could not check socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// unixListener removes the socket when it is closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() {
+		if rmErr := os.Remove(l.path); rmErr != nil && err == nil && !errors.Is(rmErr, os.ErrNotExist) {
+			err = rmErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,120 @@
+package socks
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	// a stale socket of a previous run
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	p := &Proxy{
+		Proxyhandler:   &DefaultHandler{Timeout: time.Second},
+		Timeout:        time.Second,
+		UnixSocketMode: 0600,
+	}
+	if err := p.ListenUnix(path); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0600 {
+		t.Fatalf("got permissions %o, want 600", got)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries in the socket directory, want 1", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Client{}).negotiateMethod(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// the socket is live now and must not be taken over
+	other := &Proxy{Proxyhandler: &DefaultHandler{Timeout: time.Second}}
+	if err := other.ListenUnix(path); err == nil {
+		other.Close()
+		t.Fatal("listened on a socket in use by another proxy")
+	}
+}
+
+func TestListenUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{Proxyhandler: &DefaultHandler{Timeout: time.Second}}
+	if err := p.ListenUnix(path); err == nil {
+		p.Close()
+		t.Fatal("replaced a regular file")
+	}
+}
+
+// unixRequest builds a connect request to the unix socket at path
+func unixRequest(path string) []byte {
+	request := []byte{byte(Version5), byte(RequestCmdConnect), 0x00, byte(RequestAddressTypeUnixPath)}
+	request = append(request, path...)
+	return append(request, 0x00, 0x00, 0x00)
+}
+
+func TestUnixTarget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveLines(t, l)
+
+	tests := []struct {
+		name  string
+		allow bool
+		reply RequestReplyReason
+	}{
+		{"allowed", true, RequestReplySucceeded},
+		{"disabled", false, RequestReplyAddressTypeNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{
+				Proxyhandler:     &DefaultHandler{Timeout: time.Second},
+				Timeout:          time.Second,
+				AllowUnixTargets: tt.allow,
+			}
+			conn := dialProxy(t, serveProxy(t, p), "", "")
+			if _, err := conn.Write(unixRequest(path)); err != nil {
+				t.Fatal(err)
+			}
+			if reply := readReplyReason(t, conn); reply != tt.reply {
+				t.Fatalf("got reply %s, want %s", reply, tt.reply)
+			}
+			if tt.reply == RequestReplySucceeded {
+				roundTrip(t, conn)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+	Unix domain socket destinations (vendor extension)
+
+	A client connects to a unix domain socket on the proxy host by sending a
+	CONNECT request with the address type RequestAddressTypeUnixPath (0xFE).
+	The address is the absolute path of the socket terminated by a NUL byte.
+	The port follows the path like for the other address types and is
+	ignored.
+
+	+----+-----+-------+------+----------+------+----------+
+	|VER | CMD |  RSV  | ATYP |   PATH   | NUL  | DST.PORT |
+	+----+-----+-------+------+----------+------+----------+
+	| 1  |  1  | X'00' | X'FE'| Variable | X'00'|    2     |
+	+----+-----+-------+------+----------+------+----------+
+
+	The extension lets clients reach any socket the proxy process can open,
+	like the docker socket, so it is disabled unless Proxy.AllowUnixTargets
+	is set. The access lists and port restrictions do not apply to unix
+	destinations, use a Policy to restrict the allowed paths.
+*/
+
+// parseUnixPath parses the NUL terminated path and the port of a request
+// with the address type RequestAddressTypeUnixPath. buf starts after the
+// address type
+func parseUnixPath(buf []byte) ([]byte, uint16, error) {
+	end := bytes.IndexByte(buf, 0)
+	if end < 0 {
+		return nil, 0, fmt.Errorf("unix path is not terminated")
+	}
+	if end < 2 || buf[0] != '/' {
+		return nil, 0, fmt.Errorf("unix path %q is not absolute", buf[:end])
+	}
+	if len(buf) < end+3 {
+		return nil, 0, fmt.Errorf("invalid request header length (%d)", len(buf)+4)
+	}
+	return buf[:end], binary.BigEndian.Uint16(buf[end+1 : end+3]), nil
+}
@@ -0,0 +1,35 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ExportListener returns a duplicate of the listening socket so it can be
+// passed to another process. The proxy keeps serving on its own listener
+// until it is shut down.
+func (p *Proxy) ExportListener() (*os.File, error) {
+	listener := p.primaryListener()
+	if listener == nil {
+		return nil, fmt.Errorf("proxy is not listening")
+	}
+
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener of type %T can not be exported", listener)
+	}
+	return filer.File()
+}
+
+// ImportListener starts serving on a listening socket exported by
+// ExportListener, usually in another process. The file can be closed
+// afterwards.
+func (p *Proxy) ImportListener(f *os.File) error {
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return fmt.Errorf("could not import listener: %w", err)
+	}
+	go p.Serve(listener)
+	return nil
+}
@@ -0,0 +1,94 @@
+//go:build !windows && !js
+// +build !windows,!js
+
+package socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Graceful upgrade
+
+	The running process calls GracefulUpgrade which listens on a unix socket.
+	The new process calls TakeOverListener with the same socket path, receives
+	the listening socket and starts accepting connections. The old process
+	then stops accepting and drains its connections using Shutdown.
+*/
+
+// GracefulUpgrade waits for a new process to connect to the unix socket at
+// socketPath, hands over the listening socket and shuts down the proxy. ctx
+// limits the wait for the new process and the draining.
+func (p *Proxy) GracefulUpgrade(ctx context.Context, socketPath string) error {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := l.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("waiting for new process on %s", socketPath)
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return fmt.Errorf("new process did not connect: %w", err)
+	}
+	defer conn.Close()
+
+	f, err := p.ExportListener()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rights := syscall.UnixRights(int(f.Fd()))
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, rights, nil); err != nil {
+		return fmt.Errorf("could not send listener: %w", err)
+	}
+	log.Info("listener handed over, draining connections")
+	return p.Shutdown(ctx)
+}
+
+// TakeOverListener receives the listening socket from a process running
+// GracefulUpgrade on socketPath and starts serving on it
+func (p *Proxy) TakeOverListener(socketPath string) error {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return fmt.Errorf("could not receive listener: %w", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	if len(msgs) != 1 {
+		return fmt.Errorf("expected one control message, got %d", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return err
+	}
+	if len(fds) != 1 {
+		return fmt.Errorf("expected one file descriptor, got %d", len(fds))
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "listener")
+	defer f.Close()
+	return p.ImportListener(f)
+}
@@ -0,0 +1,119 @@
+//go:build !windows && !js
+// +build !windows,!js
+
+package socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestGracefulUpgrade hands the listener to a second proxy while clients
+// keep connecting and checks that no connection is refused
+func TestGracefulUpgrade(t *testing.T) {
+	target := lineServer(t)
+	old := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	addr := serveProxy(t, old)
+	next := &Proxy{
+		Proxyhandler: &DefaultHandler{Timeout: time.Second},
+		Timeout:      time.Second,
+	}
+	defer next.Close()
+
+	// a session of the old proxy that has to survive the handover
+	session := dialProxy(t, addr, "", "")
+	if reply := sendRequest(t, session, target); reply != RequestReplySucceeded {
+		t.Fatalf("got reply %s, want %s", reply, RequestReplySucceeded)
+	}
+
+	client := &Client{ProxyAddr: addr, Timeout: 5 * time.Second}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var connections int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := relayLine(client, target); err != nil {
+					t.Errorf("connection failed during the handover: %v", err)
+					return
+				}
+				atomic.AddInt64(&connections, 1)
+			}
+		}()
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "upgrade.sock")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	upgraded := make(chan error, 1)
+	go func() { upgraded <- old.GracefulUpgrade(ctx, socketPath) }()
+	// the old proxy may not listen on the socket yet
+	waitFor(t, func() bool { return next.TakeOverListener(socketPath) == nil })
+
+	// the new proxy serves the clients while the old one drains
+	waitFor(t, func() bool { return next.Stats().TotalSessions >= 10 })
+	roundTrip(t, session)
+	select {
+	case err := <-upgraded:
+		t.Fatalf("GracefulUpgrade returned %v before the session ended", err)
+	default:
+	}
+	session.Close()
+	select {
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatalf("GracefulUpgrade returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("old proxy did not finish draining")
+	}
+
+	close(stop)
+	wg.Wait()
+	if n := atomic.LoadInt64(&connections); n < 10 {
+		t.Fatalf("only %d connections were served", n)
+	}
+	if !old.isClosed() {
+		t.Fatal("old proxy was not closed")
+	}
+}
+
+// relayLine connects to the line server at target through the client and
+// sends one line
+func relayLine(client *Client, target string) error {
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		return err
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != "ok\n" {
+		return fmt.Errorf("got %q, want %q", buf, "ok\n")
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// defaultDialer returns the dialer used by Client if Dialer is not set.
+// Browsers can not open tcp connections so a WebSocket bridge is used
+func defaultDialer() ContextDialer {
+	return &WebSocketDialer{}
+}
+
+// WebSocketDialer connects to the proxy through a WebSocket to TCP bridge
+// like websockify, because browsers can not open tcp connections. Every
+// binary message carries a part of the tcp stream. It is only available in
+// js/wasm builds
+type WebSocketDialer struct {
+	// URL is the address of the bridge. Defaults to ws://address/ with the
+	// address passed to DialContext
+	URL string
+}
+
+// DialContext opens a WebSocket to the bridge and waits until it is
+// connected. network is ignored, the bridge decides where to connect to
+func (d *WebSocketDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	url := d.URL
+	if url == "" {
+		url = "ws://" + address + "/"
+	}
+	constructor := js.Global().Get("WebSocket")
+	if constructor.IsUndefined() {
+		return nil, errors.New("WebSocket is not supported by the runtime")
+	}
+	socket, err := newWebSocket(constructor, url)
+	if err != nil {
+		return nil, err
+	}
+	socket.Set("binaryType", "arraybuffer")
+
+	c := &webSocketConn{
+		socket:   socket,
+		addr:     webSocketAddr(url),
+		opened:   make(chan struct{}),
+		readable: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}, 1),
+	}
+	c.handle("open", func(js.Value) { close(c.opened) })
+	c.handle("message", c.onMessage)
+	c.handle("error", func(js.Value) { c.fail(fmt.Errorf("websocket error on %s", url)) })
+	c.handle("close", func(js.Value) {
+		c.fail(io.EOF)
+		c.release()
+	})
+
+	select {
+	case <-c.opened:
+		return c, nil
+	case <-c.closed:
+		c.Close()
+		return nil, fmt.Errorf("could not connect to %s: %w", url, c.err)
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// newWebSocket creates the WebSocket. An invalid url throws an exception
+// which is returned as error
+func newWebSocket(constructor js.Value, url string) (socket js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not create websocket for %s: %v", url, r)
+		}
+	}()
+	return constructor.New(url), nil
+}
+
+// webSocketAddr is the url of the bridge
+type webSocketAddr string
+
+func (a webSocketAddr) Network() string { return "websocket" }
+func (a webSocketAddr) String() string  { return string(a) }
+
+// webSocketConn is a net.Conn over a browser WebSocket. The callbacks of
+// the WebSocket must not block, so received messages are buffered until
+// they are read
+type webSocketConn struct {
+	socket js.Value
+	addr   webSocketAddr
+	opened chan struct{}
+
+	mu    sync.Mutex
+	buf   []byte
+	funcs []js.Func
+	// readable is signaled when data was received
+	readable chan struct{}
+	// closed is closed when the socket was closed or failed, err holds why
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+	// deadline is signaled when the read deadline changed
+	deadline     chan struct{}
+	readDeadline time.Time
+}
+
+// handle sets the event handler of the socket
+func (c *webSocketConn) handle(event string, f func(js.Value)) {
+	fn := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		var e js.Value
+		if len(args) > 0 {
+			e = args[0]
+		}
+		f(e)
+		return nil
+	})
+	c.mu.Lock()
+	c.funcs = append(c.funcs, fn)
+	c.mu.Unlock()
+	c.socket.Set("on"+event, fn)
+}
+
+// release frees the event handlers once the socket is closed
+func (c *webSocketConn) release() {
+	c.mu.Lock()
+	funcs := c.funcs
+	c.funcs = nil
+	c.mu.Unlock()
+	for _, event := range []string{"open", "message", "error", "close"} {
+		c.socket.Set("on"+event, js.Null())
+	}
+	for _, fn := range funcs {
+		fn.Release()
+	}
+}
+
+func (c *webSocketConn) onMessage(event js.Value) {
+	data := event.Get("data")
+	var b []byte
+	if data.Type() == js.TypeString {
+		b = []byte(data.String())
+	} else {
+		array := js.Global().Get("Uint8Array").New(data)
+		b = make([]byte, array.Get("length").Int())
+		js.CopyBytesToGo(b, array)
+	}
+	c.mu.Lock()
+	c.buf = append(c.buf, b...)
+	c.mu.Unlock()
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// fail marks the connection as closed with err. Only the first error is
+// kept
+func (c *webSocketConn) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.closed)
+	})
+}
+
+// Read returns the buffered data. It returns io.EOF once the socket was
+// closed and all data was read
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.buf) > 0 {
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			c.mu.Lock()
+			pending := len(c.buf) > 0
+			err := c.err
+			c.mu.Unlock()
+			if pending {
+				continue
+			}
+			return 0, err
+		default:
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-c.readable:
+		case <-c.closed:
+		case <-c.deadline:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write sends b as one binary message. The browser buffers the message so
+// Write does not block
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	array := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(array, b)
+	c.socket.Call("send", array)
+	return len(b), nil
+}
+
+// Close closes the socket
+func (c *webSocketConn) Close() error {
+	c.fail(net.ErrClosed)
+	c.socket.Call("close")
+	c.release()
+	return nil
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr  { return c.addr }
+func (c *webSocketConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	select {
+	case c.deadline <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
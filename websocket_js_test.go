@@ -0,0 +1,152 @@
+package socks_test
+
+import (
+	"io"
+	"net"
+	"syscall/js"
+	"testing"
+	"time"
+
+	socks "github.com/firefart/gosocks"
+	"github.com/firefart/gosocks/sockstest"
+)
+
+// mockWebSocket replaces the WebSocket constructor of the runtime with a
+// bridge to the proxy. Every socket is served as a new client connection.
+// It returns a channel receiving the urls of the opened sockets
+func mockWebSocket(t *testing.T, p *socks.Proxy) <-chan string {
+	t.Helper()
+	urls := make(chan string, 10)
+	var funcs []js.Func
+	newFunc := func(f func(args []js.Value) interface{}) js.Func {
+		fn := js.FuncOf(func(this js.Value, args []js.Value) interface{} { return f(args) })
+		funcs = append(funcs, fn)
+		return fn
+	}
+
+	constructor := newFunc(func(args []js.Value) interface{} {
+		urls <- args[0].String()
+		socket := js.Global().Get("Object").New()
+		client, server := net.Pipe()
+		// the callbacks must not block, the data is passed to the pipe by
+		// a goroutine
+		sent := make(chan []byte, 64)
+		socket.Set("send", newFunc(func(args []js.Value) interface{} {
+			b := make([]byte, args[0].Get("length").Int())
+			js.CopyBytesToGo(b, args[0])
+			sent <- b
+			return nil
+		}))
+		socket.Set("close", newFunc(func([]js.Value) interface{} {
+			client.Close()
+			return nil
+		}))
+		go func() {
+			for b := range sent {
+				if _, err := client.Write(b); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			emit(socket, "onopen", js.Global().Get("Object").New())
+			buf := make([]byte, 1024)
+			for {
+				n, err := client.Read(buf)
+				if n > 0 {
+					array := js.Global().Get("Uint8Array").New(n)
+					js.CopyBytesToJS(array, buf[:n])
+					event := js.Global().Get("Object").New()
+					event.Set("data", array.Get("buffer"))
+					emit(socket, "onmessage", event)
+				}
+				if err != nil {
+					close(sent)
+					emit(socket, "onclose", js.Global().Get("Object").New())
+					return
+				}
+			}
+		}()
+		go p.HandleConn(server)
+		return socket
+	})
+
+	original := js.Global().Get("WebSocket")
+	js.Global().Set("WebSocket", constructor)
+	t.Cleanup(func() {
+		js.Global().Set("WebSocket", original)
+		for _, fn := range funcs {
+			fn.Release()
+		}
+	})
+	return urls
+}
+
+// emit calls the event handler of the socket from the event loop like a
+// browser, so the handlers set after the constructor returned are used
+func emit(socket js.Value, handler string, event js.Value) {
+	var fn js.Func
+	fn = js.FuncOf(func(js.Value, []js.Value) interface{} {
+		defer fn.Release()
+		if f := socket.Get(handler); f.Type() == js.TypeFunction {
+			f.Invoke(event)
+		}
+		return nil
+	})
+	js.Global().Call("setTimeout", fn, 0)
+}
+
+func TestWebSocketDialer(t *testing.T) {
+	p := &socks.Proxy{
+		Proxyhandler: sockstest.NewMockHandler(),
+		Timeout:      time.Second,
+	}
+	urls := mockWebSocket(t, p)
+
+	// the default dialer of the client uses the WebSocket
+	client := &socks.Client{ProxyAddr: "proxy.example:1080", Timeout: 5 * time.Second}
+	conn, err := client.Dial("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if url := <-urls; url != "ws://proxy.example:1080/" {
+		t.Fatalf("connected to %s, want ws://proxy.example:1080/", url)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q back, want %q", buf, "ping")
+	}
+}
+
+func TestWebSocketDialerURL(t *testing.T) {
+	p := &socks.Proxy{
+		Proxyhandler: sockstest.NewMockHandler(),
+		Timeout:      time.Second,
+	}
+	urls := mockWebSocket(t, p)
+
+	client := &socks.Client{
+		ProxyAddr: "proxy.example:1080",
+		Timeout:   5 * time.Second,
+		Dialer:    &socks.WebSocketDialer{URL: "wss://bridge.example/socks"},
+	}
+	conn, err := client.Dial("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if url := <-urls; url != "wss://bridge.example/socks" {
+		t.Fatalf("connected to %s, want wss://bridge.example/socks", url)
+	}
+}
@@ -0,0 +1,55 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// writeDeadliner is implemented by connections supporting write deadlines
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// stallWriter limits the time of every single write. A write that does not
+// finish in time closes the session, usually the peer stopped reading and
+// its receive window is full
+type stallWriter struct {
+	io.WriteCloser
+	conn    writeDeadliner
+	timeout time.Duration
+	sess    *session
+}
+
+// stallWriter wraps w if WriteStallTimeout is set and w supports write
+// deadlines. Other writers are returned unchanged
+func (p *Proxy) stallWriter(sess *session, w io.WriteCloser) io.WriteCloser {
+	if p.WriteStallTimeout <= 0 {
+		return w
+	}
+	conn, ok := w.(writeDeadliner)
+	if !ok {
+		return w
+	}
+	return &stallWriter{WriteCloser: w, conn: conn, timeout: p.WriteStallTimeout, sess: sess}
+}
+
+func (w *stallWriter) Write(b []byte) (int, error) {
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := w.WriteCloser.Write(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		w.sess.close(CloseReasonStalledPeer)
+	}
+	return n, err
+}
+
+// clearStallDeadline removes the deadline of the last write so it does not
+// affect later writes like the next pipelined session
+func clearStallDeadline(w io.Writer) {
+	if sw, ok := w.(*stallWriter); ok {
+		_ = sw.conn.SetWriteDeadline(time.Time{})
+	}
+}